@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The order form saves a draft as soon as a contact number is typed in. If no
+// order follows within ABANDONED_ORDER_DELAY the customer is sent a link that
+// reopens the form where they left off.
+
+type AbandonedOrderReminder struct {
+	Token string `json:"token"`
+}
+
+type OrderDraft struct {
+	Token      string
+	CustomerID string
+	VariantID  int
+	Quantity   int
+	OrderID    string
+	RemindedAt time.Time
+	OrderedAt  time.Time
+	CreatedAt  time.Time
+}
+
+type AbandonedOrderStats struct {
+	Started   int
+	Ordered   int
+	Reminded  int
+	Recovered int
+}
+
+// ConversionRate is the share of reminded drafts that went on to order.
+func (s AbandonedOrderStats) ConversionRate() float64 {
+	if s.Reminded == 0 {
+		return 0
+	}
+	return float64(s.Recovered) / float64(s.Reminded) * 100
+}
+
+func init() {
+	registerJobHandler("abandoned_order", func(payload []byte) error {
+		var m AbandonedOrderReminder
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return err
+		}
+		return remindAbandonedOrder(m.Token)
+	})
+}
+
+func newDraftToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func loadOrderDraft(token string) (OrderDraft, error) {
+	var d OrderDraft
+	err := db.QueryRow(`SELECT token, customer_id, COALESCE(variant_id, 0), COALESCE(quantity, 0), COALESCE(order_id, ''),
+		reminded_at, ordered_at, created_at FROM order_drafts WHERE token = ?`, token).
+		Scan(&d.Token, &d.CustomerID, &d.VariantID, &d.Quantity, &d.OrderID, nullTime{&d.RemindedAt}, nullTime{&d.OrderedAt}, &d.CreatedAt)
+	return d, err
+}
+
+// saveOrderDraft is called by the order form in the background whenever a
+// field changes once a contact number has been entered.
+func saveOrderDraft(w http.ResponseWriter, r *http.Request) {
+	contact := strings.TrimSpace(r.FormValue("contact"))
+	if contact == "" || len(contact) > 100 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	variantID, _ := strconv.Atoi(r.FormValue("variant"))
+	qty, _ := strconv.Atoi(r.FormValue("qty"))
+
+	sess := getSession(r)
+	if token := sess.Values["draft_token"]; token != "" {
+		res, err := db.Exec("UPDATE order_drafts SET customer_id = ?, variant_id = NULLIF(?, 0), quantity = NULLIF(?, 0) WHERE token = ? AND order_id IS NULL",
+			contact, variantID, qty, token)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		// MySQL reports unchanged rows as unaffected, so check the draft
+		// is still open before starting a new one.
+		if n, _ := res.RowsAffected(); n > 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if d, err := loadOrderDraft(token); err == nil && d.OrderID == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	token := newDraftToken()
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO order_drafts (token, customer_id, variant_id, quantity) VALUES (?, ?, NULLIF(?, 0), NULLIF(?, 0))",
+		token, contact, variantID, qty)
+	if err == nil {
+		err = enqueueJobIn(tx, "abandoned_order", AbandonedOrderReminder{Token: token}, envDuration("ABANDONED_ORDER_DELAY", time.Hour))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	sess.Values["draft_token"] = token
+	_ = saveSession(sess)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// markDraftOrdered closes the session's draft once its order is placed.
+func markDraftOrdered(r *http.Request, orderID string) error {
+	sess := getSession(r)
+	token := sess.Values["draft_token"]
+	if token == "" {
+		return nil
+	}
+	delete(sess.Values, "draft_token")
+	_ = saveSession(sess)
+	_, err := db.Exec("UPDATE order_drafts SET order_id = ?, ordered_at = NOW() WHERE token = ? AND order_id IS NULL", orderID, token)
+	return err
+}
+
+// remindAbandonedOrder sends the resume link unless the customer has ordered
+// since, from this draft or otherwise.
+func remindAbandonedOrder(token string) error {
+	d, err := loadOrderDraft(token)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if d.OrderID != "" || !d.RemindedAt.IsZero() {
+		return nil
+	}
+	var ordered bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM orders WHERE customer_id = ? AND created_at >= ?)", d.CustomerID, d.CreatedAt).Scan(&ordered); err != nil {
+		return err
+	}
+	if ordered {
+		return nil
+	}
+
+	link := strings.TrimRight(envOr("PUBLIC_URL", "http://localhost:8080"), "/") + "/place-order?resume=" + url.QueryEscape(d.Token)
+	if err := notifyCustomer(db, d.CustomerID, "abandoned_order", map[string]string{"Link": link}); err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE order_drafts SET reminded_at = NOW() WHERE token = ?", token)
+	return err
+}
+
+func abandonedOrdersPage(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	var s AbandonedOrderStats
+	err = db.QueryRow(`SELECT COUNT(*), COUNT(order_id), COUNT(reminded_at), COALESCE(SUM(ordered_at >= reminded_at), 0)
+		FROM order_drafts WHERE created_at >= NOW() - INTERVAL ? DAY`, days).Scan(&s.Started, &s.Ordered, &s.Reminded, &s.Recovered)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query(`SELECT token, customer_id, COALESCE(variant_id, 0), COALESCE(quantity, 0), COALESCE(order_id, ''),
+		reminded_at, ordered_at, created_at FROM order_drafts
+		WHERE reminded_at IS NOT NULL ORDER BY reminded_at DESC LIMIT 50`)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var drafts []OrderDraft
+	for rows.Next() {
+		var d OrderDraft
+		_ = rows.Scan(&d.Token, &d.CustomerID, &d.VariantID, &d.Quantity, &d.OrderID, nullTime{&d.RemindedAt}, nullTime{&d.OrderedAt}, &d.CreatedAt)
+		drafts = append(drafts, d)
+	}
+	t := mustParseTemplates("abandoned_orders.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Stats  AbandonedOrderStats
+		Days   int
+		Drafts []OrderDraft
+	}{s, days, drafts})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The accountant imports the store's books as journal entries instead of
+// re-keying them: as a Xero manual journal CSV or a QuickBooks IIF file.
+//
+//   - A sale is booked when the order is delivered. Cash collected on
+//     delivery goes to the COD clearing account, advance payments come out
+//     of customer deposits and gift cards out of the gift card liability.
+//     Walk-in sales go to cash on hand or card clearing.
+//   - Advance payments are booked when staff confirm they arrived.
+//   - Refunds to store credit move money from sales returns to the gift
+//     card liability.
+//
+// Prices include tax at the sales tax rate from the shop settings, which is
+// split out of every sale and refund. Account names can be changed with
+// ACCOUNT_<KEY> environment variables, e.g. ACCOUNT_SALES=4000.
+
+var journalAccounts = map[string]string{
+	"cod":        "COD Clearing",
+	"till":       "Cash on Hand",
+	"card":       "Card Clearing",
+	"bank":       "Bank",
+	"deposits":   "Customer Deposits",
+	"gift_cards": "Gift Card Liability",
+	"sales":      "Sales",
+	"shipping":   "Shipping Income",
+	"tax":        "Sales Tax Payable",
+	"returns":    "Sales Returns",
+}
+
+func journalAccount(key string) string {
+	return envOr("ACCOUNT_"+strings.ToUpper(key), journalAccounts[key])
+}
+
+// JournalLine amounts are debits when positive and credits when negative.
+type JournalLine struct {
+	Account string
+	Amount  Money
+}
+
+type JournalEntry struct {
+	Date      time.Time
+	Reference string
+	Memo      string
+	Lines     []JournalLine
+}
+
+func (e *JournalEntry) add(key string, amount Money) {
+	if amount != 0 {
+		e.Lines = append(e.Lines, JournalLine{Account: journalAccount(key), Amount: amount})
+	}
+}
+
+// taxIncluded is the tax contained in a tax-inclusive amount.
+func taxIncluded(amount Money) Money {
+	rate := settingFloat("tax_rate") / 100
+	return moneyFromFloat(amount.Float() * rate / (1 + rate))
+}
+
+// journalEntries books the store's deliveries, advance payments and
+// refunds between from and to (exclusive).
+func journalEntries(storeID int, from, to time.Time) ([]JournalEntry, error) {
+	var entries []JournalEntry
+	rows, err := reportDB().Query(`SELECT e.order_id, e.type, e.data, e.created_at FROM order_events e JOIN orders o ON o.order_id = e.order_id
+		WHERE o.store_id = ? AND e.type IN (?, ?) AND e.created_at >= ? AND e.created_at < ? ORDER BY e.id`,
+		storeID, OrderEventStatusChanged, OrderEventPaid, from, to)
+	if err != nil {
+		return nil, err
+	}
+	type delivery struct {
+		orderID string
+		at      time.Time
+	}
+	var delivered []delivery
+	for rows.Next() {
+		var orderID, kind string
+		var data []byte
+		var at time.Time
+		if err := rows.Scan(&orderID, &kind, &data, &at); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		switch kind {
+		case OrderEventStatusChanged:
+			var c StatusChange
+			if json.Unmarshal(data, &c) == nil && c.To == "DELIVERED" {
+				delivered = append(delivered, delivery{orderID, at})
+			}
+		case OrderEventPaid:
+			var p OrderPayment
+			if json.Unmarshal(data, &p) == nil && p.Method == PaymentPrepaid {
+				e := JournalEntry{Date: at, Reference: orderID, Memo: "Advance payment for " + orderID}
+				e.add("bank", p.Amount)
+				e.add("deposits", -p.Amount)
+				entries = append(entries, e)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, d := range delivered {
+		var o Order
+		if err := scanOrder(reportDB().QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ?", d.orderID), &o); err != nil {
+			return nil, err
+		}
+		gift, err := giftCardPaid(o.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		e := JournalEntry{Date: d.at, Reference: o.OrderID, Memo: "Sale " + o.OrderID + " to " + o.CustomerID}
+		e.add("gift_cards", gift)
+		switch o.PaymentMethod {
+		case PaymentPrepaid:
+			e.add("deposits", o.TotalAmount-gift)
+		case PaymentCash:
+			e.add("till", o.TotalAmount-gift)
+		case PaymentCard:
+			e.add("card", o.TotalAmount-gift)
+		default:
+			e.add("cod", o.TotalAmount-gift)
+		}
+		tax := taxIncluded(o.TotalAmount)
+		fees := o.ShippingFee + o.RushFee + o.GiftWrapFee
+		e.add("sales", -(o.TotalAmount - fees - tax))
+		e.add("shipping", -fees)
+		e.add("tax", -tax)
+		entries = append(entries, e)
+	}
+
+	rows, err = reportDB().Query(`SELECT t.order_id, t.amount, t.created_at FROM gift_card_transactions t JOIN orders o ON o.order_id = t.order_id
+		WHERE o.store_id = ? AND t.reason = 'refund' AND t.created_at >= ? AND t.created_at < ? ORDER BY t.id`, storeID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orderID string
+		var amount Money
+		var at time.Time
+		if err := rows.Scan(&orderID, &amount, &at); err != nil {
+			return nil, err
+		}
+		tax := taxIncluded(amount)
+		e := JournalEntry{Date: at, Reference: orderID, Memo: "Refund to store credit for " + orderID}
+		e.add("returns", amount-tax)
+		e.add("tax", tax)
+		e.add("gift_cards", -amount)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// writeXeroJournal writes Xero's manual journal import format, where each
+// narration and date pair becomes one journal.
+func writeXeroJournal(out io.Writer, entries []JournalEntry) error {
+	cw := csv.NewWriter(out)
+	_ = cw.Write([]string{"*Narration", "*Date", "Description", "*AccountCode", "*TaxRate", "*Amount", "Reference"})
+	for _, e := range entries {
+		for _, l := range e.Lines {
+			_ = cw.Write([]string{e.Memo, e.Date.Format("02/01/2006"), e.Memo, l.Account, "Tax Exempt", fmt.Sprintf("%.2f", l.Amount), e.Reference})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeIIFJournal writes QuickBooks Desktop general journal transactions.
+func writeIIFJournal(out io.Writer, entries []JournalEntry) error {
+	clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	if _, err := io.WriteString(out, "!TRNS\tTRNSTYPE\tDATE\tACCNT\tAMOUNT\tDOCNUM\tMEMO\r\n!SPL\tTRNSTYPE\tDATE\tACCNT\tAMOUNT\tDOCNUM\tMEMO\r\n!ENDTRNS\r\n"); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		for i, l := range e.Lines {
+			kind := "SPL"
+			if i == 0 {
+				kind = "TRNS"
+			}
+			_, err := fmt.Fprintf(out, "%s\tGENERAL JOURNAL\t%s\t%s\t%.2f\t%s\t%s\r\n",
+				kind, e.Date.Format("01/02/2006"), clean.Replace(l.Account), l.Amount, clean.Replace(e.Reference), clean.Replace(e.Memo))
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(out, "ENDTRNS\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// monthRange reads from and to (inclusive) dates from the query, defaulting
+// to the current month so far.
+func monthRange(r *http.Request) (from, to time.Time, ok bool) {
+	now := time.Now()
+	from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	to = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if v := r.URL.Query().Get("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return from, to, false
+		}
+		from = t
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return from, to, false
+		}
+		to = t
+	}
+	return from, to, !to.Before(from)
+}
+
+func accountingPage(w http.ResponseWriter, r *http.Request) {
+	from, to, _ := monthRange(r)
+	t := mustParseTemplates("accounting.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		From, To string
+		Flashes  []Flash
+	}{storeSwitcher(r), from.Format("2006-01-02"), to.Format("2006-01-02"), popFlashes(r)})
+}
+
+func accountingExport(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := monthRange(r)
+	format := r.URL.Query().Get("format")
+	if !ok || (format != "xero" && format != "iif") {
+		redirectWithFlash(w, r, "/admin/accounting", "error", "Pick a format and a date range that ends after it starts.")
+		return
+	}
+	entries, err := journalEntries(currentStoreID(r), from, to.AddDate(0, 0, 1))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	name := fmt.Sprintf("journal-%s-%s", from.Format("20060102"), to.Format("20060102"))
+	_ = recordAudit(db, r, "accounting.export", name, fmt.Sprintf("%s, %d entries", format, len(entries)))
+	if format == "iif" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.iif"`)
+		_ = writeIIFJournal(w, entries)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	_ = writeXeroJournal(w, entries)
+}
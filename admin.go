@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requireAdmin guards the /admin subrouter with HTTP basic auth against
+// ADMIN_USER / ADMIN_PASSWORD, or a branch manager listed in STORE_ADMINS.
+// Admin pages stay closed until one of them is set. Admins with an
+// authenticator set up also need a code once per session.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (envOr("ADMIN_USER", "") == "" || envOr("ADMIN_PASSWORD", "") == "") && len(storeAdmins()) == 0 {
+			writeError(w, r, http.StatusServiceUnavailable, "Admin access is not configured")
+			return
+		}
+		// Browsers send the password with every request, so the throttle is
+		// only consulted until a session has signed in with it.
+		name, _, sent := r.BasicAuth()
+		sess := getSession(r)
+		if sent && sess.Values["admin_user"] != name {
+			wait, err := loginWait("admin", name, clientIP(r))
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, "DB error")
+				return
+			}
+			if wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, r, http.StatusTooManyRequests, loginWaitMessage(wait))
+				return
+			}
+		}
+		user, ok := adminUser(r)
+		if !ok {
+			if sent {
+				if err := recordLoginFailure("admin", name, clientIP(r)); err != nil {
+					log.Printf("admin sign-in: %v", err)
+				}
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+shopName()+` Admin"`)
+			writeError(w, r, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		if sess.Values["admin_user"] != user {
+			if err := clearLoginFailures("admin", user); err != nil {
+				log.Printf("admin sign-in: %v", err)
+			}
+			sess.Values["admin_user"] = user
+			_ = saveSession(sess)
+		}
+		if !secondFactorPassed(w, r, user) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAllowedNetwork keeps the admin pages to the addresses in
+// ADMIN_ALLOWED_NETWORKS, a comma-separated list of CIDR ranges or single
+// IPs such as the shop network and the VPN, so leaked credentials are no
+// use from outside. Unset means anywhere; set but unparseable means nowhere.
+func requireAllowedNetwork(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spec := envOr("ADMIN_ALLOWED_NETWORKS", "")
+		if spec == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := net.ParseIP(clientIP(r))
+		if ip == nil || !ipInNetworks(ip, parseNetworks(spec)) {
+			log.Printf("admin: refused %s %s from %s", r.Method, r.URL.Path, clientIP(r))
+			writeError(w, r, http.StatusForbidden, "Forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseNetworks reads a comma-separated list of CIDR ranges and single IPs,
+// skipping entries it can't parse.
+func parseNetworks(spec string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("network list: skipping %q: %v", entry, err)
+			continue
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireStaff signs in whoever works the order desk so their changes are
+// attributed to them. Shops that haven't set up admin access carry on
+// without signing in.
+func requireStaff(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (envOr("ADMIN_USER", "") == "" || envOr("ADMIN_PASSWORD", "") == "") && len(storeAdmins()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		requireAdmin(next).ServeHTTP(w, r)
+	})
+}
+
+// staffUser is the signed-in staff member, or "" for customers and the system.
+func staffUser(r *http.Request) string {
+	user, _ := adminUser(r)
+	return user
+}
+
+// adminUser returns the admin name if the request carries valid credentials.
+func adminUser(r *http.Request) (string, bool) {
+	user, _, ok := authenticateAdmin(r)
+	return user, ok
+}
+
+// adminStoreCode returns the store a branch manager is limited to, or "" for
+// the shop owner and non-admin requests.
+func adminStoreCode(r *http.Request) string {
+	_, store, _ := authenticateAdmin(r)
+	return store
+}
+
+type storeAdmin struct {
+	store, user, password string
+}
+
+// storeAdmins parses STORE_ADMINS, a list of store_code:user:password
+// entries separated by semicolons or newlines. A password hash has commas
+// in it, so lists with no hashes may still be separated by commas, as they
+// were before passwords could be given hashed.
+func storeAdmins() []storeAdmin {
+	return parseStoreAdmins(envOr("STORE_ADMINS", ""))
+}
+
+func parseStoreAdmins(v string) []storeAdmin {
+	entries := strings.FieldsFunc(v, func(c rune) bool { return c == ';' || c == '\n' })
+	if !strings.ContainsAny(v, ";\n") && !strings.Contains(v, "$argon2") {
+		entries = strings.Split(v, ",")
+	}
+	var admins []storeAdmin
+	for _, entry := range entries {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] != "" {
+			admins = append(admins, storeAdmin{store: parts[0], user: parts[1], password: parts[2]})
+		}
+	}
+	return admins
+}
+
+func authenticateAdmin(r *http.Request) (user, store string, ok bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", "", false
+	}
+	if credentialsMatch(user, pass, envOr("ADMIN_USER", ""), envOr("ADMIN_PASSWORD", "")) {
+		return user, "", true
+	}
+	for _, a := range storeAdmins() {
+		if credentialsMatch(user, pass, a.user, a.password) {
+			return user, a.store, true
+		}
+	}
+	return "", "", false
+}
+
+// credentialsMatch checks pass against the admin's stored password, or
+// wantPass until they set one.
+func credentialsMatch(user, pass, wantUser, wantPass string) bool {
+	if wantUser == "" || wantPass == "" || subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) != 1 {
+		return false
+	}
+	ok, err := verifyCredential("admin", user, pass, wantPass)
+	if err != nil {
+		log.Printf("admin sign-in for %s: %v", user, err)
+	}
+	return ok
+}
+
+// configuredPassword is the password the environment gives user.
+func configuredPassword(user string) string {
+	if user == envOr("ADMIN_USER", "") {
+		return envOr("ADMIN_PASSWORD", "")
+	}
+	for _, a := range storeAdmins() {
+		if a.user == user {
+			return a.password
+		}
+	}
+	return ""
+}
+
+// changedOrders lists the store's orders changed since since, most
+// recently changed first.
+func changedOrders(storeID int, since time.Time, limit int) ([]Order, error) {
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE store_id = ? AND deleted_at IS NULL AND updated_at >= ? ORDER BY updated_at DESC LIMIT ?", storeID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func adminDashboard(w http.ResponseWriter, r *http.Request) {
+	tickets, err := openTickets(currentStoreID(r), 10)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	late, err := lateRushOrders(currentStoreID(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	changed, err := changedOrders(currentStoreID(r), time.Now().Add(-time.Hour), 20)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	sales, err := salesSummary(currentStoreID(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	user, _ := adminUser(r)
+	t := mustParseTemplates("admin_dashboard.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		User        string
+		OpenTickets []Ticket
+		LateRush    []Order
+		RushSLA     time.Duration
+		Changed     []Order
+		Sales       SalesSummary
+		Flashes     []Flash
+	}{storeSwitcher(r), user, tickets, late, rushOrderSLA(), changed, sales, popFlashes(r)})
+}
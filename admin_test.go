@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStoreAdmins(t *testing.T) {
+	hash := "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g"
+	tests := []struct {
+		name, in string
+		want     []storeAdmin
+	}{
+		{"empty", "", nil},
+		{"commas", "kandy:nimal:pw1, galle:sunil:pw2", []storeAdmin{{"kandy", "nimal", "pw1"}, {"galle", "sunil", "pw2"}}},
+		{"semicolons", "kandy:nimal:pw1;galle:sunil:pw2;", []storeAdmin{{"kandy", "nimal", "pw1"}, {"galle", "sunil", "pw2"}}},
+		{"newlines", "kandy:nimal:pw1\ngalle:sunil:pw2\n", []storeAdmin{{"kandy", "nimal", "pw1"}, {"galle", "sunil", "pw2"}}},
+		{"hashed", "kandy:nimal:" + hash + ";galle:sunil:pw2", []storeAdmin{{"kandy", "nimal", hash}, {"galle", "sunil", "pw2"}}},
+		{"hashed alone", "kandy:nimal:" + hash, []storeAdmin{{"kandy", "nimal", hash}}},
+		{"colon in password", "kandy:nimal:a:b", []storeAdmin{{"kandy", "nimal", "a:b"}}},
+		{"dollar in password", "kandy:nimal:pa$s,galle:sunil:pw2", []storeAdmin{{"kandy", "nimal", "pa$s"}, {"galle", "sunil", "pw2"}}},
+		{"incomplete", "kandy:nimal;galle::pw2;:sunil:pw3", nil},
+	}
+	for _, tt := range tests {
+		if got := parseStoreAdmins(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseStoreAdmins = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
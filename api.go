@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Every API error has the same shape:
+//
+//	{"code": "not_found", "message": "Order not found", "request_id": "…",
+//	 "field_errors": {"quantity": "Quantity must be between 1 and 100."}}
+//
+// code is stable for clients to branch on; message is for people. "error"
+// repeats the message for clients written before the other fields.
+// request_id is also in the X-Request-ID response header and lets us find
+// the request in the logs.
+
+type APIError struct {
+	Code        string            `json:"code"`
+	Message     string            `json:"message"`
+	FieldErrors map[string]string `json:"field_errors,omitempty"`
+	RequestID   string            `json:"request_id"`
+	Error       string            `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError answers with the error code that goes with status.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeAPIError(w, status, errorCode(status), message, nil)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string, fieldErrors map[string]string) {
+	writeJSON(w, status, APIError{
+		Code:        code,
+		Message:     message,
+		FieldErrors: fieldErrors,
+		RequestID:   w.Header().Get("X-Request-ID"),
+		Error:       message,
+	})
+}
+
+// errorCode is the default code for status: "not_found", "too_many_requests"…
+func errorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(strings.ReplaceAll(text, "-", " ")), " ", "_")
+}
+
+// wantsJSON reports whether the client asked for JSON rather than a page:
+// it called the API, or its Accept header names application/json before
+// text/html.
+func wantsJSON(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.ReplaceAll(params, " ", "") == "q=0" {
+			continue
+		}
+		switch strings.TrimSpace(mediaType) {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
+}
+
+// writeError fails a request in the format its caller expects: the API
+// envelope for JSON clients, plain text otherwise.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if wantsJSON(r) {
+		writeJSONError(w, status, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "No such endpoint")
+}
+
+func apiMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed here")
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID tags every request with an ID in X-Request-ID, keeping one
+// sent by a proxy in front of us if it looks sane.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = rand.Text()
+			r.Header.Set("X-Request-ID", id)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API keys open one part of the API each: "chatbot" or "pos". Besides
+// CHATBOT_API_KEY and POS_API_KEY, partners get their own keys through
+// API_KEYS, a comma-separated list of name:scope:daily_quota:key entries,
+// so each can be given a different tier. Requests are counted per key and
+// day; once a key is over its quota (0 means none) it gets 429 until
+// midnight. Key holders can see their usage at /api/v1/usage.
+
+type APIKey struct {
+	Name       string
+	Scope      string
+	DailyQuota int
+	key        string
+}
+
+func apiKeys() []APIKey {
+	var keys []APIKey
+	if k := envOr("CHATBOT_API_KEY", ""); k != "" {
+		keys = append(keys, APIKey{Name: "chatbot", Scope: "chatbot", DailyQuota: envInt("CHATBOT_DAILY_QUOTA", 0), key: k})
+	}
+	if k := envOr("POS_API_KEY", ""); k != "" {
+		keys = append(keys, APIKey{Name: "pos", Scope: "pos", DailyQuota: envInt("POS_DAILY_QUOTA", 0), key: k})
+	}
+	for _, entry := range strings.Split(envOr("API_KEYS", ""), ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 4)
+		if len(parts) != 4 || parts[0] == "" || parts[3] == "" {
+			continue
+		}
+		quota, err := strconv.Atoi(parts[2])
+		if err != nil || quota < 0 {
+			continue
+		}
+		keys = append(keys, APIKey{Name: parts[0], Scope: parts[1], DailyQuota: quota, key: parts[3]})
+	}
+	return keys
+}
+
+type apiKeyContext struct{}
+
+// requestAPIKey is the key the request was let in with.
+func requestAPIKey(r *http.Request) APIKey {
+	k, _ := r.Context().Value(apiKeyContext{}).(APIKey)
+	return k
+}
+
+// requireAPIKey lets in requests carrying a key for scope, or any key when
+// scope is "", and counts them against the key's quota.
+func requireAPIKey(scope, unconfigured string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var candidates []APIKey
+			for _, k := range apiKeys() {
+				if scope == "" || k.Scope == scope {
+					candidates = append(candidates, k)
+				}
+			}
+			if len(candidates) == 0 {
+				writeJSONError(w, http.StatusServiceUnavailable, unconfigured)
+				return
+			}
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if got == "" {
+				got = r.Header.Get("X-API-Key")
+			}
+			var key APIKey
+			found := false
+			for _, k := range candidates {
+				if subtle.ConstantTimeCompare([]byte(got), []byte(k.key)) == 1 {
+					key, found = k, true
+				}
+			}
+			if !found {
+				writeAPIError(w, http.StatusUnauthorized, "invalid_api_key", "Invalid API key", nil)
+				return
+			}
+			used, err := countAPIRequest(key.Name)
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "DB error")
+				return
+			}
+			if key.DailyQuota > 0 {
+				w.Header().Set("X-RateLimit-Limit", strconv.Itoa(key.DailyQuota))
+				w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(key.DailyQuota-used, 0)))
+				w.Header().Set("X-RateLimit-Reset", strconv.Itoa(secondsToMidnight()))
+				if used > key.DailyQuota {
+					w.Header().Set("Retry-After", strconv.Itoa(secondsToMidnight()))
+					writeAPIError(w, http.StatusTooManyRequests, "quota_exceeded", "Daily request quota used up", nil)
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+		})
+	}
+}
+
+// countAPIRequest adds a request to today's count for the key and returns
+// the new count. Refused requests count too, so the report shows them.
+func countAPIRequest(name string) (int, error) {
+	res, err := db.Exec(`INSERT INTO api_usage (key_name, day, requests) VALUES (?, CURDATE(), LAST_INSERT_ID(1))
+		ON DUPLICATE KEY UPDATE requests = LAST_INSERT_ID(requests + 1)`, name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.LastInsertId()
+	return int(n), err
+}
+
+func secondsToMidnight() int {
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	return int(midnight.Sub(now).Seconds())
+}
+
+type APIUsageDay struct {
+	Date     string `json:"date"`
+	Requests int    `json:"requests"`
+}
+
+func apiUsageDays(name string, days int) ([]APIUsageDay, error) {
+	rows, err := db.Query(`SELECT DATE_FORMAT(day, '%Y-%m-%d'), requests FROM api_usage
+		WHERE key_name = ? AND day > CURDATE() - INTERVAL ? DAY ORDER BY day DESC`, name, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []APIUsageDay
+	for rows.Next() {
+		var d APIUsageDay
+		if err := rows.Scan(&d.Date, &d.Requests); err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// apiUsage reports the calling key's quota and the last 30 days of use.
+func apiUsage(w http.ResponseWriter, r *http.Request) {
+	key := requestAPIKey(r)
+	days, err := apiUsageDays(key.Name, 30)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	today := 0
+	if len(days) > 0 && days[0].Date == time.Now().Format("2006-01-02") {
+		today = days[0].Requests
+	}
+	usage := map[string]interface{}{
+		"key":         key.Name,
+		"scope":       key.Scope,
+		"daily_quota": key.DailyQuota,
+		"today":       today,
+		"days":        days,
+	}
+	if key.DailyQuota > 0 {
+		usage["remaining"] = max(key.DailyQuota-today, 0)
+		usage["resets_in"] = secondsToMidnight()
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+type APIKeyUsage struct {
+	APIKey
+	Today     int
+	Month     int
+	DaysOver  int
+	Remaining int
+}
+
+func apiUsagePage(w http.ResponseWriter, r *http.Request) {
+	var keys []APIKeyUsage
+	for _, k := range apiKeys() {
+		u := APIKeyUsage{APIKey: k}
+		err := db.QueryRow(`SELECT COALESCE(SUM(CASE WHEN day = CURDATE() THEN requests END), 0), COALESCE(SUM(requests), 0),
+				COALESCE(SUM(? > 0 AND requests > ?), 0)
+			FROM api_usage WHERE key_name = ? AND day > CURDATE() - INTERVAL 30 DAY`, k.DailyQuota, k.DailyQuota, k.Name).
+			Scan(&u.Today, &u.Month, &u.DaysOver)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		u.Remaining = max(k.DailyQuota-u.Today, 0)
+		keys = append(keys, u)
+	}
+	t := mustParseTemplates("api_usage.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Keys    []APIKeyUsage
+		Flashes []Flash
+	}{keys, popFlashes(r)})
+}
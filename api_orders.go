@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /api/v1/orders lists the store's orders newest first, a page at a
+// time. Pages are cut by keyset on (created_at, id) rather than offset, so
+// orders placed while a client is paging neither shift nor repeat what it
+// sees: pass the response's next_cursor back as ?cursor= to continue. It
+// is absent on the last page. ?limit= sets the page size (50, at most 200)
+// and ?status= and ?customer= narrow the list. ?updated_since= keeps the
+// orders changed since a time, given as RFC 3339 or as a duration back
+// from now like 1h, so a client can sync just what changed. PATCH
+// /api/v1/orders/{id} edits one (see order_edits.go) and DELETE deletes it.
+//
+// GET /api/v1/orders/{id} answers with an ETag and Last-Modified from the
+// order's updated_at, and 304 Not Modified when the client's copy is
+// still current.
+
+const (
+	apiOrdersPageSize    = 50
+	apiOrdersMaxPageSize = 200
+)
+
+type orderCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        int       `json:"id"`
+}
+
+func (c orderCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeOrderCursor(s string) (orderCursor, bool) {
+	var c orderCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.ID <= 0 {
+		return c, false
+	}
+	return c, true
+}
+
+// scanAlso scans columns selected after the usual ones into extra.
+type scanAlso struct {
+	rowScanner
+	extra []interface{}
+}
+
+func (s scanAlso) Scan(dest ...interface{}) error {
+	return s.rowScanner.Scan(append(dest, s.extra...)...)
+}
+
+type orderPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+func apiOrders(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := apiOrdersPageSize
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = min(n, apiOrdersMaxPageSize)
+	}
+	where, args := "WHERE store_id = ? AND deleted_at IS NULL", []interface{}{currentStoreID(r)}
+	if status := q.Get("status"); status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+	if customer := q.Get("customer"); customer != "" {
+		where += " AND customer_id = ?"
+		args = append(args, customer)
+	}
+	if s := q.Get("updated_since"); s != "" {
+		since, ok := parseSince(s)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "updated_since must be a time like 2006-01-02T15:04:05Z or a duration like 1h")
+			return
+		}
+		where += " AND updated_at >= ?"
+		args = append(args, since)
+	}
+	if s := q.Get("cursor"); s != "" {
+		c, ok := decodeOrderCursor(s)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		where += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, c.CreatedAt, c.CreatedAt, c.ID)
+	}
+	// One row past the page tells whether there is another.
+	rows, err := db.Query("SELECT "+orderColumns+", created_at FROM orders "+where+" ORDER BY created_at DESC, id DESC LIMIT ?",
+		append(args, limit+1)...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	defer rows.Close()
+	page := orderPage{Orders: []Order{}}
+	var last orderCursor
+	for rows.Next() {
+		var o Order
+		var created time.Time
+		if err := scanOrder(scanAlso{rows, []interface{}{&created}}, &o); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		if len(page.Orders) == limit {
+			page.NextCursor = last.encode()
+			break
+		}
+		page.Orders = append(page.Orders, o)
+		last = orderCursor{CreatedAt: created, ID: o.ID}
+	}
+	if err := rows.Err(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// parseSince reads a time as RFC 3339 or as a positive duration before now.
+func parseSince(s string) (time.Time, bool) {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return time.Now().Add(-d), true
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
+
+// notModified sets the validators for a response last changed at modified
+// and reports whether the request's copy is current, having sent the 304.
+func notModified(w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	etag := `"` + strconv.FormatInt(modified.UnixMicro(), 36) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if match != "*" && !strings.Contains(match, etag) {
+			return false
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || modified.Truncate(time.Second).After(t) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// apiDeleteOrder deletes an order through the same path as the delete
+// page, audit entry and order event included. Deleting an order that is
+// already gone succeeds again, so clients can retry safely; only one that
+// never existed is a 404.
+func apiDeleteOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	err := deleteOrder(r, orderID)
+	if err == errOrderNotFound {
+		var deleted bool
+		err = db.QueryRow("SELECT COUNT(*) > 0 FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NOT NULL", orderID, currentStoreID(r)).Scan(&deleted)
+		if err == nil && !deleted {
+			writeJSONError(w, http.StatusNotFound, "Order not found")
+			return
+		}
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB delete error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
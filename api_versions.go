@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The API is versioned by path: /api/v1, /api/v2… Each version registers
+// its own routes, pointing at the same handlers and queries wherever its
+// contract hasn't changed, so old and new versions run side by side. To
+// retire one, set API_<VERSION>_DEPRECATED and API_<VERSION>_SUNSET to
+// dates (YYYY-MM-DD, e.g. API_V1_SUNSET=2027-06-30): its responses then
+// carry Deprecation and Sunset headers (RFC 9745, RFC 8594) and a Link to
+// the newest version. API_<VERSION>_DEPRECATION_DOCS can point clients at
+// upgrade notes.
+
+type apiVersion struct {
+	name   string
+	routes func(api *mux.Router)
+}
+
+var apiVersions = []apiVersion{
+	{"v1", apiV1Routes},
+}
+
+func mountAPI(r *mux.Router) {
+	latest := apiVersions[len(apiVersions)-1].name
+	for _, v := range apiVersions {
+		api := r.PathPrefix("/api/" + v.name).Subrouter()
+		api.Use(corsMiddleware, deprecationHeaders(v.name, latest))
+		api.NotFoundHandler = http.HandlerFunc(apiNotFound)
+		api.MethodNotAllowedHandler = http.HandlerFunc(apiMethodNotAllowed)
+		// Matched by hand rather than with Methods, which would turn every
+		// unknown path into a 405.
+		api.PathPrefix("/").MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return r.Method == http.MethodOptions
+		}).HandlerFunc(corsPreflight)
+		v.routes(api)
+	}
+}
+
+// adminAPI puts an API endpoint behind the same checks as the admin pages.
+func adminAPI(h http.HandlerFunc) http.Handler {
+	return requireAllowedNetwork(requireAdmin(h))
+}
+
+func apiV1Routes(api *mux.Router) {
+	api.HandleFunc("/devices", registerDevice).Methods("POST")
+	api.HandleFunc("/devices/{token}", unregisterDevice).Methods("DELETE")
+	api.HandleFunc("/push-preferences", setPushPreference).Methods("PUT")
+	api.Handle("/usage", requireAPIKey("", "API access is not configured")(http.HandlerFunc(apiUsage))).Methods("GET")
+	api.Handle("/reorder-suggestions", adminAPI(reorderSuggestionsAPI)).Methods("GET")
+	api.Handle("/orders", adminAPI(apiOrders)).Methods("GET")
+	api.Handle("/orders/{orderID}", adminAPI(searchOrderPage)).Methods("GET")
+	api.Handle("/orders/{orderID}", adminAPI(apiPatchOrder)).Methods("PATCH")
+	api.Handle("/orders/{orderID}", adminAPI(apiDeleteOrder)).Methods("DELETE")
+	api.HandleFunc("/orders/{orderID}/timeline", apiOrderTimeline).Methods("GET")
+	api.Handle("/customers/{contact}/orders", adminAPI(searchCustomerPage)).Methods("GET")
+	api.Handle("/reports", adminAPI(viewReports)).Methods("GET")
+	api.Handle("/reports/margins", adminAPI(marginReport)).Methods("GET")
+	api.Handle("/pricing/preview", adminAPI(pricingPreview)).Methods("GET")
+
+	chatbot := api.PathPrefix("/chatbot").Subrouter()
+	chatbot.Use(requireAPIKey("chatbot", "Chatbot access is not configured"))
+	chatbot.HandleFunc("/products", chatbotProducts).Methods("GET")
+	chatbot.HandleFunc("/orders", chatbotPlaceOrder).Methods("POST")
+	chatbot.HandleFunc("/orders/{orderID}", chatbotOrder).Methods("GET")
+	chatbot.HandleFunc("/customers/{contact}/orders", chatbotCustomerOrders).Methods("GET")
+
+	pos := api.PathPrefix("/pos").Subrouter()
+	pos.Use(requireAPIKey("pos", "POS sync is not configured"))
+	pos.HandleFunc("/products", chatbotProducts).Methods("GET")
+	pos.HandleFunc("/sales", posSyncSales).Methods("POST")
+}
+
+// deprecationHeaders tells clients of a version being retired when it
+// was deprecated, when it goes away and what replaces it.
+func deprecationHeaders(version, latest string) mux.MiddlewareFunc {
+	env := "API_" + strings.ToUpper(version)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if d, err := time.Parse("2006-01-02", envOr(env+"_DEPRECATED", "")); err == nil {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(d.Unix(), 10))
+				if version != latest {
+					w.Header().Add("Link", `</api/`+latest+`>; rel="successor-version"`)
+				}
+				if docs := envOr(env+"_DEPRECATION_DOCS", ""); docs != "" {
+					w.Header().Add("Link", `<`+docs+`>; rel="deprecation"; type="text/html"`)
+				}
+			}
+			if s, err := time.Parse("2006-01-02", envOr(env+"_SUNSET", "")); err == nil {
+				w.Header().Set("Sunset", s.Format(http.TimeFormat))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
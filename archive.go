@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Delivered orders untouched for ARCHIVE_AFTER_MONTHS (12) months are moved
+// nightly from orders to orders_archive, which keeps the tables the shop
+// works from small. Their items, events and payments stay where they are.
+// Searches and the sales report leave archived orders out unless asked with
+// archived=1; daily_sales counts them either way. orders_archive is made
+// like orders and given any column orders gains, so rows copy as they are.
+
+const archiveBatchSize = 500
+
+// archiveColumns is the orders columns, which orders_archive has too.
+// ensureSchema sets it.
+var archiveColumns string
+
+func init() {
+	registerScheduledTask("order-archive", "45 2 * * *", archiveOrders)
+}
+
+// syncOrdersArchive makes orders_archive, or adds the columns orders has
+// gained since it was made.
+func syncOrdersArchive() error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS orders_archive LIKE orders"); err != nil {
+		return err
+	}
+	var name, create string
+	if err := db.QueryRow("SHOW CREATE TABLE orders").Scan(&name, &create); err != nil {
+		return err
+	}
+	columns, err := tableColumns("orders")
+	if err != nil {
+		return err
+	}
+	archived, err := tableColumns("orders_archive")
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for _, c := range archived {
+		have[c] = true
+	}
+	for _, line := range strings.Split(create, "\n") {
+		def := strings.TrimSuffix(strings.TrimSpace(line), ",")
+		column, _, ok := strings.Cut(strings.TrimPrefix(def, "`"), "`")
+		if !strings.HasPrefix(def, "`") || !ok || have[column] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE orders_archive ADD COLUMN " + def); err != nil {
+			return err
+		}
+	}
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = "`" + c + "`"
+	}
+	archiveColumns = strings.Join(quoted, ", ")
+	return nil
+}
+
+func tableColumns(table string) ([]string, error) {
+	rows, err := db.Query("SELECT COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// ordersFrom is the table to read orders from: orders, or with archived
+// orders and orders_archive together under the name orders, so
+// orderColumns works on either.
+func ordersFrom(archived bool) string {
+	if !archived {
+		return "orders"
+	}
+	return "(SELECT " + archiveColumns + " FROM orders UNION ALL SELECT " + archiveColumns + " FROM orders_archive) orders"
+}
+
+// wantsArchived is whether a search or report asked for archived orders too.
+func wantsArchived(r *http.Request) bool {
+	v := r.FormValue("archived")
+	return v == "1" || v == "true" || v == "on"
+}
+
+func archiveOrders() error {
+	months := envInt("ARCHIVE_AFTER_MONTHS", 12)
+	if months <= 0 {
+		return nil
+	}
+	total := 0
+	for {
+		n, err := archiveOrderBatch(months)
+		total += n
+		if err != nil || n < archiveBatchSize {
+			if total > 0 {
+				log.Printf("archived %d orders delivered over %d months ago", total, months)
+			}
+			return err
+		}
+	}
+}
+
+func archiveOrderBatch(months int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id FROM orders WHERE status = 'DELIVERED' AND updated_at < NOW() - INTERVAL ? MONTH ORDER BY id LIMIT ? FOR UPDATE",
+		months, archiveBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var ids []interface{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	in := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	if _, err := tx.Exec("INSERT INTO orders_archive ("+archiveColumns+") SELECT "+archiveColumns+" FROM orders WHERE id IN ("+in+")", ids...); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM orders WHERE id IN ("+in+")", ids...); err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
+
+func archivedOrder(storeID int, orderID string) (Order, error) {
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders_archive orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", orderID, storeID), &o)
+	return o, err
+}
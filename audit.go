@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type AuditEntry struct {
+	ID        int64
+	Action    string
+	EntityID  string
+	Details   string
+	Actor     string
+	IP        string
+	CreatedAt time.Time
+}
+
+func auditActor(r *http.Request) string {
+	if user, ok := adminUser(r); ok {
+		return user
+	}
+	return "anonymous"
+}
+
+// clientIP is the address the request came from. Behind the reverse proxies
+// listed in TRUSTED_PROXIES (CIDR ranges or IPs) it is the last address in
+// X-Forwarded-For that isn't one of them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	proxies := parseNetworks(envOr("TRUSTED_PROXIES", ""))
+	if ip := net.ParseIP(host); ip == nil || !ipInNetworks(ip, proxies) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		host = hop
+		if !ipInNetworks(ip, proxies) {
+			break
+		}
+	}
+	return host
+}
+
+func recordAudit(ex execer, r *http.Request, action, entityID, details string) error {
+	_, err := ex.Exec("INSERT INTO audit_log (action, entity_id, details, actor, ip) VALUES (?, ?, ?, ?, ?)",
+		action, entityID, details, auditActor(r), clientIP(r))
+	return err
+}
+
+func auditLogPage(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT id, action, entity_id, COALESCE(details, ''), actor, ip, created_at FROM audit_log ORDER BY id DESC LIMIT 500")
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		_ = rows.Scan(&e.ID, &e.Action, &e.EntityID, &e.Details, &e.Actor, &e.IP, &e.CreatedAt)
+		entries = append(entries, e)
+	}
+	t := mustParseTemplates("audit_log.html")
+	_ = t.Execute(w, entries)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// Customers can order sizes a store has run out of. The order is taken as
+// BACKORDERED, shows the variant's expected restock date, and becomes
+// PROCESSING by itself once the store has stock for it, oldest backorders
+// first. Variants a store keeps no stock records for are never backordered,
+// so shops that don't track inventory keep working.
+const OrderBackordered = "BACKORDERED"
+
+// Pending items on orders in these statuses are spoken for; new orders
+// queue behind backorders, which in turn wait for the others.
+const (
+	stockClaimingStatuses = "'PROCESSING', 'PARTIALLY_SHIPPED', 'CUTTING', 'SEWING', 'QC'"
+	stockQueueStatuses    = stockClaimingStatuses + ", '" + OrderBackordered + "'"
+)
+
+// availableStock is the variant's stock across the store's locations less
+// what pending items on orders in claiming (a quoted SQL list) still need.
+// tracked is false when the store has no stock record for the variant.
+func availableStock(tx *sql.Tx, storeID, variantID int, claiming string) (available int, tracked bool, err error) {
+	var records int
+	err = tx.QueryRow(`SELECT COUNT(*), COALESCE(SUM(s.quantity), 0) FROM stock s JOIN locations l ON l.id = s.location_id
+		WHERE l.store_id = ? AND s.variant_id = ?`, storeID, variantID).Scan(&records, &available)
+	if err != nil || records == 0 {
+		return 0, false, err
+	}
+	var claimed int
+	err = tx.QueryRow(`SELECT COALESCE(SUM(i.quantity), 0) FROM order_items i JOIN orders o ON o.order_id = i.order_id
+		WHERE o.store_id = ? AND i.variant_id = ? AND i.status = ? AND o.deleted_at IS NULL AND o.status IN (`+claiming+`)`,
+		storeID, variantID, ItemPending).Scan(&claimed)
+	return available - claimed, true, err
+}
+
+// releaseBackorders moves the store's backorders for variantID to PROCESSING
+// inside tx, oldest first, for as long as the stock covers them. The
+// released orders are returned so the caller can emit them after committing.
+func releaseBackorders(tx *sql.Tx, storeID, variantID int) ([]Order, error) {
+	available, tracked, err := availableStock(tx, storeID, variantID, stockClaimingStatuses)
+	if err != nil || !tracked || available <= 0 {
+		return nil, err
+	}
+	rows, err := tx.Query("SELECT "+orderColumns+` FROM orders WHERE store_id = ? AND status = ? AND deleted_at IS NULL
+		AND order_id IN (SELECT order_id FROM order_items WHERE variant_id = ?) ORDER BY id FOR UPDATE`,
+		storeID, OrderBackordered, variantID)
+	if err != nil {
+		return nil, err
+	}
+	var waiting []Order
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		waiting = append(waiting, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var released []Order
+	for _, o := range waiting {
+		lines, err := orderLines(tx, o.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		need := 0
+		for _, p := range linesWithStatus(lines, ItemPending) {
+			if lines[p].VariantID == variantID {
+				need += lines[p].Quantity
+			}
+		}
+		if need > available {
+			break
+		}
+		available -= need
+		if _, err := tx.Exec("UPDATE orders SET status = ? WHERE order_id = ?", statuses[0], o.OrderID); err != nil {
+			return nil, err
+		}
+		if err := recordOrderEvent(tx, o.OrderID, OrderEventStatusChanged, StatusChange{From: OrderBackordered, To: statuses[0]}); err != nil {
+			return nil, err
+		}
+		o.Status = statuses[0]
+		released = append(released, o)
+	}
+	return released, nil
+}
+
+func emitReleasedBackorders(released []Order) {
+	for i := range released {
+		emitOrderEvent(OrderEvent{Type: EventOrderStatusChanged, OrderID: released[i].OrderID, Order: &released[i], OldStatus: OrderBackordered})
+	}
+}
+
+// releaseWaitingBackorders is the scheduled sweep behind the release on
+// stock adjustments: it also picks up stock freed by cancelled orders and
+// returns.
+func releaseWaitingBackorders() error {
+	rows, err := db.Query(`SELECT DISTINCT o.store_id, i.variant_id FROM orders o JOIN order_items i ON i.order_id = o.order_id
+		WHERE o.status = ? AND o.deleted_at IS NULL`, OrderBackordered)
+	if err != nil {
+		return err
+	}
+	type waiting struct{ storeID, variantID int }
+	var pairs []waiting
+	for rows.Next() {
+		var p waiting
+		if err := rows.Scan(&p.storeID, &p.variantID); err != nil {
+			rows.Close()
+			return err
+		}
+		pairs = append(pairs, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range pairs {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		released, err := releaseBackorders(tx, p.storeID, p.variantID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if len(released) > 0 {
+			log.Printf("backorders: released %d order(s) for variant %d in store %d", len(released), p.variantID, p.storeID)
+		}
+		emitReleasedBackorders(released)
+	}
+	return nil
+}
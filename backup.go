@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Backup is the on-disk dump format: gzipped JSON with every table created by
+// schemaStatements. Column values are kept as raw bytes (base64 in JSON) so
+// restoring round-trips exactly, NULLs included.
+type Backup struct {
+	Version   int                     `json:"version"`
+	CreatedAt time.Time               `json:"created_at"`
+	Tables    map[string]*BackupTable `json:"tables"`
+}
+
+type BackupTable struct {
+	Columns []string   `json:"columns"`
+	Rows    [][][]byte `json:"rows"`
+}
+
+var createTablePattern = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS (\w+)`)
+
+func backupTableNames() []string {
+	var names []string
+	for _, stmt := range schemaStatements {
+		if m := createTablePattern.FindStringSubmatch(stmt); m != nil {
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	dest := fs.Arg(0)
+	if dest == "" {
+		dest = "backup-" + time.Now().Format("20060102-150405") + ".json.gz"
+	}
+
+	b, err := dumpDatabase()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(b); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if err := writeBackupFile(dest, buf.Bytes()); err != nil {
+		return err
+	}
+	for name, t := range b.Tables {
+		log.Printf("backup: %s: %d rows", name, len(t.Rows))
+	}
+	log.Printf("backup written to %s (%d bytes)", dest, buf.Len())
+	return nil
+}
+
+// dumpDatabase reads every table inside one read-only repeatable-read
+// transaction, so the dump is a consistent snapshot even while orders come in.
+func dumpDatabase() (*Backup, error) {
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	b := &Backup{Version: 1, CreatedAt: time.Now(), Tables: map[string]*BackupTable{}}
+	for _, name := range backupTableNames() {
+		rows, err := tx.Query("SELECT * FROM " + name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		cols, _ := rows.Columns()
+		t := &BackupTable{Columns: cols}
+		for rows.Next() {
+			raw := make([]sql.RawBytes, len(cols))
+			dest := make([]interface{}, len(cols))
+			for i := range raw {
+				dest[i] = &raw[i]
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			row := make([][]byte, len(cols))
+			for i, v := range raw {
+				if v != nil {
+					row[i] = append([]byte{}, v...)
+				}
+			}
+			t.Rows = append(t.Rows, row)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		b.Tables[name] = t
+	}
+	return b, nil
+}
+
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "confirm that current data should be replaced")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: restore [-yes] backup.json.gz|s3://bucket/key")
+	}
+	src := fs.Arg(0)
+
+	data, err := readBackupFile(src)
+	if err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("not a backup file: %v", err)
+	}
+	var b Backup
+	if err := json.NewDecoder(zr).Decode(&b); err != nil {
+		return fmt.Errorf("not a backup file: %v", err)
+	}
+	if b.Version != 1 {
+		return fmt.Errorf("unsupported backup version %d", b.Version)
+	}
+
+	log.Printf("backup taken %s:", b.CreatedAt.Format("2006-01-02 15:04:05"))
+	for name, t := range b.Tables {
+		log.Printf("  %s: %d rows", name, len(t.Rows))
+	}
+	if !*yes {
+		return errors.New("restore replaces all current data; re-run with -yes to continue")
+	}
+	if err := restoreDatabase(&b); err != nil {
+		return err
+	}
+	log.Printf("restore complete")
+	return nil
+}
+
+// restoreDatabase replaces the contents of every table in the backup within a
+// single transaction. Tables added since the backup was taken are left alone.
+func restoreDatabase(b *Backup) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		return err
+	}
+
+	known := map[string]bool{}
+	for _, name := range backupTableNames() {
+		known[name] = true
+	}
+	for name, t := range b.Tables {
+		if !known[name] {
+			log.Printf("restore: skipping unknown table %s", name)
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM " + name); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		cols := "`" + strings.Join(t.Columns, "`, `") + "`"
+		placeholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(t.Columns)), ", ") + ")"
+		for start := 0; start < len(t.Rows); start += 500 {
+			end := start + 500
+			if end > len(t.Rows) {
+				end = len(t.Rows)
+			}
+			var values []string
+			var args []interface{}
+			for _, row := range t.Rows[start:end] {
+				values = append(values, placeholder)
+				for _, v := range row {
+					// Bound as strings: MySQL rejects binary-charset values for JSON columns.
+					if v == nil {
+						args = append(args, nil)
+					} else {
+						args = append(args, string(v))
+					}
+				}
+			}
+			if _, err := tx.Exec("INSERT INTO "+name+" ("+cols+") VALUES "+strings.Join(values, ", "), args...); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	if _, err := tx.Exec("SET FOREIGN_KEY_CHECKS = 1"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func writeBackupFile(dest string, data []byte) error {
+	if rest, ok := strings.CutPrefix(dest, "s3://"); ok {
+		bucket, key, _ := strings.Cut(rest, "/")
+		if bucket == "" || key == "" {
+			return fmt.Errorf("invalid S3 location %q, want s3://bucket/key", dest)
+		}
+		return putS3Object(bucket, key, data)
+	}
+	return os.WriteFile(dest, data, 0600)
+}
+
+func readBackupFile(src string) ([]byte, error) {
+	if rest, ok := strings.CutPrefix(src, "s3://"); ok {
+		bucket, key, _ := strings.Cut(rest, "/")
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("invalid S3 location %q, want s3://bucket/key", src)
+		}
+		return getS3Object(bucket, key)
+	}
+	return os.ReadFile(src)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type BatchDeleteResult struct {
+	OrderID string
+	Deleted bool
+	Error   string
+}
+
+func selectedOrderIDs(r *http.Request) []string {
+	_ = r.ParseForm()
+	seen := map[string]bool{}
+	var ids []string
+	for _, id := range r.Form["orderids"] {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func batchDeletePage(w http.ResponseWriter, r *http.Request) {
+	ids := selectedOrderIDs(r)
+	if len(ids) == 0 {
+		redirectWithFlash(w, r, "/delete-order", "error", "Select at least one order to delete.")
+		return
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := []interface{}{currentStoreID(r)}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE store_id = ? AND deleted_at IS NULL AND order_id IN ("+placeholders+") ORDER BY order_id", args...)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		_ = scanOrder(rows, &o)
+		orders = append(orders, o)
+	}
+
+	t := mustParseTemplates("batch_delete_confirm.html")
+	_ = t.Execute(w, struct {
+		Orders []Order
+		IDs    []string
+		Token  string
+	}{orders, ids, signToken("batch-delete", strings.Join(ids, ","), 10*time.Minute)})
+}
+
+func confirmBatchDelete(w http.ResponseWriter, r *http.Request) {
+	ids := selectedOrderIDs(r)
+	if len(ids) == 0 || !verifyToken("batch-delete", strings.Join(ids, ","), r.FormValue("token")) {
+		redirectWithFlash(w, r, "/delete-order", "error", "The batch delete confirmation has expired. Please try again.")
+		return
+	}
+
+	var results []BatchDeleteResult
+	deleted := 0
+	for _, id := range ids {
+		res := BatchDeleteResult{OrderID: id}
+		switch err := deleteOrder(r, id); {
+		case err == nil:
+			res.Deleted = true
+			deleted++
+		case err == errOrderNotFound:
+			res.Error = "Order not found"
+		default:
+			res.Error = "Database error"
+		}
+		results = append(results, res)
+	}
+	summary := fmt.Sprintf("%d of %d orders deleted", deleted, len(ids))
+	_ = recordAudit(db, r, "order.batch_delete", strings.Join(ids, ","), summary)
+
+	data, _ := json.Marshal(results)
+	s := getSession(r)
+	s.Values["batch_delete_result"] = string(data)
+	_ = saveSession(s)
+	http.Redirect(w, r, "/delete-order/batch/result", http.StatusSeeOther)
+}
+
+func batchDeleteResult(w http.ResponseWriter, r *http.Request) {
+	s := getSession(r)
+	raw, ok := s.Values["batch_delete_result"]
+	if !ok {
+		http.Redirect(w, r, "/delete-order", http.StatusSeeOther)
+		return
+	}
+	delete(s.Values, "batch_delete_result")
+	_ = saveSession(s)
+
+	var results []BatchDeleteResult
+	_ = json.Unmarshal([]byte(raw), &results)
+	deleted := 0
+	for _, res := range results {
+		if res.Deleted {
+			deleted++
+		}
+	}
+	t := mustParseTemplates("batch_delete_result.html")
+	_ = t.Execute(w, struct {
+		Results []BatchDeleteResult
+		Deleted int
+		Failed  int
+	}{results, deleted, len(results) - deleted})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// Staff keep a blocklist of phone numbers, email addresses and IP addresses
+// of abusive customers at /admin/blocklist. Web orders from a blocked
+// identity are refused, or, for entries set to review, taken as usual and
+// quietly held on the review queue (fraud.go) with the entry's reason.
+// Every time an entry stops an order it is counted. Orders staff take are
+// not checked.
+const (
+	BlockPhone = "phone"
+	BlockEmail = "email"
+	BlockIP    = "ip"
+
+	BlockRefuse = "refuse"
+	BlockReview = "review"
+)
+
+var blockKindLabels = map[string]string{BlockPhone: "Phone", BlockEmail: "Email", BlockIP: "IP address"}
+
+type BlockedIdentity struct {
+	ID        int
+	Kind      string
+	Value     string
+	Action    string
+	Reason    string
+	Hits      int
+	LastHitAt time.Time
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+func (b BlockedIdentity) KindLabel() string {
+	return blockKindLabels[b.Kind]
+}
+
+// Describe is how the entry is given as the reason an order was held.
+func (b BlockedIdentity) Describe() string {
+	return "Blocklisted " + strings.ToLower(b.KindLabel()) + " " + b.Value + ": " + b.Reason
+}
+
+// blockValue normalizes value as an identity of kind so that the same
+// number or address written differently still matches. It returns "" when
+// value isn't one.
+func blockValue(kind, value string) string {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case BlockPhone:
+		var b strings.Builder
+		for i, c := range value {
+			if unicode.IsDigit(c) || (c == '+' && i == 0) {
+				b.WriteRune(c)
+			}
+		}
+		if strings.TrimPrefix(b.String(), "+") == "" {
+			return ""
+		}
+		return b.String()
+	case BlockEmail:
+		if !strings.Contains(value, "@") {
+			return ""
+		}
+		return strings.ToLower(value)
+	case BlockIP:
+		if ip := net.ParseIP(value); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// blockedIdentity finds the blocklist entry for an order under contact from
+// ip, preferring one that refuses the order. ok is false when neither is
+// blocked.
+func blockedIdentity(contact, ip string) (b BlockedIdentity, ok bool, err error) {
+	phone, email := blockValue(BlockPhone, contact), blockValue(BlockEmail, contact)
+	if email != "" {
+		phone = ""
+	}
+	err = db.QueryRow(`SELECT id, kind, value, action, reason FROM blocked_identities
+		WHERE (kind = ? AND value = ?) OR (kind = ? AND value = ?) OR (kind = ? AND value = ?)
+		ORDER BY action = ? DESC, id LIMIT 1`,
+		BlockPhone, phone, BlockEmail, email, BlockIP, blockValue(BlockIP, ip), BlockRefuse).
+		Scan(&b.ID, &b.Kind, &b.Value, &b.Action, &b.Reason)
+	if err == sql.ErrNoRows {
+		return b, false, nil
+	}
+	return b, err == nil, err
+}
+
+func countBlockHit(ex execer, id int) error {
+	_, err := ex.Exec("UPDATE blocked_identities SET hits = hits + 1, last_hit_at = NOW() WHERE id = ?", id)
+	return err
+}
+
+// refuseBlockedOrder answers an order from a blocked identity set to be
+// refused, and reports whether it did.
+func refuseBlockedOrder(w http.ResponseWriter, r *http.Request, contact string) bool {
+	if staffUser(r) != "" {
+		return false
+	}
+	b, blocked, err := blockedIdentity(contact, clientIP(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return true
+	}
+	if !blocked || b.Action != BlockRefuse {
+		return false
+	}
+	if err := countBlockHit(db, b.ID); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return true
+	}
+	http.Error(w, "Sorry, we can't take this order online. Please contact the shop.", http.StatusForbidden)
+	return true
+}
+
+func blocklistPage(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT id, kind, value, action, reason, hits, last_hit_at,
+		created_by, created_at FROM blocked_identities ORDER BY created_at DESC, id DESC`)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var entries []BlockedIdentity
+	for rows.Next() {
+		var b BlockedIdentity
+		if err := rows.Scan(&b.ID, &b.Kind, &b.Value, &b.Action, &b.Reason, &b.Hits, nullTime{&b.LastHitAt}, &b.CreatedBy, &b.CreatedAt); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, b)
+	}
+	t := mustParseTemplates("blocklist.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Entries []BlockedIdentity
+		Flashes []Flash
+	}{entries, popFlashes(r)})
+}
+
+func addBlockedIdentity(w http.ResponseWriter, r *http.Request) {
+	back := "/admin/blocklist"
+	kind, action := r.FormValue("kind"), r.FormValue("action")
+	value := blockValue(kind, r.FormValue("value"))
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if value == "" || (action != BlockRefuse && action != BlockReview) {
+		redirectWithFlash(w, r, back, "error", "Enter a valid phone number, email address or IP address.")
+		return
+	}
+	if reason == "" || len(reason) > 300 {
+		redirectWithFlash(w, r, back, "error", "Say in up to 300 characters why it is blocked.")
+		return
+	}
+	_, err := db.Exec(`INSERT INTO blocked_identities (kind, value, action, reason, created_by) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE action = VALUES(action), reason = VALUES(reason)`, kind, value, action, reason, auditActor(r))
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "blocklist.add", kind+":"+value, action+": "+reason)
+	redirectWithFlash(w, r, back, "success", value+" is blocked.")
+}
+
+func removeBlockedIdentity(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var kind, value string
+	err := db.QueryRow("SELECT kind, value FROM blocked_identities WHERE id = ?", id).Scan(&kind, &value)
+	if err == sql.ErrNoRows {
+		redirectWithFlash(w, r, "/admin/blocklist", "error", "That entry was already removed.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM blocked_identities WHERE id = ?", id); err != nil {
+		http.Error(w, "DB delete error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "blocklist.remove", kind+":"+value, "")
+	redirectWithFlash(w, r, "/admin/blocklist", "success", value+" is no longer blocked.")
+}
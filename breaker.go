@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// When MySQL can't be reached, DB_BREAKER_FAILURES (3) connection failures
+// in a row open the breaker: for DB_BREAKER_COOLDOWN (15s) statements fail
+// at once with errDBUnavailable instead of each waiting on a dead server,
+// and the shop runs degraded. The home page, the storefront and the order
+// form still show from the last stores and catalog read; everything else gets a page saying
+// to try again shortly, and the API a 503. After the cooldown the next
+// statement tries the server again and closes the breaker if it answers.
+
+var errDBUnavailable = errors.New("database unavailable")
+
+const dbUnavailableMessage = "We can't reach our order system right now. Please try again in a few minutes."
+
+type circuitBreaker struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+var dbBreaker circuitBreaker
+
+func init() {
+	expvar.Publish("db_breaker_open", expvar.Func(func() interface{} { return !dbBreaker.allow() }))
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	return !time.Now().Before(b.openUntil)
+}
+
+// openFor is how long until the breaker lets statements through again.
+func (b *circuitBreaker) openFor() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	return time.Until(b.openUntil)
+}
+
+// record counts err towards opening the breaker if it means the server
+// couldn't be reached; any other outcome shows it is up.
+func (b *circuitBreaker) record(err error) {
+	threshold := envInt("DB_BREAKER_FAILURES", 3)
+	b.Lock()
+	defer b.Unlock()
+	if !connectionError(err) {
+		if b.failures >= threshold {
+			log.Printf("database reachable again")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		if b.failures == threshold {
+			log.Printf("database unreachable (%v), failing fast", err)
+		}
+		b.openUntil = time.Now().Add(envDuration("DB_BREAKER_COOLDOWN", 15*time.Second))
+	}
+}
+
+// trip opens b straight away, for a server already known to be down.
+func (b *circuitBreaker) trip() {
+	threshold := envInt("DB_BREAKER_FAILURES", 3)
+	b.Lock()
+	defer b.Unlock()
+	b.failures = max(b.failures, threshold)
+	b.openUntil = time.Now().Add(envDuration("DB_BREAKER_COOLDOWN", 15*time.Second))
+}
+
+func connectionError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, errDBUnavailable) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.As(err, &netErr)
+}
+
+// degradedPaths work from lastGood reads while the database is down.
+var degradedPaths = map[string]bool{"/": true, "/place-order": true, "/shop": true}
+
+// degradedGuard turns requests away while the breaker is open, rather than
+// have each handler fail on its own.
+func degradedGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dbBreaker.allow() || (r.Method == http.MethodGet && (degradedPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/shop/"))) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(dbBreaker.openFor(), time.Second).Seconds()))))
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeAPIError(w, http.StatusServiceUnavailable, "unavailable", dbUnavailableMessage, nil)
+			return
+		}
+		if isHTMX(r) {
+			w.Header().Set("HX-Reswap", "none")
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		t := mustParseTemplates("unavailable.html")
+		_ = t.Execute(w, dbUnavailableMessage)
+	})
+}
+
+// lastGood keeps the last result of each read, to answer with while the
+// database can't be reached.
+type lastGood[T any] struct {
+	sync.Mutex
+	results map[string]T
+}
+
+func (c *lastGood[T]) load(key string, read func() (T, error)) (T, error) {
+	v, err := read()
+	c.Lock()
+	defer c.Unlock()
+	if err == nil {
+		if c.results == nil {
+			c.results = map[string]T{}
+		}
+		c.results[key] = v
+	} else if last, ok := c.results[key]; ok && connectionError(err) {
+		return last, nil
+	}
+	return v, err
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BrokerMessage struct {
+	Subject string          `json:"subject"`
+	Data    json.RawMessage `json:"data"`
+}
+
+var broker *natsPublisher
+
+// setupBroker publishes order events to NATS when BROKER_ENABLED=true.
+// Messages go through the job queue so a broker outage only delays them.
+func setupBroker() {
+	if envOr("BROKER_ENABLED", "false") != "true" {
+		return
+	}
+	broker = &natsPublisher{url: envOr("BROKER_URL", "nats://127.0.0.1:4222")}
+	prefix := envOr("BROKER_SUBJECT_PREFIX", "fashionshop")
+
+	registerJobHandler("broker_publish", func(payload []byte) error {
+		var m BrokerMessage
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return err
+		}
+		return broker.publish(m.Subject, m.Data)
+	})
+	onOrderEvent(func(ev OrderEvent) {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("broker: encode %s: %v", ev.Type, err)
+			return
+		}
+		if err := enqueueJob("broker_publish", BrokerMessage{Subject: prefix + "." + ev.Type, Data: data}); err != nil {
+			log.Printf("broker: enqueue %s: %v", ev.Type, err)
+		}
+	})
+}
+
+// natsPublisher speaks just enough of the NATS text protocol to publish.
+type natsPublisher struct {
+	url string
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func (p *natsPublisher) publish(subject string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(p.w, "PUB %s %d\r\n", subject, len(data))
+	p.w.Write(data)
+	p.w.WriteString("\r\n")
+	if err := p.w.Flush(); err != nil {
+		p.closeLocked()
+		return err
+	}
+	return nil
+}
+
+func (p *natsPublisher) connect() error {
+	u, err := url.Parse(p.url)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected greeting %q: %v", line, err)
+	}
+
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "fashionshop"}
+	if u.User != nil {
+		opts["user"] = u.User.Username()
+		opts["pass"], _ = u.User.Password()
+	}
+	connect, _ := json.Marshal(opts)
+	w := bufio.NewWriter(conn)
+	w.WriteString("CONNECT " + string(connect) + "\r\nPING\r\n")
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		if strings.HasPrefix(line, "PONG") {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return fmt.Errorf("nats: %s", strings.TrimSpace(line))
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	p.conn, p.w = conn, w
+	go p.readLoop(conn, r)
+	return nil
+}
+
+func (p *natsPublisher) readLoop(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		p.mu.Lock()
+		if p.conn != conn {
+			p.mu.Unlock()
+			return
+		}
+		if err != nil {
+			log.Printf("nats: connection lost: %v", err)
+			p.closeLocked()
+			p.mu.Unlock()
+			return
+		}
+		if strings.HasPrefix(line, "PING") {
+			p.w.WriteString("PONG\r\n")
+			p.w.Flush()
+		} else if strings.HasPrefix(line, "-ERR") {
+			log.Printf("nats: %s", strings.TrimSpace(line))
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *natsPublisher) closeLocked() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.w = nil, nil
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// At the end of the day staff count the cash couriers brought back and
+// close the day against the cash-on-delivery collections in the ledger.
+// Any difference is recorded with an explanation. A closed day is locked:
+// no more cash can be booked to it, and its closing report no longer
+// changes.
+
+type DayClosing struct {
+	Day        string
+	Expected   Money
+	Counted    Money
+	Difference Money
+	Note       string
+	ClosedBy   string
+	ClosedAt   time.Time
+}
+
+type CashUpPage struct {
+	StoreSwitcher
+	Day         string
+	Collections []LedgerEntry
+	Expected    Money
+	Closing     *DayClosing
+	Flashes     []Flash
+}
+
+var errDayClosed = errors.New("the day has been closed")
+
+// dayClosed reports whether the store's cash-up for day is done.
+func dayClosed(tx *sql.Tx, storeID int, day string) (bool, error) {
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM day_closings WHERE store_id = ? AND day = ?", storeID, day).Scan(&n)
+	return n > 0, err
+}
+
+// codCollections lists the cash collected on delivery on day.
+func codCollections(storeID int, day string) ([]LedgerEntry, Money, error) {
+	rows, err := db.Query(`SELECT id, COALESCE(order_id, ''), kind, method, amount, reference, actor, created_at
+		FROM ledger_entries WHERE store_id = ? AND kind = ? AND DATE(created_at) = ? ORDER BY id`, storeID, LedgerCODCollection, day)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var entries []LedgerEntry
+	var total Money
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.ID, &e.OrderID, &e.Kind, &e.Method, &e.Amount, &e.Reference, &e.Actor, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, e)
+		total += e.Amount
+	}
+	return entries, total, rows.Err()
+}
+
+func dayClosing(storeID int, day string) (*DayClosing, error) {
+	var c DayClosing
+	err := db.QueryRow(`SELECT DATE_FORMAT(day, '%Y-%m-%d'), expected, counted, difference, note, closed_by, closed_at
+		FROM day_closings WHERE store_id = ? AND day = ?`, storeID, day).
+		Scan(&c.Day, &c.Expected, &c.Counted, &c.Difference, &c.Note, &c.ClosedBy, &c.ClosedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &c, err
+}
+
+func loadCashUpPage(r *http.Request, day string) (CashUpPage, error) {
+	storeID := currentStoreID(r)
+	p := CashUpPage{StoreSwitcher: storeSwitcher(r), Day: day}
+	var err error
+	if p.Collections, p.Expected, err = codCollections(storeID, day); err != nil {
+		return p, err
+	}
+	p.Closing, err = dayClosing(storeID, day)
+	return p, err
+}
+
+// cashUpDay reads the day from the URL or the query, defaulting to today.
+func cashUpDay(r *http.Request) (string, bool) {
+	day := mux.Vars(r)["day"]
+	if day == "" {
+		day = r.FormValue("day")
+	}
+	if day == "" {
+		return time.Now().Format("2006-01-02"), true
+	}
+	t, err := time.ParseInLocation("2006-01-02", day, time.Local)
+	return day, err == nil && !t.After(time.Now())
+}
+
+func cashUpPage(w http.ResponseWriter, r *http.Request) {
+	day, ok := cashUpDay(r)
+	if !ok {
+		redirectWithFlash(w, r, "/admin/cash-up", "error", "Pick a day that has already started.")
+		return
+	}
+	p, err := loadCashUpPage(r, day)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	p.Flashes = popFlashes(r)
+	t := mustParseTemplates("cash_up.html", "partials.html")
+	_ = t.Execute(w, p)
+}
+
+// closeDay records the counted cash against the expected and locks the day.
+// A difference needs a note.
+func closeDay(w http.ResponseWriter, r *http.Request) {
+	day, ok := cashUpDay(r)
+	back := "/admin/cash-up?day=" + day
+	if !ok {
+		redirectWithFlash(w, r, "/admin/cash-up", "error", "Pick a day that has already started.")
+		return
+	}
+	counted, err := parseMoney(r.FormValue("counted"))
+	note := strings.TrimSpace(r.FormValue("note"))
+	if err != nil || counted < 0 || len(note) > 500 {
+		redirectWithFlash(w, r, back, "error", "Enter the cash counted, zero or more, and a note of at most 500 characters.")
+		return
+	}
+	storeID := currentStoreID(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var expected Money
+	err = tx.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE store_id = ? AND kind = ? AND DATE(created_at) = ?",
+		storeID, LedgerCODCollection, day).Scan(&expected)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	difference := counted - expected
+	if difference != 0 && note == "" {
+		redirectWithFlash(w, r, back, "error", fmt.Sprintf("The count is %s off; explain the difference in the note.", money(difference)))
+		return
+	}
+	res, err := tx.Exec(`INSERT IGNORE INTO day_closings (store_id, day, expected, counted, difference, note, closed_by) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		storeID, day, expected, counted, difference, note, auditActor(r))
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		redirectWithFlash(w, r, back, "error", day+" has already been closed.")
+		return
+	}
+	if err = recordAudit(tx, r, "day.close", day, fmt.Sprintf("expected %.2f, counted %.2f", expected, counted)); err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", fmt.Sprintf("%s closed with %s counted.", day, money(counted)))
+}
+
+func dayClosingReport(w http.ResponseWriter, r *http.Request) {
+	day, ok := cashUpDay(r)
+	if !ok {
+		http.Error(w, "Invalid day", http.StatusBadRequest)
+		return
+	}
+	p, err := loadCashUpPage(r, day)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if p.Closing == nil {
+		redirectWithFlash(w, r, "/admin/cash-up?day="+day, "error", day+" has not been closed yet.")
+		return
+	}
+	t := mustParseTemplates("day_closing_report.html")
+	_ = t.Execute(w, p)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type Product struct {
+	ID            int
+	Name          string
+	ProductType   string
+	Active        bool
+	MadeToMeasure bool
+	Variants      []Variant
+}
+
+type Variant struct {
+	ID          int
+	ProductID   int
+	ProductName string
+	ProductType string
+	SKU         string
+	Size        string
+	Color       string
+	Material    string
+	Price       Money
+	Cost        Money
+	WeightGrams int
+	Active      bool
+	RestockDate string
+	// Made-to-measure variants are cut to the customer's measurements.
+	MadeToMeasure bool
+}
+
+// Label is how a variant is shown in pickers and order lines.
+func (v Variant) Label() string {
+	parts := []string{v.ProductName}
+	if v.Color != "" {
+		parts = append(parts, v.Color)
+	}
+	if v.Material != "" {
+		parts = append(parts, v.Material)
+	}
+	return strings.Join(parts, " · ") + " — " + v.Size
+}
+
+type OrderItem struct {
+	ID          int64  `json:"-"`
+	VariantID   int    `json:"variant_id"`
+	SKU         string `json:"sku"`
+	ProductName string `json:"product_name"`
+	Size        string `json:"size"`
+	Color       string `json:"color"`
+	Quantity    int    `json:"quantity"`
+	UnitPrice   Money  `json:"unit_price"`
+	Status      string `json:"status,omitempty"`
+	LocationID  int    `json:"location_id,omitempty"`
+}
+
+func (it OrderItem) LineTotal() Money {
+	return it.UnitPrice.Times(it.Quantity)
+}
+
+const variantOrder = "p.name, p.id, v.color, FIELD(v.size, 'XS', 'S', 'M', 'L', 'XL', 'XXL'), v.id"
+
+const variantColumns = "v.id, v.product_id, p.name, p.product_type, v.sku, v.size, v.color, v.material, v.price, v.cost, v.weight_grams, v.active AND p.active, " +
+	"COALESCE(DATE_FORMAT(v.restock_date, '%Y-%m-%d'), ''), p.made_to_measure"
+
+func scanVariant(row rowScanner, v *Variant) error {
+	return row.Scan(&v.ID, &v.ProductID, &v.ProductName, &v.ProductType, &v.SKU, &v.Size, &v.Color, &v.Material, &v.Price, &v.Cost, &v.WeightGrams, &v.Active, &v.RestockDate, &v.MadeToMeasure)
+}
+
+func queryVariants(where string, args ...interface{}) ([]Variant, error) {
+	rows, err := db.Query("SELECT "+variantColumns+" FROM product_variants v JOIN products p ON p.id = v.product_id "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var variants []Variant
+	for rows.Next() {
+		var v Variant
+		if err := scanVariant(rows, &v); err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+	return variants, rows.Err()
+}
+
+// activeVariants lists what can currently be ordered, grouped by product.
+func activeVariants() ([]Variant, error) {
+	return queryVariants("WHERE v.active AND p.active ORDER BY " + variantOrder)
+}
+
+func variantByID(id int) (Variant, error) {
+	var v Variant
+	err := scanVariant(db.QueryRow("SELECT "+variantColumns+" FROM product_variants v JOIN products p ON p.id = v.product_id WHERE v.id = ?", id), &v)
+	return v, err
+}
+
+func variantBySKU(sku string) (Variant, error) {
+	var v Variant
+	err := scanVariant(db.QueryRow("SELECT "+variantColumns+" FROM product_variants v JOIN products p ON p.id = v.product_id WHERE v.sku = ?", sku), &v)
+	return v, err
+}
+
+// defaultVariant maps a bare size, as used before the catalog existed, onto
+// the Classic T-Shirt.
+func defaultVariant(size string) (Variant, error) {
+	var v Variant
+	err := scanVariant(db.QueryRow("SELECT "+variantColumns+" FROM product_variants v JOIN products p ON p.id = v.product_id WHERE v.product_id = 1 AND v.size = ?", size), &v)
+	return v, err
+}
+
+// insertOrderItems also copies each variant's current cost price onto its
+// items for the margin report.
+func insertOrderItems(tx *sql.Tx, orderID string, items []OrderItem) error {
+	for _, it := range items {
+		if it.Status == "" {
+			it.Status = ItemPending
+		}
+		_, err := tx.Exec(`INSERT INTO order_items (order_id, variant_id, sku, product_name, size, color, quantity, unit_price, unit_cost, status, location_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, COALESCE((SELECT cost FROM product_variants WHERE id = ?), 0), ?, NULLIF(?, 0))`,
+			orderID, it.VariantID, it.SKU, it.ProductName, it.Size, it.Color, it.Quantity, it.UnitPrice, it.VariantID, it.Status, it.LocationID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func orderItems(orderID string) ([]OrderItem, error) {
+	rows, err := db.Query("SELECT id, variant_id, sku, product_name, size, color, quantity, unit_price, status, COALESCE(location_id, 0) FROM order_items WHERE order_id = ? ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []OrderItem
+	for rows.Next() {
+		var it OrderItem
+		if err := rows.Scan(&it.ID, &it.VariantID, &it.SKU, &it.ProductName, &it.Size, &it.Color, &it.Quantity, &it.UnitPrice, &it.Status, &it.LocationID); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+func productsPage(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT id, name, product_type, active, made_to_measure FROM products ORDER BY name, id")
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var products []Product
+	for rows.Next() {
+		var p Product
+		_ = rows.Scan(&p.ID, &p.Name, &p.ProductType, &p.Active, &p.MadeToMeasure)
+		products = append(products, p)
+	}
+	variants, err := queryVariants("ORDER BY " + variantOrder)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	for _, v := range variants {
+		for i := range products {
+			if products[i].ID == v.ProductID {
+				products[i].Variants = append(products[i].Variants, v)
+			}
+		}
+	}
+
+	t := mustParseTemplates("products.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Products []Product
+		Sizes    []string
+		Flashes  []Flash
+	}{products, sizes, popFlashes(r)})
+}
+
+func createProduct(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	productType := strings.TrimSpace(r.FormValue("product_type"))
+	if name == "" {
+		redirectWithFlash(w, r, "/admin/products", "error", "A product needs a name.")
+		return
+	}
+	if productType == "" {
+		productType = "t-shirt"
+	}
+	madeToMeasure := r.FormValue("made_to_measure") == "on"
+	res, err := db.Exec("INSERT INTO products (name, product_type, made_to_measure) VALUES (?, ?, ?)", name, productType, madeToMeasure)
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	_ = recordAudit(db, r, "product.create", strconv.FormatInt(id, 10), name)
+	redirectWithFlash(w, r, "/admin/products", "success", "Product "+name+" created. Add its variants below.")
+}
+
+// setMadeToMeasure switches whether a product is cut to the customer's
+// measurements.
+func setMadeToMeasure(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	var name string
+	err = db.QueryRow("SELECT name FROM products WHERE id = ?", id).Scan(&name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	on := r.FormValue("made_to_measure") == "on"
+	if _, err := db.Exec("UPDATE products SET made_to_measure = ? WHERE id = ?", on, id); err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "product.made_to_measure", strconv.Itoa(id), fmt.Sprintf("%s: %t", name, on))
+	redirectWithFlash(w, r, "/admin/products", "success", "Product "+name+" updated.")
+}
+
+var skuPattern = regexp.MustCompile(`^[A-Z0-9-]{1,40}$`)
+
+func createVariant(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	sku := strings.ToUpper(strings.TrimSpace(r.FormValue("sku")))
+	size := r.FormValue("size")
+	price, perr := parseMoney(r.FormValue("price"))
+	cost, cerr := parseMoney(r.FormValue("cost"))
+	if r.FormValue("cost") == "" {
+		cost, cerr = 0, nil
+	}
+	weight, werr := strconv.Atoi(r.FormValue("weight"))
+	if r.FormValue("weight") == "" {
+		weight, werr = defaultVariantWeight, nil
+	}
+	if _, ok := priceMap[size]; !ok || !skuPattern.MatchString(sku) || perr != nil || price <= 0 || cerr != nil || cost < 0 || werr != nil || weight < 0 {
+		redirectWithFlash(w, r, "/admin/products", "error", "A variant needs a SKU (letters, digits, dashes), a size and a positive price, and no negative cost.")
+		return
+	}
+	if _, err := variantBySKU(sku); err == nil {
+		redirectWithFlash(w, r, "/admin/products", "error", "SKU "+sku+" is already in use.")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO product_variants (product_id, sku, size, color, material, price, cost, weight_grams) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		productID, sku, size, strings.TrimSpace(r.FormValue("color")), strings.TrimSpace(r.FormValue("material")), price, cost, weight)
+	if err == nil {
+		id, _ := res.LastInsertId()
+		err = recordPriceChange(tx, r, int(id), 0, price)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "variant.create", sku, fmt.Sprintf("%s %.2f", size, price))
+	redirectWithFlash(w, r, "/admin/products", "success", "Variant "+sku+" added.")
+}
+
+func updateVariant(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid variant ID", http.StatusBadRequest)
+		return
+	}
+	v, err := variantByID(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Variant not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	price, err := parseMoney(r.FormValue("price"))
+	cost, cerr := parseMoney(r.FormValue("cost"))
+	weight, werr := strconv.Atoi(r.FormValue("weight"))
+	if err != nil || price <= 0 || cerr != nil || cost < 0 || werr != nil || weight < 0 {
+		redirectWithFlash(w, r, "/admin/products", "error", "Price must be a positive number, cost zero or more and weight zero or more grams.")
+		return
+	}
+	restock := r.FormValue("restock_date")
+	if _, err := time.Parse("2006-01-02", restock); restock != "" && err != nil {
+		redirectWithFlash(w, r, "/admin/products", "error", "The expected restock date is not a valid date.")
+		return
+	}
+	active := r.FormValue("active") == "on"
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE product_variants SET price = ?, cost = ?, weight_grams = ?, active = ?, restock_date = NULLIF(?, '') WHERE id = ?", price, cost, weight, active, restock, id)
+	if err == nil && price != v.Price {
+		err = recordPriceChange(tx, r, id, v.Price, price)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "variant.update", v.SKU, fmt.Sprintf("price %.2f -> %.2f, cost %.2f -> %.2f, weight %dg -> %dg, active %t, restock %q -> %q", v.Price, price, v.Cost, cost, v.WeightGrams, weight, active, v.RestockDate, restock))
+	redirectWithFlash(w, r, "/admin/products", "success", "Variant "+v.SKU+" updated.")
+}
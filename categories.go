@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Categories are permanent groupings ("T-Shirts", "Kids"); collections are
+// seasonal ones ("Summer 2025"). Both work the same way.
+var categoryKinds = []string{"category", "collection"}
+
+type Category struct {
+	ID           int
+	Name         string
+	Slug         string
+	Kind         string
+	ProductCount int
+}
+
+var categoriesRead lastGood[[]Category]
+
+func loadCategories() ([]Category, error) {
+	return categoriesRead.load("", queryCategories)
+}
+
+func queryCategories() ([]Category, error) {
+	rows, err := db.Query(`SELECT c.id, c.name, c.slug, c.kind, COUNT(pc.product_id)
+		FROM categories c LEFT JOIN product_categories pc ON pc.category_id = c.id
+		GROUP BY c.id, c.name, c.slug, c.kind ORDER BY c.kind, c.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &c.Kind, &c.ProductCount); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// categoryFilter resolves the ?category= query parameter (an id or a slug).
+// Zero means no filter.
+func categoryFilter(r *http.Request) int {
+	v := r.URL.Query().Get("category")
+	if v == "" {
+		return 0
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM categories WHERE id = ? OR slug = ?", v, v).Scan(&id); err != nil {
+		return 0
+	}
+	return id
+}
+
+// The order form keeps working from the last read while the database is
+// unavailable.
+var catalogRead lastGood[[]Variant]
+
+// activeVariantsIn narrows activeVariants to one category; zero means all.
+func activeVariantsIn(categoryID int) ([]Variant, error) {
+	return catalogRead.load(strconv.Itoa(categoryID), func() ([]Variant, error) {
+		if categoryID == 0 {
+			return activeVariants()
+		}
+		return queryVariants("WHERE v.active AND p.active AND p.id IN (SELECT product_id FROM product_categories WHERE category_id = ?) ORDER BY "+variantOrder, categoryID)
+	})
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slugify(s string) string {
+	return strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+func validCategoryKind(kind string) bool {
+	for _, k := range categoryKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func categoriesPage(w http.ResponseWriter, r *http.Request) {
+	categories, err := loadCategories()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("categories.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Categories []Category
+		Kinds      []string
+		Flashes    []Flash
+	}{categories, categoryKinds, popFlashes(r)})
+}
+
+func createCategory(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	kind := r.FormValue("kind")
+	slug := slugify(name)
+	if slug == "" || !validCategoryKind(kind) {
+		redirectWithFlash(w, r, "/admin/categories", "error", "A category needs a name.")
+		return
+	}
+	res, err := db.Exec("INSERT IGNORE INTO categories (name, slug, kind) VALUES (?, ?, ?)", name, slug, kind)
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		redirectWithFlash(w, r, "/admin/categories", "error", "A category called "+name+" already exists.")
+		return
+	}
+	id, _ := res.LastInsertId()
+	_ = recordAudit(db, r, "category.create", slug, name)
+	http.Redirect(w, r, "/admin/categories/"+strconv.FormatInt(id, 10), http.StatusSeeOther)
+}
+
+func editCategoryPage(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	var c Category
+	err := db.QueryRow("SELECT id, name, slug, kind FROM categories WHERE id = ?", id).Scan(&c.ID, &c.Name, &c.Slug, &c.Kind)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	type productOption struct {
+		ID       int
+		Name     string
+		Selected bool
+	}
+	rows, err := db.Query(`SELECT p.id, p.name, pc.category_id IS NOT NULL FROM products p
+		LEFT JOIN product_categories pc ON pc.product_id = p.id AND pc.category_id = ? ORDER BY p.name, p.id`, id)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var products []productOption
+	for rows.Next() {
+		var p productOption
+		_ = rows.Scan(&p.ID, &p.Name, &p.Selected)
+		products = append(products, p)
+	}
+
+	t := mustParseTemplates("category_edit.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Category
+		Kinds    []string
+		Products []productOption
+		Flashes  []Flash
+	}{c, categoryKinds, products, popFlashes(r)})
+}
+
+func updateCategory(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	back := "/admin/categories/" + strconv.Itoa(id)
+	name := strings.TrimSpace(r.FormValue("name"))
+	kind := r.FormValue("kind")
+	if name == "" || !validCategoryKind(kind) {
+		redirectWithFlash(w, r, back, "error", "A category needs a name.")
+		return
+	}
+	_ = r.ParseForm()
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE categories SET name = ?, kind = ? WHERE id = ?", name, kind, id)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Unchanged rows report 0 too; make sure the category exists.
+			err = tx.QueryRow("SELECT id FROM categories WHERE id = ?", id).Scan(&id)
+		}
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM product_categories WHERE category_id = ?", id)
+	}
+	for _, pid := range r.PostForm["products"] {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT INTO product_categories (product_id, category_id) SELECT id, ? FROM products WHERE id = ?", id, pid)
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "category.update", strconv.Itoa(id), name+": "+strings.Join(r.PostForm["products"], ","))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", name+" saved.")
+}
+
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var name string
+	err = tx.QueryRow("SELECT name FROM categories WHERE id = ?", id).Scan(&name)
+	if err == sql.ErrNoRows {
+		redirectWithFlash(w, r, "/admin/categories", "error", "That category no longer exists.")
+		return
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM product_categories WHERE category_id = ?", id)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM categories WHERE id = ?", id)
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "category.delete", strconv.Itoa(id), name)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB delete error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/categories", "success", name+" deleted.")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The chatbot API lets our messaging bot look up and place orders on a
+// customer's behalf. It has its own key, CHATBOT_API_KEY, which grants access
+// to these endpoints only; partner keys with the chatbot scope do the same.
+
+type chatbotProduct struct {
+	VariantID int    `json:"variant_id"`
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	Size      string `json:"size"`
+	Color     string `json:"color"`
+	Price     Money  `json:"price"`
+}
+
+func chatbotProducts(w http.ResponseWriter, r *http.Request) {
+	variants, err := activeVariants()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	products := []chatbotProduct{}
+	for _, v := range variants {
+		products = append(products, chatbotProduct{VariantID: v.ID, SKU: v.SKU, Name: v.Label(), Size: v.Size, Color: v.Color, Price: v.Price})
+	}
+	writeJSON(w, http.StatusOK, products)
+}
+
+// chatbotOrder returns one order, but only to the contact it was placed
+// under, so the bot cannot be used to look up other people's orders.
+func chatbotOrder(w http.ResponseWriter, r *http.Request) {
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND customer_id = ? AND deleted_at IS NULL",
+		mux.Vars(r)["orderID"], r.URL.Query().Get("contact")), &o)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "Order not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	o.Items, _ = orderItems(o.OrderID)
+	writeJSON(w, http.StatusOK, o)
+}
+
+func chatbotCustomerOrders(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE customer_id = ? AND deleted_at IS NULL ORDER BY created_at DESC LIMIT 5", mux.Vars(r)["contact"])
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	defer rows.Close()
+	orders := []Order{}
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		orders = append(orders, o)
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+type chatbotOrderRequest struct {
+	Contact   string `json:"contact" validate:"required,maxlen=100"`
+	SKU       string `json:"sku"`
+	VariantID int    `json:"variant_id"`
+	Quantity  int    `json:"quantity" validate:"required,min=1,max=100"`
+	Notes     string `json:"notes" validate:"maxlen=500"`
+	Store     string `json:"store"`
+}
+
+func chatbotPlaceOrder(w http.ResponseWriter, r *http.Request) {
+	var req chatbotOrderRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeJSONInvalid(w, err)
+		return
+	}
+	var v Variant
+	var err error
+	if req.SKU != "" {
+		v, err = variantBySKU(strings.ToUpper(req.SKU))
+	} else {
+		v, err = variantByID(req.VariantID)
+	}
+	if err == sql.ErrNoRows || (err == nil && !v.Active) {
+		writeJSONError(w, http.StatusBadRequest, "Unknown or unavailable product")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	storeID := 1
+	if req.Store != "" {
+		s, err := storeByCode(req.Store)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Unknown store")
+			return
+		}
+		storeID = s.ID
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	defer tx.Rollback()
+	order, err := createOrder(tx, storeID, ChannelOnline, req.Contact, v, req.Quantity, req.Notes, "")
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB insert error")
+		return
+	}
+	emitOrderEvent(OrderEvent{Type: EventOrderCreated, OrderID: order.OrderID, Order: &order})
+	writeJSON(w, http.StatusCreated, order)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Customers pay cash on delivery unless they choose to pay in advance.
+// Cash on delivery is refused for balances over COD_MAX_ORDER_VALUE and for
+// customers who have refused COD_MAX_REFUSALS deliveries or more.
+const (
+	PaymentCOD     = "cod"
+	PaymentPrepaid = "prepaid"
+)
+
+// PaymentMethodChoice is the data of an OrderEventPaymentMethodSet event.
+type PaymentMethodChoice struct {
+	Method string `json:"method"`
+}
+
+// PaymentMethodLabel is how the order's payment method is shown to people.
+func (o Order) PaymentMethodLabel() string {
+	switch o.PaymentMethod {
+	case PaymentCOD:
+		return "Cash on delivery"
+	case PaymentPrepaid:
+		return "Pay in advance"
+	case PaymentCash:
+		return "Cash in store"
+	case PaymentCard:
+		return "Card in store"
+	}
+	return ""
+}
+
+func refusedDeliveries(contact string) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM orders WHERE customer_id = ? AND status = 'REFUSED'", contact).Scan(&n)
+	return n, err
+}
+
+// codRefusal explains why cash on delivery cannot be used for amountDue, or
+// returns "" when it can.
+func codRefusal(contact string, amountDue Money) (string, error) {
+	if limit := Money(envInt("COD_MAX_ORDER_VALUE", 25000)) * 100; limit > 0 && amountDue > limit {
+		return fmt.Sprintf("Cash on delivery is only available for orders up to %s. Please choose to pay in advance.", money(limit)), nil
+	}
+	refused, err := refusedDeliveries(contact)
+	if err != nil {
+		return "", err
+	}
+	if max := envInt("COD_MAX_REFUSALS", 2); max > 0 && refused >= max {
+		return "Cash on delivery is not available on this account because earlier deliveries were refused. Please choose to pay in advance.", nil
+	}
+	return "", nil
+}
+
+func setPaymentMethod(tx *sql.Tx, o *Order, method string) error {
+	if _, err := tx.Exec("UPDATE orders SET payment_method = ? WHERE order_id = ?", method, o.OrderID); err != nil {
+		return err
+	}
+	o.PaymentMethod = method
+	return recordOrderEvent(tx, o.OrderID, OrderEventPaymentMethodSet, PaymentMethodChoice{Method: method})
+}
+
+// recordCODCollection books the cash the courier collected for a delivered
+// order, what gift cards did not cover. It fails with errDayClosed once
+// today's cash-up is done.
+func recordCODCollection(tx *sql.Tx, r *http.Request, orderID string) error {
+	var method string
+	var total Money
+	if err := tx.QueryRow("SELECT payment_method, total_amount FROM orders WHERE order_id = ?", orderID).Scan(&method, &total); err != nil {
+		return err
+	}
+	if method == PaymentPrepaid {
+		return nil
+	}
+	paid, err := giftCardPaid(orderID)
+	if err != nil {
+		return err
+	}
+	due := total - paid
+	if due <= 0 {
+		return nil
+	}
+	closed, err := dayClosed(tx, currentStoreID(r), time.Now().Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	if closed {
+		return errDayClosed
+	}
+	return recordLedgerEntry(tx, currentStoreID(r), orderID, LedgerCODCollection, PaymentCOD, due, "", auditActor(r))
+}
+
+// markDeliveryRefused records that the customer turned the courier away.
+// The goods go back to the location they were picked from.
+func markDeliveryRefused(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	back := "/change-status"
+	var status string
+	err := db.QueryRow("SELECT status FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", orderID, currentStoreID(r)).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if status != "DELIVERING" {
+		redirectWithFlash(w, r, back, "error", "Only orders out for delivery can be marked as refused.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE orders SET status = 'REFUSED' WHERE order_id = ?", orderID)
+	if err == nil {
+		err = recordOrderEventBy(tx, orderID, OrderEventStatusChanged, staffUser(r), StatusChange{From: status, To: "REFUSED"})
+	}
+	if err == nil {
+		err = returnOrderStock(tx, r, orderID, "refused")
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "order.refused", orderID, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	var o Order
+	if err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ?", orderID), &o); err != nil {
+		log.Printf("reload refused order %s: %v", orderID, err)
+	}
+	emitOrderEvent(OrderEvent{Type: EventOrderStatusChanged, OrderID: orderID, Order: &o, OldStatus: status})
+	redirectWithFlash(w, r, back, "success", "Order "+orderID+" marked as refused.")
+}
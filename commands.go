@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+var commands = map[string]func(args []string) error{
+	"rebuild-orders": func(args []string) error { return rebuildOrders() },
+	"import-legacy":  importLegacyCommand,
+	"backup":         backupCommand,
+	"restore":        restoreCommand,
+	"read-only":      readOnlyCommand,
+	"reset-2fa":      resetTwoFactorCommand,
+	"hash-password":  hashPasswordCommand,
+	"reset-password": resetPasswordCommand,
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q (available: %v)", name, names)
+	}
+	return cmd(args)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// OrderComment is an internal staff note on an order. Customers never see
+// these; use the order's notes for anything meant for them.
+type OrderComment struct {
+	ID        int             `json:"id"`
+	ParentID  int             `json:"parent_id,omitempty"`
+	Author    string          `json:"author"`
+	Body      string          `json:"body"`
+	CreatedAt time.Time       `json:"created_at"`
+	Replies   []*OrderComment `json:"replies,omitempty"`
+}
+
+const maxCommentLength = 2000
+
+// orderComments returns the order's comment threads, oldest first, with
+// replies nested under the comment they answer.
+func orderComments(orderID string) ([]*OrderComment, error) {
+	rows, err := db.Query("SELECT id, COALESCE(parent_id, 0), author, body, created_at FROM order_comments WHERE order_id = ? ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byID := map[int]*OrderComment{}
+	var threads []*OrderComment
+	for rows.Next() {
+		c := &OrderComment{}
+		if err := rows.Scan(&c.ID, &c.ParentID, &c.Author, &c.Body, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		byID[c.ID] = c
+		if parent := byID[c.ParentID]; parent != nil {
+			parent.Replies = append(parent.Replies, c)
+		} else {
+			threads = append(threads, c)
+		}
+	}
+	return threads, rows.Err()
+}
+
+func orderCommentsPage(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", orderID, currentStoreID(r)), &o)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	comments, err := orderComments(orderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("order_comments.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Order    Order
+		Comments []*OrderComment
+		Flashes  []Flash
+	}{o, comments, popFlashes(r)})
+}
+
+func addOrderComment(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	back := "/admin/orders/" + url.PathEscape(orderID) + "/comments"
+	body := strings.TrimSpace(r.FormValue("body"))
+	if body == "" || utf8.RuneCountInString(body) > maxCommentLength {
+		redirectWithFlash(w, r, back, "error", "A comment needs between 1 and 2000 characters.")
+		return
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL)", orderID, currentStoreID(r)).Scan(&exists); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	// Replies must answer a comment on the same order.
+	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+	if parentID != 0 {
+		var parentOrder string
+		err := db.QueryRow("SELECT order_id FROM order_comments WHERE id = ?", parentID).Scan(&parentOrder)
+		if err != nil || parentOrder != orderID {
+			redirectWithFlash(w, r, back, "error", "The comment you replied to no longer exists.")
+			return
+		}
+	}
+	_, err := db.Exec("INSERT INTO order_comments (order_id, parent_id, author, body) VALUES (?, NULLIF(?, 0), ?, ?)",
+		orderID, parentID, auditActor(r), body)
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The order placed page gives a link to the order's confirmation that can
+// be bookmarked, or sent to whoever is receiving a gift. It is signed for
+// that one order, so it can't be changed to show another, and shows what
+// was ordered and how it's getting on but not the contact, address or
+// prices.
+
+const confirmationLinkTTL = 365 * 24 * time.Hour
+
+// OrderConfirmation is what a confirmation link shows of an order.
+type OrderConfirmation struct {
+	OrderID      string
+	Status       string
+	CreatedAt    time.Time
+	Items        []OrderItem
+	Pickup       bool
+	StoreName    string
+	DeliveryDate string
+	DeliverySlot string
+	TrackingCode string
+	GiftMessage  string
+}
+
+func confirmationPath(orderID string) string {
+	return "/confirmation/" + url.PathEscape(orderID) + "/" + signToken("order-confirmation", orderID, confirmationLinkTTL)
+}
+
+// confirmationURL is the full link to order orderID's confirmation.
+func confirmationURL(orderID string) string {
+	return strings.TrimRight(envOr("PUBLIC_URL", "http://localhost:8080"), "/") + confirmationPath(orderID)
+}
+
+func orderConfirmationPage(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	if !verifyToken("order-confirmation", orderID, mux.Vars(r)["token"]) {
+		w.WriteHeader(http.StatusNotFound)
+		t := mustParseTemplates("order_not_found.html")
+		_ = t.Execute(w, nil)
+		return
+	}
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND deleted_at IS NULL", orderID), &o)
+	if err == sql.ErrNoRows {
+		err = scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders_archive orders WHERE order_id = ? AND deleted_at IS NULL", orderID), &o)
+	}
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		t := mustParseTemplates("order_not_found.html")
+		_ = t.Execute(w, nil)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	// The link was shared before the order was merged; follow it along.
+	if o.MergedInto != "" {
+		http.Redirect(w, r, confirmationPath(o.MergedInto), http.StatusSeeOther)
+		return
+	}
+	items, err := orderItems(orderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	c := OrderConfirmation{
+		OrderID: o.OrderID, Status: o.Status, CreatedAt: o.CreatedAt, Items: items, Pickup: o.Pickup,
+		DeliveryDate: o.DeliveryDate, DeliverySlot: o.DeliverySlot, TrackingCode: o.TrackingCode, GiftMessage: o.GiftMessage,
+	}
+	if o.Pickup {
+		stores, _ := loadStores()
+		c.StoreName = StoreSwitcher{Stores: stores, StoreID: o.StoreID}.CurrentStore().Name
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	t := mustParseTemplates("confirmation.html")
+	_ = t.Execute(w, c)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Browser apps hosted elsewhere, like the React dashboard, can call the API
+// once their origins are listed in CORS_ALLOWED_ORIGINS (comma-separated,
+// or * for any). CORS_ALLOWED_METHODS and CORS_ALLOWED_HEADERS are what
+// their preflight requests may ask for, CORS_MAX_AGE how long browsers may
+// remember the answer, and CORS_ALLOW_CREDENTIALS=true lets them send
+// cookies and basic auth along (never with *).
+
+func corsAllowedOrigin(origin string) (allow string, ok bool) {
+	for _, o := range strings.Split(envOr("CORS_ALLOWED_ORIGINS", ""), ",") {
+		o = strings.TrimRight(strings.TrimSpace(o), "/")
+		switch {
+		case o == "*":
+			return "*", true
+		case o != "" && strings.EqualFold(o, origin):
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		allow, ok := corsAllowedOrigin(origin)
+		if origin == "" || !ok {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		credentials := allow != "*" && envOr("CORS_ALLOW_CREDENTIALS", "") == "true"
+		w.Header().Set("Access-Control-Allow-Origin", allow)
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", envOr("CORS_ALLOWED_METHODS", "GET, POST, PUT, PATCH, DELETE"))
+			w.Header().Set("Access-Control-Allow-Headers", envOr("CORS_ALLOWED_HEADERS", "Authorization, Content-Type, X-API-Key"))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(envInt("CORS_MAX_AGE", 600)))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "Deprecation, Link, Retry-After, Sunset, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-Request-ID")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsPreflight gives OPTIONS requests a route to match, so the API's
+// middleware runs for them; corsMiddleware answers them itself.
+func corsPreflight(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
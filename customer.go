@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Customers sign in with the contact number their orders are placed under:
+// a one-time code is texted to it and the session remembers the number.
+
+const maxLoginAttempts = 5
+
+// customerContact is the signed-in customer's contact number, or "".
+func customerContact(r *http.Request) string {
+	return getSession(r).Values["customer"]
+}
+
+// requireCustomer sends visitors who are not signed in to the login page and
+// back again afterwards.
+func requireCustomer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if customerContact(r) == "" {
+			back := r.URL.RequestURI()
+			if r.Method != http.MethodGet {
+				back = customerHome()
+			}
+			http.Redirect(w, r, "/account/login?next="+url.QueryEscape(back), http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// customerHome is where customers land after signing in.
+func customerHome() string {
+	if featureEnabled("wishlist") {
+		return "/wishlist"
+	}
+	return "/account/login"
+}
+
+// localPath keeps post-login redirects on this site.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func customerLoginPage(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	if next := r.URL.Query().Get("next"); next != "" {
+		sess.Values["login_next"] = localPath(next)
+		_ = saveSession(sess)
+	}
+	t := mustParseTemplates("account_login.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Customer string
+		Pending  string
+		Google   bool
+		Flashes  []Flash
+	}{customerContact(r), sess.Values["login_contact"], googleLoginEnabled(), popFlashes(r)})
+}
+
+func requestLoginCode(w http.ResponseWriter, r *http.Request) {
+	contact := strings.TrimSpace(r.FormValue("contact"))
+	if contact == "" || len(contact) > 100 {
+		redirectWithFlash(w, r, "/account/login", "error", "Enter the contact number you order with.")
+		return
+	}
+	if wait, err := loginWait("customer", contact, clientIP(r)); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	} else if wait > 0 {
+		redirectWithFlash(w, r, "/account/login", "error", loginWaitMessage(wait))
+		return
+	}
+	code, err := oneTimeCode()
+	if err != nil {
+		http.Error(w, "Could not create a login code", http.StatusInternalServerError)
+		return
+	}
+	_, msg := notificationText("login_code", map[string]string{"Code": code})
+	if err := enqueueJob("sms", SMSMessage{To: contact, Message: msg}); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	sess := getSession(r)
+	if next := r.FormValue("next"); next != "" {
+		sess.Values["login_next"] = localPath(next)
+	}
+	sess.Values["login_contact"] = contact
+	sess.Values["login_token"] = signToken("customer-login", contact+"\x00"+code, 10*time.Minute)
+	sess.Values["login_attempts"] = "0"
+	_ = saveSession(sess)
+	redirectWithFlash(w, r, "/account/login", "success", "We texted a login code to "+contact+".")
+}
+
+// oneTimeCode is a random six-digit code to text to a contact.
+func oneTimeCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func verifyLoginCode(w http.ResponseWriter, r *http.Request) {
+	sess := getSession(r)
+	contact := sess.Values["login_contact"]
+	if contact == "" {
+		redirectWithFlash(w, r, "/account/login", "error", "Ask for a login code first.")
+		return
+	}
+	wait, err := loginWait("customer", contact, clientIP(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		redirectWithFlash(w, r, "/account/login", "error", loginWaitMessage(wait))
+		return
+	}
+	attempts, _ := strconv.Atoi(sess.Values["login_attempts"])
+	code := strings.TrimSpace(r.FormValue("code"))
+	if attempts >= maxLoginAttempts || !verifyToken("customer-login", contact+"\x00"+code, sess.Values["login_token"]) {
+		if err := recordLoginFailure("customer", contact, clientIP(r)); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		attempts++
+		msg := "That code is wrong or has expired."
+		if attempts >= maxLoginAttempts {
+			delete(sess.Values, "login_token")
+			msg = "Too many attempts. Ask for a new code."
+		}
+		sess.Values["login_attempts"] = strconv.Itoa(attempts)
+		_ = saveSession(sess)
+		redirectWithFlash(w, r, "/account/login", "error", msg)
+		return
+	}
+
+	if err := clearLoginFailures("customer", contact); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if err := markContactVerified(contact); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	signInCustomer(w, r, contact, "Signed in as "+contact+".")
+}
+
+// signInCustomer starts a fresh session for contact, with their guest
+// orders added to their account, and sends them on to where they were going.
+func signInCustomer(w http.ResponseWriter, r *http.Request, contact, msg string) {
+	if err := claimGuestOrders(contact); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	next := getSession(r).Values["login_next"]
+	if next == "" {
+		next = customerHome()
+	}
+	sess := renewSession(w, r)
+	for _, k := range []string{"login_contact", "login_token", "login_attempts", "login_next"} {
+		delete(sess.Values, k)
+	}
+	sess.Values["customer"] = contact
+	_ = saveSession(sess)
+	redirectWithFlash(w, r, next, "success", msg)
+}
+
+func customerLogout(w http.ResponseWriter, r *http.Request) {
+	sess := renewSession(w, r)
+	delete(sess.Values, "customer")
+	_ = saveSession(sess)
+	redirectWithFlash(w, r, "/", "success", "Signed out.")
+}
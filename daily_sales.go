@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// daily_sales holds each store's orders, items and revenue per day and
+// channel, so the dashboard, the reports page and the daily email add up a
+// few rows instead of scanning orders. The daily-sales task refreshes it
+// every five minutes, redoing just the days with orders changed since the
+// last refresh, by updated_at, or deleted since, by their events. The
+// first refresh after a start picks up from the newest row. Archived orders
+// (archive.go) still count.
+
+type DailySales struct {
+	Day     time.Time
+	Orders  int
+	Items   int
+	Revenue Money
+}
+
+// SalesSummary is the store's sales today and over the last 7 and 30 days.
+type SalesSummary struct {
+	Today, Week, Month DailySales
+}
+
+func init() {
+	registerScheduledTask("daily-sales", "*/5 * * * *", refreshDailySales)
+}
+
+// salesOrders is the orders daily_sales counts.
+const salesOrders = `(SELECT store_id, created_at, channel, quantity, total_amount FROM orders WHERE deleted_at IS NULL
+	UNION ALL SELECT store_id, created_at, channel, quantity, total_amount FROM orders_archive WHERE deleted_at IS NULL) o`
+
+var (
+	dailySalesMu sync.Mutex
+	// dailySalesFrom is the database time the last refresh started at.
+	dailySalesFrom time.Time
+)
+
+func refreshDailySales() error {
+	dailySalesMu.Lock()
+	defer dailySalesMu.Unlock()
+	var start time.Time
+	if err := db.QueryRow("SELECT NOW(6)").Scan(&start); err != nil {
+		return err
+	}
+	from := dailySalesFrom
+	if from.IsZero() {
+		var last sql.NullTime
+		if err := db.QueryRow("SELECT MAX(refreshed_at) FROM daily_sales").Scan(&last); err != nil {
+			return err
+		}
+		if !last.Valid {
+			return rebuildDailySales(start)
+		}
+		from = last.Time
+	}
+	rows, err := db.Query(`SELECT DATE(created_at) FROM orders WHERE updated_at >= ?
+		UNION SELECT DATE(created_at) FROM order_events WHERE type = ? AND order_id IN (SELECT order_id FROM order_events WHERE type = ? AND created_at >= ?)`,
+		from, OrderEventOrdered, OrderEventDeleted, from)
+	if err != nil {
+		return err
+	}
+	var days []time.Time
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return err
+		}
+		days = append(days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, day := range days {
+		if err := refreshSalesDay(day, start); err != nil {
+			return err
+		}
+	}
+	dailySalesFrom = start
+	return nil
+}
+
+// rebuildDailySales fills daily_sales from every order in one pass.
+func rebuildDailySales(start time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM daily_sales"); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO daily_sales (store_id, day, channel, orders, items, revenue, refreshed_at)
+		SELECT store_id, DATE(created_at), channel, COUNT(*), SUM(quantity), SUM(total_amount), ? FROM `+salesOrders+`
+		GROUP BY store_id, DATE(created_at), channel`, start)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err == nil {
+		dailySalesFrom = start
+	}
+	return err
+}
+
+func refreshSalesDay(day, refreshedAt time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM daily_sales WHERE day = ?", day); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO daily_sales (store_id, day, channel, orders, items, revenue, refreshed_at)
+		SELECT store_id, ?, channel, COUNT(*), SUM(quantity), SUM(total_amount), ? FROM `+salesOrders+`
+		WHERE created_at >= ? AND created_at < ? GROUP BY store_id, channel`,
+		day, refreshedAt, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dailySales is the store's sales for each day from from on, newest first.
+// An empty channel is all of them.
+func dailySales(storeID int, channel string, from time.Time) ([]DailySales, error) {
+	rows, err := reportDB().Query(`SELECT day, SUM(orders), SUM(items), SUM(revenue) FROM daily_sales
+		WHERE store_id = ? AND (? = '' OR channel = ?) AND day >= ? GROUP BY day ORDER BY day DESC`,
+		storeID, channel, channel, from.Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var days []DailySales
+	for rows.Next() {
+		var d DailySales
+		if err := rows.Scan(&d.Day, &d.Orders, &d.Items, &d.Revenue); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+func (s *DailySales) add(d DailySales) {
+	s.Orders += d.Orders
+	s.Items += d.Items
+	s.Revenue += d.Revenue
+}
+
+func salesSummary(storeID int) (SalesSummary, error) {
+	y, m, d := time.Now().Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	days, err := dailySales(storeID, "", today.AddDate(0, 0, -29))
+	var s SalesSummary
+	for _, day := range days {
+		s.Month.add(day)
+		if !day.Day.Before(today.AddDate(0, 0, -6)) {
+			s.Week.add(day)
+		}
+		if !day.Day.Before(today) {
+			s.Today.add(day)
+		}
+	}
+	return s, err
+}
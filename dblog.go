@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Databases are opened through a wrapper round the MySQL driver that
+// times every statement, in or out of a transaction. With DB_QUERY_LOG=true
+// each one is logged with how long it took and its arguments, strings
+// reduced to their length. One slower than DB_SLOW_QUERY (500ms) is logged
+// as slow either way and counted by statement in the db_slow_queries
+// metric at /admin/metrics, which shows which reports want an index. The
+// wrapper is also where each database's circuitBreaker (breaker.go) sees
+// every outcome.
+
+var slowQueries = expvar.NewMap("db_slow_queries")
+
+var (
+	queryLog       = envOr("DB_QUERY_LOG", "") == "true"
+	slowQueryAfter = envDuration("DB_SLOW_QUERY", 500*time.Millisecond)
+)
+
+// openDB opens dsn with its outcomes going to b.
+func openDB(dsn string, b *circuitBreaker) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return openDBConfig(cfg, b)
+}
+
+func openDBConfig(cfg *mysql.Config, b *circuitBreaker) (*sql.DB, error) {
+	// Without these a server that has gone away leaves requests waiting
+	// on it for minutes instead of tripping its breaker.
+	if cfg.Timeout == 0 {
+		cfg.Timeout = envDuration("DB_CONNECT_TIMEOUT", 5*time.Second)
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = envDuration("DB_READ_TIMEOUT", time.Minute)
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = envDuration("DB_WRITE_TIMEOUT", 30*time.Second)
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(loggedConnector{connector, b}), nil
+}
+
+// queryDone reports a statement that has run to b and the log.
+func queryDone(b *circuitBreaker, query string, args []driver.NamedValue, start time.Time, err error) {
+	b.record(err)
+	took := time.Since(start)
+	slow := took >= slowQueryAfter
+	if !slow && !queryLog {
+		return
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	msg := fmt.Sprintf("query %s %s: %s %s", took.Round(time.Millisecond), queryArgs(args), query, errSuffix(err))
+	if slow {
+		key := query
+		if len(key) > 200 {
+			key = key[:200]
+		}
+		slowQueries.Add(key, 1)
+		msg = "slow " + msg
+	}
+	log.Print(strings.TrimSpace(msg))
+}
+
+// queryArgs shows args with strings and bytes, which may be names,
+// contacts or secrets, reduced to their length.
+func queryArgs(args []driver.NamedValue) string {
+	parts := make([]string, len(args))
+	for i, a := range args {
+		switch v := a.Value.(type) {
+		case string:
+			parts[i] = fmt.Sprintf("<%d chars>", len(v))
+		case []byte:
+			parts[i] = fmt.Sprintf("<%d bytes>", len(v))
+		case time.Time:
+			parts[i] = v.Format(time.DateTime)
+		default:
+			parts[i] = fmt.Sprint(v)
+		}
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+func errSuffix(err error) string {
+	if err == nil {
+		return ""
+	}
+	return "(" + err.Error() + ")"
+}
+
+type loggedConnector struct {
+	driver.Connector
+	breaker *circuitBreaker
+}
+
+func (c loggedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if !c.breaker.allow() {
+		return nil, errDBUnavailable
+	}
+	conn, err := c.Connector.Connect(ctx)
+	c.breaker.record(err)
+	if err != nil {
+		return nil, err
+	}
+	return loggedConn{conn, c.breaker}, nil
+}
+
+// loggedConn passes everything on to the MySQL connection, which
+// implements all of these.
+type loggedConn struct {
+	driver.Conn
+	breaker *circuitBreaker
+}
+
+func (c loggedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if !c.breaker.allow() {
+		return nil, errDBUnavailable
+	}
+	tx, err := c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+	c.breaker.record(err)
+	return tx, err
+}
+
+func (c loggedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if !c.breaker.allow() {
+		return nil, errDBUnavailable
+	}
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		c.breaker.record(err)
+		return nil, err
+	}
+	return loggedStmt{stmt, query, c.breaker}, nil
+}
+
+// Statements with arguments come back as driver.ErrSkip and are run again
+// prepared, so they are logged by loggedStmt.
+func (c loggedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !c.breaker.allow() {
+		return nil, errDBUnavailable
+	}
+	start := time.Now()
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		queryDone(c.breaker, query, args, start, err)
+	}
+	return rows, err
+}
+
+func (c loggedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !c.breaker.allow() {
+		return nil, errDBUnavailable
+	}
+	start := time.Now()
+	res, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		queryDone(c.breaker, query, args, start, err)
+	}
+	return res, err
+}
+
+func (c loggedConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c loggedConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c loggedConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+func (c loggedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+type loggedStmt struct {
+	driver.Stmt
+	query   string
+	breaker *circuitBreaker
+}
+
+func (s loggedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	queryDone(s.breaker, s.query, args, start, err)
+	return rows, err
+}
+
+func (s loggedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	queryDone(s.breaker, s.query, args, start, err)
+	return res, err
+}
+
+func (s loggedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	return s.Stmt.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Customers can book a delivery window when they order. Each store has its
+// own slots, and a slot takes at most Capacity orders per day.
+
+type DeliverySlot struct {
+	ID       int    `json:"id"`
+	Label    string `json:"label"`
+	Position int    `json:"-"`
+	Capacity int    `json:"capacity"`
+	Active   bool   `json:"-"`
+	Booked   int    `json:"booked"`
+}
+
+// Remaining is how many more orders the slot takes on the day it was loaded for.
+func (s DeliverySlot) Remaining() int {
+	if s.Booked >= s.Capacity {
+		return 0
+	}
+	return s.Capacity - s.Booked
+}
+
+// DeliverySchedule is the data of an OrderEventDeliveryScheduled event.
+type DeliverySchedule struct {
+	Date   string `json:"date"`
+	SlotID int    `json:"slot_id"`
+	Label  string `json:"label"`
+}
+
+type DeliveryGroup struct {
+	Slot   DeliverySlot
+	Orders []Order
+}
+
+var (
+	errDeliverySlotUnavailable = errors.New("delivery slot is not available")
+	errDeliverySlotFull        = errors.New("delivery slot is fully booked")
+)
+
+// deliverySlots lists a store's slots with how many orders each already has
+// on date. Cancelled orders free up their slot.
+func deliverySlots(storeID int, date string, activeOnly bool) ([]DeliverySlot, error) {
+	where := "WHERE s.store_id = ?"
+	if activeOnly {
+		where += " AND s.active"
+	}
+	rows, err := db.Query(`SELECT s.id, s.label, s.position, s.capacity, s.active,
+		(SELECT COUNT(*) FROM orders o WHERE o.delivery_slot_id = s.id AND o.delivery_date = ? AND o.status <> 'CANCELLED' AND o.deleted_at IS NULL)
+		FROM delivery_slots s `+where+" ORDER BY s.position, s.id", date, storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var slots []DeliverySlot
+	for rows.Next() {
+		var s DeliverySlot
+		if err := rows.Scan(&s.ID, &s.Label, &s.Position, &s.Capacity, &s.Active, &s.Booked); err != nil {
+			return nil, err
+		}
+		slots = append(slots, s)
+	}
+	return slots, rows.Err()
+}
+
+// deliveryDateRange is the first and last day a delivery can be booked for:
+// tomorrow up to DELIVERY_BOOKING_DAYS ahead.
+func deliveryDateRange() (string, string) {
+	today := time.Now()
+	return today.AddDate(0, 0, 1).Format("2006-01-02"), today.AddDate(0, 0, envInt("DELIVERY_BOOKING_DAYS", 14)).Format("2006-01-02")
+}
+
+func validDeliveryDate(date string) bool {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return false
+	}
+	first, last := deliveryDateRange()
+	return date >= first && date <= last
+}
+
+// scheduleDelivery books o into a slot inside tx, failing if the slot is
+// inactive, belongs to another store or is full that day. The slot row is
+// locked so concurrent orders cannot overbook it.
+func scheduleDelivery(tx *sql.Tx, o *Order, slotID int, date string) error {
+	var storeID, capacity, booked int
+	var label string
+	var active bool
+	err := tx.QueryRow("SELECT store_id, label, capacity, active FROM delivery_slots WHERE id = ? FOR UPDATE", slotID).
+		Scan(&storeID, &label, &capacity, &active)
+	if err == sql.ErrNoRows || (err == nil && (!active || storeID != o.StoreID)) {
+		return errDeliverySlotUnavailable
+	} else if err != nil {
+		return err
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM orders WHERE delivery_slot_id = ? AND delivery_date = ? AND status <> 'CANCELLED' AND deleted_at IS NULL AND order_id <> ?",
+		slotID, date, o.OrderID).Scan(&booked)
+	if err != nil {
+		return err
+	}
+	if booked >= capacity {
+		return errDeliverySlotFull
+	}
+	if _, err := tx.Exec("UPDATE orders SET delivery_date = ?, delivery_slot_id = ? WHERE order_id = ?", date, slotID, o.OrderID); err != nil {
+		return err
+	}
+	o.DeliveryDate, o.DeliverySlotID, o.DeliverySlot = date, slotID, label
+	return recordOrderEvent(tx, o.OrderID, OrderEventDeliveryScheduled, DeliverySchedule{Date: date, SlotID: slotID, Label: label})
+}
+
+// deliverySlotsAPI backs the order form's slot picker.
+func deliverySlotsAPI(w http.ResponseWriter, r *http.Request) {
+	date := r.URL.Query().Get("date")
+	if !validDeliveryDate(date) {
+		writeJSONError(w, http.StatusBadRequest, "date is outside the booking window")
+		return
+	}
+	slots, err := deliverySlots(currentStoreID(r), date, true)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	if slots == nil {
+		slots = []DeliverySlot{}
+	}
+	writeJSON(w, http.StatusOK, slots)
+}
+
+// deliveriesPage is the day's delivery list, grouped by slot, together with
+// the slot settings.
+func deliveriesPage(w http.ResponseWriter, r *http.Request) {
+	date := r.URL.Query().Get("date")
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		date = time.Now().Format("2006-01-02")
+	}
+	storeID := currentStoreID(r)
+	slots, err := deliverySlots(storeID, date, false)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE store_id = ? AND delivery_date = ? AND status <> 'CANCELLED' AND deleted_at IS NULL ORDER BY priority DESC, created_at",
+		storeID, date)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	bySlot := map[int][]Order{}
+	for rows.Next() {
+		var o Order
+		_ = scanOrder(rows, &o)
+		bySlot[o.DeliverySlotID] = append(bySlot[o.DeliverySlotID], o)
+	}
+	var groups []DeliveryGroup
+	for _, s := range slots {
+		if orders := bySlot[s.ID]; len(orders) > 0 {
+			groups = append(groups, DeliveryGroup{Slot: s, Orders: orders})
+		}
+	}
+	t := mustParseTemplates("deliveries.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		Date    string
+		Groups  []DeliveryGroup
+		Slots   []DeliverySlot
+		Flashes []Flash
+	}{storeSwitcher(r), date, groups, slots, popFlashes(r)})
+}
+
+// saveDeliverySlot adds a slot to the current store, or updates one when an
+// id is posted.
+func saveDeliverySlot(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	label := strings.TrimSpace(r.FormValue("label"))
+	position, _ := strconv.Atoi(r.FormValue("position"))
+	capacity, err := strconv.Atoi(r.FormValue("capacity"))
+	if label == "" || len(label) > 50 || err != nil || capacity < 0 {
+		redirectWithFlash(w, r, "/admin/deliveries", "error", "A slot needs a label and a capacity of zero or more.")
+		return
+	}
+	active := r.FormValue("active") != ""
+	storeID := currentStoreID(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if id == 0 {
+		var res sql.Result
+		res, err = tx.Exec("INSERT INTO delivery_slots (store_id, label, position, capacity, active) VALUES (?, ?, ?, ?, TRUE)", storeID, label, position, capacity)
+		if err == nil {
+			var newID int64
+			newID, _ = res.LastInsertId()
+			id = int(newID)
+		}
+	} else {
+		var res sql.Result
+		res, err = tx.Exec("UPDATE delivery_slots SET label = ?, position = ?, capacity = ?, active = ? WHERE id = ? AND store_id = ?",
+			label, position, capacity, active, id, storeID)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				var exists bool
+				_ = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM delivery_slots WHERE id = ? AND store_id = ?)", id, storeID).Scan(&exists)
+				if !exists {
+					http.Error(w, "Slot not found", http.StatusNotFound)
+					return
+				}
+			}
+		}
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "delivery_slot.save", strconv.Itoa(id), label+" capacity "+strconv.Itoa(capacity))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/deliveries", "success", "Delivery slot "+label+" saved.")
+}
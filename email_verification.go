@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A customer account's email address, the contact itself or the one given
+// on My Notifications, must be verified before the account can pay with
+// store credit or see its invoices. We email a link signed for the
+// account and address that works for EMAIL_VERIFICATION_TTL (48h); it can
+// be sent again once a minute. Changing the address needs it verifying
+// again. Signing in with Google verifies the Google account's address.
+
+const emailResendWait = time.Minute
+
+// accountEmail is the address contact's account gets email at, and
+// whether it has been verified.
+func accountEmail(contact string) (string, bool, error) {
+	p, err := loadNotificationPreferences(contact)
+	email := p.EmailTo()
+	if err != nil || email == "" {
+		return email, false, err
+	}
+	var verified bool
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM verified_emails WHERE customer_id = ? AND email = ?)", contact, strings.ToLower(email)).Scan(&verified)
+	return email, verified, err
+}
+
+func markEmailVerified(contact, email string) error {
+	_, err := db.Exec("INSERT IGNORE INTO verified_emails (customer_id, email) VALUES (?, ?)", contact, strings.ToLower(email))
+	return err
+}
+
+// requireVerifiedEmail sends signed-in customers without a verified email
+// address to verify one.
+func requireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, verified, err := accountEmail(customerContact(r))
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if !verified {
+			redirectWithFlash(w, r, "/account/email", "error", "Verify your email address first.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func customerEmailPage(w http.ResponseWriter, r *http.Request) {
+	email, verified, err := accountEmail(customerContact(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("account_email.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Customer string
+		Email    string
+		Verified bool
+		Flashes  []Flash
+	}{customerContact(r), email, verified, popFlashes(r)})
+}
+
+func sendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	back := "/account/email"
+	contact := customerContact(r)
+	email, verified, err := accountEmail(contact)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if email == "" {
+		redirectWithFlash(w, r, "/account/notifications", "error", "Enter your email address first.")
+		return
+	}
+	if verified {
+		redirectWithFlash(w, r, back, "success", email+" is already verified.")
+		return
+	}
+	sess := getSession(r)
+	if sent, err := strconv.ParseInt(sess.Values["email_verification_sent"], 10, 64); err == nil && time.Since(time.Unix(sent, 0)) < emailResendWait {
+		redirectWithFlash(w, r, back, "error", "We just sent you a link. Wait a minute before asking for another.")
+		return
+	}
+	ttl := envDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+	email = strings.ToLower(email)
+	link := strings.TrimRight(envOr("PUBLIC_URL", "http://localhost:8080"), "/") + "/account/email/confirm?" + url.Values{
+		"c": {contact},
+		"e": {email},
+		"t": {signToken("email-verification", contact+"\x00"+email, ttl)},
+	}.Encode()
+	subject, body := notificationText("email_verification", map[string]string{"Link": link, "Hours": strconv.Itoa(int(ttl.Hours()))})
+	if err := enqueueJob("email", EmailMessage{To: email, Subject: subject, Body: body}); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	sess.Values["email_verification_sent"] = strconv.FormatInt(time.Now().Unix(), 10)
+	_ = saveSession(sess)
+	redirectWithFlash(w, r, back, "success", "We emailed a link to "+email+". Open it to verify the address.")
+}
+
+// confirmCustomerEmail is where the emailed link goes. It works without
+// signing in, as the email may be opened on another device.
+func confirmCustomerEmail(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	contact, email := q.Get("c"), q.Get("e")
+	back := "/account/email"
+	if customerContact(r) != contact {
+		back = "/account/login"
+	}
+	if contact == "" || email == "" || !verifyToken("email-verification", contact+"\x00"+email, q.Get("t")) {
+		redirectWithFlash(w, r, back, "error", "That link has expired or isn't valid. Sign in and ask for a new one.")
+		return
+	}
+	if err := markEmailVerified(contact, email); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", email+" is verified. Thank you!")
+}
+
+// customerInvoicesPage lists the invoices of the customer's delivered orders.
+func customerInvoicesPage(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT "+orderColumns+" FROM "+ordersFrom(true)+" WHERE customer_id = ? AND NOT guest AND status = 'DELIVERED' ORDER BY created_at DESC",
+		customerContact(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, o)
+	}
+	t := mustParseTemplates("account_invoices.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Customer string
+		Orders   []Order
+		Flashes  []Flash
+	}{customerContact(r), orders, popFlashes(r)})
+}
+
+func customerInvoice(w http.ResponseWriter, r *http.Request) {
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM "+ordersFrom(true)+" WHERE order_id = ? AND customer_id = ? AND NOT guest AND status = 'DELIVERED'",
+		mux.Vars(r)["orderID"], customerContact(r)), &o)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	pdf, err := orderInvoicePDF(o)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="`+invoiceFilename(o.OrderID)+`"`)
+	_, _ = w.Write(pdf)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventOrderCreated       = "order.created"
+	EventOrderStatusChanged = "order.status_changed"
+	EventOrderUpdated       = "order.updated"
+	EventOrderDeleted       = "order.deleted"
+)
+
+type OrderEvent struct {
+	Type      string `json:"type"`
+	OrderID   string `json:"order_id"`
+	Order     *Order `json:"order,omitempty"`
+	OldStatus string `json:"old_status,omitempty"`
+	// StoreID is set on events without the order, such as deletions.
+	StoreID int       `json:"store_id,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// EventStoreID is the store of the order ev is about.
+func (ev OrderEvent) EventStoreID() int {
+	if ev.Order != nil {
+		return ev.Order.StoreID
+	}
+	return ev.StoreID
+}
+
+// forStaffFeed is ev as the live board and event stream send it to staff:
+// the order keeps only what the board shows, not its address, location,
+// gift message or items.
+func (ev OrderEvent) forStaffFeed() OrderEvent {
+	if o := ev.Order; o != nil {
+		ev.Order = &Order{
+			ID: o.ID, OrderID: o.OrderID, CustomerID: o.CustomerID, Size: o.Size, Quantity: o.Quantity,
+			TotalAmount: o.TotalAmount, Status: o.Status, CreatedAt: o.CreatedAt, UpdatedAt: o.UpdatedAt,
+			StoreID: o.StoreID, Notes: o.Notes, Priority: o.Priority,
+		}
+	}
+	return ev
+}
+
+var (
+	orderListenersMu sync.RWMutex
+	orderListeners   []func(OrderEvent)
+)
+
+// onOrderEvent registers fn to be called after every order mutation.
+// Listeners run synchronously on the request goroutine and must not block.
+func onOrderEvent(fn func(OrderEvent)) {
+	orderListenersMu.Lock()
+	defer orderListenersMu.Unlock()
+	orderListeners = append(orderListeners, fn)
+}
+
+func emitOrderEvent(ev OrderEvent) {
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	orderListenersMu.RLock()
+	defer orderListenersMu.RUnlock()
+	for _, fn := range orderListeners {
+		fn(ev)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Checkout experiments show visitors one of several variants of the order
+// form. A visitor is identified by a long-lived cookie and always lands in
+// the same variant. Seeing the form counts as an exposure and placing an
+// order as a conversion, both kept per variant for the experiments report.
+// The first variant is the control; with the "experiments" feature flag off
+// everyone gets it and nothing is recorded.
+
+type Experiment struct {
+	Name        string
+	Description string
+	Variants    []string
+}
+
+var experiments = []Experiment{
+	{Name: "checkout_total", Description: "Show a running order total above the Place Order button",
+		Variants: []string{"control", "live_total"}},
+}
+
+const visitorCookie = "visitor"
+
+// visitorID is the visitor's experiment cookie, set on first sight when w
+// is not nil.
+func visitorID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(visitorCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	if w == nil {
+		return ""
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	id := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+	return id
+}
+
+func (e Experiment) variantFor(visitor string) string {
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + "\x00" + visitor))
+	return e.Variants[h.Sum32()%uint32(len(e.Variants))]
+}
+
+// exposeExperiments buckets the visitor into every experiment and records
+// that they saw their variants. It returns the variant per experiment.
+func exposeExperiments(w http.ResponseWriter, r *http.Request) map[string]string {
+	assigned := map[string]string{}
+	visitor := ""
+	if featureEnabled("experiments") {
+		visitor = visitorID(w, r)
+	}
+	for _, e := range experiments {
+		assigned[e.Name] = e.Variants[0]
+		if visitor == "" {
+			continue
+		}
+		assigned[e.Name] = e.variantFor(visitor)
+		_, err := db.Exec("INSERT IGNORE INTO experiment_exposures (experiment, variant, visitor_id) VALUES (?, ?, ?)",
+			e.Name, assigned[e.Name], visitor)
+		if err != nil {
+			log.Printf("experiment %s exposure: %v", e.Name, err)
+		}
+	}
+	return assigned
+}
+
+// recordConversion credits an order to the variants the visitor was shown.
+func recordConversion(r *http.Request, o Order) {
+	visitor := visitorID(nil, r)
+	if visitor == "" || !featureEnabled("experiments") {
+		return
+	}
+	_, err := db.Exec(`INSERT INTO experiment_conversions (experiment, variant, visitor_id, order_id, amount)
+		SELECT experiment, variant, visitor_id, ?, ? FROM experiment_exposures WHERE visitor_id = ?`, o.OrderID, o.TotalAmount, visitor)
+	if err != nil {
+		log.Printf("experiment conversion for %s: %v", o.OrderID, err)
+	}
+}
+
+type ExperimentResult struct {
+	Variant   string
+	Visitors  int
+	Converted int
+	Orders    int
+	Revenue   Money
+}
+
+func (v ExperimentResult) ConversionRate() float64 {
+	if v.Visitors == 0 {
+		return 0
+	}
+	return float64(v.Converted) * 100 / float64(v.Visitors)
+}
+
+func (v ExperimentResult) AverageOrder() Money {
+	if v.Orders == 0 {
+		return 0
+	}
+	return moneyFromFloat(v.Revenue.Float() / float64(v.Orders))
+}
+
+type ExperimentReport struct {
+	Experiment
+	Results []ExperimentResult
+}
+
+func experimentsPage(w http.ResponseWriter, r *http.Request) {
+	var reports []ExperimentReport
+	for _, e := range experiments {
+		rep := ExperimentReport{Experiment: e}
+		for _, variant := range e.Variants {
+			res := ExperimentResult{Variant: variant}
+			err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM experiment_exposures WHERE experiment = ? AND variant = ?),
+					COUNT(DISTINCT visitor_id), COUNT(*), COALESCE(SUM(amount), 0)
+				FROM experiment_conversions WHERE experiment = ? AND variant = ?`, e.Name, variant, e.Name, variant).
+				Scan(&res.Visitors, &res.Converted, &res.Orders, &res.Revenue)
+			if err != nil {
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+			rep.Results = append(rep.Results, res)
+		}
+		reports = append(reports, rep)
+	}
+	t := mustParseTemplates("experiments.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Running     bool
+		Experiments []ExperimentReport
+		Flashes     []Flash
+	}{featureEnabled("experiments"), reports, popFlashes(r)})
+}
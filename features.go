@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Feature flags switch parts of the shop on and off without a deploy, so
+// unfinished work can ship dark. A flag that was never toggled on the admin
+// page follows FEATURE_<NAME> (true/false), then its default. Flags are
+// cached like the shop settings, for SETTINGS_CACHE_TTL.
+
+type FeatureFlag struct {
+	Name        string
+	Description string
+	Default     bool
+
+	Enabled   bool
+	Toggled   bool
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+var featureFlags = []FeatureFlag{
+	{Name: "prepaid_payments", Description: "Customers can pay in advance by bank transfer", Default: true},
+	{Name: "gift_card_checkout", Description: "Customers can pay with gift cards and store credit at checkout", Default: true},
+	{Name: "rush_orders", Description: "Customers can pay extra to have an order sent out first", Default: true},
+	{Name: "gift_wrap", Description: "Customers can have an order gift wrapped with a message", Default: true},
+	{Name: "wishlist", Description: "Signed-in customers can save products to a wishlist", Default: true},
+	{Name: "support_tickets", Description: "Signed-in customers can open support tickets", Default: true},
+	{Name: "standing_orders", Description: "Signed-in customers can manage their standing orders", Default: true},
+	{Name: "order_otp", Description: "Orders from phone numbers we don't know yet wait for a texted code", Default: true},
+	{Name: "form_spam_checks", Description: "The order form turns away bots by a hidden field and how fast it was filled in", Default: true},
+	{Name: "experiments", Description: "Visitors are split between the variants of checkout experiments", Default: true},
+}
+
+var featureCache struct {
+	sync.Mutex
+	flags    map[string]FeatureFlag
+	loadedAt time.Time
+}
+
+func featureDefault(f FeatureFlag) bool {
+	on, err := strconv.ParseBool(envOr("FEATURE_"+strings.ToUpper(f.Name), ""))
+	if err != nil {
+		return f.Default
+	}
+	return on
+}
+
+// loadFeatureFlags is every known flag with its current state.
+func loadFeatureFlags() ([]FeatureFlag, error) {
+	saved := map[string]FeatureFlag{}
+	rows, err := db.Query("SELECT name, enabled, updated_by, updated_at FROM feature_flags")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f FeatureFlag
+		if err := rows.Scan(&f.Name, &f.Enabled, &f.UpdatedBy, &f.UpdatedAt); err != nil {
+			return nil, err
+		}
+		saved[f.Name] = f
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	flags := make([]FeatureFlag, len(featureFlags))
+	for i, f := range featureFlags {
+		f.Enabled = featureDefault(f)
+		if s, ok := saved[f.Name]; ok {
+			f.Enabled, f.Toggled, f.UpdatedBy, f.UpdatedAt = s.Enabled, true, s.UpdatedBy, s.UpdatedAt
+		}
+		flags[i] = f
+	}
+	return flags, nil
+}
+
+// featureEnabled reports whether the named feature is on. When the flags
+// can't be read the last state read is used, or the defaults.
+func featureEnabled(name string) bool {
+	featureCache.Lock()
+	defer featureCache.Unlock()
+	if featureCache.flags == nil || time.Since(featureCache.loadedAt) > envDuration("SETTINGS_CACHE_TTL", time.Minute) {
+		flags, err := loadFeatureFlags()
+		if err != nil {
+			log.Printf("feature flags: %v", err)
+		} else {
+			featureCache.flags = map[string]FeatureFlag{}
+			for _, f := range flags {
+				featureCache.flags[f.Name] = f
+			}
+		}
+		featureCache.loadedAt = time.Now()
+	}
+	if f, ok := featureCache.flags[name]; ok {
+		return f.Enabled
+	}
+	for _, f := range featureFlags {
+		if f.Name == name {
+			return featureDefault(f)
+		}
+	}
+	log.Printf("unknown feature flag %q", name)
+	return false
+}
+
+// requireFeature answers 404 for the routes of a feature that is off.
+func requireFeature(name string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !featureEnabled(name) {
+				http.NotFound(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func featureFlagsPage(w http.ResponseWriter, r *http.Request) {
+	flags, err := loadFeatureFlags()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("feature_flags.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Flags   []FeatureFlag
+		Flashes []Flash
+	}{flags, popFlashes(r)})
+}
+
+// toggleFeatureFlag turns a flag on or off, or with action=reset hands it
+// back to its environment variable and default.
+func toggleFeatureFlag(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	known := false
+	for _, f := range featureFlags {
+		known = known || f.Name == name
+	}
+	if !known {
+		http.NotFound(w, r)
+		return
+	}
+	var err error
+	var msg string
+	switch r.FormValue("action") {
+	case "reset":
+		_, err = db.Exec("DELETE FROM feature_flags WHERE name = ?", name)
+		msg = name + " follows its default again."
+		if err == nil {
+			err = recordAudit(db, r, "feature.reset", name, "")
+		}
+	default:
+		on := r.FormValue("enabled") == "1"
+		_, err = db.Exec(`INSERT INTO feature_flags (name, enabled, updated_by) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE enabled = VALUES(enabled), updated_by = VALUES(updated_by)`, name, on, auditActor(r))
+		msg = name + " is off."
+		if on {
+			msg = name + " is on."
+		}
+		if err == nil {
+			err = recordAudit(db, r, "feature.toggle", name, strconv.FormatBool(on))
+		}
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	featureCache.Lock()
+	featureCache.flags = nil
+	featureCache.Unlock()
+	redirectWithFlash(w, r, "/admin/features", "success", msg)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Web orders are screened for patterns fraudsters leave before anyone
+// starts on them: more than FRAUD_MAX_ORDERS_PER_IP (5) orders from one
+// address within FRAUD_IP_WINDOW (1h), and a number with no delivered order
+// placing FRAUD_MAX_NEW_COD (2) or more open cash on delivery orders of
+// FRAUD_HIGH_VALUE_COD (10000) or over. FRAUD_CHECK_POLICY says what
+// happens to a suspicious order: "hold" (the default) keeps it ON_HOLD
+// until staff approve it on the review queue, "flag" only puts it on the
+// queue and "off" turns the checks off. Orders from identities on the
+// blocklist (blocklist.go) for review are always held. Orders staff take
+// are not screened.
+const OrderOnHold = "ON_HOLD"
+
+// OrderReview is an order on the review queue.
+type OrderReview struct {
+	ID        int
+	Order     Order
+	Reasons   []string
+	Held      bool
+	FlaggedAt time.Time
+}
+
+func fraudCheckPolicy() string {
+	return envOr("FRAUD_CHECK_POLICY", "hold")
+}
+
+// fraudReasons lists what looks suspicious about order o, placed from ip
+// with amountDue to pay by method.
+func fraudReasons(tx *sql.Tx, o Order, ip, method string, amountDue Money) ([]string, error) {
+	var reasons []string
+	window := envDuration("FRAUD_IP_WINDOW", time.Hour)
+	if max := envInt("FRAUD_MAX_ORDERS_PER_IP", 5); max > 0 && ip != "" {
+		var n int
+		err := tx.QueryRow("SELECT COUNT(*) FROM orders WHERE client_ip = ? AND created_at >= NOW() - INTERVAL ? SECOND",
+			ip, int(window.Seconds())).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n > max {
+			reasons = append(reasons, fmt.Sprintf("%d orders from %s in the last %s", n, ip, window))
+		}
+	}
+	limit := Money(envInt("FRAUD_HIGH_VALUE_COD", 10000)) * 100
+	if max := envInt("FRAUD_MAX_NEW_COD", 2); max > 0 && method == PaymentCOD && amountDue >= limit {
+		var delivered bool
+		var open int
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM orders WHERE customer_id = ? AND status = 'DELIVERED'),
+			(SELECT COUNT(*) FROM orders WHERE customer_id = ? AND payment_method = ? AND total_amount >= ? AND order_id <> ?
+				AND status NOT IN ('DELIVERED', 'REFUSED', 'MERGED', 'CANCELLED'))`,
+			o.CustomerID, o.CustomerID, PaymentCOD, limit, o.OrderID).Scan(&delivered, &open)
+		if err != nil {
+			return nil, err
+		}
+		if !delivered && open+1 >= max {
+			reasons = append(reasons, fmt.Sprintf("%d open cash on delivery orders of %s or more from a new number", open+1, money(limit)))
+		}
+	}
+	return reasons, nil
+}
+
+// screenOrder records where web order o came from and runs the checks on
+// it inside tx, holding it or putting it on the review queue as the
+// policy and blocklist say. Call it once the payment method is set.
+func screenOrder(tx *sql.Tx, r *http.Request, o *Order, amountDue Money) error {
+	if staffUser(r) != "" {
+		return nil
+	}
+	ip := clientIP(r)
+	if _, err := tx.Exec("UPDATE orders SET client_ip = ? WHERE order_id = ?", ip, o.OrderID); err != nil {
+		return err
+	}
+	var reasons []string
+	held := false
+	b, blocked, err := blockedIdentity(o.CustomerID, ip)
+	if err != nil {
+		return err
+	}
+	if blocked && b.Action == BlockReview {
+		if err := countBlockHit(tx, b.ID); err != nil {
+			return err
+		}
+		reasons, held = append(reasons, b.Describe()), true
+	}
+	if policy := fraudCheckPolicy(); policy != "off" {
+		found, err := fraudReasons(tx, *o, ip, o.PaymentMethod, amountDue)
+		if err != nil {
+			return err
+		}
+		reasons = append(reasons, found...)
+		held = held || (policy == "hold" && len(found) > 0)
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec("INSERT INTO order_reviews (order_id, store_id, reasons, held) VALUES (?, ?, ?, ?)",
+		o.OrderID, o.StoreID, strings.Join(reasons, "\n"), held); err != nil {
+		return err
+	}
+	if !held {
+		return nil
+	}
+	if _, err := tx.Exec("UPDATE orders SET status = ? WHERE order_id = ?", OrderOnHold, o.OrderID); err != nil {
+		return err
+	}
+	if err := recordOrderEvent(tx, o.OrderID, OrderEventStatusChanged, StatusChange{From: o.Status, To: OrderOnHold}); err != nil {
+		return err
+	}
+	o.Status = OrderOnHold
+	return nil
+}
+
+// releaseHeldOrder moves an approved order off hold inside tx, to
+// PROCESSING, or BACKORDERED when the store no longer has the stock.
+func releaseHeldOrder(tx *sql.Tx, o Order, actor string) (string, error) {
+	lines, err := orderLines(tx, o.OrderID)
+	if err != nil {
+		return "", err
+	}
+	status := statuses[0]
+	for _, p := range linesWithStatus(lines, ItemPending) {
+		available, tracked, err := availableStock(tx, o.StoreID, lines[p].VariantID, stockQueueStatuses)
+		if err != nil {
+			return "", err
+		}
+		if tracked && available < lines[p].Quantity {
+			status = OrderBackordered
+		}
+	}
+	if _, err := tx.Exec("UPDATE orders SET status = ? WHERE order_id = ?", status, o.OrderID); err != nil {
+		return "", err
+	}
+	return status, recordOrderEventBy(tx, o.OrderID, OrderEventStatusChanged, actor, StatusChange{From: OrderOnHold, To: status})
+}
+
+func orderReviewsPage(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT id, order_id, reasons, held, flagged_at FROM order_reviews
+		WHERE store_id = ? AND decided_at IS NULL ORDER BY flagged_at, id`, currentStoreID(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var reviews []OrderReview
+	for rows.Next() {
+		var v OrderReview
+		var reasons string
+		if err := rows.Scan(&v.ID, &v.Order.OrderID, &reasons, &v.Held, &v.FlaggedAt); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		v.Reasons = strings.Split(reasons, "\n")
+		reviews = append(reviews, v)
+	}
+	rows.Close()
+	for i := range reviews {
+		if err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ?", reviews[i].Order.OrderID), &reviews[i].Order); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+	t := mustParseTemplates("order_reviews.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Reviews []OrderReview
+		Flashes []Flash
+	}{reviews, popFlashes(r)})
+}
+
+// decideOrderReview approves or rejects an order on the review queue.
+// Approving a held order starts work on it; rejecting cancels the order.
+func decideOrderReview(w http.ResponseWriter, r *http.Request) {
+	back := "/admin/order-reviews"
+	id, decision := mux.Vars(r)["id"], mux.Vars(r)["decision"]
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var orderID string
+	err = tx.QueryRow("SELECT order_id FROM order_reviews WHERE id = ? AND store_id = ? AND decided_at IS NULL FOR UPDATE", id, currentStoreID(r)).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		redirectWithFlash(w, r, back, "error", "That order has already been reviewed.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var o Order
+	if err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? FOR UPDATE", orderID), &o); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	old := o.Status
+	switch {
+	case decision == "approve" && o.Status == OrderOnHold:
+		o.Status, err = releaseHeldOrder(tx, o, staffUser(r))
+	case decision == "reject" && (o.Status == OrderOnHold || o.Status == statuses[0] || o.Status == OrderBackordered):
+		_, err = tx.Exec("UPDATE orders SET status = 'CANCELLED' WHERE order_id = ?", orderID)
+		if err == nil {
+			err = recordOrderEventBy(tx, orderID, OrderEventCancelled, staffUser(r), OrderCancellation{Reason: "rejected in review"})
+		}
+		if err == nil {
+			err = reverseGiftCardRedemptions(tx, orderID)
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE stock_reservations SET status = ?, resolved_at = NOW() WHERE order_id = ? AND status = ?", ReservationReleased, orderID, ReservationHeld)
+		}
+		o.Status = "CANCELLED"
+	case decision == "reject":
+		redirectWithFlash(w, r, back, "error", "Order "+orderID+" is "+o.Status+" and can no longer be cancelled here.")
+		return
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE order_reviews SET decision = ?, decided_by = ?, decided_at = NOW() WHERE id = ?", decision, auditActor(r), id)
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "order_review."+decision, orderID, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if o.Status != old {
+		emitOrderEvent(OrderEvent{Type: EventOrderStatusChanged, OrderID: orderID, Order: &o, OldStatus: old})
+	}
+	if decision == "reject" {
+		redirectWithFlash(w, r, back, "success", "Order "+orderID+" cancelled.")
+		return
+	}
+	redirectWithFlash(w, r, back, "success", "Order "+orderID+" approved.")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delivery addresses are looked up with a Nominatim-compatible geocoder at
+// GEOCODER_URL when the order is placed. Addresses it cannot find are
+// rejected; addresses further than DELIVERY_RADIUS_KM from DELIVERY_CENTER
+// are accepted but flagged for staff. Without GEOCODER_URL addresses are
+// taken as typed.
+
+// maxAddressLength caps the delivery address, in characters.
+const maxAddressLength = 300
+
+// DeliveryAddress is the data of an OrderEventAddressSet event.
+type DeliveryAddress struct {
+	Address     string  `json:"address"`
+	Latitude    float64 `json:"latitude,omitempty"`
+	Longitude   float64 `json:"longitude,omitempty"`
+	OutsideArea bool    `json:"outside_area,omitempty"`
+}
+
+var errAddressNotFound = errors.New("address could not be found")
+
+// Geocoded reports whether the order's address was located on the map.
+func (o Order) Geocoded() bool {
+	return o.Latitude != 0 || o.Longitude != 0
+}
+
+// geocodeAddress locates address. It returns the address without
+// coordinates when no geocoder is configured.
+func geocodeAddress(address string) (DeliveryAddress, error) {
+	a := DeliveryAddress{Address: address}
+	endpoint := envOr("GEOCODER_URL", "")
+	if endpoint == "" {
+		return a, nil
+	}
+	q := url.Values{"q": {address}, "format": {"json"}, "limit": {"1"}}
+	if cc := envOr("GEOCODER_COUNTRY", "lk"); cc != "" {
+		q.Set("countrycodes", cc)
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return a, err
+	}
+	req.Header.Set("User-Agent", "fashion-shop-orders")
+	if key := envOr("GEOCODER_KEY", ""); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return a, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return a, fmt.Errorf("geocoder returned %s", resp.Status)
+	}
+	var results []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return a, err
+	}
+	if len(results) == 0 {
+		return a, errAddressNotFound
+	}
+	a.Latitude, _ = strconv.ParseFloat(results[0].Lat, 64)
+	a.Longitude, _ = strconv.ParseFloat(results[0].Lon, 64)
+	a.OutsideArea = !insideDeliveryArea(a.Latitude, a.Longitude)
+	return a, nil
+}
+
+// insideDeliveryArea reports whether a point is within DELIVERY_RADIUS_KM of
+// DELIVERY_CENTER, given as "lat,lng". It defaults to 30 km around Colombo.
+func insideDeliveryArea(lat, lng float64) bool {
+	center := strings.Split(envOr("DELIVERY_CENTER", "6.9271,79.8612"), ",")
+	if len(center) != 2 {
+		return true
+	}
+	clat, err1 := strconv.ParseFloat(strings.TrimSpace(center[0]), 64)
+	clng, err2 := strconv.ParseFloat(strings.TrimSpace(center[1]), 64)
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	return distanceKm(lat, lng, clat, clng) <= float64(envInt("DELIVERY_RADIUS_KM", 30))
+}
+
+// distanceKm is the great-circle distance between two points.
+func distanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKm = 6371
+	rad := math.Pi / 180
+	dLat, dLng := (lat2-lat1)*rad, (lng2-lng1)*rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// setDeliveryAddress stores a geocoded address on o inside tx.
+func setDeliveryAddress(tx *sql.Tx, o *Order, a DeliveryAddress) error {
+	_, err := tx.Exec("UPDATE orders SET address = ?, latitude = NULLIF(?, 0), longitude = NULLIF(?, 0), outside_area = ? WHERE order_id = ?",
+		a.Address, a.Latitude, a.Longitude, a.OutsideArea, o.OrderID)
+	if err != nil {
+		return err
+	}
+	o.Address, o.Latitude, o.Longitude, o.OutsideArea = a.Address, a.Latitude, a.Longitude, a.OutsideArea
+	return recordOrderEvent(tx, o.OrderID, OrderEventAddressSet, a)
+}
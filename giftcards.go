@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Gift cards are sold over the counter and can be spent by whoever holds the
+// code. Store credit works the same way but is issued for refunds and can
+// only be spent by the customer it belongs to.
+const (
+	GiftCardKindGift   = "gift_card"
+	GiftCardKindCredit = "store_credit"
+)
+
+// OrderPayment is the data of an OrderEventPaid or OrderEventRefunded event.
+type OrderPayment struct {
+	Method string `json:"method"`
+	Code   string `json:"code"`
+	Amount Money  `json:"amount"`
+}
+
+type GiftCard struct {
+	ID            int
+	Code          string
+	Kind          string
+	CustomerID    string
+	InitialAmount Money
+	Balance       Money
+	ExpiresAt     time.Time
+	IssuedBy      string
+	CreatedAt     time.Time
+}
+
+var (
+	errGiftCardNotFound = errors.New("gift card not found")
+	errGiftCardExpired  = errors.New("gift card has expired")
+	errGiftCardEmpty    = errors.New("gift card has no balance left")
+	errCreditUnverified = errors.New("store credit can be used once you are signed in and have verified your email address")
+)
+
+// Codes avoid characters that are easy to misread on a printed card.
+const giftCardAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func newGiftCardCode(prefix string) string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	for i, c := range b {
+		if i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(giftCardAlphabet[int(c)%len(giftCardAlphabet)])
+	}
+	return sb.String()
+}
+
+func normalizeGiftCardCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func recordGiftCardTransaction(ex execer, cardID int64, amount Money, reason, orderID, actor string) error {
+	_, err := ex.Exec("INSERT INTO gift_card_transactions (gift_card_id, amount, reason, order_id, actor) VALUES (?, ?, ?, NULLIF(?, ''), ?)",
+		cardID, amount, reason, orderID, actor)
+	return err
+}
+
+// redeemGiftCard spends as much of the card as the order needs, up to its
+// balance, and records the payment against the order. Store credit can only
+// be spent under the contact number it was issued to, and only by its
+// customer signed in with a verified email address (verifiedAccount).
+func redeemGiftCard(tx *sql.Tx, code string, o Order, verifiedAccount bool) (Money, error) {
+	var id int64
+	var kind, customerID string
+	var balance Money
+	var expired bool
+	err := tx.QueryRow("SELECT id, kind, COALESCE(customer_id, ''), balance, COALESCE(expires_at < CURDATE(), FALSE) FROM gift_cards WHERE code = ? FOR UPDATE",
+		normalizeGiftCardCode(code)).Scan(&id, &kind, &customerID, &balance, &expired)
+	if err == sql.ErrNoRows || (err == nil && kind == GiftCardKindCredit && customerID != o.CustomerID) {
+		return 0, errGiftCardNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	if kind == GiftCardKindCredit && !verifiedAccount {
+		return 0, errCreditUnverified
+	}
+	if expired {
+		return 0, errGiftCardExpired
+	}
+	if balance <= 0 {
+		return 0, errGiftCardEmpty
+	}
+	amount := min(balance, o.TotalAmount)
+	if _, err := tx.Exec("UPDATE gift_cards SET balance = balance - ? WHERE id = ?", amount, id); err != nil {
+		return 0, err
+	}
+	if err := recordGiftCardTransaction(tx, id, -amount, "redemption", o.OrderID, o.CustomerID); err != nil {
+		return 0, err
+	}
+	return amount, recordOrderEvent(tx, o.OrderID, OrderEventPaid, OrderPayment{Method: kind, Code: normalizeGiftCardCode(code), Amount: amount})
+}
+
+// giftCardPaid is how much of an order was paid with gift cards or credit.
+func giftCardPaid(orderID string) (Money, error) {
+	var paid Money
+	err := db.QueryRow("SELECT COALESCE(-SUM(amount), 0) FROM gift_card_transactions WHERE order_id = ? AND reason IN ('redemption', 'reversal')", orderID).Scan(&paid)
+	return paid, err
+}
+
+// reverseGiftCardRedemptions puts what was spent on a cancelled order back
+// on the cards it came from.
+func reverseGiftCardRedemptions(tx *sql.Tx, orderID string) error {
+	rows, err := tx.Query(`SELECT t.gift_card_id, c.kind, c.code, -SUM(t.amount) FROM gift_card_transactions t JOIN gift_cards c ON c.id = t.gift_card_id
+		WHERE t.order_id = ? AND t.reason IN ('redemption', 'reversal') GROUP BY t.gift_card_id, c.kind, c.code`, orderID)
+	if err != nil {
+		return err
+	}
+	var spent []OrderPayment
+	var cards []int64
+	for rows.Next() {
+		var p OrderPayment
+		var id int64
+		if err := rows.Scan(&id, &p.Method, &p.Code, &p.Amount); err != nil {
+			rows.Close()
+			return err
+		}
+		if p.Amount > 0 {
+			spent, cards = append(spent, p), append(cards, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i, p := range spent {
+		if _, err := tx.Exec("UPDATE gift_cards SET balance = balance + ? WHERE id = ?", p.Amount, cards[i]); err != nil {
+			return err
+		}
+		if err := recordGiftCardTransaction(tx, cards[i], p.Amount, "reversal", orderID, "system"); err != nil {
+			return err
+		}
+		if err := recordOrderEvent(tx, orderID, OrderEventRefunded, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func giftCardsPage(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT id, code, kind, COALESCE(customer_id, ''), initial_amount, balance, expires_at, issued_by, created_at
+		FROM gift_cards ORDER BY id DESC LIMIT 200`)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var cards []GiftCard
+	for rows.Next() {
+		var c GiftCard
+		_ = rows.Scan(&c.ID, &c.Code, &c.Kind, &c.CustomerID, &c.InitialAmount, &c.Balance, nullTime{&c.ExpiresAt}, &c.IssuedBy, &c.CreatedAt)
+		cards = append(cards, c)
+	}
+	t := mustParseTemplates("gift_cards.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Cards       []GiftCard
+		DefaultDays int
+		Flashes     []Flash
+	}{cards, envInt("GIFT_CARD_VALID_DAYS", 365), popFlashes(r)})
+}
+
+func issueGiftCard(w http.ResponseWriter, r *http.Request) {
+	amount, err := parseMoney(r.FormValue("amount"))
+	days, derr := strconv.Atoi(r.FormValue("valid_days"))
+	if err != nil || amount <= 0 || derr != nil || days < 0 {
+		redirectWithFlash(w, r, "/admin/gift-cards", "error", "A gift card needs a positive amount and a validity of zero or more days.")
+		return
+	}
+	var expires interface{}
+	if days > 0 {
+		expires = time.Now().AddDate(0, 0, days).Format("2006-01-02")
+	}
+	code := newGiftCardCode("GC")
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO gift_cards (code, kind, initial_amount, balance, expires_at, issued_by) VALUES (?, ?, ?, ?, ?, ?)",
+		code, GiftCardKindGift, amount, amount, expires, auditActor(r))
+	if err == nil {
+		id, _ := res.LastInsertId()
+		err = recordGiftCardTransaction(tx, id, amount, "issue", "", auditActor(r))
+	}
+	if err == nil {
+		err = recordLedgerEntry(tx, currentStoreID(r), "", LedgerSale, GiftCardKindGift, amount, code, auditActor(r))
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "gift_card.issue", code, fmt.Sprintf("%.2f", amount))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/gift-cards", "success", fmt.Sprintf("Gift card %s issued for %s.", code, money(amount)))
+}
+
+// refundableAmount locks orderID in the store and returns its customer and
+// how much of it has not been refunded yet.
+func refundableAmount(tx *sql.Tx, storeID int, orderID string) (string, Money, error) {
+	var customerID string
+	var total, refunded Money
+	err := tx.QueryRow("SELECT customer_id, total_amount FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL FOR UPDATE", orderID, storeID).Scan(&customerID, &total)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tx.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM gift_card_transactions WHERE order_id = ? AND reason = 'refund'", orderID).Scan(&refunded); err != nil {
+		return "", 0, err
+	}
+	return customerID, total - refunded, nil
+}
+
+// creditRefund adds amount from orderID to the customer's store credit,
+// opening it if they have none, and returns its code.
+func creditRefund(tx *sql.Tx, r *http.Request, customerID, orderID string, amount Money) (string, error) {
+	var cardID int64
+	var code string
+	err := tx.QueryRow("SELECT id, code FROM gift_cards WHERE kind = ? AND customer_id = ? FOR UPDATE", GiftCardKindCredit, customerID).Scan(&cardID, &code)
+	if err == sql.ErrNoRows {
+		code = newGiftCardCode("SC")
+		var res sql.Result
+		res, err = tx.Exec("INSERT INTO gift_cards (code, kind, customer_id, initial_amount, balance, issued_by) VALUES (?, ?, ?, 0, 0, ?)",
+			code, GiftCardKindCredit, customerID, auditActor(r))
+		if err == nil {
+			cardID, err = res.LastInsertId()
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE gift_cards SET balance = balance + ?, initial_amount = initial_amount + ? WHERE id = ?", amount, amount, cardID)
+	}
+	if err == nil {
+		err = recordGiftCardTransaction(tx, cardID, amount, "refund", orderID, auditActor(r))
+	}
+	if err == nil {
+		err = recordLedgerEntry(tx, currentStoreID(r), orderID, LedgerRefund, GiftCardKindCredit, -amount, code, auditActor(r))
+	}
+	if err == nil {
+		err = recordOrderEvent(tx, orderID, OrderEventRefunded, OrderPayment{Method: GiftCardKindCredit, Code: code, Amount: amount})
+	}
+	return code, err
+}
+
+// refundToStoreCredit refunds part or all of an order onto the customer's
+// store credit instead of paying out cash. Each customer has one store credit
+// code that later refunds top up.
+func refundToStoreCredit(w http.ResponseWriter, r *http.Request) {
+	orderID := strings.TrimSpace(r.FormValue("order_id"))
+	amount, err := parseMoney(r.FormValue("amount"))
+	if orderID == "" || err != nil || amount <= 0 {
+		redirectWithFlash(w, r, "/admin/gift-cards", "error", "Enter an order ID and a positive amount to refund.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	customerID, left, err := refundableAmount(tx, currentStoreID(r), orderID)
+	if err == sql.ErrNoRows {
+		redirectWithFlash(w, r, "/admin/gift-cards", "error", "Order "+orderID+" not found.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if amount > left {
+		redirectWithFlash(w, r, "/admin/gift-cards", "error", "Only "+money(left)+" of "+orderID+" is left to refund.")
+		return
+	}
+
+	code, err := creditRefund(tx, r, customerID, orderID, amount)
+	if err == nil {
+		err = recordAudit(tx, r, "store_credit.refund", orderID, fmt.Sprintf("%.2f to %s", amount, code))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	err = notifyCustomer(db, customerID, "store_credit_refund", map[string]string{"Total": fmt.Sprintf("%.2f", amount), "OrderID": orderID, "Code": code})
+	if err != nil {
+		log.Printf("store credit notification for %s: %v", orderID, err)
+	}
+	redirectWithFlash(w, r, "/admin/gift-cards", "success", fmt.Sprintf("Refunded %s of %s to store credit %s.", money(amount), orderID, code))
+}
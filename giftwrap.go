@@ -0,0 +1,33 @@
+package main
+
+import "database/sql"
+
+// Customers can have an order gift wrapped, for the gift_wrap_fee setting,
+// with a short message for the card. The packing slip flags wrapped orders
+// and carries the message for whoever packs them.
+
+// GiftWrap is the data of an OrderEventGiftWrapped event.
+type GiftWrap struct {
+	Fee     Money  `json:"fee"`
+	Message string `json:"message,omitempty"`
+}
+
+// maxGiftMessage caps the gift card message, in characters.
+const maxGiftMessage = 200
+
+func (g GiftWrap) apply(o *Order) {
+	o.GiftWrap, o.GiftWrapFee, o.GiftMessage = true, g.Fee, g.Message
+	o.TotalAmount = o.TotalAmount + g.Fee
+}
+
+// requestGiftWrap has o gift wrapped inside tx and adds the fee to its total.
+func requestGiftWrap(tx *sql.Tx, o *Order, message string) error {
+	g := GiftWrap{Fee: settingMoney("gift_wrap_fee"), Message: message}
+	_, err := tx.Exec("UPDATE orders SET gift_wrap = TRUE, gift_wrap_fee = ?, gift_message = ?, total_amount = total_amount + ? WHERE order_id = ?",
+		g.Fee, g.Message, g.Fee, o.OrderID)
+	if err != nil {
+		return err
+	}
+	g.apply(o)
+	return recordOrderEvent(tx, o.OrderID, OrderEventGiftWrapped, g)
+}
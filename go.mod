@@ -1,9 +1,14 @@
 module fashion_shop_gorilla
 
-go 1.24
+go 1.24.0
+
+require (
+	github.com/go-sql-driver/mysql v1.9.3
+	github.com/gorilla/mux v1.8.1
+	golang.org/x/crypto v0.43.0
+)
 
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/go-sql-driver/mysql v1.9.3 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
+	golang.org/x/sys v0.37.0 // indirect
 )
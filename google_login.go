@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Customers can also sign in with Google (OpenID Connect) once
+// GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET are set; register
+// PUBLIC_URL/account/login/google/callback as the redirect URI. A Google
+// account is linked on first sign-in to the customer whose orders use its
+// verified email address, and stays linked if the address changes later.
+
+const (
+	googleAuthURL  = "https://accounts.google.com/o/oauth2/v2/auth"
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+func googleLoginEnabled() bool {
+	return envOr("GOOGLE_CLIENT_ID", "") != "" && envOr("GOOGLE_CLIENT_SECRET", "") != ""
+}
+
+func googleRedirectURL() string {
+	return strings.TrimRight(envOr("PUBLIC_URL", "http://localhost:8080"), "/") + "/account/login/google/callback"
+}
+
+func startGoogleLogin(w http.ResponseWriter, r *http.Request) {
+	if !googleLoginEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	state, nonce := newSessionID(), newSessionID()
+	sess := getSession(r)
+	sess.Values["google_state"] = state
+	sess.Values["google_nonce"] = nonce
+	_ = saveSession(sess)
+	q := url.Values{
+		"client_id":     {envOr("GOOGLE_CLIENT_ID", "")},
+		"redirect_uri":  {googleRedirectURL()},
+		"response_type": {"code"},
+		"scope":         {"openid email"},
+		"state":         {state},
+		"nonce":         {nonce},
+		"prompt":        {"select_account"},
+	}
+	http.Redirect(w, r, googleAuthURL+"?"+q.Encode(), http.StatusSeeOther)
+}
+
+type googleIdentity struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Nonce         string `json:"nonce"`
+	Expires       int64  `json:"exp"`
+}
+
+// exchangeGoogleCode trades the authorization code for the ID token. The
+// token comes straight from Google's token endpoint over TLS, which OpenID
+// Connect accepts in place of checking its signature.
+func exchangeGoogleCode(code string) (googleIdentity, error) {
+	var id googleIdentity
+	form := url.Values{
+		"code":          {code},
+		"client_id":     {envOr("GOOGLE_CLIENT_ID", "")},
+		"client_secret": {envOr("GOOGLE_CLIENT_SECRET", "")},
+		"redirect_uri":  {googleRedirectURL()},
+		"grant_type":    {"authorization_code"},
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.PostForm(googleTokenURL, form)
+	if err != nil {
+		return id, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return id, fmt.Errorf("google token endpoint returned %s", resp.Status)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return id, err
+	}
+	parts := strings.Split(token.IDToken, ".")
+	if len(parts) != 3 {
+		return id, fmt.Errorf("malformed id token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return id, err
+	}
+	err = json.Unmarshal(payload, &id)
+	return id, err
+}
+
+// valid checks the token was issued by Google to this shop for this
+// sign-in, and hasn't expired.
+func (id googleIdentity) valid(nonce string) bool {
+	return (id.Issuer == "https://accounts.google.com" || id.Issuer == "accounts.google.com") &&
+		id.Audience == envOr("GOOGLE_CLIENT_ID", "") &&
+		id.Subject != "" &&
+		time.Now().Unix() < id.Expires &&
+		nonce != "" && subtle.ConstantTimeCompare([]byte(id.Nonce), []byte(nonce)) == 1
+}
+
+func googleLoginCallback(w http.ResponseWriter, r *http.Request) {
+	if !googleLoginEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	sess := getSession(r)
+	state, nonce := sess.Values["google_state"], sess.Values["google_nonce"]
+	delete(sess.Values, "google_state")
+	delete(sess.Values, "google_nonce")
+	_ = saveSession(sess)
+
+	q := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		redirectWithFlash(w, r, "/account/login", "error", "That Google sign-in has expired. Please try again.")
+		return
+	}
+	if q.Get("error") != "" {
+		redirectWithFlash(w, r, "/account/login", "error", "Google sign-in was cancelled.")
+		return
+	}
+	id, err := exchangeGoogleCode(q.Get("code"))
+	if err == nil && !id.valid(nonce) {
+		err = fmt.Errorf("id token for %q failed validation", id.Email)
+	}
+	if err != nil {
+		log.Printf("google login: %v", err)
+		redirectWithFlash(w, r, "/account/login", "error", "Could not sign in with Google. Please try again.")
+		return
+	}
+	if !id.EmailVerified || id.Email == "" {
+		redirectWithFlash(w, r, "/account/login", "error", "Your Google account's email address isn't verified yet.")
+		return
+	}
+	contact, err := linkGoogleAccount(id)
+	if err == nil {
+		err = markEmailVerified(contact, id.Email)
+	}
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	signInCustomer(w, r, contact, "Signed in with Google as "+contact+".")
+}
+
+// linkGoogleAccount is the customer a Google account signs in as, linking
+// it on first use to the customer who orders with its email address.
+func linkGoogleAccount(id googleIdentity) (string, error) {
+	var contact string
+	err := db.QueryRow("SELECT customer_id FROM google_accounts WHERE subject = ?", id.Subject).Scan(&contact)
+	if err == nil {
+		return contact, nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+	// Keep the spelling already on their orders, if they have any.
+	contact = strings.ToLower(id.Email)
+	err = db.QueryRow("SELECT customer_id FROM orders WHERE customer_id = ? ORDER BY id DESC LIMIT 1", contact).Scan(&contact)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	_, err = db.Exec("INSERT IGNORE INTO google_accounts (subject, email, customer_id) VALUES (?, ?, ?)", id.Subject, id.Email, contact)
+	return contact, err
+}
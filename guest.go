@@ -0,0 +1,39 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// Anyone can order under any contact number without signing in. An order
+// placed by someone not signed in as its contact is a guest order, and stays
+// out of that customer's account until they prove the number is theirs:
+// signing in, by a texted code or Google, adds every guest order under it to
+// the account. When a guest order's contact already has an account, the
+// order placed page offers to do that straight away.
+
+func markGuestOrder(tx *sql.Tx, orderID string) error {
+	_, err := tx.Exec("UPDATE orders SET guest = TRUE WHERE order_id = ?", orderID)
+	return err
+}
+
+// claimGuestOrders adds contact's guest orders to their account, once they
+// have signed in as contact.
+func claimGuestOrders(contact string) error {
+	_, err := db.Exec("UPDATE orders SET guest = FALSE WHERE customer_id = ? AND guest", contact)
+	return err
+}
+
+// offerAccountLink is whether to offer the visitor to verify the contact on
+// guest order o and add it to the contact's existing account.
+func offerAccountLink(r *http.Request, o Order) (bool, error) {
+	if customerContact(r) == o.CustomerID {
+		return false, nil
+	}
+	var offer bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM orders WHERE order_id = ? AND guest)
+		AND (EXISTS (SELECT 1 FROM orders WHERE customer_id = ? AND NOT guest)
+			OR EXISTS (SELECT 1 FROM google_accounts WHERE customer_id = ?))`,
+		o.OrderID, o.CustomerID, o.CustomerID).Scan(&offer)
+	return offer, err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// isHTMX reports whether the request came from htmx and wants a fragment
+// rather than a full page.
+func isHTMX(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true"
+}
+
+func renderPartial(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Add("Vary", "HX-Request")
+	t := mustParseTemplates("partials.html")
+	_ = t.ExecuteTemplate(w, name, data)
+}
+
+func orderStatusBadge(w http.ResponseWriter, r *http.Request) {
+	var o Order
+	err := db.QueryRow("SELECT order_id, status FROM orders WHERE order_id = ? AND deleted_at IS NULL", mux.Vars(r)["orderID"]).Scan(&o.OrderID, &o.Status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	renderPartial(w, "status_badge", o)
+}
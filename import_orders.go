@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type ImportError struct {
+	Line    int
+	Message string
+}
+
+type ImportResult struct {
+	Filename string
+	Imported []string
+	Errors   []ImportError
+}
+
+type importRow struct {
+	line    int
+	contact string
+	variant Variant
+	qty     int
+}
+
+var importColumns = map[string]string{
+	"contact": "contact", "customer_id": "contact", "phone": "contact",
+	"size": "size",
+	"sku":  "sku",
+	"qty":  "qty", "quantity": "qty",
+}
+
+func importOrdersPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		t := mustParseTemplates("import_orders.html", "partials.html")
+		_ = t.Execute(w, struct{ Flashes []Flash }{popFlashes(r)})
+		return
+	}
+
+	if err := r.ParseMultipartForm(5 << 20); err != nil {
+		redirectWithFlash(w, r, "/admin/import-orders", "error", "Upload a CSV file of at most 5 MB.")
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		redirectWithFlash(w, r, "/admin/import-orders", "error", "Choose a CSV file to import.")
+		return
+	}
+	defer file.Close()
+
+	result, err := importOrdersCSV(r, file)
+	if err != nil {
+		http.Error(w, "DB import error", http.StatusInternalServerError)
+		return
+	}
+	result.Filename = header.Filename
+	if len(result.Imported) > 0 {
+		_ = recordAudit(db, r, "order.import", header.Filename, fmt.Sprintf("%d orders imported, %d rows rejected", len(result.Imported), len(result.Errors)))
+	}
+
+	data, _ := json.Marshal(result)
+	s := getSession(r)
+	s.Values["import_result"] = string(data)
+	_ = saveSession(s)
+	http.Redirect(w, r, "/admin/import-orders/result", http.StatusSeeOther)
+}
+
+// importOrdersCSV validates every row first, then inserts all valid rows in a
+// single transaction so a database failure leaves nothing half-imported.
+func importOrdersCSV(r *http.Request, in io.Reader) (ImportResult, error) {
+	var result ImportResult
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		result.Errors = append(result.Errors, ImportError{Line: 1, Message: "Could not read the header row"})
+		return result, nil
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		if col, ok := importColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			cols[col] = i
+		}
+	}
+	for _, col := range []string{"contact", "qty"} {
+		if _, ok := cols[col]; !ok {
+			result.Errors = append(result.Errors, ImportError{Line: 1, Message: "Missing required column: " + col})
+		}
+	}
+	_, hasSize := cols["size"]
+	_, hasSKU := cols["sku"]
+	if !hasSize && !hasSKU {
+		result.Errors = append(result.Errors, ImportError{Line: 1, Message: "Missing required column: size or sku"})
+	}
+	if len(result.Errors) > 0 {
+		return result, nil
+	}
+
+	var rows []importRow
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			result.Errors = append(result.Errors, ImportError{Line: perr.Line, Message: perr.Err.Error()})
+			continue
+		} else if err != nil {
+			return result, err
+		}
+		line, _ := cr.FieldPos(0)
+		field := func(col string) string {
+			if i, ok := cols[col]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+
+		row := importRow{line: line, contact: field("contact")}
+		var problems []string
+		if row.contact == "" {
+			problems = append(problems, "contact is required")
+		}
+		if sku := strings.ToUpper(field("sku")); sku != "" {
+			row.variant, err = variantBySKU(sku)
+			if err == nil && !row.variant.Active {
+				err = sql.ErrNoRows
+			}
+			if err == sql.ErrNoRows {
+				problems = append(problems, fmt.Sprintf("unknown SKU %q", field("sku")))
+			}
+		} else {
+			row.variant, err = defaultVariant(strings.ToUpper(field("size")))
+			if err == sql.ErrNoRows {
+				problems = append(problems, fmt.Sprintf("invalid size %q", field("size")))
+			}
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return result, err
+		}
+		row.qty, err = strconv.Atoi(field("qty"))
+		if err != nil || row.qty <= 0 {
+			problems = append(problems, fmt.Sprintf("quantity %q must be a positive number", field("qty")))
+		}
+		if len(problems) > 0 {
+			result.Errors = append(result.Errors, ImportError{Line: line, Message: strings.Join(problems, "; ")})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return result, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	var created []Order
+	storeID := currentStoreID(r)
+	for _, row := range rows {
+		o, err := createOrder(tx, storeID, ChannelOnline, row.contact, row.variant, row.qty, "", staffUser(r))
+		if err != nil {
+			tx.Rollback()
+			return result, fmt.Errorf("line %d: %v", row.line, err)
+		}
+		created = append(created, o)
+	}
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	for i := range created {
+		result.Imported = append(result.Imported, created[i].OrderID)
+		emitOrderEvent(OrderEvent{Type: EventOrderCreated, OrderID: created[i].OrderID, Order: &created[i]})
+	}
+	return result, nil
+}
+
+func importOrdersResult(w http.ResponseWriter, r *http.Request) {
+	s := getSession(r)
+	raw, ok := s.Values["import_result"]
+	if !ok {
+		http.Redirect(w, r, "/admin/import-orders", http.StatusSeeOther)
+		return
+	}
+	delete(s.Values, "import_result")
+	_ = saveSession(s)
+
+	var result ImportResult
+	_ = json.Unmarshal([]byte(raw), &result)
+	t := mustParseTemplates("import_result.html")
+	_ = t.Execute(w, result)
+}
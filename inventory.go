@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Location struct {
+	ID       int
+	StoreID  int
+	Code     string
+	Name     string
+	Position int
+}
+
+type StockRow struct {
+	Variant    Variant
+	Quantities map[int]int
+}
+
+type StockMovement struct {
+	ID        int64
+	SKU       string
+	Quantity  int
+	From      string
+	To        string
+	Reason    string
+	OrderID   string
+	Actor     string
+	CreatedAt time.Time
+}
+
+// Every new store starts with these locations, in fulfilment order.
+var defaultLocations = []struct{ code, name string }{
+	{"shop-floor", "Shop Floor"},
+	{"back-store", "Back Store"},
+	{"warehouse", "Warehouse"},
+}
+
+func createDefaultLocations(ex execer, storeID int64) error {
+	for i, l := range defaultLocations {
+		if _, err := ex.Exec("INSERT INTO locations (store_id, code, name, position) VALUES (?, ?, ?, ?)", storeID, l.code, l.name, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func storeLocations(storeID int) ([]Location, error) {
+	rows, err := db.Query("SELECT id, store_id, code, name, position FROM locations WHERE store_id = ? ORDER BY position, id", storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var locations []Location
+	for rows.Next() {
+		var l Location
+		if err := rows.Scan(&l.ID, &l.StoreID, &l.Code, &l.Name, &l.Position); err != nil {
+			return nil, err
+		}
+		locations = append(locations, l)
+	}
+	return locations, rows.Err()
+}
+
+var errInsufficientStock = errors.New("insufficient stock")
+
+// moveStock changes stock at from and/or to (either may be 0 for stock
+// entering or leaving the business) and records the movement.
+func moveStock(tx *sql.Tx, r *http.Request, variantID, qty, from, to int, reason, orderID string) error {
+	if from != 0 {
+		var have int
+		err := tx.QueryRow("SELECT quantity FROM stock WHERE location_id = ? AND variant_id = ? FOR UPDATE", from, variantID).Scan(&have)
+		if err == sql.ErrNoRows || (err == nil && have < qty) {
+			return errInsufficientStock
+		} else if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE stock SET quantity = quantity - ? WHERE location_id = ? AND variant_id = ?", qty, from, variantID); err != nil {
+			return err
+		}
+	}
+	if to != 0 {
+		if _, err := tx.Exec("INSERT INTO stock (location_id, variant_id, quantity) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE quantity = quantity + VALUES(quantity)", to, variantID, qty); err != nil {
+			return err
+		}
+	}
+	actor := "system"
+	if r != nil {
+		actor = auditActor(r)
+	}
+	_, err := tx.Exec("INSERT INTO stock_movements (variant_id, quantity, from_location_id, to_location_id, reason, order_id, actor) VALUES (?, ?, NULLIF(?, 0), NULLIF(?, 0), ?, NULLIF(?, ''), ?)",
+		variantID, qty, from, to, reason, orderID, actor)
+	return err
+}
+
+// fulfilOrder ships the order's items that have not gone out yet, taking
+// them from the first location in its store that has all of them in stock.
+// Items nobody has stock for ship unassigned so shops that don't track
+// inventory yet keep working.
+func fulfilOrder(tx *sql.Tx, r *http.Request, orderID string) error {
+	var storeID int
+	if err := tx.QueryRow("SELECT store_id FROM orders WHERE order_id = ?", orderID).Scan(&storeID); err != nil {
+		return err
+	}
+	lines, err := orderLines(tx, orderID)
+	if err != nil {
+		return err
+	}
+	pending := linesWithStatus(lines, ItemPending)
+	need := map[int]int{}
+	for _, p := range pending {
+		need[lines[p].VariantID] += lines[p].Quantity
+	}
+	if len(need) == 0 {
+		return nil
+	}
+
+	locations, err := storeLocations(storeID)
+	if err != nil {
+		return err
+	}
+	for _, l := range locations {
+		covered := 0
+		for variantID, qty := range need {
+			var have int
+			err := tx.QueryRow("SELECT quantity FROM stock WHERE location_id = ? AND variant_id = ?", l.ID, variantID).Scan(&have)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if have >= qty {
+				covered++
+			}
+		}
+		if covered < len(need) {
+			continue
+		}
+		for variantID, qty := range need {
+			if err := moveStock(tx, r, variantID, qty, l.ID, 0, "fulfilment", orderID); err != nil {
+				return err
+			}
+		}
+		if _, err = tx.Exec("UPDATE orders SET fulfilled_location_id = ? WHERE order_id = ?", l.ID, orderID); err != nil {
+			return err
+		}
+		return setItemStatus(tx, orderID, lines, pending, ItemShipped, l.ID)
+	}
+	return setItemStatus(tx, orderID, lines, pending, ItemShipped, 0)
+}
+
+func inventoryPage(w http.ResponseWriter, r *http.Request) {
+	storeID := currentStoreID(r)
+	locations, err := storeLocations(storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	variants, err := queryVariants("ORDER BY " + variantOrder)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var grid []StockRow
+	for _, v := range variants {
+		grid = append(grid, StockRow{Variant: v, Quantities: map[int]int{}})
+	}
+	byID := map[int]*StockRow{}
+	for i := range grid {
+		byID[grid[i].Variant.ID] = &grid[i]
+	}
+
+	rows, err := db.Query("SELECT s.location_id, s.variant_id, s.quantity FROM stock s JOIN locations l ON l.id = s.location_id WHERE l.store_id = ?", storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var locationID, variantID, qty int
+		_ = rows.Scan(&locationID, &variantID, &qty)
+		if row := byID[variantID]; row != nil {
+			row.Quantities[locationID] = qty
+		}
+	}
+
+	mrows, err := db.Query(`SELECT m.id, COALESCE(v.sku, ''), m.quantity, COALESCE(f.name, ''), COALESCE(t.name, ''), m.reason, COALESCE(m.order_id, ''), m.actor, m.created_at
+		FROM stock_movements m LEFT JOIN product_variants v ON v.id = m.variant_id
+		LEFT JOIN locations f ON f.id = m.from_location_id LEFT JOIN locations t ON t.id = m.to_location_id
+		WHERE f.store_id = ? OR t.store_id = ? ORDER BY m.id DESC LIMIT 50`, storeID, storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer mrows.Close()
+	var movements []StockMovement
+	for mrows.Next() {
+		var m StockMovement
+		_ = mrows.Scan(&m.ID, &m.SKU, &m.Quantity, &m.From, &m.To, &m.Reason, &m.OrderID, &m.Actor, &m.CreatedAt)
+		movements = append(movements, m)
+	}
+
+	t := mustParseTemplates("inventory.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		Locations []Location
+		Stock     []StockRow
+		Movements []StockMovement
+		Flashes   []Flash
+	}{storeSwitcher(r), locations, grid, movements, popFlashes(r)})
+}
+
+// locationInStore parses a location id from the form and checks it belongs to
+// the current store, so branch managers cannot touch other branches' stock.
+func locationInStore(r *http.Request, field string) (int, bool) {
+	id, err := strconv.Atoi(r.FormValue(field))
+	if err != nil {
+		return 0, false
+	}
+	var storeID int
+	err = db.QueryRow("SELECT store_id FROM locations WHERE id = ?", id).Scan(&storeID)
+	return id, err == nil && storeID == currentStoreID(r)
+}
+
+func adjustStock(w http.ResponseWriter, r *http.Request) {
+	location, ok := locationInStore(r, "location_id")
+	v, verr := variantFromForm(r)
+	count, err := strconv.Atoi(r.FormValue("quantity"))
+	if !ok || verr != nil || err != nil || count < 0 {
+		redirectWithFlash(w, r, "/admin/inventory", "error", "Pick a location, a product and a stock count of zero or more.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var have int
+	err = tx.QueryRow("SELECT quantity FROM stock WHERE location_id = ? AND variant_id = ? FOR UPDATE", location, v.ID).Scan(&have)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var released []Order
+	switch {
+	case count > have:
+		err = moveStock(tx, r, v.ID, count-have, 0, location, "adjustment", "")
+		if err == nil {
+			released, err = releaseBackorders(tx, currentStoreID(r), v.ID)
+		}
+	case count < have:
+		err = moveStock(tx, r, v.ID, have-count, location, 0, "adjustment", "")
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "stock.adjust", strconv.Itoa(location), fmt.Sprintf("%s: %d -> %d", v.SKU, have, count))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	emitReleasedBackorders(released)
+	msg := fmt.Sprintf("Stock of %s set to %d.", v.SKU, count)
+	if len(released) > 0 {
+		msg += fmt.Sprintf(" %d backorder(s) are now PROCESSING.", len(released))
+	}
+	redirectWithFlash(w, r, "/admin/inventory", "success", msg)
+}
+
+func transferStock(w http.ResponseWriter, r *http.Request) {
+	from, okFrom := locationInStore(r, "from")
+	to, okTo := locationInStore(r, "to")
+	v, verr := variantFromForm(r)
+	qty, err := strconv.Atoi(r.FormValue("quantity"))
+	if !okFrom || !okTo || from == to || verr != nil || err != nil || qty <= 0 {
+		redirectWithFlash(w, r, "/admin/inventory", "error", "Pick two different locations, a product and a positive quantity.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	err = moveStock(tx, r, v.ID, qty, from, to, "transfer", "")
+	if err == errInsufficientStock {
+		redirectWithFlash(w, r, "/admin/inventory", "error", fmt.Sprintf("Not enough %s stock at the source location.", v.SKU))
+		return
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "stock.transfer", fmt.Sprintf("%d->%d", from, to), fmt.Sprintf("%d x %s", qty, v.SKU))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/inventory", "success", fmt.Sprintf("Transferred %d x %s.", qty, v.SKU))
+}
+
+func variantFromForm(r *http.Request) (Variant, error) {
+	id, err := strconv.Atoi(r.FormValue("variant_id"))
+	if err != nil {
+		return Variant{}, err
+	}
+	return variantByID(id)
+}
+
+// returnOrderStock puts the order's shipped items back where they were taken
+// from and marks them returned. Items that were never assigned a location
+// are not restocked.
+func returnOrderStock(tx *sql.Tx, r *http.Request, orderID, reason string) error {
+	var fallback int
+	if err := tx.QueryRow("SELECT COALESCE(fulfilled_location_id, 0) FROM orders WHERE order_id = ?", orderID).Scan(&fallback); err != nil {
+		return err
+	}
+	lines, err := orderLines(tx, orderID)
+	if err != nil {
+		return err
+	}
+	out := linesWithStatus(lines, ItemShipped, ItemDelivered)
+	for _, p := range out {
+		locationID := lines[p].LocationID
+		if locationID == 0 {
+			locationID = fallback
+		}
+		if locationID == 0 {
+			continue
+		}
+		if err := moveStock(tx, r, lines[p].VariantID, lines[p].Quantity, 0, locationID, reason, orderID); err != nil {
+			return err
+		}
+	}
+	if err := setItemStatus(tx, orderID, lines, out, ItemReturned, 0); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE orders SET fulfilled_location_id = NULL WHERE order_id = ?", orderID)
+	return err
+}
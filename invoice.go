@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Once an order is delivered, customers who take email are sent a receipt
+// with the invoice attached as a PDF. The PDF is drawn when the
+// job runs rather than stored with it.
+
+type ReceiptEmail struct {
+	OrderID string `json:"order_id"`
+}
+
+func init() {
+	registerJobHandler("order_receipt", func(payload []byte) error {
+		var m ReceiptEmail
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return err
+		}
+		return sendReceiptEmail(m.OrderID)
+	})
+	onOrderEvent(func(ev OrderEvent) {
+		if ev.Order == nil || ev.Order.Status != "DELIVERED" || ev.Order.CustomerID == "" {
+			return
+		}
+		// Walk-in sales are delivered as they are made.
+		if ev.Type != EventOrderStatusChanged && ev.Type != EventOrderCreated {
+			return
+		}
+		if err := enqueueJob("order_receipt", ReceiptEmail{OrderID: ev.OrderID}); err != nil {
+			log.Printf("receipt: enqueue for %s: %v", ev.OrderID, err)
+		}
+	})
+}
+
+func sendReceiptEmail(orderID string) error {
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND deleted_at IS NULL", orderID), &o)
+	if err == sql.ErrNoRows {
+		// Deleted since it was delivered.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	prefs, err := loadNotificationPreferences(o.CustomerID)
+	if err != nil || !prefs.wants("order_receipt", NotifyEmail) {
+		return err
+	}
+	pdf, err := orderInvoicePDF(o)
+	if err != nil {
+		return err
+	}
+	subject, body := notificationText("order_receipt", map[string]string{"OrderID": o.OrderID, "Total": fmt.Sprintf("%.2f", o.TotalAmount)})
+	return sendEmail(EmailMessage{
+		To:      prefs.EmailTo(),
+		Subject: subject,
+		Body:    body,
+		Attachments: []EmailAttachment{{
+			Filename: invoiceFilename(o.OrderID), ContentType: "application/pdf", Data: pdf,
+		}},
+	})
+}
+
+func invoiceFilename(orderID string) string {
+	return "invoice-" + strings.Trim(strings.NewReplacer("#", "", "/", "-").Replace(orderID), "-") + ".pdf"
+}
+
+// orderInvoicePDF draws the invoice for o on one A4 page.
+func orderInvoicePDF(o Order) ([]byte, error) {
+	items, err := orderItems(o.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	gift, err := giftCardPaid(o.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	var store Store
+	_ = db.QueryRow("SELECT id, code, name, created_at FROM stores WHERE id = ?", o.StoreID).Scan(&store.ID, &store.Code, &store.Name, &store.CreatedAt)
+
+	p := &pdfPage{}
+	y := 790.0
+	p.text(50, y, 20, true, shopName())
+	p.text(400, y, 16, true, "INVOICE")
+	for _, line := range append([]string{store.Name}, strings.Split(setting("shop_address"), "\n")...) {
+		if line = strings.TrimSpace(line); line != "" {
+			y -= 13
+			p.text(50, y, 9, false, line)
+		}
+	}
+	y -= 30
+	p.text(50, y, 10, false, "Order "+o.OrderID)
+	p.text(400, y, 10, false, "Date "+formatDate(o.CreatedAt))
+	y -= 15
+	p.text(50, y, 10, false, "Customer "+o.CustomerID)
+	if o.Address != "" {
+		y -= 15
+		p.text(50, y, 10, false, "Deliver to "+o.Address)
+	}
+	y -= 30
+	p.text(50, y, 10, true, "Item")
+	p.text(330, y, 10, true, "Qty")
+	p.text(380, y, 10, true, "Unit ("+currency()+")")
+	p.text(470, y, 10, true, "Total ("+currency()+")")
+	y -= 6
+	p.line(50, y, 545, y)
+	for _, it := range items {
+		y -= 16
+		name := it.ProductName
+		if it.Color != "" {
+			name += ", " + it.Color
+		}
+		p.text(50, y, 10, false, name+", "+it.Size)
+		p.text(330, y, 10, false, fmt.Sprint(it.Quantity))
+		p.text(380, y, 10, false, fmt.Sprintf("%.2f", it.UnitPrice))
+		p.text(470, y, 10, false, fmt.Sprintf("%.2f", it.LineTotal()))
+	}
+	y -= 8
+	p.line(50, y, 545, y)
+	row := func(label string, amount Money, bold bool) {
+		y -= 16
+		p.text(330, y, 10, bold, label)
+		p.text(470, y, 10, bold, fmt.Sprintf("%.2f", amount))
+	}
+	if o.ShippingFee > 0 {
+		row("Shipping", o.ShippingFee, false)
+	}
+	if o.RushFee > 0 {
+		row("Rush delivery", o.RushFee, false)
+	}
+	if o.GiftWrapFee > 0 {
+		row("Gift wrap", o.GiftWrapFee, false)
+	}
+	row("Total", o.TotalAmount, true)
+	if tax := taxIncluded(o.TotalAmount); tax > 0 {
+		row("Includes tax", tax, false)
+	}
+	if gift > 0 {
+		row("Paid by gift card", gift, false)
+	}
+	if label := o.PaymentMethodLabel(); label != "" {
+		y -= 16
+		p.text(330, y, 10, false, "Paid: "+label)
+	}
+	p.text(50, 60, 9, false, "Thank you for shopping with us!")
+	return p.bytes(), nil
+}
+
+func orderInvoice(w http.ResponseWriter, r *http.Request) {
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", mux.Vars(r)["orderID"], currentStoreID(r)), &o)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	pdf, err := orderInvoicePDF(o)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="`+invoiceFilename(o.OrderID)+`"`)
+	_, _ = w.Write(pdf)
+}
+
+// pdfPage is just enough PDF to print text, rules and boxes in the standard
+// Helvetica fonts, which every reader has built in.
+type pdfPage struct {
+	content bytes.Buffer
+}
+
+func (p *pdfPage) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.1f Tf %.1f %.1f Td (%s) Tj ET\n", font, size, x, y, pdfString(s))
+}
+
+func (p *pdfPage) line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(&p.content, "0.5 w %.1f %.1f m %.1f %.1f l S\n", x1, y1, x2, y2)
+}
+
+// rect fills a black box with its bottom left corner at x, y.
+func (p *pdfPage) rect(x, y, w, h float64) {
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f re f\n", x, y, w, h)
+}
+
+// pdfString escapes s for a PDF literal string in WinAnsi, which matches
+// Latin-1 closely enough; anything outside it prints as "?".
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '—' || r == '–':
+			b.WriteByte('-')
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// bytes is the page as an A4 document.
+func (p *pdfPage) bytes() []byte {
+	return pdfDocument(595, 842, p)
+}
+
+// pdfDocument puts pages, each width × height points, into one PDF.
+func pdfDocument(width, height float64, pages ...*pdfPage) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+	var kids []string
+	for _, p := range pages {
+		n := len(objects) + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", n))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.1f %.1f] /Contents %d 0 R /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> >>", width, height, n+1),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String()))
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
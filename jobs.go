@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type Job struct {
+	ID          int64
+	Kind        string
+	Payload     string
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+	RunAt       time.Time
+	CreatedAt   time.Time
+}
+
+type jobHandler func(payload []byte) error
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+var jobHandlers = map[string]jobHandler{}
+
+func registerJobHandler(kind string, h jobHandler) {
+	jobHandlers[kind] = h
+}
+
+func enqueueJob(kind string, payload interface{}) error {
+	return enqueueJobIn(db, kind, payload, 0)
+}
+
+// enqueueJobIn queues a job on ex (the db or an open transaction) that becomes
+// runnable after delay.
+func enqueueJobIn(ex execer, kind string, payload interface{}, delay time.Duration) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec("INSERT INTO jobs (kind, payload, max_attempts, run_at) VALUES (?, ?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))",
+		kind, string(data), envInt("JOB_MAX_ATTEMPTS", 5), int(delay.Seconds()))
+	return err
+}
+
+// A worker claims a job by leasing it for JOB_LEASE (5m), and renews the
+// lease while the job runs. A job left RUNNING by a worker that died, on
+// this instance or another, is claimed again once its lease has run out,
+// as are jobs left RUNNING from before leases. Every claim counts an
+// attempt, so the attempt number tells whether a worker still holds the
+// job; one that lost it leaves the lease and the outcome to the new holder.
+func jobLease() time.Duration {
+	return envDuration("JOB_LEASE", 5*time.Minute)
+}
+
+func startJobWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go jobWorker()
+	}
+}
+
+func jobWorker() {
+	poll := envDuration("JOB_POLL_INTERVAL", 2*time.Second)
+	for {
+		if readOnly() {
+			time.Sleep(poll)
+			continue
+		}
+		j, err := claimJob()
+		if err != nil {
+			log.Printf("job claim error: %v", err)
+			time.Sleep(poll)
+			continue
+		}
+		if j == nil {
+			time.Sleep(poll)
+			continue
+		}
+		runJob(j)
+	}
+}
+
+func claimJob() (*Job, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var j Job
+	err = tx.QueryRow(`SELECT id, kind, payload, attempts, max_attempts FROM jobs
+		WHERE (status = 'PENDING' AND run_at <= NOW()) OR (status = 'RUNNING' AND locked_until < NOW())
+			OR (status = 'RUNNING' AND locked_until IS NULL)
+		ORDER BY run_at, id LIMIT 1 FOR UPDATE SKIP LOCKED`).
+		Scan(&j.ID, &j.Kind, &j.Payload, &j.Attempts, &j.MaxAttempts)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return nil, nil
+	} else if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE jobs SET status = 'RUNNING', attempts = attempts + 1, locked_until = NOW() + INTERVAL ? SECOND WHERE id = ?",
+		int(jobLease().Seconds()), j.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	j.Attempts++
+	return &j, nil
+}
+
+// renewLease keeps j leased until done is closed.
+func renewLease(j *Job, done <-chan struct{}) {
+	lease := jobLease()
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			_, err := db.Exec("UPDATE jobs SET locked_until = NOW() + INTERVAL ? SECOND WHERE id = ? AND status = 'RUNNING' AND attempts = ?",
+				int(lease.Seconds()), j.ID, j.Attempts)
+			if err != nil {
+				log.Printf("job %d lease error: %v", j.ID, err)
+			}
+		}
+	}
+}
+
+func runJob(j *Job) {
+	done := make(chan struct{})
+	go renewLease(j, done)
+	err := callJobHandler(j)
+	close(done)
+	if err == nil {
+		finishJob(j, "status = 'DONE', last_error = NULL")
+		return
+	}
+
+	log.Printf("job %d (%s) attempt %d failed: %v", j.ID, j.Kind, j.Attempts, err)
+	if j.Attempts >= j.MaxAttempts {
+		finishJob(j, "status = 'FAILED', last_error = ?", err.Error())
+	} else {
+		backoff := j.Attempts * j.Attempts * 30
+		finishJob(j, "status = 'PENDING', last_error = ?, run_at = DATE_ADD(NOW(), INTERVAL ? SECOND)", err.Error(), backoff)
+	}
+}
+
+// finishJob records the outcome of j's attempt with set, unless another
+// worker has claimed the job since.
+func finishJob(j *Job, set string, args ...interface{}) {
+	args = append(args, j.ID, j.Attempts)
+	res, err := db.Exec("UPDATE jobs SET "+set+", locked_until = NULL WHERE id = ? AND status = 'RUNNING' AND attempts = ?", args...)
+	if err != nil {
+		log.Printf("job %d update error: %v", j.ID, err)
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		log.Printf("job %d attempt %d lost its lease; result dropped", j.ID, j.Attempts)
+	}
+}
+
+func callJobHandler(j *Job) (err error) {
+	h, ok := jobHandlers[j.Kind]
+	if !ok {
+		return fmt.Errorf("no handler for job kind %q", j.Kind)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return h([]byte(j.Payload))
+}
+
+// jobPayloadFields are the payload fields the jobs page shows. The rest,
+// such as addresses, message bodies with their sign-in links and codes,
+// and tokens, are blanked out.
+var jobPayloadFields = map[string]bool{"order_id": true, "event": true, "endpoint_id": true, "subject": true}
+
+// redactPayload is payload as the jobs page shows it.
+func redactPayload(payload string) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return "[redacted]"
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		v := "[redacted]"
+		if jobPayloadFields[k] {
+			v = string(fields[k])
+		}
+		parts[i] = k + ": " + v
+	}
+	return strings.Join(parts, ", ")
+}
+
+func jobsPage(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT id, kind, payload, status, attempts, max_attempts, COALESCE(last_error, ''), run_at, created_at FROM jobs ORDER BY id DESC LIMIT 200")
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		var j Job
+		_ = rows.Scan(&j.ID, &j.Kind, &j.Payload, &j.Status, &j.Attempts, &j.MaxAttempts, &j.LastError, &j.RunAt, &j.CreatedAt)
+		j.Payload = redactPayload(j.Payload)
+		jobs = append(jobs, j)
+	}
+	t := mustParseTemplates("jobs.html")
+	_ = t.Execute(w, jobs)
+}
+
+func retryJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("UPDATE jobs SET status = 'PENDING', attempts = 0, run_at = NOW() WHERE id = ? AND status = 'FAILED'", id)
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Shipping labels are drawn as a PDF, one label a page, at the size of the
+// label printer's stock: LABEL_SIZE in millimetres, 100x150 (4×6") by
+// default. Each has the delivery address, the order ID as a QR code for
+// the courier's scanner, and the cash to collect for COD orders.
+
+// labelSize is the label stock's width and height in points.
+func labelSize() (float64, float64) {
+	w, h := 100.0, 150.0
+	if ws, hs, ok := strings.Cut(envOr("LABEL_SIZE", ""), "x"); ok {
+		if n, err := strconv.ParseFloat(strings.TrimSpace(ws), 64); err == nil && n >= 50 {
+			w = n
+		}
+		if n, err := strconv.ParseFloat(strings.TrimSpace(hs), 64); err == nil && n >= 50 {
+			h = n
+		}
+	}
+	const pointsPerMM = 72 / 25.4
+	return w * pointsPerMM, h * pointsPerMM
+}
+
+// wrapText breaks s into lines of at most width characters.
+func wrapText(s string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		if line != "" && len([]rune(line))+1+len([]rune(word)) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// codDue is what the courier collects for o: nothing for prepaid orders,
+// otherwise whatever gift cards did not cover.
+func codDue(o Order) (Money, error) {
+	if o.PaymentMethod == PaymentPrepaid {
+		return 0, nil
+	}
+	paid, err := giftCardPaid(o.OrderID)
+	if err != nil {
+		return 0, err
+	}
+	return max(o.TotalAmount-paid, 0), nil
+}
+
+// drawShippingLabel lays o's label out on a width × height page.
+func drawShippingLabel(o Order, width, height float64) (*pdfPage, error) {
+	due, err := codDue(o)
+	if err != nil {
+		return nil, err
+	}
+	var store Store
+	_ = db.QueryRow("SELECT id, code, name, created_at FROM stores WHERE id = ?", o.StoreID).Scan(&store.ID, &store.Code, &store.Name, &store.CreatedAt)
+
+	p := &pdfPage{}
+	const margin = 14.0
+	right := width - margin
+	chars := int((width - 2*margin) / 6) // Helvetica averages about half its size
+	y := height - margin - 8
+	from := shopName()
+	if store.Name != "" {
+		from += ", " + store.Name
+	}
+	p.text(margin, y, 8, false, "From: "+from)
+	if o.Priority {
+		p.text(right-40, y, 10, true, "RUSH")
+	}
+	y -= 8
+	p.line(margin, y, right, y)
+
+	y -= 16
+	p.text(margin, y, 9, true, "SHIP TO")
+	y -= 18
+	p.text(margin, y, 13, true, o.CustomerID)
+	for _, line := range wrapText(o.Address, chars) {
+		y -= 15
+		p.text(margin, y, 12, false, line)
+	}
+	if o.PostalCode != "" {
+		y -= 24
+		p.text(margin, y, 20, true, o.PostalCode)
+	}
+	if o.DeliveryDate != "" {
+		y -= 18
+		p.text(margin, y, 10, false, "Deliver "+o.DeliveryDate+", "+o.DeliverySlot)
+	}
+	y -= 10
+	p.line(margin, y, right, y)
+
+	qr, err := qrEncode(o.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	side := min(width*0.42, y-margin-70)
+	module := side / float64(qr.size)
+	top := y - 10
+	for row := 0; row < qr.size; row++ {
+		for col := 0; col < qr.size; col++ {
+			if qr.dark[row][col] {
+				p.rect(margin+float64(col)*module, top-float64(row+1)*module, module, module)
+			}
+		}
+	}
+	x := margin + side + 12
+	p.text(x, top-16, 9, false, "Order")
+	p.text(x, top-34, 16, true, o.OrderID)
+	if o.TrackingCode != "" {
+		p.text(x, top-52, 9, false, "Tracking "+o.TrackingCode)
+	}
+	p.text(x, top-70, 9, false, fmt.Sprintf("%d item(s)", o.Quantity))
+
+	y = margin + 14
+	p.line(margin, y+28, right, y+28)
+	if due > 0 {
+		p.text(margin, y, 18, true, "COLLECT "+money(due))
+	} else {
+		p.text(margin, y, 14, true, "PAID - do not collect")
+	}
+	return p, nil
+}
+
+func writeShippingLabels(w http.ResponseWriter, orders []Order, filename string) {
+	width, height := labelSize()
+	var pages []*pdfPage
+	for _, o := range orders {
+		p, err := drawShippingLabel(o, width, height)
+		if err != nil {
+			http.Error(w, "Could not draw the label for "+o.OrderID, http.StatusInternalServerError)
+			return
+		}
+		pages = append(pages, p)
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="`+filename+`"`)
+	_, _ = w.Write(pdfDocument(width, height, pages...))
+}
+
+func orderShippingLabel(w http.ResponseWriter, r *http.Request) {
+	o, err := storeOrder(currentStoreID(r), mux.Vars(r)["orderID"])
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	writeShippingLabels(w, []Order{o}, "label-"+strings.Trim(strings.NewReplacer("#", "", "/", "-").Replace(o.OrderID), "-")+".pdf")
+}
+
+// shippingLabels prints labels for the store's DELIVERING orders, those to
+// be delivered on ?date= if given.
+func shippingLabels(w http.ResponseWriter, r *http.Request) {
+	where, args := "WHERE store_id = ? AND status = 'DELIVERING' AND deleted_at IS NULL", []interface{}{currentStoreID(r)}
+	name := "labels-" + time.Now().Format("20060102")
+	back := "/admin/deliveries"
+	if date := r.URL.Query().Get("date"); date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			redirectWithFlash(w, r, "/admin/deliveries", "error", "Pick a delivery date to print labels for.")
+			return
+		}
+		where += " AND delivery_date = ?"
+		args = append(args, date)
+		name = "labels-" + strings.ReplaceAll(date, "-", "")
+		back = "/admin/deliveries?date=" + date
+	}
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders "+where+" ORDER BY delivery_slot_id, priority DESC, created_at", args...)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			rows.Close()
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if len(orders) == 0 {
+		redirectWithFlash(w, r, back, "error", "There are no orders out for delivery to print labels for.")
+		return
+	}
+	writeShippingLabels(w, orders, name+".pdf")
+}
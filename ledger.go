@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Every movement of money is written to the ledger in the same transaction
+// as the change that caused it, so the books don't have to be pieced
+// together from order totals. Amounts are positive for money coming in and
+// negative for money going out. Gift card redemptions move no money (it
+// came in when the card was sold) and are not in the ledger.
+const (
+	LedgerSale          = "sale"
+	LedgerCODCollection = "cod_collection"
+	LedgerRefund        = "refund"
+	LedgerGatewayFee    = "gateway_fee"
+	LedgerWalkInSale    = "walk_in_sale"
+)
+
+var ledgerKindLabels = map[string]string{
+	LedgerSale:          "Advance payments and gift card sales",
+	LedgerCODCollection: "Cash collected on delivery",
+	LedgerRefund:        "Refunds",
+	LedgerGatewayFee:    "Gateway fees",
+	LedgerWalkInSale:    "Walk-in sales",
+}
+
+type LedgerEntry struct {
+	ID        int64
+	OrderID   string
+	Kind      string
+	Method    string
+	Amount    Money
+	Reference string
+	Actor     string
+	CreatedAt time.Time
+}
+
+type LedgerTotal struct {
+	Kind   string
+	Count  int
+	Amount Money
+}
+
+func (t LedgerTotal) Label() string {
+	return ledgerKindLabels[t.Kind]
+}
+
+func recordLedgerEntry(ex execer, storeID int, orderID, kind, method string, amount Money, reference, actor string) error {
+	_, err := ex.Exec(`INSERT INTO ledger_entries (store_id, order_id, kind, method, amount, reference, actor)
+		VALUES (?, NULLIF(?, ''), ?, ?, ?, ?, ?)`, storeID, orderID, kind, method, amount, reference, actor)
+	return err
+}
+
+// ledgerPage shows the opening balance, the movements by kind and the
+// closing balance for a date range, with the entries behind them.
+func ledgerPage(w http.ResponseWriter, r *http.Request) {
+	storeID := currentStoreID(r)
+	from, to, ok := monthRange(r)
+	if !ok {
+		redirectWithFlash(w, r, "/admin/ledger", "error", "Pick a date range that ends after it starts.")
+		return
+	}
+	end := to.AddDate(0, 0, 1)
+
+	var opening Money
+	if err := db.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE store_id = ? AND created_at < ?", storeID, from).Scan(&opening); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query(`SELECT kind, COUNT(*), SUM(amount) FROM ledger_entries WHERE store_id = ? AND created_at >= ? AND created_at < ?
+		GROUP BY kind ORDER BY kind`, storeID, from, end)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var totals []LedgerTotal
+	var net Money
+	for rows.Next() {
+		var t LedgerTotal
+		if err := rows.Scan(&t.Kind, &t.Count, &t.Amount); err != nil {
+			rows.Close()
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		totals = append(totals, t)
+		net += t.Amount
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT id, COALESCE(order_id, ''), kind, method, amount, reference, actor, created_at
+		FROM ledger_entries WHERE store_id = ? AND created_at >= ? AND created_at < ? ORDER BY id DESC LIMIT 500`, storeID, from, end)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.ID, &e.OrderID, &e.Kind, &e.Method, &e.Amount, &e.Reference, &e.Actor, &e.CreatedAt); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	t := mustParseTemplates("ledger.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		From, To string
+		Opening  Money
+		Totals   []LedgerTotal
+		Net      Money
+		Closing  Money
+		Entries  []LedgerEntry
+		Flashes  []Flash
+	}{storeSwitcher(r), from.Format("2006-01-02"), to.Format("2006-01-02"), opening, totals, net, opening + net, entries, popFlashes(r)})
+}
+
+// Description is how an entry reads in the ledger table.
+func (e LedgerEntry) Description() string {
+	label := ledgerKindLabels[e.Kind]
+	if e.OrderID != "" {
+		label += " · " + e.OrderID
+	}
+	if e.Reference != "" {
+		label += fmt.Sprintf(" (%s)", e.Reference)
+	}
+	return label
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The legacy Excel/Access system is exported to CSV before importing.
+// Column names differ per export, so they are mapped with -columns.
+const defaultLegacyColumns = "order_id=OrderNo,customer_id=Phone,size=Size,quantity=Qty,total_amount=Amount,status=Status,created_at=OrderDate"
+
+var legacyDateLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"1/2/2006 15:04:05",
+	"1/2/2006 15:04",
+	"1/2/2006",
+	"02/01/2006",
+}
+
+var legacyStatuses = map[string]string{
+	"new": "PROCESSING", "pending": "PROCESSING", "processing": "PROCESSING",
+	"shipped": "DELIVERING", "dispatched": "DELIVERING", "delivering": "DELIVERING", "out for delivery": "DELIVERING",
+	"delivered": "DELIVERED", "completed": "DELIVERED", "complete": "DELIVERED", "done": "DELIVERED", "closed": "DELIVERED",
+}
+
+func importLegacyCommand(args []string) error {
+	fs := flag.NewFlagSet("import-legacy", flag.ContinueOnError)
+	columns := fs.String("columns", defaultLegacyColumns, "comma-separated field=LegacyColumn mapping")
+	dryRun := fs.Bool("dry-run", false, "validate the file without writing anything")
+	storeCode := fs.String("store", "main", "code of the store the orders belong to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: import-legacy [-columns ...] [-store code] [-dry-run] export.csv")
+	}
+	store, err := storeByCode(*storeCode)
+	if err != nil {
+		return fmt.Errorf("store %q: %v", *storeCode, err)
+	}
+	// Legacy orders are all of the original product, in its sizes.
+	variants, err := queryVariants("WHERE v.product_id = 1")
+	if err != nil {
+		return err
+	}
+	prices := map[string]Money{}
+	for _, v := range variants {
+		prices[v.Size] = v.Price
+	}
+	loc := shopLocation()
+
+	mapping := map[string]string{}
+	for _, pair := range strings.Split(*columns, ",") {
+		field, legacy, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("bad column mapping %q", pair)
+		}
+		mapping[strings.TrimSpace(field)] = strings.ToLower(strings.TrimSpace(legacy))
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("reading header: %v", err)
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		for field, legacy := range mapping {
+			if strings.ToLower(strings.TrimSpace(name)) == legacy {
+				cols[field] = i
+			}
+		}
+	}
+	for _, required := range []string{"order_id", "customer_id", "size", "quantity", "created_at"} {
+		if _, ok := cols[required]; !ok {
+			return fmt.Errorf("column for %s (%q) not found in header", required, mapping[required])
+		}
+	}
+
+	var imported, skipped, failed int
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			failed++
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		o, createdAt, err := parseLegacyOrder(rec, cols, prices, loc)
+		o.StoreID = store.ID
+		if err != nil {
+			log.Printf("line %d: %v", line, err)
+			failed++
+			continue
+		}
+		if *dryRun {
+			imported++
+			continue
+		}
+		done, err := importLegacyOrder(o, createdAt)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if done {
+			imported++
+		} else {
+			skipped++
+		}
+	}
+
+	if !*dryRun {
+		if err := raiseOrderSequence(); err != nil {
+			return err
+		}
+	}
+	log.Printf("legacy import: %d imported, %d already present, %d rejected", imported, skipped, failed)
+	return nil
+}
+
+// raiseOrderSequence keeps the auto-increment id of orders, which new order
+// codes are made from (generateOrderID), above every ODR# code in use, so
+// that new orders carry on after imported ones. MySQL before 8.0 forgets a
+// raised AUTO_INCREMENT on restart, so this runs at startup as well.
+func raiseOrderSequence() error {
+	var highest, maxID int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(CAST(SUBSTRING(order_id, 5) AS UNSIGNED)), 0), COALESCE(MAX(id), 0)
+		FROM (SELECT id, order_id FROM orders UNION ALL SELECT id, order_id FROM orders_archive) o
+		WHERE order_id REGEXP '^ODR#[0-9]+$'`).Scan(&highest, &maxID)
+	if err != nil || highest <= maxID {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE orders AUTO_INCREMENT = %d", highest+1))
+	return err
+}
+
+func parseLegacyOrder(rec []string, cols map[string]int, prices map[string]Money, loc *time.Location) (Order, time.Time, error) {
+	field := func(name string) string {
+		if i, ok := cols[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+	o := Order{
+		OrderID:    field("order_id"),
+		CustomerID: field("customer_id"),
+		Size:       strings.ToUpper(field("size")),
+		Status:     statuses[len(statuses)-1],
+	}
+	if o.OrderID == "" || o.CustomerID == "" {
+		return o, time.Time{}, errors.New("order code and customer are required")
+	}
+	price, ok := prices[o.Size]
+	if !ok {
+		return o, time.Time{}, fmt.Errorf("invalid size %q", o.Size)
+	}
+	qty, err := strconv.Atoi(field("quantity"))
+	if err != nil || qty <= 0 {
+		return o, time.Time{}, fmt.Errorf("invalid quantity %q", field("quantity"))
+	}
+	o.Quantity = qty
+
+	// Legacy amounts are kept as charged, even where prices have changed since.
+	o.TotalAmount = price.Times(qty)
+	if amount := strings.ReplaceAll(field("total_amount"), ",", ""); amount != "" {
+		if o.TotalAmount, err = parseMoney(amount); err != nil {
+			return o, time.Time{}, fmt.Errorf("invalid amount %q", field("total_amount"))
+		}
+	}
+	if s := field("status"); s != "" {
+		if o.Status, ok = legacyStatuses[strings.ToLower(s)]; !ok {
+			return o, time.Time{}, fmt.Errorf("unknown status %q", s)
+		}
+	}
+
+	for _, layout := range legacyDateLayouts {
+		if t, err := time.ParseInLocation(layout, field("created_at"), loc); err == nil {
+			return o, t, nil
+		}
+	}
+	return o, time.Time{}, fmt.Errorf("unrecognised date %q", field("created_at"))
+}
+
+// importLegacyOrder inserts o unless its code has been seen before (including
+// orders that were imported and later deleted), which makes re-runs safe.
+func importLegacyOrder(o Order, createdAt time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var seen bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM orders WHERE order_id = ?) OR EXISTS(SELECT 1 FROM order_events WHERE order_id = ?)",
+		o.OrderID, o.OrderID).Scan(&seen)
+	if err != nil || seen {
+		return false, err
+	}
+
+	res, err := tx.Exec("INSERT INTO orders (order_id, customer_id, size, quantity, total_amount, status, created_at, store_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		o.OrderID, o.CustomerID, o.Size, o.Quantity, o.TotalAmount, o.Status, createdAt, o.StoreID)
+	if err != nil {
+		return false, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+	o.ID = int(id)
+
+	v, err := defaultVariant(o.Size)
+	if err != nil {
+		return false, err
+	}
+	o.Items = []OrderItem{{
+		VariantID: v.ID, SKU: v.SKU, ProductName: v.ProductName, Size: v.Size, Color: v.Color,
+		// The unit price is the amount charged shared out, to the nearest cent.
+		Quantity: o.Quantity, UnitPrice: (o.TotalAmount + Money(o.Quantity)/2) / Money(o.Quantity),
+	}}
+	if err = insertOrderItems(tx, o.OrderID, o.Items); err != nil {
+		return false, err
+	}
+
+	final := o.Status
+	o.Status = statuses[0]
+	data, _ := json.Marshal(o)
+	if _, err = tx.Exec("INSERT INTO order_events (order_id, type, data, created_at) VALUES (?, ?, ?, ?)",
+		o.OrderID, OrderEventOrdered, string(data), createdAt); err != nil {
+		return false, err
+	}
+	if final != o.Status {
+		change, _ := json.Marshal(StatusChange{From: o.Status, To: final})
+		if _, err = tx.Exec("INSERT INTO order_events (order_id, type, data, created_at) VALUES (?, ?, ?, ?)",
+			o.OrderID, OrderEventStatusChanged, string(change), createdAt); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
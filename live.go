@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+var liveHub = newWSHub()
+
+func init() {
+	onOrderEvent(func(ev OrderEvent) {
+		msg, err := json.Marshal(ev.forStaffFeed())
+		if err != nil {
+			log.Printf("live: encode %s: %v", ev.Type, err)
+			return
+		}
+		liveHub.broadcast(ev.EventStoreID(), msg)
+	})
+}
+
+func liveBoardPage(w http.ResponseWriter, r *http.Request) {
+	storeID := currentStoreID(r)
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE status NOT IN ('DELIVERED', 'REFUSED', 'MERGED', 'CANCELLED') AND store_id = ? AND deleted_at IS NULL"+staffOrderBy, storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		_ = scanOrder(rows, &o)
+		orders = append(orders, o)
+	}
+	t := mustParseTemplates("live.html")
+	_ = t.Execute(w, struct {
+		Orders  []Order
+		StoreID int
+	}{orders, storeID})
+}
+
+func liveSocket(w http.ResponseWriter, r *http.Request) {
+	c, err := wsUpgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	liveHub.add(c, currentStoreID(r))
+	c.serve()
+	liveHub.remove(c)
+}
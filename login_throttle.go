@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Failed sign-ins are counted per account and per address over
+// LOGIN_FAILURE_WINDOW (15m by default). After three misses on an account
+// each further try waits twice as long as the last (1s, 2s, 4s…), and at
+// LOGIN_LOCKOUT_AFTER misses (10) the account is locked for the rest of the
+// window. An address starts waiting after that many misses across every
+// account it tries, and is locked at three times as many. ADMIN_EMAIL hears
+// about each lockout, since that many misses means someone is guessing.
+
+const loginFreeAttempts = 3
+
+func init() {
+	registerScheduledTask("login-failure-cleanup", "20 * * * *", func() error {
+		_, err := db.Exec("DELETE FROM login_failures WHERE failed_at < NOW() - INTERVAL 1 DAY")
+		return err
+	})
+}
+
+func loginFailureWindow() time.Duration {
+	return envDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute)
+}
+
+func loginLockoutAfter() int {
+	return envInt("LOGIN_LOCKOUT_AFTER", 10)
+}
+
+// loginWait is how long the next sign-in on account from ip has to wait,
+// or 0 to go ahead. scope keeps admin, customer and code sign-ins apart.
+func loginWait(scope, account, ip string) (time.Duration, error) {
+	window := loginFailureWindow()
+	lockAt := loginLockoutAfter()
+	var n, ago int
+	err := db.QueryRow(`SELECT COUNT(*), COALESCE(TIMESTAMPDIFF(SECOND, MAX(failed_at), NOW()), 0) FROM login_failures
+		WHERE scope = ? AND account = ? AND failed_at > NOW() - INTERVAL ? SECOND`, scope, account, int(window.Seconds())).Scan(&n, &ago)
+	if err != nil {
+		return 0, err
+	}
+	wait := throttleWait(n, loginFreeAttempts, lockAt, time.Duration(ago)*time.Second, window)
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(TIMESTAMPDIFF(SECOND, MAX(failed_at), NOW()), 0) FROM login_failures
+		WHERE ip = ? AND failed_at > NOW() - INTERVAL ? SECOND`, ip, int(window.Seconds())).Scan(&n, &ago)
+	if err != nil {
+		return 0, err
+	}
+	return max(wait, throttleWait(n, lockAt, 3*lockAt, time.Duration(ago)*time.Second, window)), nil
+}
+
+// throttleWait is what is left of the hold-off after failures, the last
+// one ago: nothing for the first free ones, then doubling from a second,
+// then the whole window once locked.
+func throttleWait(failures, free, lockAt int, ago, window time.Duration) time.Duration {
+	var delay time.Duration
+	switch {
+	case failures >= lockAt:
+		delay = window
+	case failures >= free:
+		delay = window
+		if shift := failures - free; shift < 30 {
+			delay = min(time.Second<<shift, window)
+		}
+	}
+	return max(delay-ago, 0)
+}
+
+func loginWaitMessage(wait time.Duration) string {
+	if wait < time.Minute {
+		return fmt.Sprintf("Too many failed sign-ins. Try again in %d seconds.", int(math.Ceil(wait.Seconds())))
+	}
+	return fmt.Sprintf("Too many failed sign-ins. Try again in %d minutes.", int(math.Ceil(wait.Minutes())))
+}
+
+// recordLoginFailure counts a miss and tells the admin when it locks the
+// account or the address.
+func recordLoginFailure(scope, account, ip string) error {
+	if _, err := db.Exec("INSERT INTO login_failures (scope, account, ip) VALUES (?, ?, ?)", scope, account, ip); err != nil {
+		return err
+	}
+	window := loginFailureWindow()
+	lockAt := loginLockoutAfter()
+	var byAccount, byIP int
+	err := db.QueryRow(`SELECT
+			(SELECT COUNT(*) FROM login_failures WHERE scope = ? AND account = ? AND failed_at > NOW() - INTERVAL ? SECOND),
+			(SELECT COUNT(*) FROM login_failures WHERE ip = ? AND failed_at > NOW() - INTERVAL ? SECOND)`,
+		scope, account, int(window.Seconds()), ip, int(window.Seconds())).Scan(&byAccount, &byIP)
+	if err != nil {
+		return err
+	}
+	switch {
+	case byAccount == lockAt:
+		return alertLockout(fmt.Sprintf("Sign-in locked for %s (%s)", account, scope),
+			fmt.Sprintf("%d failed %s sign-ins for %s in the last %s, the latest from %s.\nThe account is locked for %s.\n",
+				byAccount, scope, account, window, ip, window))
+	case byIP == 3*lockAt:
+		return alertLockout(fmt.Sprintf("Sign-ins locked from %s", ip),
+			fmt.Sprintf("%d failed sign-ins from %s in the last %s, the latest a %s sign-in for %s.\nThe address is locked for %s.\n",
+				byIP, ip, window, scope, account, window))
+	}
+	return nil
+}
+
+func alertLockout(subject, body string) error {
+	log.Printf("login throttle: %s", subject)
+	to := envOr("ADMIN_EMAIL", "")
+	if to == "" {
+		return nil
+	}
+	return enqueueJob("email", EmailMessage{To: to, Subject: subject, Body: body})
+}
+
+// clearLoginFailures forgets an account's misses once it signs in.
+func clearLoginFailures(scope, account string) error {
+	_, err := db.Exec("DELETE FROM login_failures WHERE scope = ? AND account = ?", scope, account)
+	return err
+}
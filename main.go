@@ -2,26 +2,58 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"expvar"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 )
 
 type Order struct {
-	ID          int
-	OrderID     string
-	CustomerID  string
-	Size        string
-	Quantity    int
-	TotalAmount float64
-	Status      string
-	CreatedAt   string
+	ID          int     `json:"id"`
+	OrderID     string  `json:"order_id"`
+	CustomerID  string  `json:"customer_id"`
+	Size        string  `json:"size"`
+	Quantity    int     `json:"quantity"`
+	TotalAmount Money   `json:"total_amount"`
+	Status      string  `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	StoreID     int         `json:"store_id"`
+	Notes       string      `json:"notes,omitempty"`
+	DeliveryDate   string   `json:"delivery_date,omitempty"`
+	DeliverySlotID int      `json:"delivery_slot_id,omitempty"`
+	DeliverySlot   string   `json:"delivery_slot,omitempty"`
+	PostalCode     string   `json:"postal_code,omitempty"`
+	ShippingFee    Money    `json:"shipping_fee,omitempty"`
+	Address        string   `json:"address,omitempty"`
+	Latitude       float64  `json:"latitude,omitempty"`
+	Longitude      float64  `json:"longitude,omitempty"`
+	OutsideArea    bool     `json:"outside_area,omitempty"`
+	Pickup         bool     `json:"pickup,omitempty"`
+	PaymentMethod  string   `json:"payment_method,omitempty"`
+	Priority       bool     `json:"priority,omitempty"`
+	RushFee        Money    `json:"rush_fee,omitempty"`
+	AgeMinutes     int      `json:"-"`
+	ParentOrderID  string   `json:"parent_order_id,omitempty"`
+	TrackingCode   string   `json:"tracking_code,omitempty"`
+	MergedInto     string   `json:"merged_into,omitempty"`
+	RestockDate    string   `json:"restock_date,omitempty"`
+	Channel        string   `json:"channel,omitempty"`
+	GiftWrap       bool     `json:"gift_wrap,omitempty"`
+	GiftWrapFee    Money    `json:"gift_wrap_fee,omitempty"`
+	GiftMessage    string   `json:"gift_message,omitempty"`
+	MadeToOrder    bool     `json:"made_to_order,omitempty"`
+	Items       []OrderItem `json:"items,omitempty"`
 }
 
 var db *sql.DB
@@ -29,6 +61,7 @@ var db *sql.DB
 var priceMap = map[string]float64{
 	"XS": 600, "S": 800, "M": 900, "L": 1000, "XL": 1100, "XXL": 1200,
 }
+var sizes = []string{"XS", "S", "M", "L", "XL", "XXL"}
 var statuses = []string{"PROCESSING", "DELIVERING", "DELIVERED"}
 
 
@@ -36,64 +69,320 @@ func generateOrderID(nextSeq int) string {
 	return fmt.Sprintf("ODR#%05d", nextSeq)
 }
 
-func mustParseTemplates(name string) *template.Template {
-	return template.Must(template.ParseFiles("templates/" + name))
+// pendingOrderID is a unique placeholder for the code of an order being
+// inserted, until its id is known to make the code from.
+func pendingOrderID() string {
+	return "NEW-" + newSessionID()[:16]
+}
+
+func mustParseTemplates(names ...string) *template.Template {
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = "templates/" + name
+	}
+	return template.Must(template.New(names[0]).Funcs(templateFuncs).ParseFiles(paths...))
+}
+
+// templateFuncs make the shop settings and feature flags available to every
+// template.
+var templateFuncs = template.FuncMap{
+	"currency": currency,
+	"money":    money,
+	"datetime": formatDateTime,
+	"date":     formatDate,
+	"clock":    formatClock,
+	"shopName": shopName,
+	"setting":  setting,
+	"feature":  featureEnabled,
+	"readOnly": readOnly,
+	"readOnlyMessage": func() string {
+		return readOnlyMessage
+	},
+}
+
+const orderColumns = "id, order_id, customer_id, size, quantity, total_amount, status, created_at, store_id, notes, " +
+	"COALESCE(delivery_date, ''), COALESCE(delivery_slot_id, 0), COALESCE((SELECT label FROM delivery_slots WHERE delivery_slots.id = orders.delivery_slot_id), ''), postal_code, shipping_fee, " +
+	"address, COALESCE(latitude, 0), COALESCE(longitude, 0), outside_area, pickup, payment_method, " +
+	"priority, rush_fee, TIMESTAMPDIFF(MINUTE, created_at, NOW()), parent_order_id, " +
+	"tracking_code, merged_into, " + madeToOrderColumn + ", " +
+	"COALESCE((SELECT DATE_FORMAT(MAX(v.restock_date), '%Y-%m-%d') FROM order_items i JOIN product_variants v ON v.id = i.variant_id WHERE i.order_id = orders.order_id AND i.status = 'PENDING' AND orders.status = 'BACKORDERED'), ''), " +
+	"channel, gift_wrap, gift_wrap_fee, gift_message, updated_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row rowScanner, o *Order) error {
+	return row.Scan(&o.ID, &o.OrderID, &o.CustomerID, &o.Size, &o.Quantity, &o.TotalAmount, &o.Status, &o.CreatedAt, &o.StoreID, &o.Notes,
+		&o.DeliveryDate, &o.DeliverySlotID, &o.DeliverySlot, &o.PostalCode, &o.ShippingFee,
+		&o.Address, &o.Latitude, &o.Longitude, &o.OutsideArea, &o.Pickup, &o.PaymentMethod,
+		&o.Priority, &o.RushFee, &o.AgeMinutes, &o.ParentOrderID,
+		&o.TrackingCode, &o.MergedInto, &o.MadeToOrder, &o.RestockDate, &o.Channel,
+		&o.GiftWrap, &o.GiftWrapFee, &o.GiftMessage, &o.UpdatedAt)
 }
 
 func home(w http.ResponseWriter, r *http.Request) {
-	t := mustParseTemplates("home.html")
-	_ = t.Execute(w, nil)
+	t := mustParseTemplates("home.html", "partials.html")
+	_ = t.Execute(w, storeSwitcher(r))
 }
 
 
 func placeOrderPage(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		t := mustParseTemplates("form.html")
-		_ = t.Execute(w, nil)
+		categoryID := categoryFilter(r)
+		variants, err := activeVariantsIn(categoryID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		categories, _ := loadCategories()
+		charts, _ := variantSizeCharts(variants)
+		slots, _ := deliverySlots(currentStoreID(r), "", true)
+		deliveryFrom, deliveryTo := deliveryDateRange()
+		draft := OrderDraft{CustomerID: customerContact(r)}
+		// The storefront's "Order this" links here with the variant picked.
+		draft.VariantID, _ = strconv.Atoi(r.URL.Query().Get("variant"))
+		if token := r.URL.Query().Get("resume"); token != "" {
+			if d, err := loadOrderDraft(token); err == nil && d.OrderID == "" {
+				draft = d
+				sess := getSession(r)
+				sess.Values["draft_token"] = token
+				_ = saveSession(sess)
+			}
+		}
+		t := mustParseTemplates("form.html", "partials.html")
+		_ = t.Execute(w, struct {
+			Variants   []Variant
+			Categories []Category
+			CategoryID int
+			SizeCharts []SizeChart
+			Customer   string
+			Draft      OrderDraft
+			Slots      []DeliverySlot
+			DeliveryFrom string
+			DeliveryTo   string
+			RushFee      Money
+			GiftWrapFee  Money
+			Measurements []MeasurementField
+			Experiments  map[string]string
+			Guard        FormGuard
+		}{variants, categories, categoryID, charts, customerContact(r), draft, slots, deliveryFrom, deliveryTo, rushOrderFee(), settingMoney("gift_wrap_fee"), measurementFields, exposeExperiments(w, r), newFormGuard("order-form")})
 		return
 	}
 
 	if r.Method == http.MethodPost {
+		if reason, err := formSpamReason(r, "order-form"); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		} else if reason != "" {
+			http.Error(w, reason, http.StatusBadRequest)
+			return
+		}
 		contact := r.FormValue("contact")
-		size := r.FormValue("size")
 		qty, err := strconv.Atoi(r.FormValue("qty"))
 		if err != nil {
 			http.Error(w, "Quantity must be a number", http.StatusBadRequest)
 			return
 		}
-		price, ok := priceMap[size]
-		if !ok {
-			http.Error(w, "Invalid size", http.StatusBadRequest)
+		notes := strings.TrimSpace(r.FormValue("notes"))
+		if utf8.RuneCountInString(notes) > maxOrderNotes {
+			http.Error(w, fmt.Sprintf("Notes can be at most %d characters", maxOrderNotes), http.StatusBadRequest)
+			return
+		}
+		giftWrap := r.FormValue("gift_wrap") != "" && featureEnabled("gift_wrap")
+		giftMessage := strings.TrimSpace(r.FormValue("gift_message"))
+		if utf8.RuneCountInString(giftMessage) > maxGiftMessage {
+			http.Error(w, fmt.Sprintf("The gift message can be at most %d characters", maxGiftMessage), http.StatusBadRequest)
+			return
+		}
+		pickup := r.FormValue("fulfilment") == "pickup"
+		slotID, _ := strconv.Atoi(r.FormValue("delivery_slot"))
+		deliveryDate := r.FormValue("delivery_date")
+		if pickup {
+			slotID = 0
+		}
+		if slotID != 0 && !validDeliveryDate(deliveryDate) {
+			from, to := deliveryDateRange()
+			http.Error(w, "Pick a delivery date between "+from+" and "+to, http.StatusBadRequest)
+			return
+		}
+		address := strings.TrimSpace(r.FormValue("address"))
+		postalCode := r.FormValue("postal_code")
+		if utf8.RuneCountInString(address) > maxAddressLength {
+			http.Error(w, fmt.Sprintf("Address can be at most %d characters", maxAddressLength), http.StatusBadRequest)
+			return
+		}
+		var delivery DeliveryAddress
+		if !pickup && address != "" {
+			delivery, err = geocodeAddress(address)
+			if err == errAddressNotFound {
+				http.Error(w, "We could not find that delivery address, please check it", http.StatusBadRequest)
+				return
+			} else if err != nil {
+				// A geocoder outage should not stop the sale; staff see the address is unchecked.
+				log.Printf("geocoding delivery address: %v", err)
+			}
+		}
+		if policy := deliveryZonePolicy(); !pickup && policy != "off" {
+			serviced, err := postalCodeServiced(postalCode)
+			if err != nil {
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+			if !serviced && policy == "reject" {
+				http.Error(w, fmt.Sprintf("Sorry, we don't deliver to postal code %s yet. You can still place this order with store pickup and collect it from our %s store.",
+					normalizePostalCode(postalCode), storeSwitcher(r).CurrentStore().Name), http.StatusBadRequest)
+				return
+			}
+			delivery.OutsideArea = delivery.OutsideArea || !serviced
+		}
+		// Older clients still post a bare size for the Classic T-Shirt.
+		var variant Variant
+		if id, convErr := strconv.Atoi(r.FormValue("variant")); convErr == nil {
+			variant, err = variantByID(id)
+		} else {
+			variant, err = defaultVariant(r.FormValue("size"))
+		}
+		if err == sql.ErrNoRows || (err == nil && !variant.Active) {
+			http.Error(w, "Invalid product", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		var measurements []Measurement
+		if variant.MadeToMeasure {
+			if measurements, err = parseMeasurements(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if refuseBlockedOrder(w, r, contact) {
+			return
+		}
+		if needsCode, err := orderNeedsCode(r, contact); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		} else if needsCode {
+			holdOrderForCode(w, r, contact)
 			return
 		}
-		amount := price * float64(qty)
 
-		
 		tx, err := db.Begin()
 		if err != nil {
 			http.Error(w, "DB error", http.StatusInternalServerError)
 			return
 		}
-		
-		res, err := tx.Exec("INSERT INTO orders (order_id, customer_id, size, quantity, total_amount, status) VALUES (?, ?, ?, ?, ?, ?)",
-			"", contact, size, qty, amount, statuses[0])
+		order, err := createOrder(tx, currentStoreID(r), ChannelOnline, contact, variant, qty, notes, staffUser(r))
+		if err == nil {
+			err = saveMeasurements(tx, order.OrderID, measurements)
+		}
+		if err == nil && customerContact(r) != contact {
+			err = markGuestOrder(tx, order.OrderID)
+		}
 		if err != nil {
 			tx.Rollback()
 			http.Error(w, "DB insert error", http.StatusInternalServerError)
 			return
 		}
-		lastID, err := res.LastInsertId()
+		if pickup {
+			err = choosePickup(tx, &order)
+		} else {
+			if delivery.Address != "" || delivery.OutsideArea {
+				err = setDeliveryAddress(tx, &order, delivery)
+			}
+			if err == nil {
+				err = chargeShipping(tx, &order, postalCode, variant.WeightGrams*qty)
+			}
+		}
 		if err != nil {
 			tx.Rollback()
-			http.Error(w, "DB id error", http.StatusInternalServerError)
+			http.Error(w, "DB insert error", http.StatusInternalServerError)
+			return
+		}
+		if r.FormValue("rush") != "" && featureEnabled("rush_orders") {
+			if err = requestRush(tx, &order); err != nil {
+				tx.Rollback()
+				http.Error(w, "DB insert error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if giftWrap {
+			if err = requestGiftWrap(tx, &order, giftMessage); err != nil {
+				tx.Rollback()
+				http.Error(w, "DB insert error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if slotID != 0 {
+			err = scheduleDelivery(tx, &order, slotID, deliveryDate)
+			if err == errDeliverySlotFull || err == errDeliverySlotUnavailable {
+				tx.Rollback()
+				http.Error(w, "Delivery slot not accepted: "+err.Error()+", please pick another", http.StatusConflict)
+				return
+			} else if err != nil {
+				tx.Rollback()
+				http.Error(w, "DB insert error", http.StatusInternalServerError)
+				return
+			}
+		}
+		var giftCardAmount Money
+		if code := r.FormValue("gift_card"); strings.TrimSpace(code) != "" && featureEnabled("gift_card_checkout") {
+			_, verified, err := accountEmail(contact)
+			if err == nil {
+				giftCardAmount, err = redeemGiftCard(tx, code, order, verified && customerContact(r) == contact)
+			}
+			if err == errGiftCardNotFound || err == errGiftCardExpired || err == errGiftCardEmpty || err == errCreditUnverified {
+				tx.Rollback()
+				http.Error(w, "Gift card not accepted: "+err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				tx.Rollback()
+				http.Error(w, "DB insert error", http.StatusInternalServerError)
+				return
+			}
+		}
+		method := PaymentCOD
+		if r.FormValue("payment") == PaymentPrepaid && featureEnabled("prepaid_payments") {
+			method = PaymentPrepaid
+		}
+		if method == PaymentCOD {
+			reason, err := codRefusal(contact, order.TotalAmount-giftCardAmount)
+			if err != nil {
+				tx.Rollback()
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+			if reason != "" {
+				tx.Rollback()
+				http.Error(w, reason, http.StatusBadRequest)
+				return
+			}
+		}
+		if err = setPaymentMethod(tx, &order, method); err != nil {
+			tx.Rollback()
+			http.Error(w, "DB insert error", http.StatusInternalServerError)
 			return
 		}
-
-		orderCode := generateOrderID(int(lastID))
-		_, err = tx.Exec("UPDATE orders SET order_id = ? WHERE id = ?", orderCode, lastID)
-		if err != nil {
+		if due := order.TotalAmount - giftCardAmount; method == PaymentPrepaid && due > 0 {
+			if err = reserveStock(tx, order, due); err != nil {
+				tx.Rollback()
+				http.Error(w, "DB insert error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err = screenOrder(tx, r, &order, order.TotalAmount-giftCardAmount); err != nil {
 			tx.Rollback()
-			http.Error(w, "DB update error", http.StatusInternalServerError)
+			http.Error(w, "DB insert error", http.StatusInternalServerError)
+			return
+		}
+		if err = useFormToken(tx, r); err == errFormTokenUsed {
+			tx.Rollback()
+			http.Error(w, formTokenUsedMessage, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			tx.Rollback()
+			http.Error(w, "DB insert error", http.StatusInternalServerError)
 			return
 		}
 		err = tx.Commit()
@@ -101,114 +390,329 @@ func placeOrderPage(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "DB commit error", http.StatusInternalServerError)
 			return
 		}
-
-	
-		order := Order{
-			ID:          int(lastID),
-			OrderID:     orderCode,
-			CustomerID:  contact,
-			Size:        size,
-			Quantity:    qty,
-			TotalAmount: amount,
-			Status:      statuses[0],
+		orderCode := order.OrderID
+		emitOrderEvent(OrderEvent{Type: EventOrderCreated, OrderID: orderCode, Order: &order})
+		if err := markDraftOrdered(r, orderCode); err != nil {
+			log.Printf("order draft for %s: %v", orderCode, err)
 		}
+		recordConversion(r, order)
 
-		t := mustParseTemplates("success.html")
-		_ = t.Execute(w, order)
+		sess := getSession(r)
+		sess.Values["last_order"] = orderCode
+		_ = saveSession(sess)
+		msg := "Order "+orderCode+" placed successfully."
+		if order.Status == OrderOnHold {
+			msg = "Order "+orderCode+" placed. We check some orders before we start on them and will be in touch shortly."
+		}
+		redirectWithFlash(w, r, "/order-placed", "success", msg)
 	}
 }
 
+// maxOrderNotes caps the customer's delivery notes, in characters.
+const maxOrderNotes = 500
 
-func searchCustomerPage(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		t := mustParseTemplates("search_customer_form.html")
-		_ = t.Execute(w, nil)
-		return
+// createOrder inserts a new order and its event inside tx. It is PROCESSING,
+// or BACKORDERED when the store is short of the variant. The item is priced
+// by the pricing rules.
+// Callers validate the input and emit EventOrderCreated after committing.
+// actor is the staff member taking the order, or "" when nobody did.
+func createOrder(tx *sql.Tx, storeID int, channel, contact string, v Variant, qty int, notes, actor string) (Order, error) {
+	status := statuses[0]
+	available, tracked, err := availableStock(tx, storeID, v.ID, stockQueueStatuses)
+	if err != nil {
+		return Order{}, err
 	}
-
-	contact := r.FormValue("contact")
-	rows, err := db.Query("SELECT id, order_id, customer_id, size, quantity, total_amount, status, created_at FROM orders WHERE customer_id = ?", contact)
+	if tracked && available < qty {
+		status = OrderBackordered
+	}
+	unitPrice, _, _, err := dynamicPrice(tx, time.Now(), contact, channel, v, qty, v.Price)
+	if err != nil {
+		return Order{}, err
+	}
+	amount := unitPrice.Times(qty)
+	res, err := tx.Exec("INSERT INTO orders (order_id, customer_id, size, quantity, total_amount, status, store_id, notes, channel) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		pendingOrderID(), contact, v.Size, qty, amount, status, storeID, notes, channel)
 	if err != nil {
+		return Order{}, err
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return Order{}, err
+	}
+
+	orderCode := generateOrderID(int(lastID))
+	if _, err = tx.Exec("UPDATE orders SET order_id = ? WHERE id = ?", orderCode, lastID); err != nil {
+		return Order{}, err
+	}
+
+	order := Order{
+		ID:          int(lastID),
+		OrderID:     orderCode,
+		CustomerID:  contact,
+		Size:        v.Size,
+		Quantity:    qty,
+		TotalAmount: amount,
+		Status:      status,
+		StoreID:     storeID,
+		Notes:       notes,
+		Channel:     channel,
+		Items: []OrderItem{{
+			VariantID: v.ID, SKU: v.SKU, ProductName: v.ProductName, Size: v.Size, Color: v.Color,
+			Quantity: qty, UnitPrice: unitPrice,
+		}},
+	}
+	if err = insertOrderItems(tx, orderCode, order.Items); err != nil {
+		return Order{}, err
+	}
+	if err = recordOrderEventBy(tx, orderCode, OrderEventOrdered, actor, order); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+func orderPlacedPage(w http.ResponseWriter, r *http.Request) {
+	orderID := getSession(r).Values["last_order"]
+	row := db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND deleted_at IS NULL", orderID)
+	var o Order
+	err := scanOrder(row, &o)
+	if err == sql.ErrNoRows {
+		http.Redirect(w, r, "/place-order", http.StatusSeeOther)
+		return
+	} else if err != nil {
 		http.Error(w, "DB error", http.StatusInternalServerError)
 		return
 	}
+	o.Items, _ = orderItems(o.OrderID)
+	paid, _ := giftCardPaid(o.OrderID)
+	reservation, _ := orderReservation(o.OrderID)
+	linkAccount, _ := offerAccountLink(r, o)
+	t := mustParseTemplates("success.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Order
+		GiftCardPaid Money
+		BalanceDue   Money
+		Reservation  *StockReservation
+		LinkAccount  bool
+		ShareURL     string
+		Flashes      []Flash
+	}{o, paid, o.TotalAmount - paid, reservation, linkAccount, confirmationURL(o.OrderID), popFlashes(r)})
+}
+
+
+// customerOrders is every order the customer placed at the store.
+func customerOrders(storeID int, contact string, archived bool) ([]Order, error) {
+	rows, err := db.Query("SELECT "+orderColumns+" FROM "+ordersFrom(archived)+" WHERE customer_id = ? AND store_id = ? AND deleted_at IS NULL", contact, storeID)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var found []Order
 	for rows.Next() {
 		var o Order
-		_ = rows.Scan(&o.ID, &o.OrderID, &o.CustomerID, &o.Size, &o.Quantity, &o.TotalAmount, &o.Status, &o.CreatedAt)
+		if err := scanOrder(rows, &o); err != nil {
+			return nil, err
+		}
 		found = append(found, o)
 	}
+	return found, rows.Err()
+}
+
+func searchCustomerPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	if r.Method == http.MethodGet && !wantsJSON(r) {
+		t := mustParseTemplates("search_customer_form.html")
+		_ = t.Execute(w, nil)
+		return
+	}
+
+	contact := r.FormValue("contact")
+	if c, ok := mux.Vars(r)["contact"]; ok {
+		contact = c
+	}
+	found, err := customerOrders(currentStoreID(r), contact, wantsArchived(r))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "DB error")
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, struct {
+			Orders []Order `json:"orders"`
+		}{append([]Order{}, found...)})
+		return
+	}
+	if isHTMX(r) {
+		renderPartial(w, "search_results", found)
+		return
+	}
 	t := mustParseTemplates("search_customer_results.html")
 	_ = t.Execute(w, found)
 }
 
 
+// storeOrder looks up one of the store's orders by its order ID.
+func storeOrder(storeID int, orderID string) (Order, error) {
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", orderID, storeID), &o)
+	return o, err
+}
+
 func searchOrderPage(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
+	w.Header().Add("Vary", "Accept")
+	if r.Method == http.MethodGet && !wantsJSON(r) {
 		t := mustParseTemplates("search_order_form.html")
 		_ = t.Execute(w, nil)
 		return
 	}
 
 	orderID := strings.TrimSpace(r.FormValue("orderid"))
+	if id, ok := mux.Vars(r)["orderID"]; ok {
+		orderID = id
+	}
 	if orderID == "" {
-		http.Error(w, "Order ID required", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "Order ID required")
+		return
+	}
+	o, err := storeOrder(currentStoreID(r), orderID)
+	if err == sql.ErrNoRows && wantsArchived(r) {
+		o, err = archivedOrder(currentStoreID(r), orderID)
+	}
+	if wantsJSON(r) && err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+	if isHTMX(r) && err == sql.ErrNoRows {
+		renderPartial(w, "search_results", nil)
+		return
+	} else if isHTMX(r) && err == nil {
+		renderPartial(w, "search_results", []Order{o})
 		return
 	}
-	row := db.QueryRow("SELECT id, order_id, customer_id, size, quantity, total_amount, status, created_at FROM orders WHERE order_id = ?", orderID)
-	var o Order
-	err := row.Scan(&o.ID, &o.OrderID, &o.CustomerID, &o.Size, &o.Quantity, &o.TotalAmount, &o.Status, &o.CreatedAt)
 	if err == sql.ErrNoRows {
 		t := mustParseTemplates("order_not_found.html")
 		_ = t.Execute(w, nil)
 		return
 	} else if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, "DB error")
+		return
+	}
+	if wantsJSON(r) && notModified(w, r, o.UpdatedAt) {
+		return
+	}
+	o.Items, _ = orderItems(o.OrderID)
+	reservation, _ := orderReservation(o.OrderID)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, struct {
+			Order
+			Reservation *StockReservation `json:"reservation,omitempty"`
+		}{o, reservation})
 		return
 	}
 	t := mustParseTemplates("search_order_results.html")
-	_ = t.Execute(w, o)
+	_ = t.Execute(w, struct {
+		Order
+		Reservation *StockReservation
+	}{o, reservation})
 }
 
 
+type OrderListPage struct {
+	Orders  []Order
+	Flashes []Flash
+}
+
 type ReportData struct {
+	StoreSwitcher
+	Categories  []Category
+	CategoryID  int
+	Channel     string
+	Archived    bool
 	Orders      []Order
 	TotalOrders int
-	TotalAmount float64
+	TotalAmount Money
+	Daily       []DailySales
 }
 
-func viewReports(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, order_id, customer_id, size, quantity, total_amount, status, created_at FROM orders ORDER BY created_at DESC")
+// reportOrders is the store's orders for the sales report, optionally in
+// one category or channel and with archived orders or not, with their total.
+func reportOrders(storeID, categoryID int, channel string, archived bool) ([]Order, Money, error) {
+	where, args := "WHERE store_id = ? AND deleted_at IS NULL", []interface{}{storeID}
+	if categoryID != 0 {
+		where += ` AND order_id IN (SELECT i.order_id FROM order_items i JOIN product_variants v ON v.id = i.variant_id
+			JOIN product_categories pc ON pc.product_id = v.product_id WHERE pc.category_id = ?)`
+		args = append(args, categoryID)
+	}
+	if channel != "" {
+		where += " AND channel = ?"
+		args = append(args, channel)
+	}
+	rows, err := reportDB().Query("SELECT "+orderColumns+" FROM "+ordersFrom(archived)+" "+where+staffOrderBy, args...)
 	if err != nil {
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
+		return nil, 0, err
 	}
 	defer rows.Close()
 
 	var orders []Order
-	var total float64
+	var total Money
 	for rows.Next() {
 		var o Order
-		_ = rows.Scan(&o.ID, &o.OrderID, &o.CustomerID, &o.Size, &o.Quantity, &o.TotalAmount, &o.Status, &o.CreatedAt)
+		if err := scanOrder(rows, &o); err != nil {
+			return nil, 0, err
+		}
 		orders = append(orders, o)
 		total += o.TotalAmount
 	}
+	return orders, total, rows.Err()
+}
 
+func viewReports(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	categoryID := categoryFilter(r)
+	channel := r.URL.Query().Get("channel")
+	if channel != ChannelOnline && channel != ChannelWalkIn {
+		channel = ""
+	}
+	archived := wantsArchived(r)
+	orders, total, err := reportOrders(currentStoreID(r), categoryID, channel, archived)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "DB error")
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, struct {
+			CategoryID  int     `json:"category_id,omitempty"`
+			Channel     string  `json:"channel,omitempty"`
+			Archived    bool    `json:"archived,omitempty"`
+			TotalOrders int     `json:"total_orders"`
+			TotalAmount Money   `json:"total_amount"`
+			Orders      []Order `json:"orders"`
+		}{categoryID, channel, archived, len(orders), total, append([]Order{}, orders...)})
+		return
+	}
+
+	categories, _ := loadCategories()
 	data := ReportData{
+		Categories:    categories,
+		StoreSwitcher: storeSwitcher(r),
+		CategoryID:    categoryID,
+		Channel:       channel,
+		Archived:      archived,
 		Orders:      orders,
 		TotalOrders: len(orders),
 		TotalAmount: total,
 	}
-	t := mustParseTemplates("reports.html")
+	if categoryID == 0 {
+		// daily_sales isn't broken down by category.
+		data.Daily, _ = dailySales(currentStoreID(r), channel, time.Now().AddDate(0, 0, -13))
+	}
+	t := mustParseTemplates("reports.html", "partials.html")
 	_ = t.Execute(w, data)
 }
 
 
 func changeStatusPage(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		rows, err := db.Query("SELECT id, order_id, customer_id, size, quantity, total_amount, status, created_at FROM orders ORDER BY created_at DESC")
+		rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE store_id = ? AND deleted_at IS NULL"+staffOrderBy, currentStoreID(r))
 		if err != nil {
 			http.Error(w, "DB error", http.StatusInternalServerError)
 			return
@@ -217,59 +721,114 @@ func changeStatusPage(w http.ResponseWriter, r *http.Request) {
 		var orders []Order
 		for rows.Next() {
 			var o Order
-			_ = rows.Scan(&o.ID, &o.OrderID, &o.CustomerID, &o.Size, &o.Quantity, &o.TotalAmount, &o.Status, &o.CreatedAt)
+			_ = scanOrder(rows, &o)
 			orders = append(orders, o)
 		}
-		t := mustParseTemplates("change_status_form.html")
-		_ = t.Execute(w, orders)
+		t := mustParseTemplates("change_status_form.html", "partials.html")
+		_ = t.Execute(w, OrderListPage{Orders: orders, Flashes: popFlashes(r)})
 		return
 	}
 
-	idStr := r.FormValue("orderid")
-	
-	orderID := idStr
-	
-	row := db.QueryRow("SELECT status FROM orders WHERE order_id = ?", orderID)
-	var currentStatus string
-	err := row.Scan(&currentStatus)
-	if err == sql.ErrNoRows {
-		t := mustParseTemplates("status_error.html")
-		_ = t.Execute(w, nil)
-		return
-	} else if err != nil {
+	orderID := r.FormValue("orderid")
+	tx, err := db.Begin()
+	if err != nil {
 		http.Error(w, "DB error", http.StatusInternalServerError)
 		return
 	}
-
-	var newStatus string
-	if currentStatus == "PROCESSING" {
-		newStatus = "DELIVERING"
-	} else if currentStatus == "DELIVERING" {
-		newStatus = "DELIVERED"
+	change, err := advanceOrderStatus(tx, r, orderID)
+	if err == nil {
+		err = tx.Commit()
 	} else {
-		t := mustParseTemplates("status_error.html")
-		_ = t.Execute(w, nil)
-		return
+		tx.Rollback()
 	}
-
-	_, err = db.Exec("UPDATE orders SET status = ? WHERE order_id = ?", newStatus, orderID)
-	if err != nil {
+	switch err {
+	case nil:
+	case errOrderNotFound:
+		redirectWithFlash(w, r, "/change-status", "error", "Order "+orderID+" was not found.")
+		return
+	case errOrderFinal:
+		if isHTMX(r) {
+			w.Header().Set("HX-Reswap", "none")
+			http.Error(w, "Order is "+change.From, http.StatusConflict)
+			return
+		}
+		redirectWithFlash(w, r, "/change-status", "error", "Order "+orderID+" is "+change.From+" and cannot be updated.")
+		return
+	case errInsufficientMaterial:
+		if isHTMX(r) {
+			w.Header().Set("HX-Reswap", "none")
+			http.Error(w, "Not enough material to cut", http.StatusConflict)
+			return
+		}
+		redirectWithFlash(w, r, "/change-status", "error", "There is not enough material in stock to cut "+orderID+".")
+		return
+	case errDayClosed:
+		if isHTMX(r) {
+			w.Header().Set("HX-Reswap", "none")
+			http.Error(w, "Today's cash-up is closed", http.StatusConflict)
+			return
+		}
+		redirectWithFlash(w, r, "/change-status", "error", "Today's cash-up has been closed, so cash on delivery for "+orderID+" can only be booked tomorrow.")
+		return
+	default:
 		http.Error(w, "DB update error", http.StatusInternalServerError)
 		return
 	}
 
-	row2 := db.QueryRow("SELECT id, order_id, customer_id, size, quantity, total_amount, status, created_at FROM orders WHERE order_id = ?", orderID)
+	row2 := db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ?", orderID)
 	var o Order
-	_ = row2.Scan(&o.ID, &o.OrderID, &o.CustomerID, &o.Size, &o.Quantity, &o.TotalAmount, &o.Status, &o.CreatedAt)
-
-	t := mustParseTemplates("status_updated.html")
-	_ = t.Execute(w, o)
+	_ = scanOrder(row2, &o)
+	emitOrderEvent(OrderEvent{Type: EventOrderStatusChanged, OrderID: orderID, Order: &o, OldStatus: change.From})
+	if isHTMX(r) {
+		renderPartial(w, "order_row", o)
+		return
+	}
+	redirectWithFlash(w, r, "/change-status", "success", "Order "+orderID+" is now "+change.To+".")
 }
 
 
+var errOrderFinal = errors.New("order cannot be advanced")
+
+// advanceOrderStatus moves orderID on to its next status inside tx, taking
+// its stock when it goes out and booking cash on delivery when it arrives.
+// Made-to-measure orders use up their materials when they are cut.
+// On errOrderFinal the change's From is the status it is stuck in.
+func advanceOrderStatus(tx *sql.Tx, r *http.Request, orderID string) (StatusChange, error) {
+	var change StatusChange
+	var madeToOrder bool
+	err := tx.QueryRow("SELECT status, "+madeToOrderColumn+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL FOR UPDATE", orderID, currentStoreID(r)).
+		Scan(&change.From, &madeToOrder)
+	if err == sql.ErrNoRows {
+		return change, errOrderNotFound
+	} else if err != nil {
+		return change, err
+	}
+	change.To = nextOrderStatus(change.From, madeToOrder)
+	if change.To == "" {
+		return change, errOrderFinal
+	}
+	if _, err := tx.Exec("UPDATE orders SET status = ? WHERE order_id = ?", change.To, orderID); err != nil {
+		return change, err
+	}
+	if err := recordOrderEventBy(tx, orderID, OrderEventStatusChanged, staffUser(r), change); err != nil {
+		return change, err
+	}
+	switch change.To {
+	case productionStages[0]:
+		err = consumeMaterials(tx, r, orderID)
+	case "DELIVERING":
+		err = fulfilOrder(tx, r, orderID)
+	case "DELIVERED":
+		if err = markItemsDelivered(tx, orderID); err == nil {
+			err = recordCODCollection(tx, r, orderID)
+		}
+	}
+	return change, err
+}
+
 func deleteOrderPage(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		rows, err := db.Query("SELECT id, order_id, customer_id, size, quantity, total_amount, status, created_at FROM orders ORDER BY created_at DESC")
+		rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE store_id = ? AND deleted_at IS NULL ORDER BY created_at DESC", currentStoreID(r))
 		if err != nil {
 			http.Error(w, "DB error", http.StatusInternalServerError)
 			return
@@ -278,36 +837,88 @@ func deleteOrderPage(w http.ResponseWriter, r *http.Request) {
 		var orders []Order
 		for rows.Next() {
 			var o Order
-			_ = rows.Scan(&o.ID, &o.OrderID, &o.CustomerID, &o.Size, &o.Quantity, &o.TotalAmount, &o.Status, &o.CreatedAt)
+			_ = scanOrder(rows, &o)
 			orders = append(orders, o)
 		}
-		t := mustParseTemplates("delete_order_form.html")
-		_ = t.Execute(w, orders)
+		t := mustParseTemplates("delete_order_form.html", "partials.html")
+		_ = t.Execute(w, OrderListPage{Orders: orders, Flashes: popFlashes(r)})
 		return
 	}
 
 	orderID := r.FormValue("orderid")
-	res, err := db.Exec("DELETE FROM orders WHERE order_id = ?", orderID)
-	if err != nil {
-		http.Error(w, "DB delete error", http.StatusInternalServerError)
+	row := db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", orderID, currentStoreID(r))
+	var o Order
+	err := scanOrder(row, &o)
+	if err == sql.ErrNoRows {
+		redirectWithFlash(w, r, "/delete-order", "error", "Order "+orderID+" was not found.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
 		return
 	}
-	n, _ := res.RowsAffected()
-	if n == 0 {
-		t := mustParseTemplates("order_not_found.html")
-		_ = t.Execute(w, nil)
+	t := mustParseTemplates("delete_confirm.html")
+	_ = t.Execute(w, struct {
+		Order
+		Token string
+	}{o, signToken("delete-order", orderID, 10*time.Minute)})
+}
+
+func confirmDeleteOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := r.FormValue("orderid")
+	if !verifyToken("delete-order", orderID, r.FormValue("token")) {
+		redirectWithFlash(w, r, "/delete-order", "error", "The confirmation for "+orderID+" has expired. Please try again.")
 		return
 	}
+	err := deleteOrder(r, orderID)
+	if err == errOrderNotFound {
+		redirectWithFlash(w, r, "/delete-order", "error", "Order "+orderID+" was not found.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB delete error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/delete-order", "success", "Order "+orderID+" has been deleted.")
+}
 
-	t := mustParseTemplates("order_deleted.html")
-	_ = t.Execute(w, struct{ OrderID string }{OrderID: orderID})
+var errOrderNotFound = errors.New("order not found")
+
+// deleteOrder soft-deletes one of the store's orders: the row and its items
+// stay, with deleted_at set, so it can still be looked into and restored by
+// hand, but every list and lookup leaves it out.
+func deleteOrder(r *http.Request, orderID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE orders SET deleted_at = NOW() WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", orderID, currentStoreID(r))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return errOrderNotFound
+	}
+	if err = recordOrderEventBy(tx, orderID, OrderEventDeleted, staffUser(r), struct{}{}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = recordAudit(tx, r, "order.delete", orderID, ""); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	emitOrderEvent(OrderEvent{Type: EventOrderDeleted, OrderID: orderID, StoreID: currentStoreID(r)})
+	return nil
 }
 
 func main() {
 	
 	var err error
-	dsn := "root:1234@tcp(127.0.0.1:3306)/orderdb?parseTime=true"
-	db, err = sql.Open("mysql", dsn)
+	dsn := envOr("DB_DSN", "root:1234@tcp(127.0.0.1:3306)/orderdb?parseTime=true")
+	db, err = openDB(dsn, &dbBreaker)
 	if err != nil {
 		log.Fatalf("DB open error: %v", err)
 	}
@@ -317,15 +928,228 @@ func main() {
 		log.Fatalf("DB ping error: %v", err)
 	}
 
+	if err = ensureSchema(); err != nil {
+		log.Fatalf("DB schema error: %v", err)
+	}
+	if err = verifySchema(); err != nil {
+		log.Fatalf("DB schema check failed: %v", err)
+	}
+	if err = useShopTimezone(dsn); err != nil {
+		log.Fatalf("DB timezone error: %v", err)
+	}
+	if err = openReplica(); err != nil {
+		log.Fatalf("DB replica error: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		if err = runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	if err = setupSessions(); err != nil {
+		log.Fatalf("Session store error: %v", err)
+	}
+	setupBroker()
+	startJobWorkers(envInt("JOB_WORKERS", 2))
+	startScheduler()
+
 	r := mux.NewRouter()
+	r.Use(sessionMiddleware, readOnlyGuard, degradedGuard)
 	r.HandleFunc("/", home).Methods("GET")
+	r.HandleFunc("/store", switchStore).Methods("POST")
+	r.HandleFunc("/shop", shopPage).Methods("GET")
+	r.HandleFunc("/shop/{slug}", shopSlugPage).Methods("GET")
 	r.HandleFunc("/place-order", placeOrderPage).Methods("GET", "POST")
-	r.HandleFunc("/search-customer", searchCustomerPage).Methods("GET", "POST")
-	r.HandleFunc("/search-order", searchOrderPage).Methods("GET", "POST")
-	r.HandleFunc("/reports", viewReports).Methods("GET")
-	r.HandleFunc("/change-status", changeStatusPage).Methods("GET", "POST")
-	r.HandleFunc("/delete-order", deleteOrderPage).Methods("GET", "POST")
+	r.HandleFunc("/place-order/draft", saveOrderDraft).Methods("POST")
+	r.HandleFunc("/place-order/verify", orderCodePage).Methods("GET")
+	r.HandleFunc("/place-order/verify", verifyOrderCode).Methods("POST")
+	r.HandleFunc("/place-order/verify/resend", sendOrderCode).Methods("POST")
+	r.HandleFunc("/delivery-slots", deliverySlotsAPI).Methods("GET")
+	r.HandleFunc("/shipping-quote", shippingQuoteAPI).Methods("GET")
+	r.HandleFunc("/order-placed", orderPlacedPage).Methods("GET")
+	r.Handle("/search-customer", requireStaff(http.HandlerFunc(searchCustomerPage))).Methods("GET", "POST")
+	r.Handle("/search-order", requireStaff(http.HandlerFunc(searchOrderPage))).Methods("GET", "POST")
+	r.Handle("/reports", requireStaff(http.HandlerFunc(viewReports))).Methods("GET")
+	r.Handle("/change-status", requireStaff(http.HandlerFunc(changeStatusPage))).Methods("GET", "POST")
+	r.Handle("/delete-order", requireStaff(http.HandlerFunc(deleteOrderPage))).Methods("GET", "POST")
+	r.Handle("/delete-order/confirm", requireStaff(http.HandlerFunc(confirmDeleteOrder))).Methods("POST")
+	r.Handle("/delete-order/batch", requireStaff(http.HandlerFunc(batchDeletePage))).Methods("POST")
+	r.Handle("/delete-order/batch/confirm", requireStaff(http.HandlerFunc(confirmBatchDelete))).Methods("POST")
+	r.Handle("/delete-order/batch/result", requireStaff(http.HandlerFunc(batchDeleteResult))).Methods("GET")
+	r.Handle("/orders/{orderID}", requireStaff(http.HandlerFunc(orderDetailPage))).Methods("GET")
+	r.HandleFunc("/orders/{orderID}/badge", orderStatusBadge).Methods("GET")
+	r.HandleFunc("/confirmation/{orderID}/{token}", orderConfirmationPage).Methods("GET")
+	r.Handle("/live", requireStaff(http.HandlerFunc(liveBoardPage))).Methods("GET")
+	r.Handle("/live/ws", requireStaff(http.HandlerFunc(liveSocket))).Methods("GET")
+	r.Handle("/events", requireStaff(http.HandlerFunc(eventsStream))).Methods("GET")
+
+	r.HandleFunc("/account/login", customerLoginPage).Methods("GET")
+	r.HandleFunc("/account/login", requestLoginCode).Methods("POST")
+	r.HandleFunc("/account/verify", verifyLoginCode).Methods("POST")
+	r.HandleFunc("/account/login/google", startGoogleLogin).Methods("GET")
+	r.HandleFunc("/account/login/google/callback", googleLoginCallback).Methods("GET")
+	r.HandleFunc("/account/logout", customerLogout).Methods("POST")
+
+	tickets := r.PathPrefix("/account/tickets").Subrouter()
+	tickets.Use(requireFeature("support_tickets"), requireCustomer)
+	tickets.HandleFunc("", customerTicketsPage).Methods("GET")
+	tickets.HandleFunc("", openTicket).Methods("POST")
+	tickets.HandleFunc("/{id:[0-9]+}", customerTicketPage).Methods("GET")
+	tickets.HandleFunc("/{id:[0-9]+}", customerTicketReply).Methods("POST")
+
+	standing := r.PathPrefix("/account/standing-orders").Subrouter()
+	standing.Use(requireFeature("standing_orders"), requireCustomer)
+	standing.HandleFunc("", customerStandingOrdersPage).Methods("GET")
+	standing.HandleFunc("/{id:[0-9]+}/{action:pause|resume|cancel}", customerChangeStandingOrder).Methods("POST")
+
+	notifications := r.PathPrefix("/account/notifications").Subrouter()
+	notifications.Use(requireCustomer)
+	notifications.HandleFunc("", customerNotificationsPage).Methods("GET")
+	notifications.HandleFunc("", saveCustomerNotifications).Methods("POST")
+
+	r.HandleFunc("/account/email/confirm", confirmCustomerEmail).Methods("GET")
+	email := r.PathPrefix("/account/email").Subrouter()
+	email.Use(requireCustomer)
+	email.HandleFunc("", customerEmailPage).Methods("GET")
+	email.HandleFunc("", sendEmailVerification).Methods("POST")
+
+	invoices := r.PathPrefix("/account/invoices").Subrouter()
+	invoices.Use(requireCustomer, requireVerifiedEmail)
+	invoices.HandleFunc("", customerInvoicesPage).Methods("GET")
+	invoices.HandleFunc("/{orderID}", customerInvoice).Methods("GET")
+
+	wishlist := r.PathPrefix("/wishlist").Subrouter()
+	wishlist.Use(requireFeature("wishlist"), requireCustomer)
+	wishlist.HandleFunc("", wishlistPage).Methods("GET")
+	wishlist.HandleFunc("", addToWishlist).Methods("POST")
+	wishlist.HandleFunc("/{id:[0-9]+}/order", orderWishlistItem).Methods("POST")
+	wishlist.HandleFunc("/{id:[0-9]+}", removeWishlistItem).Methods("DELETE")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAllowedNetwork, requireAdmin)
+	admin.HandleFunc("", adminDashboard).Methods("GET")
+	admin.HandleFunc("/tickets", adminTicketsPage).Methods("GET")
+	admin.HandleFunc("/tickets/{id:[0-9]+}", adminTicketPage).Methods("GET")
+	admin.HandleFunc("/tickets/{id:[0-9]+}", adminTicketReply).Methods("POST")
+	admin.HandleFunc("/jobs", jobsPage).Methods("GET")
+	admin.HandleFunc("/jobs/{id:[0-9]+}/retry", retryJob).Methods("POST")
+	admin.HandleFunc("/scheduler", schedulerPage).Methods("GET")
+	admin.HandleFunc("/scheduler/{name}/run", runTaskNow).Methods("POST")
+	admin.HandleFunc("/audit-log", auditLogPage).Methods("GET")
+	admin.HandleFunc("/api-usage", apiUsagePage).Methods("GET")
+	admin.Handle("/metrics", expvar.Handler()).Methods("GET")
+	admin.HandleFunc("/webhooks", webhooksPage).Methods("GET")
+	admin.HandleFunc("/webhooks", addWebhookEndpoint).Methods("POST")
+	admin.HandleFunc("/webhooks/{id:[0-9]+}/rotate", rotateWebhookSecret).Methods("POST")
+	admin.HandleFunc("/webhooks/{id:[0-9]+}/retire", retireWebhookSecret).Methods("POST")
+	admin.HandleFunc("/webhooks/{id:[0-9]+}", deleteWebhookEndpoint).Methods("DELETE")
+	admin.HandleFunc("/read-only", toggleReadOnly).Methods("POST")
+	admin.HandleFunc("/two-factor", twoFactorPage).Methods("GET")
+	admin.HandleFunc("/two-factor", verifyTwoFactor).Methods("POST")
+	admin.HandleFunc("/security", securityPage).Methods("GET")
+	admin.HandleFunc("/security/setup", startTOTPSetup).Methods("POST")
+	admin.HandleFunc("/security/confirm", confirmTOTPSetup).Methods("POST")
+	admin.HandleFunc("/security/backup-codes", regenerateBackupCodes).Methods("POST")
+	admin.HandleFunc("/security/disable", disableTwoFactor).Methods("POST")
+	admin.HandleFunc("/security/password", changeAdminPassword).Methods("POST")
+	admin.HandleFunc("/experiments", experimentsPage).Methods("GET")
+	admin.HandleFunc("/features", featureFlagsPage).Methods("GET")
+	admin.HandleFunc("/features/{name}", toggleFeatureFlag).Methods("POST")
+	admin.HandleFunc("/settings", settingsPage).Methods("GET")
+	admin.HandleFunc("/settings", saveSettings).Methods("POST")
+	admin.HandleFunc("/notifications", notificationTemplatesPage).Methods("GET")
+	admin.HandleFunc("/notifications/{name}", saveNotificationTemplate).Methods("POST")
+	admin.HandleFunc("/import-orders", importOrdersPage).Methods("GET", "POST")
+	admin.HandleFunc("/import-orders/result", importOrdersResult).Methods("GET")
+	admin.HandleFunc("/stores", storesPage).Methods("GET", "POST")
+	admin.HandleFunc("/products", productsPage).Methods("GET")
+	admin.HandleFunc("/products", createProduct).Methods("POST")
+	admin.HandleFunc("/products/{id:[0-9]+}/variants", createVariant).Methods("POST")
+	admin.HandleFunc("/products/{id:[0-9]+}/made-to-measure", setMadeToMeasure).Methods("POST")
+	admin.HandleFunc("/variants/{id:[0-9]+}", updateVariant).Methods("POST")
+	admin.HandleFunc("/orders/{orderID}/comments", orderCommentsPage).Methods("GET")
+	admin.HandleFunc("/orders/{orderID}/comments", addOrderComment).Methods("POST")
+	admin.HandleFunc("/orders/{orderID}/refused", markDeliveryRefused).Methods("POST")
+	admin.HandleFunc("/orders/{orderID}/ship-available", shipAvailableItems).Methods("POST")
+	admin.HandleFunc("/orders/{orderID}/payment-received", confirmPayment).Methods("POST")
+	admin.HandleFunc("/orders/{orderID}/invoice.pdf", orderInvoice).Methods("GET")
+	admin.HandleFunc("/orders/{orderID}/export.json", exportOrder).Methods("GET")
+	admin.HandleFunc("/orders/{orderID}/packing-slip", orderPackingSlip).Methods("GET")
+	admin.HandleFunc("/orders/{orderID}/production-slip", productionSlip).Methods("GET")
+	admin.HandleFunc("/production", productionBoard).Methods("GET")
+	admin.HandleFunc("/production/{orderID}/assign", assignProductionStage).Methods("POST")
+	admin.HandleFunc("/production/{orderID}/advance", advanceProduction).Methods("POST")
+	admin.HandleFunc("/margins", marginReport).Methods("GET")
+	admin.HandleFunc("/price-history", priceHistory).Methods("GET")
+	admin.HandleFunc("/pricing", pricingPage).Methods("GET")
+	admin.HandleFunc("/pricing", savePricingRule).Methods("POST")
+	admin.HandleFunc("/pricing/preview", pricingPreview).Methods("GET")
+	admin.HandleFunc("/pricing/{id:[0-9]+}", deletePricingRule).Methods("DELETE")
+	admin.HandleFunc("/materials", materialsPage).Methods("GET")
+	admin.HandleFunc("/materials", createMaterial).Methods("POST")
+	admin.HandleFunc("/materials/{id:[0-9]+}/stock", adjustMaterial).Methods("POST")
+	admin.HandleFunc("/products/{id:[0-9]+}/materials", setMaterialLine).Methods("POST")
+	admin.HandleFunc("/orders/{orderID}/label.pdf", orderShippingLabel).Methods("GET")
+	admin.HandleFunc("/orders/{orderID}/returns", approveReturn).Methods("POST")
+	admin.HandleFunc("/returns", returnsPage).Methods("GET")
+	admin.HandleFunc("/returns/{id:[0-9]+}/status", advanceReturn).Methods("POST")
+	admin.HandleFunc("/returns/{id:[0-9]+}/label.pdf", returnLabel).Methods("GET")
+	admin.HandleFunc("/orders/{orderID}/split", splitOrderPage).Methods("GET")
+	admin.HandleFunc("/orders/{orderID}/split", splitOrderHandler).Methods("POST")
+	admin.HandleFunc("/merge-orders", mergeOrdersPage).Methods("GET")
+	admin.HandleFunc("/merge-orders", mergeOrdersHandler).Methods("POST")
+	admin.HandleFunc("/standing-orders", standingOrdersPage).Methods("GET")
+	admin.HandleFunc("/standing-orders", createStandingOrder).Methods("POST")
+	admin.HandleFunc("/standing-orders/{id:[0-9]+}/{action:pause|resume|cancel}", adminChangeStandingOrder).Methods("POST")
+	admin.HandleFunc("/wishlist", wishlistReport).Methods("GET")
+	admin.HandleFunc("/abandoned-orders", abandonedOrdersPage).Methods("GET")
+	admin.HandleFunc("/deliveries", deliveriesPage).Methods("GET")
+	admin.HandleFunc("/deliveries/packing-slips", deliveryPackingSlips).Methods("GET")
+	admin.HandleFunc("/shipping-labels.pdf", shippingLabels).Methods("GET")
+	admin.HandleFunc("/delivery-slots", saveDeliverySlot).Methods("POST")
+	admin.HandleFunc("/shipping", shippingPage).Methods("GET")
+	admin.HandleFunc("/shipping/zones", saveShippingZone).Methods("POST")
+	admin.HandleFunc("/shipping/rules", saveShippingRule).Methods("POST")
+	admin.HandleFunc("/shipping/rules/{id:[0-9]+}", deleteShippingRule).Methods("DELETE")
+	admin.HandleFunc("/gift-cards", giftCardsPage).Methods("GET")
+	admin.HandleFunc("/gift-cards", issueGiftCard).Methods("POST")
+	admin.HandleFunc("/store-credit", refundToStoreCredit).Methods("POST")
+	admin.HandleFunc("/payment-exceptions", paymentExceptionsPage).Methods("GET")
+	admin.HandleFunc("/order-reviews", orderReviewsPage).Methods("GET")
+	admin.HandleFunc("/order-reviews/{id:[0-9]+}/{decision:approve|reject}", decideOrderReview).Methods("POST")
+	admin.HandleFunc("/blocklist", blocklistPage).Methods("GET")
+	admin.HandleFunc("/blocklist", addBlockedIdentity).Methods("POST")
+	admin.HandleFunc("/blocklist/{id:[0-9]+}", removeBlockedIdentity).Methods("DELETE")
+	admin.HandleFunc("/accounting", accountingPage).Methods("GET")
+	admin.HandleFunc("/accounting/export", accountingExport).Methods("GET")
+	admin.HandleFunc("/ledger", ledgerPage).Methods("GET")
+	admin.HandleFunc("/shift-report", shiftReportPage).Methods("GET")
+	admin.HandleFunc("/pos", posPage).Methods("GET")
+	admin.HandleFunc("/pos", posSale).Methods("POST")
+	admin.HandleFunc("/pos/{orderID}/receipt", posReceipt).Methods("GET")
+	admin.HandleFunc("/cash-up", cashUpPage).Methods("GET")
+	admin.HandleFunc("/cash-up", closeDay).Methods("POST")
+	admin.HandleFunc("/cash-up/{day}/report", dayClosingReport).Methods("GET")
+	admin.HandleFunc("/payment-exceptions/settlements", uploadSettlements).Methods("POST")
+	admin.HandleFunc("/payment-exceptions/{id:[0-9]+}/resolve", resolvePaymentException).Methods("POST")
+	admin.HandleFunc("/size-charts", sizeChartsPage).Methods("GET")
+	admin.HandleFunc("/size-charts", updateSizeChart).Methods("POST")
+	admin.HandleFunc("/categories", categoriesPage).Methods("GET")
+	admin.HandleFunc("/categories", createCategory).Methods("POST")
+	admin.HandleFunc("/categories/{id:[0-9]+}", editCategoryPage).Methods("GET")
+	admin.HandleFunc("/categories/{id:[0-9]+}", updateCategory).Methods("PUT")
+	admin.HandleFunc("/categories/{id:[0-9]+}", deleteCategory).Methods("DELETE")
+	admin.HandleFunc("/inventory", inventoryPage).Methods("GET")
+	admin.HandleFunc("/inventory/adjust", adjustStock).Methods("POST")
+	admin.HandleFunc("/inventory/transfer", transferStock).Methods("POST")
+	admin.HandleFunc("/reorder", reorderPage).Methods("GET")
+	admin.HandleFunc("/reorder/draft", createDraftPurchaseOrder).Methods("POST")
+	admin.HandleFunc("/purchase-orders/{id:[0-9]+}/discard", discardPurchaseOrder).Methods("POST")
+
+	mountAPI(r)
 
 	fmt.Println("Server running at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	log.Fatal(http.ListenAndServe(":8080", withRequestID(withMethodOverride(r))))
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Each variant has a cost price, copied onto order items when they are
+// ordered so later cost changes leave past margins alone. The margin report
+// sets the cost of the goods sold against what they sold for, per period,
+// per size and per order. Shipping and the rush and gift wrap fees are left
+// out: the margin is on the goods.
+
+type MarginRow struct {
+	Label   string `json:"label"`
+	Orders  int    `json:"orders"`
+	Units   int    `json:"units"`
+	Revenue Money  `json:"revenue"`
+	Cost    Money  `json:"cost"`
+}
+
+func (m MarginRow) Margin() Money {
+	return m.Revenue - m.Cost
+}
+
+// MarginPercent is the gross margin as a percentage of revenue.
+func (m MarginRow) MarginPercent() float64 {
+	if m.Revenue == 0 {
+		return 0
+	}
+	return float64(m.Revenue-m.Cost) / float64(m.Revenue) * 100
+}
+
+var marginPeriods = map[string]string{
+	"day":   "%Y-%m-%d",
+	"week":  "%x-W%v",
+	"month": "%Y-%m",
+}
+
+// Orders that fell through or were folded into another don't count.
+const marginOrders = "o.store_id = ? AND o.created_at >= ? AND o.created_at < ? AND o.status NOT IN ('CANCELLED', 'REFUSED', 'MERGED') AND o.deleted_at IS NULL"
+
+func marginRows(groupBy, orderBy string, args ...interface{}) ([]MarginRow, error) {
+	rows, err := reportDB().Query(`SELECT `+groupBy+`, COUNT(DISTINCT o.order_id), SUM(i.quantity), SUM(i.unit_price * i.quantity), SUM(i.unit_cost * i.quantity)
+		FROM orders o JOIN order_items i ON i.order_id = o.order_id WHERE `+marginOrders+` GROUP BY 1 ORDER BY `+orderBy, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []MarginRow
+	for rows.Next() {
+		var m MarginRow
+		if err := rows.Scan(&m.Label, &m.Orders, &m.Units, &m.Revenue, &m.Cost); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// marginReport shows the store's gross margin on orders placed between
+// ?from= and ?to= (both inclusive, the last 30 days by default), by ?period=
+// day, week or month.
+func marginReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	q := r.URL.Query()
+	to, err := time.ParseInLocation("2006-01-02", q.Get("to"), time.Local)
+	if err != nil {
+		to = time.Now()
+	}
+	to = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.Local)
+	from, err := time.ParseInLocation("2006-01-02", q.Get("from"), time.Local)
+	if err != nil || from.After(to) {
+		from = to.AddDate(0, 0, -29)
+	}
+	period := q.Get("period")
+	if _, ok := marginPeriods[period]; !ok {
+		period = "day"
+	}
+	args := []interface{}{currentStoreID(r), from, to.AddDate(0, 0, 1)}
+
+	periods, err := marginRows("DATE_FORMAT(o.created_at, '"+marginPeriods[period]+"')", "1", args...)
+	var bySize, byOrder []MarginRow
+	if err == nil {
+		bySize, err = marginRows("i.size", "FIELD(i.size, 'XS', 'S', 'M', 'L', 'XL', 'XXL'), 1", args...)
+	}
+	if err == nil {
+		byOrder, err = marginRows("o.order_id", "MAX(o.created_at) DESC LIMIT 200", args...)
+	}
+	var total MarginRow
+	var uncosted int
+	if err == nil {
+		err = reportDB().QueryRow(`SELECT COUNT(DISTINCT o.order_id), COALESCE(SUM(i.quantity), 0), COALESCE(SUM(i.unit_price * i.quantity), 0), COALESCE(SUM(i.unit_cost * i.quantity), 0),
+			COALESCE(SUM(i.unit_cost = 0), 0) FROM orders o JOIN order_items i ON i.order_id = o.order_id WHERE `+marginOrders, args...).
+			Scan(&total.Orders, &total.Units, &total.Revenue, &total.Cost, &uncosted)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "DB error")
+		return
+	}
+	total.Label = "Total"
+
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, struct {
+			From     string      `json:"from"`
+			To       string      `json:"to"`
+			Period   string      `json:"period"`
+			Total    MarginRow   `json:"total"`
+			Uncosted int         `json:"uncosted_lines"`
+			Periods  []MarginRow `json:"periods"`
+			Sizes    []MarginRow `json:"sizes"`
+			Orders   []MarginRow `json:"orders"`
+		}{from.Format("2006-01-02"), to.Format("2006-01-02"), period, total, uncosted,
+			append([]MarginRow{}, periods...), append([]MarginRow{}, bySize...), append([]MarginRow{}, byOrder...)})
+		return
+	}
+	type marginTable struct {
+		Title, Heading string
+		Orders         bool // rows are orders, linked to their page
+		Rows           []MarginRow
+	}
+	t := mustParseTemplates("margins.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		From     string
+		To       string
+		Period   string
+		Total    MarginRow
+		Uncosted int
+		Tables   []marginTable
+	}{storeSwitcher(r), from.Format("2006-01-02"), to.Format("2006-01-02"), period, total, uncosted, []marginTable{
+		{"By " + period, "Period", false, periods},
+		{"By size", "Size", false, bySize},
+		{"By order", "Order", true, byOrder},
+	}})
+}
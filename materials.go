@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Materials are the fabric rolls and consumables the workshop makes
+// made-to-measure orders from. They are stocked per store, apart from the
+// finished goods in stock, and each made-to-measure product has a bill of
+// materials saying how much of which material one item takes. An order
+// uses up its materials when it is cut.
+
+type Material struct {
+	ID       int
+	Name     string
+	Unit     string
+	LowLevel float64
+	InStock  float64
+	Needed   float64 // by the store's orders not cut yet
+}
+
+// Left is what is in stock once the orders waiting to be cut have been.
+func (m Material) Left() float64 {
+	return math.Round((m.InStock-m.Needed)*100) / 100
+}
+
+// Low reports whether m has run down to its reorder level.
+func (m Material) Low() bool {
+	return m.Left() <= m.LowLevel
+}
+
+type MaterialLine struct {
+	MaterialID int
+	Name       string
+	Unit       string
+	Quantity   float64
+}
+
+type MaterialMovement struct {
+	Material  string
+	Unit      string
+	Quantity  float64
+	Reason    string
+	OrderID   string
+	Actor     string
+	CreatedAt time.Time
+}
+
+type BillOfMaterials struct {
+	Product Product
+	Lines   []MaterialLine
+}
+
+var materialUnits = []string{"m", "cm", "pcs", "spools", "kg"}
+
+var errInsufficientMaterial = errors.New("insufficient material")
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// orderMaterials adds up the bills of materials of orderID's made-to-measure
+// items: how much of each material making the order takes.
+func orderMaterials(q querier, orderID string) ([]MaterialLine, error) {
+	rows, err := q.Query(`SELECT m.id, m.name, m.unit, SUM(b.quantity * i.quantity) FROM order_items i
+		JOIN product_variants v ON v.id = i.variant_id JOIN products p ON p.id = v.product_id AND p.made_to_measure
+		JOIN bill_of_materials b ON b.product_id = p.id JOIN materials m ON m.id = b.material_id
+		WHERE i.order_id = ? GROUP BY m.id, m.name, m.unit ORDER BY m.name`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lines []MaterialLine
+	for rows.Next() {
+		var l MaterialLine
+		if err := rows.Scan(&l.MaterialID, &l.Name, &l.Unit, &l.Quantity); err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+// moveMaterial changes the store's stock of a material by qty, negative for
+// material used up, and records the movement.
+func moveMaterial(tx *sql.Tx, r *http.Request, storeID, materialID int, qty float64, reason, orderID string) error {
+	if _, err := tx.Exec("INSERT INTO material_stock (store_id, material_id, quantity) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE quantity = quantity + VALUES(quantity)",
+		storeID, materialID, qty); err != nil {
+		return err
+	}
+	actor := "system"
+	if r != nil {
+		actor = auditActor(r)
+	}
+	_, err := tx.Exec("INSERT INTO material_movements (store_id, material_id, quantity, reason, order_id, actor) VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)",
+		storeID, materialID, qty, reason, orderID, actor)
+	return err
+}
+
+// consumeMaterials takes what cutting orderID uses from its store's
+// materials, failing with errInsufficientMaterial when any is short.
+// Products without a bill of materials use nothing, so the workshop can
+// start tracking materials one product at a time.
+func consumeMaterials(tx *sql.Tx, r *http.Request, orderID string) error {
+	var storeID int
+	if err := tx.QueryRow("SELECT store_id FROM orders WHERE order_id = ?", orderID).Scan(&storeID); err != nil {
+		return err
+	}
+	lines, err := orderMaterials(tx, orderID)
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		var have float64
+		err := tx.QueryRow("SELECT quantity FROM material_stock WHERE store_id = ? AND material_id = ? FOR UPDATE", storeID, l.MaterialID).Scan(&have)
+		if err == sql.ErrNoRows || (err == nil && have < l.Quantity) {
+			return errInsufficientMaterial
+		} else if err != nil {
+			return err
+		}
+		if err := moveMaterial(tx, r, storeID, l.MaterialID, -l.Quantity, "cutting", orderID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeMaterials lists every material with the store's stock of it and what
+// its orders waiting to be cut will take.
+func storeMaterials(storeID int) ([]Material, error) {
+	rows, err := db.Query(`SELECT m.id, m.name, m.unit, m.low_level, COALESCE(s.quantity, 0) FROM materials m
+		LEFT JOIN material_stock s ON s.material_id = m.id AND s.store_id = ? ORDER BY m.name`, storeID)
+	if err != nil {
+		return nil, err
+	}
+	var materials []Material
+	for rows.Next() {
+		var m Material
+		if err := rows.Scan(&m.ID, &m.Name, &m.Unit, &m.LowLevel, &m.InStock); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		materials = append(materials, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	needed, err := db.Query(`SELECT b.material_id, SUM(b.quantity * i.quantity) FROM orders o
+		JOIN order_items i ON i.order_id = o.order_id JOIN product_variants v ON v.id = i.variant_id
+		JOIN products p ON p.id = v.product_id AND p.made_to_measure JOIN bill_of_materials b ON b.product_id = p.id
+		WHERE o.store_id = ? AND o.status = 'PROCESSING' GROUP BY b.material_id`, storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer needed.Close()
+	for needed.Next() {
+		var id int
+		var qty float64
+		if err := needed.Scan(&id, &qty); err != nil {
+			return nil, err
+		}
+		for i := range materials {
+			if materials[i].ID == id {
+				materials[i].Needed = qty
+			}
+		}
+	}
+	return materials, needed.Err()
+}
+
+func billsOfMaterials() ([]BillOfMaterials, error) {
+	rows, err := db.Query("SELECT id, name, product_type, active, made_to_measure FROM products WHERE made_to_measure ORDER BY name, id")
+	if err != nil {
+		return nil, err
+	}
+	var boms []BillOfMaterials
+	for rows.Next() {
+		var b BillOfMaterials
+		if err := rows.Scan(&b.Product.ID, &b.Product.Name, &b.Product.ProductType, &b.Product.Active, &b.Product.MadeToMeasure); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		boms = append(boms, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	lines, err := db.Query(`SELECT b.product_id, m.id, m.name, m.unit, b.quantity FROM bill_of_materials b
+		JOIN materials m ON m.id = b.material_id ORDER BY m.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer lines.Close()
+	for lines.Next() {
+		var productID int
+		var l MaterialLine
+		if err := lines.Scan(&productID, &l.MaterialID, &l.Name, &l.Unit, &l.Quantity); err != nil {
+			return nil, err
+		}
+		for i := range boms {
+			if boms[i].Product.ID == productID {
+				boms[i].Lines = append(boms[i].Lines, l)
+			}
+		}
+	}
+	return boms, lines.Err()
+}
+
+// materialsPage lists the store's materials and the bills of materials;
+// with ?low=1 it is the low-material report, only the materials that are
+// at or below their reorder level once the orders waiting to be cut are.
+func materialsPage(w http.ResponseWriter, r *http.Request) {
+	storeID := currentStoreID(r)
+	materials, err := storeMaterials(storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	all := materials
+	lowOnly := r.URL.Query().Get("low") == "1"
+	if lowOnly {
+		var low []Material
+		for _, m := range materials {
+			if m.Low() {
+				low = append(low, m)
+			}
+		}
+		materials = low
+	}
+	boms, err := billsOfMaterials()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`SELECT m.name, m.unit, mm.quantity, mm.reason, COALESCE(mm.order_id, ''), mm.actor, mm.created_at
+		FROM material_movements mm JOIN materials m ON m.id = mm.material_id WHERE mm.store_id = ? ORDER BY mm.id DESC LIMIT 50`, storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var movements []MaterialMovement
+	for rows.Next() {
+		var mv MaterialMovement
+		_ = rows.Scan(&mv.Material, &mv.Unit, &mv.Quantity, &mv.Reason, &mv.OrderID, &mv.Actor, &mv.CreatedAt)
+		movements = append(movements, mv)
+	}
+
+	t := mustParseTemplates("materials.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		Materials    []Material
+		AllMaterials []Material
+		LowOnly      bool
+		Units        []string
+		Boms         []BillOfMaterials
+		Movements    []MaterialMovement
+		Flashes      []Flash
+	}{storeSwitcher(r), materials, all, lowOnly, materialUnits, boms, movements, popFlashes(r)})
+}
+
+func validMaterialUnit(unit string) bool {
+	for _, u := range materialUnits {
+		if u == unit {
+			return true
+		}
+	}
+	return false
+}
+
+func createMaterial(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	unit := r.FormValue("unit")
+	low, err := strconv.ParseFloat(r.FormValue("low_level"), 64)
+	if r.FormValue("low_level") == "" {
+		low, err = 0, nil
+	}
+	if name == "" || len(name) > 100 || !validMaterialUnit(unit) || err != nil || low < 0 {
+		redirectWithFlash(w, r, "/admin/materials", "error", "A material needs a name, a unit and a reorder level of zero or more.")
+		return
+	}
+	res, err := db.Exec("INSERT IGNORE INTO materials (name, unit, low_level) VALUES (?, ?, ?)", name, unit, low)
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		redirectWithFlash(w, r, "/admin/materials", "error", "A material called "+name+" already exists.")
+		return
+	}
+	id, _ := res.LastInsertId()
+	_ = recordAudit(db, r, "material.create", strconv.FormatInt(id, 10), name+" ("+unit+")")
+	redirectWithFlash(w, r, "/admin/materials", "success", "Material "+name+" added.")
+}
+
+// adjustMaterial sets the store's count of a material, after a stocktake or
+// a delivery from the supplier, and its reorder level.
+func adjustMaterial(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid material ID", http.StatusBadRequest)
+		return
+	}
+	count, cerr := strconv.ParseFloat(r.FormValue("quantity"), 64)
+	low, lerr := strconv.ParseFloat(r.FormValue("low_level"), 64)
+	if cerr != nil || lerr != nil || count < 0 || low < 0 {
+		redirectWithFlash(w, r, "/admin/materials", "error", "Enter a stock count and a reorder level of zero or more.")
+		return
+	}
+	count = math.Round(count*100) / 100
+	storeID := currentStoreID(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var name string
+	err = tx.QueryRow("SELECT name FROM materials WHERE id = ?", id).Scan(&name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Material not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var have float64
+	err = tx.QueryRow("SELECT quantity FROM material_stock WHERE store_id = ? AND material_id = ? FOR UPDATE", storeID, id).Scan(&have)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	err = nil
+	if count != have {
+		err = moveMaterial(tx, r, storeID, id, count-have, "adjustment", "")
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE materials SET low_level = ? WHERE id = ?", low, id)
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "material.adjust", strconv.Itoa(id), fmt.Sprintf("%s: %g -> %g, reorder at %g", name, have, count, low))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/materials", "success", fmt.Sprintf("Stock of %s set to %g.", name, count))
+}
+
+// setMaterialLine sets how much of a material one item of a product takes;
+// a quantity of zero takes the material off its bill of materials.
+func setMaterialLine(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+	materialID, merr := strconv.Atoi(r.FormValue("material_id"))
+	qty, qerr := strconv.ParseFloat(r.FormValue("quantity"), 64)
+	if merr != nil || qerr != nil || qty < 0 {
+		redirectWithFlash(w, r, "/admin/materials", "error", "Pick a material and the quantity one item takes.")
+		return
+	}
+	var product, material string
+	err = db.QueryRow("SELECT p.name, m.name FROM products p JOIN materials m ON m.id = ? WHERE p.id = ? AND p.made_to_measure", materialID, productID).Scan(&product, &material)
+	if err == sql.ErrNoRows {
+		redirectWithFlash(w, r, "/admin/materials", "error", "Bills of materials are for made-to-measure products.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if qty == 0 {
+		_, err = db.Exec("DELETE FROM bill_of_materials WHERE product_id = ? AND material_id = ?", productID, materialID)
+	} else {
+		_, err = db.Exec("INSERT INTO bill_of_materials (product_id, material_id, quantity) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE quantity = VALUES(quantity)",
+			productID, materialID, qty)
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "product.materials", strconv.Itoa(productID), fmt.Sprintf("%s: %g %s", product, qty, material))
+	if qty == 0 {
+		redirectWithFlash(w, r, "/admin/materials", "success", material+" taken off "+product+".")
+		return
+	}
+	redirectWithFlash(w, r, "/admin/materials", "success", fmt.Sprintf("One %s now takes %g of %s.", product, qty, material))
+}
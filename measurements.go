@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Made-to-measure products are cut to the customer's own measurements,
+// taken on the order form in centimetres and kept with the order in
+// order_measurements. The production slip prints them for the tailor.
+
+type MeasurementField struct {
+	Name     string
+	Label    string
+	Min, Max float64
+}
+
+// measurementFields are the measurements taken, in the order the tailor
+// reads them, with the range a plausible adult measurement falls in.
+var measurementFields = []MeasurementField{
+	{Name: "bust", Label: "Bust", Min: 60, Max: 160},
+	{Name: "waist", Label: "Waist", Min: 50, Max: 150},
+	{Name: "hips", Label: "Hips", Min: 60, Max: 170},
+	{Name: "shoulder", Label: "Shoulder width", Min: 30, Max: 60},
+	{Name: "sleeve", Label: "Sleeve length", Min: 20, Max: 80},
+	{Name: "length", Label: "Garment length", Min: 40, Max: 160},
+}
+
+type Measurement struct {
+	Name  string  `json:"name"`
+	Label string  `json:"label"`
+	CM    float64 `json:"cm"`
+}
+
+// parseMeasurements reads every measurement field from the form (m_<name>),
+// all of which are required.
+func parseMeasurements(r *http.Request) ([]Measurement, error) {
+	var ms []Measurement
+	for _, f := range measurementFields {
+		cm, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("m_"+f.Name)), 64)
+		if err != nil || cm < f.Min || cm > f.Max {
+			return nil, fmt.Errorf("%s must be between %g and %g cm", f.Label, f.Min, f.Max)
+		}
+		ms = append(ms, Measurement{Name: f.Name, Label: f.Label, CM: math.Round(cm*10) / 10})
+	}
+	return ms, nil
+}
+
+func saveMeasurements(tx *sql.Tx, orderID string, ms []Measurement) error {
+	for _, m := range ms {
+		if _, err := tx.Exec("INSERT INTO order_measurements (order_id, name, cm) VALUES (?, ?, ?)", orderID, m.Name, m.CM); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderMeasurements returns the measurements taken for orderID, none when
+// nothing on it is made to measure.
+func orderMeasurements(orderID string) ([]Measurement, error) {
+	rows, err := db.Query("SELECT name, cm FROM order_measurements WHERE order_id = ?", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	taken := map[string]float64{}
+	for rows.Next() {
+		var name string
+		var cm float64
+		if err := rows.Scan(&name, &cm); err != nil {
+			return nil, err
+		}
+		taken[name] = cm
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var ms []Measurement
+	for _, f := range measurementFields {
+		if cm, ok := taken[f.Name]; ok {
+			ms = append(ms, Measurement{Name: f.Name, Label: f.Label, CM: cm})
+		}
+	}
+	return ms, nil
+}
+
+// productionSlip is the tailor's copy of a made-to-measure order: what to
+// make and the measurements to make it to.
+func productionSlip(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	o, err := storeOrder(currentStoreID(r), orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	measurements, err := orderMeasurements(orderID)
+	if err == nil {
+		o.Items, err = orderItems(orderID)
+	}
+	var materials []MaterialLine
+	if err == nil {
+		materials, err = orderMaterials(db, orderID)
+	}
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("production_slip.html")
+	_ = t.Execute(w, struct {
+		Order
+		Measurements []Measurement
+		Materials    []MaterialLine
+		Back         string
+	}{o, measurements, materials, "/orders/" + url.PathEscape(orderID)})
+}
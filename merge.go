@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A customer who orders twice on one day can have both orders delivered
+// together. Staff merge them into the earliest order, which takes the
+// others' items and totals and gets a tracking code; the others are left
+// MERGED, pointing at it.
+
+// OrderMerge is the data of an OrderEventMerged event, recorded on the order
+// that absorbed another.
+type OrderMerge struct {
+	SourceOrderID string      `json:"source_order_id"`
+	Items         []OrderItem `json:"items"`
+	Quantity      int         `json:"quantity"`
+	TotalAmount   Money       `json:"total_amount"`
+	ShippingFee   Money       `json:"shipping_fee,omitempty"`
+	RushFee       Money       `json:"rush_fee,omitempty"`
+	Priority      bool        `json:"priority,omitempty"`
+	GiftWrapFee   Money       `json:"gift_wrap_fee,omitempty"`
+	GiftMessage   string      `json:"gift_message,omitempty"`
+	GiftWrap      bool        `json:"gift_wrap,omitempty"`
+	TrackingCode  string      `json:"tracking_code"`
+}
+
+// OrderMergedInto is the data of an OrderEventMergedInto event, recorded on
+// the order that was absorbed.
+type OrderMergedInto struct {
+	TargetOrderID string `json:"target_order_id"`
+}
+
+// MergeGroup is one customer's mergeable orders from one day.
+type MergeGroup struct {
+	CustomerID string
+	Day        string
+	Orders     []Order
+}
+
+var errNotMergeable = errors.New("orders cannot be merged")
+
+func (m OrderMerge) apply(o *Order) {
+	o.Items = append(o.Items, m.Items...)
+	o.Quantity += m.Quantity
+	o.TotalAmount = o.TotalAmount + m.TotalAmount
+	o.ShippingFee = o.ShippingFee + m.ShippingFee
+	o.RushFee = o.RushFee + m.RushFee
+	o.Priority = o.Priority || m.Priority
+	o.GiftWrapFee = o.GiftWrapFee + m.GiftWrapFee
+	o.GiftWrap = o.GiftWrap || m.GiftWrap
+	if o.GiftMessage == "" {
+		o.GiftMessage = m.GiftMessage
+	}
+	o.TrackingCode = m.TrackingCode
+}
+
+// mergeOrders folds orders into the first of them inside tx. They must
+// belong to one customer, have been placed on the same day and still be
+// PROCESSING.
+func mergeOrders(tx *sql.Tx, orders []Order) (Order, error) {
+	if len(orders) < 2 {
+		return Order{}, errNotMergeable
+	}
+	target := orders[0]
+	for _, o := range orders {
+		if o.CustomerID != target.CustomerID || formatDate(o.CreatedAt) != formatDate(target.CreatedAt) || o.Status != "PROCESSING" {
+			return Order{}, errNotMergeable
+		}
+	}
+	if target.TrackingCode == "" {
+		target.TrackingCode = newGiftCardCode("TRK")
+	}
+	for _, src := range orders[1:] {
+		lines, err := orderLines(tx, src.OrderID)
+		if err != nil {
+			return Order{}, err
+		}
+		for i := range lines {
+			lines[i].ID = 0
+		}
+		m := OrderMerge{
+			SourceOrderID: src.OrderID, Items: lines, Quantity: src.Quantity, TotalAmount: src.TotalAmount,
+			ShippingFee: src.ShippingFee, RushFee: src.RushFee, Priority: src.Priority, TrackingCode: target.TrackingCode,
+			GiftWrap: src.GiftWrap, GiftWrapFee: src.GiftWrapFee, GiftMessage: src.GiftMessage,
+		}
+		if _, err := tx.Exec("UPDATE order_items SET order_id = ? WHERE order_id = ?", target.OrderID, src.OrderID); err != nil {
+			return Order{}, err
+		}
+		_, err = tx.Exec("UPDATE orders SET status = 'MERGED', merged_into = ?, delivery_date = NULL, delivery_slot_id = NULL WHERE order_id = ?",
+			target.OrderID, src.OrderID)
+		if err != nil {
+			return Order{}, err
+		}
+		if err := recordOrderEvent(tx, src.OrderID, OrderEventMergedInto, OrderMergedInto{TargetOrderID: target.OrderID}); err != nil {
+			return Order{}, err
+		}
+		m.apply(&target)
+		if err := recordOrderEvent(tx, target.OrderID, OrderEventMerged, m); err != nil {
+			return Order{}, err
+		}
+	}
+	_, err := tx.Exec(`UPDATE orders SET quantity = ?, total_amount = ?, shipping_fee = ?, rush_fee = ?, priority = ?, tracking_code = ?,
+		gift_wrap = ?, gift_wrap_fee = ?, gift_message = ? WHERE order_id = ?`,
+		target.Quantity, target.TotalAmount, target.ShippingFee, target.RushFee, target.Priority, target.TrackingCode,
+		target.GiftWrap, target.GiftWrapFee, target.GiftMessage, target.OrderID)
+	return target, err
+}
+
+// mergeOrdersPage lists customers with more than one PROCESSING order from
+// the same day in the last week.
+func mergeOrdersPage(w http.ResponseWriter, r *http.Request) {
+	storeID := currentStoreID(r)
+	rows, err := db.Query(`SELECT `+orderColumns+` FROM orders
+		WHERE store_id = ? AND status = 'PROCESSING' AND deleted_at IS NULL AND created_at >= CURDATE() - INTERVAL 7 DAY
+			AND (customer_id, DATE(created_at)) IN (SELECT customer_id, DATE(created_at) FROM orders
+				WHERE store_id = ? AND status = 'PROCESSING' AND deleted_at IS NULL GROUP BY customer_id, DATE(created_at) HAVING COUNT(*) > 1)
+		ORDER BY DATE(created_at) DESC, customer_id, id`, storeID, storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var groups []MergeGroup
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		day := formatDate(o.CreatedAt)
+		if n := len(groups); n > 0 && groups[n-1].CustomerID == o.CustomerID && groups[n-1].Day == day {
+			groups[n-1].Orders = append(groups[n-1].Orders, o)
+			continue
+		}
+		groups = append(groups, MergeGroup{CustomerID: o.CustomerID, Day: day, Orders: []Order{o}})
+	}
+	t := mustParseTemplates("merge_orders.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		Groups  []MergeGroup
+		Flashes []Flash
+	}{storeSwitcher(r), groups, popFlashes(r)})
+}
+
+func mergeOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	ids := r.Form["order_id"]
+	if len(ids) < 2 {
+		redirectWithFlash(w, r, "/admin/merge-orders", "error", "Choose at least two orders to merge.")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	args := []interface{}{currentStoreID(r)}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := tx.Query("SELECT "+orderColumns+" FROM orders WHERE store_id = ? AND deleted_at IS NULL AND order_id IN (?"+strings.Repeat(", ?", len(ids)-1)+") ORDER BY id FOR UPDATE", args...)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			rows.Close()
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+	if len(orders) != len(ids) {
+		redirectWithFlash(w, r, "/admin/merge-orders", "error", "Some of those orders were not found.")
+		return
+	}
+
+	target, err := mergeOrders(tx, orders)
+	if err == errNotMergeable {
+		redirectWithFlash(w, r, "/admin/merge-orders", "error", "Only PROCESSING orders from the same customer and day can be merged.")
+		return
+	}
+	var merged []string
+	for _, o := range orders[1:] {
+		merged = append(merged, o.OrderID)
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "order.merge", target.OrderID, fmt.Sprintf("merged %s, tracking %s, total %.2f", strings.Join(merged, ", "), target.TrackingCode, target.TotalAmount))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	for _, o := range orders[1:] {
+		old := o.Status
+		o.Status, o.MergedInto = "MERGED", target.OrderID
+		emitOrderEvent(OrderEvent{Type: EventOrderStatusChanged, OrderID: o.OrderID, Order: &o, OldStatus: old})
+	}
+	redirectWithFlash(w, r, "/admin/merge-orders", "success",
+		fmt.Sprintf("Merged %s into %s. Tracking code %s, total %s.", strings.Join(merged, ", "), target.OrderID, target.TrackingCode, money(target.TotalAmount)))
+}
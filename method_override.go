@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTML forms can only GET and POST, so a POST can stand in for PUT, PATCH
+// or DELETE by naming the method in a hidden _method field, or in the
+// X-HTTP-Method-Override header for clients stuck behind proxies that
+// drop other verbs. Routes are then declared with their real methods.
+//
+// Any site can post a form here and the browser sends the staff's basic
+// auth along, so _method only counts on forms from this site. The header
+// can't be set cross-site without a CORS preflight, which cors.go answers.
+
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// withMethodOverride has to wrap the router: mux picks the route before
+// any of its own middleware runs.
+func withMethodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			method := r.Header.Get("X-HTTP-Method-Override")
+			if method == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+				_ = r.ParseForm()
+				if sameOrigin(r) {
+					method = r.PostForm.Get("_method")
+				}
+			}
+			if method = strings.ToUpper(method); overridableMethods[method] {
+				r.Method = method
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether r came from a page of this site, going by
+// Sec-Fetch-Site or, from browsers too old to send it, Origin. Requests
+// with neither weren't made by a browser on another site's behalf.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && u.Host == r.Host
+	}
+	return true
+}
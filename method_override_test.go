@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithMethodOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		headers map[string]string
+		want    string
+	}{
+		{"same origin", "_method=DELETE", map[string]string{"Sec-Fetch-Site": "same-origin"}, http.MethodDelete},
+		{"same origin by Origin", "_method=put", map[string]string{"Origin": "http://shop.example"}, http.MethodPut},
+		{"no browser headers", "_method=PATCH", nil, http.MethodPatch},
+		{"cross site", "_method=DELETE", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.MethodPost},
+		{"same site other origin", "_method=DELETE", map[string]string{"Sec-Fetch-Site": "same-site"}, http.MethodPost},
+		{"cross origin by Origin", "_method=DELETE", map[string]string{"Origin": "http://evil.example"}, http.MethodPost},
+		{"null origin", "_method=DELETE", map[string]string{"Origin": "null"}, http.MethodPost},
+		{"header", "", map[string]string{"X-HTTP-Method-Override": "DELETE"}, http.MethodDelete},
+		{"not overridable", "_method=GET", nil, http.MethodPost},
+	}
+	for _, tt := range tests {
+		var got string
+		h := withMethodOverride(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r.Method }))
+		r := httptest.NewRequest(http.MethodPost, "http://shop.example/admin/blocklist/1", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != tt.want {
+			t.Errorf("%s: method = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in cents. Amounts are DECIMAL(10,2) in the database
+// and stay whole cents in between, so totals, tax and reports add up to the
+// cent instead of drifting the way sums of float64s do. It prints with
+// %.2f, %v and %s as the decimal amount, so templates can keep using
+// printf "%.2f"; the money template func adds the currency.
+type Money int64
+
+var errBadAmount = errors.New("not an amount")
+
+// moneyFromFloat rounds f to the nearest cent. It is for amounts that come
+// from float arithmetic, like percentages; parseMoney reads typed ones.
+func moneyFromFloat(f float64) Money {
+	return Money(math.Round(f * 100))
+}
+
+// parseMoney reads a decimal amount like "1800", "-12.5" or "0.05" exactly,
+// rounding to the cent when it has more decimals.
+func parseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, errBadAmount
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || strings.ContainsAny(whole, "+-") {
+		return 0, errBadAmount
+	}
+	frac += "000"
+	cents, err := strconv.ParseInt(frac[:2], 10, 64)
+	if err != nil || strings.Trim(frac, "0123456789") != "" {
+		return 0, errBadAmount
+	}
+	m := Money(units*100 + cents)
+	if frac[2] >= '5' {
+		m++
+	}
+	if neg {
+		m = -m
+	}
+	return m, nil
+}
+
+func (m Money) Float() float64 {
+	return float64(m) / 100
+}
+
+// Times is m for qty items.
+func (m Money) Times(qty int) Money {
+	return m * Money(qty)
+}
+
+// Percent is pct per cent of m, rounded to the cent.
+func (m Money) Percent(pct float64) Money {
+	return Money(math.Round(float64(m) * pct / 100))
+}
+
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, int64(m/100), int64(m%100))
+}
+
+// Format prints m as a decimal amount whatever the verb; a precision other
+// than 2 and the + and - flags and width are honoured.
+func (m Money) Format(f fmt.State, verb rune) {
+	s := m.String()
+	if p, ok := f.Precision(); ok && p != 2 {
+		s = strconv.FormatFloat(m.Float(), 'f', p, 64)
+	}
+	if f.Flag('+') && m >= 0 {
+		s = "+" + s
+	}
+	if w, ok := f.Width(); ok && len(s) < w {
+		pad := strings.Repeat(" ", w-len(s))
+		if f.Flag('-') {
+			s += pad
+		} else {
+			s = pad + s
+		}
+	}
+	_, _ = io.WriteString(f, s)
+}
+
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan reads DECIMAL columns, which the driver hands over as text, exactly.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+	case []byte:
+		return m.Scan(string(v))
+	case string:
+		parsed, err := parseMoney(v)
+		if err != nil {
+			return fmt.Errorf("scanning %q as money: %w", v, err)
+		}
+		*m = parsed
+	case int64:
+		*m = Money(v * 100)
+	case float64:
+		*m = moneyFromFloat(v)
+	default:
+		return fmt.Errorf("scanning %T as money", src)
+	}
+	return nil
+}
+
+// Amounts are plain JSON numbers, as they were as float64s.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	parsed, err := parseMoney(strings.Trim(string(b), `"`))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
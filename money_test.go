@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+		ok   bool
+	}{
+		{"1800", 180000, true},
+		{"1800.00", 180000, true},
+		{" 49.9 ", 4990, true},
+		{"-12.5", -1250, true},
+		{"+5", 500, true},
+		{"0.05", 5, true},
+		{".5", 50, true},
+		{"7.", 700, true},
+		{"12.344", 1234, true},
+		{"12.345", 1235, true},
+		{"-0.125", -13, true},
+		{"", 0, false},
+		{".", 0, false},
+		{"abc", 0, false},
+		{"1,000", 0, false},
+		{"--5", 0, false},
+		{"1.2.3", 0, false},
+		{"1.-5", 0, false},
+		{"1e3", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseMoney(%q) error = %v, want ok %t", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("parseMoney(%q) = %d cents, want %d", tt.in, int64(got), int64(tt.want))
+		}
+	}
+}
+
+func TestMoneyFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		m      Money
+		want   string
+	}{
+		{"%v", 123456, "1234.56"},
+		{"%s", 5, "0.05"},
+		{"%.2f", 123456, "1234.56"},
+		{"%.2f", -150, "-1.50"},
+		{"%.0f", 123456, "1235"},
+		{"%.1f", 1999, "20.0"},
+		{"%+.2f", 5, "+0.05"},
+		{"%+.2f", -5, "-0.05"},
+		{"%8.2f", -150, "   -1.50"},
+		{"%-8v|", 150, "1.50    |"},
+		{"%3v", 123456, "1234.56"},
+		{"%d", 700, "7.00"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprintf(tt.format, tt.m); got != tt.want {
+			t.Errorf("Sprintf(%q, %d cents) = %q, want %q", tt.format, int64(tt.m), got, tt.want)
+		}
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want Money
+		ok   bool
+	}{
+		{nil, 0, true},
+		{[]byte("12.50"), 1250, true},
+		{"7", 700, true},
+		{"-0.01", -1, true},
+		{int64(3), 300, true},
+		{float64(2.5), 250, true},
+		{"x", 0, false},
+		{[]byte(""), 0, false},
+		{true, 0, false},
+	}
+	for _, tt := range tests {
+		m := Money(99)
+		err := m.Scan(tt.src)
+		if (err == nil) != tt.ok {
+			t.Errorf("Scan(%#v) error = %v, want ok %t", tt.src, err, tt.ok)
+			continue
+		}
+		if tt.ok && m != tt.want {
+			t.Errorf("Scan(%#v) = %d cents, want %d", tt.src, int64(m), int64(tt.want))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+)
+
+// Customers choose how we reach them (SMS, email, WhatsApp) and which
+// messages they want. Every customer message goes out through
+// notifyCustomer, so the choice holds everywhere. Until they choose, they
+// hear from us on the contact they order with.
+const (
+	NotifySMS      = "sms"
+	NotifyEmail    = "email"
+	NotifyWhatsApp = "whatsapp"
+)
+
+type NotificationPreferences struct {
+	CustomerID   string
+	SMS          bool
+	Email        bool
+	WhatsApp     bool
+	EmailAddress string // for customers who order with a phone number
+	Muted        map[string]bool
+}
+
+// Phone is the number texts and WhatsApp messages go to, or "".
+func (p NotificationPreferences) Phone() string {
+	if p.CustomerID == "" || strings.Contains(p.CustomerID, "@") {
+		return ""
+	}
+	return p.CustomerID
+}
+
+// EmailTo is the address email goes to, or "".
+func (p NotificationPreferences) EmailTo() string {
+	if strings.Contains(p.CustomerID, "@") {
+		return p.CustomerID
+	}
+	return p.EmailAddress
+}
+
+func loadNotificationPreferences(customerID string) (NotificationPreferences, error) {
+	byEmail := strings.Contains(customerID, "@")
+	p := NotificationPreferences{CustomerID: customerID, SMS: !byEmail, Email: byEmail, Muted: map[string]bool{}}
+	var muted string
+	err := db.QueryRow("SELECT sms, email, whatsapp, email_address, muted FROM notification_preferences WHERE customer_id = ?", customerID).
+		Scan(&p.SMS, &p.Email, &p.WhatsApp, &p.EmailAddress, &muted)
+	if err == sql.ErrNoRows {
+		return p, nil
+	} else if err != nil {
+		return p, err
+	}
+	for _, name := range strings.Split(muted, ",") {
+		if name != "" {
+			p.Muted[name] = true
+		}
+	}
+	return p, nil
+}
+
+// wants reports whether the customer takes the named message on channel.
+func (p NotificationPreferences) wants(name, channel string) bool {
+	if p.Muted[name] {
+		return false
+	}
+	switch channel {
+	case NotifySMS:
+		return p.SMS && p.Phone() != ""
+	case NotifyWhatsApp:
+		return p.WhatsApp && p.Phone() != ""
+	case NotifyEmail:
+		return p.Email && p.EmailTo() != ""
+	}
+	return false
+}
+
+// notifyCustomer queues the named message on ex (the db or an open
+// transaction) on every channel the customer takes it on.
+func notifyCustomer(ex execer, customerID, name string, vars map[string]string) error {
+	p, err := loadNotificationPreferences(customerID)
+	if err != nil {
+		return err
+	}
+	subject, body := notificationText(name, vars)
+	if p.wants(name, NotifySMS) {
+		if err := enqueueJobIn(ex, "sms", SMSMessage{To: p.Phone(), Message: body}, 0); err != nil {
+			return err
+		}
+	}
+	if p.wants(name, NotifyWhatsApp) {
+		if err := enqueueJobIn(ex, "whatsapp", SMSMessage{To: p.Phone(), Message: body}, 0); err != nil {
+			return err
+		}
+	}
+	if p.wants(name, NotifyEmail) {
+		if err := enqueueJobIn(ex, "email", EmailMessage{To: p.EmailTo(), Subject: subject, Body: body + "\n"}, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// customerNotifications are the messages customers can turn off.
+func customerNotifications() []NotificationTemplate {
+	var list []NotificationTemplate
+	for _, t := range notificationTemplates {
+		if !t.Always {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+func customerNotificationsPage(w http.ResponseWriter, r *http.Request) {
+	p, err := loadNotificationPreferences(customerContact(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	_, verified, err := accountEmail(customerContact(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("account_notifications.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Customer      string
+		Prefs         NotificationPreferences
+		EmailVerified bool
+		Notifications []NotificationTemplate
+		Flashes       []Flash
+	}{customerContact(r), p, verified, customerNotifications(), popFlashes(r)})
+}
+
+func saveCustomerNotifications(w http.ResponseWriter, r *http.Request) {
+	back := "/account/notifications"
+	if err := r.ParseForm(); err != nil {
+		redirectWithFlash(w, r, back, "error", "Could not read the form.")
+		return
+	}
+	p := NotificationPreferences{CustomerID: customerContact(r), Muted: map[string]bool{}}
+	for _, c := range r.Form["channel"] {
+		switch c {
+		case NotifySMS:
+			p.SMS = true
+		case NotifyEmail:
+			p.Email = true
+		case NotifyWhatsApp:
+			p.WhatsApp = true
+		}
+	}
+	if p.Phone() != "" {
+		p.EmailAddress = strings.TrimSpace(r.FormValue("email_address"))
+	}
+	if p.EmailAddress != "" && (!strings.Contains(p.EmailAddress, "@") || len(p.EmailAddress) > 100) {
+		redirectWithFlash(w, r, back, "error", "Enter a valid email address.")
+		return
+	}
+	if p.Email && p.EmailTo() == "" {
+		redirectWithFlash(w, r, back, "error", "Enter the email address to send email to.")
+		return
+	}
+	wanted := map[string]bool{}
+	for _, name := range r.Form["notification"] {
+		wanted[name] = true
+	}
+	var muted []string
+	for _, t := range customerNotifications() {
+		if !wanted[t.Name] {
+			muted = append(muted, t.Name)
+		}
+	}
+	_, err := db.Exec(`INSERT INTO notification_preferences (customer_id, sms, email, whatsapp, email_address, muted) VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE sms = VALUES(sms), email = VALUES(email), whatsapp = VALUES(whatsapp),
+			email_address = VALUES(email_address), muted = VALUES(muted)`,
+		p.CustomerID, p.SMS, p.Email, p.WhatsApp, p.EmailAddress, strings.Join(muted, ","))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	msg := "Your notification settings were saved."
+	if !p.SMS && !p.Email && !p.WhatsApp {
+		msg += " With no channel picked we will not send you updates."
+	}
+	redirectWithFlash(w, r, back, "success", msg)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The messages we send customers can be reworded from the admin without a
+// redeploy. Each message has built-in copy; an edited version saved in
+// notification_templates replaces it. Placeholders like {{OrderID}} are
+// filled in when the message is sent; {{Shop}} and {{Currency}} come from
+// the shop settings and work in every message.
+
+type NotificationTemplate struct {
+	Name        string
+	Channel     string
+	Description string
+	Subject     string // for email
+	Body        string
+	Variables   []string
+	Samples     map[string]string
+	Always      bool // sent whatever the customer's preferences
+
+	Edited    bool
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+var notificationTemplates = []NotificationTemplate{
+	{Name: "login_code", Channel: "SMS", Description: "Code for signing in to the customer account", Always: true,
+		Body:      "Your {{Shop}} login code is {{Code}}. It expires in 10 minutes.",
+		Variables: []string{"Code"}, Samples: map[string]string{"Code": "123456"}},
+	{Name: "order_code", Channel: "SMS", Description: "Code for confirming an order placed under a new phone number", Always: true,
+		Body:      "Your {{Shop}} code to confirm your order is {{Code}}. It expires in 10 minutes.",
+		Variables: []string{"Code"}, Samples: map[string]string{"Code": "123456"}},
+	{Name: "email_verification", Channel: "Email", Description: "Link for verifying the customer account's email address", Always: true,
+		Subject:   "Verify your email address for {{Shop}}",
+		Body:      "Please verify this email address for your {{Shop}} account by opening this link:\n\n{{Link}}\n\nThe link expires in {{Hours}} hours. If you didn't ask for it, you can ignore this email.\n",
+		Variables: []string{"Link", "Hours"}, Samples: map[string]string{"Link": "http://localhost:8080/account/email/confirm?c=0771234567&e=you%40example.com&t=abc", "Hours": "48"}},
+	{Name: "order_receipt", Channel: "Email", Description: "Receipt sent after delivery, with the invoice PDF attached",
+		Subject:   "Your receipt for order {{OrderID}}",
+		Body:      "Thank you for shopping with {{Shop}}!\n\nYour order {{OrderID}} has been delivered. Your receipt for {{Currency}} {{Total}} is attached.\n",
+		Variables: []string{"OrderID", "Total"}, Samples: map[string]string{"OrderID": "ODR#00042", "Total": "1800.00"}},
+	{Name: "reservation_expired", Channel: "Customer's choice", Description: "Order cancelled because the advance payment did not arrive",
+		Subject:   "Order {{OrderID}} was cancelled",
+		Body:      "We did not receive the payment for order {{OrderID}} in time, so it has been cancelled. Any gift card balance used on it has been restored.",
+		Variables: []string{"OrderID"}, Samples: map[string]string{"OrderID": "ODR#00042"}},
+	{Name: "store_credit_refund", Channel: "Customer's choice", Description: "Refund of an order to store credit",
+		Subject:   "Store credit for order {{OrderID}}",
+		Body:      "{{Currency}} {{Total}} from order {{OrderID}} was refunded to your store credit. Use code {{Code}} at checkout.",
+		Variables: []string{"Total", "OrderID", "Code"}, Samples: map[string]string{"Total": "900.00", "OrderID": "ODR#00042", "Code": "GC-AB12-CD34"}},
+	{Name: "return_approved", Channel: "Customer's choice", Description: "A return was approved and given an RMA code",
+		Subject:   "Your return for order {{OrderID}} is approved",
+		Body:      "Your return for order {{OrderID}} is approved. Its RMA code is {{Code}}; please use the return label we give you, or write the code on the parcel.",
+		Variables: []string{"OrderID", "Code"}, Samples: map[string]string{"OrderID": "ODR#00042", "Code": "RMA-AB12-CD34-EF56"}},
+	{Name: "standing_order_placed", Channel: "Customer's choice", Description: "A standing order placed its next order",
+		Subject:   "Your standing order placed order {{OrderID}}",
+		Body:      "Your standing order placed order {{OrderID}} ({{Currency}} {{Total}}). The next one is on {{NextDate}}.",
+		Variables: []string{"OrderID", "Total", "NextDate"}, Samples: map[string]string{"OrderID": "ODR#00042", "Total": "1800.00", "NextDate": "2026-11-16"}},
+	{Name: "standing_order_reminder", Channel: "Customer's choice", Description: "A standing order renews in a few days",
+		Subject:   "Your standing order renews on {{Date}}",
+		Body:      "Your standing order for {{Quantity}} x {{Product}} renews on {{Date}}. To pause or cancel it, sign in and open My Standing Orders.",
+		Variables: []string{"Quantity", "Product", "Date"}, Samples: map[string]string{"Quantity": "2", "Product": "Classic T-Shirt, Black, M", "Date": "2026-11-16"}},
+	{Name: "ticket_reply", Channel: "Customer's choice", Description: "Staff replied to a support ticket",
+		Subject:   "We replied about order {{OrderID}}",
+		Body:      "We replied to your ticket about order {{OrderID}}. Sign in to read it.",
+		Variables: []string{"OrderID"}, Samples: map[string]string{"OrderID": "ODR#00042"}},
+	{Name: "abandoned_order", Channel: "Customer's choice", Description: "Reminder about an order that was started but not placed",
+		Subject:   "Your order is waiting",
+		Body:      "You started an order at {{Shop}} but didn't finish it. Pick up where you left off: {{Link}}",
+		Variables: []string{"Link"}, Samples: map[string]string{"Link": "http://localhost:8080/place-order?resume=abc123"}},
+}
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// Placeholders are the ones t fills, the shop-wide ones last.
+func (t NotificationTemplate) Placeholders() []string {
+	return append(append([]string{}, t.Variables...), "Shop", "Currency")
+}
+
+// withShopVars adds the shop-wide placeholders to vars.
+func withShopVars(vars map[string]string) map[string]string {
+	all := map[string]string{"Shop": shopName(), "Currency": currency()}
+	for k, v := range vars {
+		all[k] = v
+	}
+	return all
+}
+
+func defaultNotificationTemplate(name string) (NotificationTemplate, bool) {
+	for _, t := range notificationTemplates {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return NotificationTemplate{}, false
+}
+
+// loadNotificationTemplate is the built-in copy with any saved edit applied.
+func loadNotificationTemplate(name string) (NotificationTemplate, error) {
+	t, ok := defaultNotificationTemplate(name)
+	if !ok {
+		return t, sql.ErrNoRows
+	}
+	var subject, body string
+	err := db.QueryRow("SELECT subject, body, updated_by, updated_at FROM notification_templates WHERE name = ?", name).
+		Scan(&subject, &body, &t.UpdatedBy, &t.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return t, nil
+	} else if err != nil {
+		return t, err
+	}
+	if subject != "" {
+		t.Subject = subject
+	}
+	t.Body, t.Edited = body, true
+	return t, nil
+}
+
+func fillPlaceholders(text string, vars map[string]string) string {
+	return placeholderPattern.ReplaceAllStringFunc(text, func(m string) string {
+		if v, ok := vars[placeholderPattern.FindStringSubmatch(m)[1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// notificationText renders the named message. When the saved copy can't be
+// read the built-in copy is sent, so a database hiccup never loses a message.
+func notificationText(name string, vars map[string]string) (subject, body string) {
+	t, err := loadNotificationTemplate(name)
+	if err != nil {
+		log.Printf("notification template %s: %v", name, err)
+		t, _ = defaultNotificationTemplate(name)
+	}
+	vars = withShopVars(vars)
+	return fillPlaceholders(t.Subject, vars), fillPlaceholders(t.Body, vars)
+}
+
+// unknownPlaceholders lists the placeholders in text that t doesn't fill.
+func (t NotificationTemplate) unknownPlaceholders(text string) []string {
+	var unknown []string
+	for _, m := range placeholderPattern.FindAllStringSubmatch(text, -1) {
+		known := false
+		for _, v := range t.Placeholders() {
+			known = known || v == m[1]
+		}
+		if !known {
+			unknown = append(unknown, "{{"+m[1]+"}}")
+		}
+	}
+	return unknown
+}
+
+type NotificationPreview struct {
+	Name, Subject, Body string
+}
+
+func notificationTemplatesPage(w http.ResponseWriter, r *http.Request) {
+	renderNotificationTemplates(w, r, nil, nil, "")
+}
+
+// renderNotificationTemplates shows every message; draft is what was just
+// posted for a template that was previewed or failed to save with problem.
+func renderNotificationTemplates(w http.ResponseWriter, r *http.Request, draft *NotificationTemplate, preview *NotificationPreview, problem string) {
+	var templates []NotificationTemplate
+	for _, d := range notificationTemplates {
+		t, err := loadNotificationTemplate(d.Name)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if draft != nil && draft.Name == t.Name {
+			t.Subject, t.Body = draft.Subject, draft.Body
+		}
+		templates = append(templates, t)
+	}
+	flashes := popFlashes(r)
+	if problem != "" {
+		flashes = append(flashes, Flash{Kind: "error", Message: problem})
+	}
+	t := mustParseTemplates("notification_templates.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Templates []NotificationTemplate
+		Preview   *NotificationPreview
+		Flashes   []Flash
+	}{templates, preview, flashes})
+}
+
+// saveNotificationTemplate saves, previews or resets one message, as the
+// action button says.
+func saveNotificationTemplate(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	def, ok := defaultNotificationTemplate(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	back := "/admin/notifications#" + name
+	if r.FormValue("action") == "reset" {
+		_, err := db.Exec("DELETE FROM notification_templates WHERE name = ?", name)
+		if err == nil {
+			err = recordAudit(db, r, "notification_template.reset", name, "")
+		}
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		redirectWithFlash(w, r, back, "success", "The "+name+" message is back to the built-in copy.")
+		return
+	}
+
+	draft := def
+	draft.Subject = strings.TrimSpace(r.FormValue("subject"))
+	draft.Body = strings.TrimSpace(r.FormValue("body"))
+	if def.Subject == "" {
+		draft.Subject = ""
+	}
+	var problem string
+	switch {
+	case draft.Body == "" || (def.Subject != "" && draft.Subject == ""):
+		problem = "The message can't be empty."
+	case len(draft.Body) > 2000 || len(draft.Subject) > 200:
+		problem = "The message is too long."
+	default:
+		if unknown := draft.unknownPlaceholders(draft.Subject + " " + draft.Body); len(unknown) > 0 {
+			problem = "Unknown placeholders: " + strings.Join(unknown, ", ") + ". Use " + "{{" + strings.Join(def.Placeholders(), "}}, {{") + "}}."
+		}
+	}
+	if problem != "" {
+		renderNotificationTemplates(w, r, &draft, nil, problem)
+		return
+	}
+	if r.FormValue("action") == "preview" {
+		samples := withShopVars(def.Samples)
+		renderNotificationTemplates(w, r, &draft, &NotificationPreview{
+			Name: name, Subject: fillPlaceholders(draft.Subject, samples), Body: fillPlaceholders(draft.Body, samples),
+		}, "")
+		return
+	}
+	_, err := db.Exec(`INSERT INTO notification_templates (name, subject, body, updated_by) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE subject = VALUES(subject), body = VALUES(body), updated_by = VALUES(updated_by), updated_at = NOW()`,
+		name, draft.Subject, draft.Body, auditActor(r))
+	if err == nil {
+		err = recordAudit(db, r, "notification_template.update", name, "")
+	}
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", "Saved the "+name+" message.")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type EmailMessage struct {
+	To          string            `json:"to"`
+	Subject     string            `json:"subject"`
+	Body        string            `json:"body"`
+	Attachments []EmailAttachment `json:"attachments,omitempty"`
+}
+
+type EmailAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+type SMSMessage struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+func init() {
+	registerJobHandler("email", func(payload []byte) error {
+		var m EmailMessage
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return err
+		}
+		return sendEmail(m)
+	})
+	registerJobHandler("sms", func(payload []byte) error {
+		var m SMSMessage
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return err
+		}
+		return sendSMS(m)
+	})
+	registerJobHandler("whatsapp", func(payload []byte) error {
+		var m SMSMessage
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return err
+		}
+		return sendWhatsApp(m)
+	})
+}
+
+func sendEmail(m EmailMessage) error {
+	host := envOr("SMTP_HOST", "")
+	if host == "" {
+		log.Printf("SMTP_HOST not set, email to %s not sent: %s", m.To, m.Subject)
+		return nil
+	}
+	from := envOr("SMTP_FROM", "orders@fashionshop.local")
+	msg := "From: " + from + "\r\n" +
+		"To: " + m.To + "\r\n" +
+		"Subject: " + m.Subject + "\r\n" +
+		"MIME-Version: 1.0\r\n"
+	if len(m.Attachments) == 0 {
+		msg += "Content-Type: text/plain; charset=UTF-8\r\n\r\n" + m.Body
+	} else {
+		body, boundary, err := mixedBody(m)
+		if err != nil {
+			return err
+		}
+		msg += "Content-Type: multipart/mixed; boundary=" + boundary + "\r\n\r\n" + body
+	}
+
+	var auth smtp.Auth
+	if user := envOr("SMTP_USER", ""); user != "" {
+		auth = smtp.PlainAuth("", user, envOr("SMTP_PASSWORD", ""), host)
+	}
+	addr := host + ":" + envOr("SMTP_PORT", "587")
+	return smtp.SendMail(addr, auth, from, []string{m.To}, []byte(msg))
+}
+
+// mixedBody lays out the text and the attachments as MIME parts.
+func mixedBody(m EmailMessage) (body, boundary string, err error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}})
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := part.Write([]byte(m.Body)); err != nil {
+		return "", "", err
+	}
+	for _, a := range m.Attachments {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType + `; name="` + a.Filename + `"`},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {`attachment; filename="` + a.Filename + `"`},
+		})
+		if err != nil {
+			return "", "", err
+		}
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			if _, err := part.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+				return "", "", err
+			}
+			encoded = encoded[76:]
+		}
+		if _, err := part.Write([]byte(encoded + "\r\n")); err != nil {
+			return "", "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", "", err
+	}
+	return buf.String(), mw.Boundary(), nil
+}
+
+func sendSMS(m SMSMessage) error {
+	return postToGateway("SMS", "SMS_GATEWAY", m)
+}
+
+// sendWhatsApp goes through a WhatsApp Business gateway that takes the same
+// form as the SMS one.
+func sendWhatsApp(m SMSMessage) error {
+	return postToGateway("WhatsApp", "WHATSAPP_GATEWAY", m)
+}
+
+// postToGateway posts m to the gateway at env+"_URL", authenticating with
+// env+"_KEY" when it is set.
+func postToGateway(name, env string, m SMSMessage) error {
+	gateway := envOr(env+"_URL", "")
+	if gateway == "" {
+		log.Printf("%s_URL not set, %s to %s not sent", env, name, m.To)
+		return nil
+	}
+	form := url.Values{"to": {m.To}, "message": {m.Message}}
+	req, err := http.NewRequest(http.MethodPost, gateway, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if key := envOr(env+"_KEY", ""); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s gateway returned %s", name, resp.Status)
+	}
+	return nil
+}
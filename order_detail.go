@@ -0,0 +1,348 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// /orders/{id} is the one page for an order: its details and items, what
+// has happened to it and who did it, the payments taken and the staff
+// comments. Order IDs in staff lists link here.
+
+// OrderHistoryEntry is one event from the order's log, described for people.
+type OrderHistoryEntry struct {
+	Type    string
+	Summary string
+	Actor   string
+	At      time.Time
+}
+
+// OrderPaymentEntry is a payment taken for the order, or a refund.
+type OrderPaymentEntry struct {
+	OrderPayment
+	Refund bool      `json:"refund,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+func paymentMethodName(method string) string {
+	switch method {
+	case GiftCardKindGift:
+		return "gift card"
+	case GiftCardKindCredit:
+		return "store credit"
+	}
+	if label := (Order{PaymentMethod: method}).PaymentMethodLabel(); label != "" {
+		return strings.ToLower(label)
+	}
+	return method
+}
+
+func (p OrderPaymentEntry) MethodName() string {
+	return paymentMethodName(p.Method)
+}
+
+// orderPayments picks the payments and refunds out of the order's events.
+func orderPayments(events []StoredOrderEvent) []OrderPaymentEntry {
+	var payments []OrderPaymentEntry
+	for _, ev := range events {
+		if ev.Type == OrderEventPaid || ev.Type == OrderEventRefunded {
+			p := OrderPaymentEntry{Refund: ev.Type == OrderEventRefunded, At: ev.CreatedAt}
+			_ = json.Unmarshal(ev.Data, &p.OrderPayment)
+			payments = append(payments, p)
+		}
+	}
+	return payments
+}
+
+// describeOrderEvent says what ev did to the order in a sentence.
+func describeOrderEvent(ev StoredOrderEvent) string {
+	switch ev.Type {
+	case OrderEventOrdered:
+		var o Order
+		if json.Unmarshal(ev.Data, &o) == nil && o.Channel == ChannelWalkIn {
+			return "Sold in store"
+		}
+		return "Order placed"
+	case OrderEventPaid, OrderEventRefunded:
+		var p OrderPayment
+		_ = json.Unmarshal(ev.Data, &p)
+		verb := "Paid"
+		if ev.Type == OrderEventRefunded {
+			verb = "Refunded"
+		}
+		return fmt.Sprintf("%s %s by %s", verb, money(p.Amount), paymentMethodName(p.Method))
+	case OrderEventStatusChanged:
+		var c StatusChange
+		_ = json.Unmarshal(ev.Data, &c)
+		return fmt.Sprintf("Status changed from %s to %s", c.From, c.To)
+	case OrderEventCancelled:
+		var c OrderCancellation
+		if json.Unmarshal(ev.Data, &c) == nil && c.Reason != "" {
+			return "Cancelled: " + c.Reason
+		}
+		return "Cancelled"
+	case OrderEventDeliveryScheduled:
+		var d DeliverySchedule
+		_ = json.Unmarshal(ev.Data, &d)
+		return fmt.Sprintf("Delivery booked for %s, %s", d.Date, d.Label)
+	case OrderEventShippingCharged:
+		var c ShippingCharge
+		_ = json.Unmarshal(ev.Data, &c)
+		if c.Pickup {
+			return "To be collected from the store"
+		}
+		return fmt.Sprintf("Shipping to %s charged at %s", c.PostalCode, money(c.Fee))
+	case OrderEventAddressSet:
+		var a DeliveryAddress
+		_ = json.Unmarshal(ev.Data, &a)
+		return "Delivery address set to " + a.Address
+	case OrderEventPaymentMethodSet:
+		var c PaymentMethodChoice
+		_ = json.Unmarshal(ev.Data, &c)
+		return "Payment by " + paymentMethodName(c.Method)
+	case OrderEventRushRequested:
+		var c RushCharge
+		_ = json.Unmarshal(ev.Data, &c)
+		return "Rush delivery requested for " + money(c.Fee)
+	case OrderEventGiftWrapped:
+		var g GiftWrap
+		_ = json.Unmarshal(ev.Data, &g)
+		return "Gift wrap requested for " + money(g.Fee)
+	case OrderEventItemsUpdated:
+		var c ItemStatusChange
+		_ = json.Unmarshal(ev.Data, &c)
+		return fmt.Sprintf("%d item line(s) marked %s", len(c.Lines), c.Status)
+	case OrderEventEdited:
+		var e OrderEdit
+		_ = json.Unmarshal(ev.Data, &e)
+		var changed []string
+		if e.Item != nil {
+			changed = append(changed, fmt.Sprintf("%d × %s", e.Item.Quantity, e.Item.Size))
+		}
+		if e.Notes != nil {
+			changed = append(changed, "notes")
+		}
+		if e.PostalCode != "" {
+			changed = append(changed, "shipping to "+e.PostalCode+" at "+money(e.ShippingFee))
+		}
+		return fmt.Sprintf("Edited (%s), total now %s", strings.Join(changed, ", "), money(e.TotalAmount))
+	case OrderEventSplit:
+		var s OrderSplit
+		_ = json.Unmarshal(ev.Data, &s)
+		return "Items split off into " + s.ChildOrderID
+	case OrderEventMerged:
+		var m OrderMerge
+		_ = json.Unmarshal(ev.Data, &m)
+		return m.SourceOrderID + " merged into this order"
+	case OrderEventMergedInto:
+		var m OrderMergedInto
+		_ = json.Unmarshal(ev.Data, &m)
+		return "Merged into " + m.TargetOrderID
+	case OrderEventDeleted:
+		return "Deleted"
+	}
+	return ev.Type
+}
+
+func orderDetailPage(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	o, err := storeOrder(currentStoreID(r), orderID)
+	if err == sql.ErrNoRows {
+		// Archived orders turn up in searches that ask for them.
+		o, err = archivedOrder(currentStoreID(r), orderID)
+	}
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		t := mustParseTemplates("order_not_found.html")
+		_ = t.Execute(w, nil)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	events, err := orderHistory(orderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var history []OrderHistoryEntry
+	for _, ev := range events {
+		history = append(history, OrderHistoryEntry{Type: ev.Type, Summary: describeOrderEvent(ev), Actor: ev.Actor, At: ev.CreatedAt})
+	}
+	payments := orderPayments(events)
+	var paid Money
+	for _, p := range payments {
+		if p.Refund {
+			paid -= p.Amount
+		} else {
+			paid += p.Amount
+		}
+	}
+	o.Items, err = orderItems(orderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	reservation, err := orderReservation(orderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	comments, err := orderComments(orderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	measurements, err := orderMeasurements(orderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	returns, err := queryReturns("WHERE order_id = ? ORDER BY id", orderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	canReturn := o.Status == "DELIVERED"
+	for _, rt := range returns {
+		if rt.Status != "REFUNDED" {
+			canReturn = false
+		}
+	}
+	t := mustParseTemplates("order_detail.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Order
+		Reservation  *StockReservation
+		History      []OrderHistoryEntry
+		Payments     []OrderPaymentEntry
+		Paid         Money
+		Comments     []*OrderComment
+		Measurements []Measurement
+		Returns      []Return
+		CanReturn    bool
+		Flashes      []Flash
+	}{o, reservation, history, payments, paid, comments, measurements, returns, canReturn, popFlashes(r)})
+}
+
+// GET /api/v1/orders/{id}/timeline lists what has happened to an order for
+// the customer: when it was placed, paid for, changed status and so on,
+// oldest first. Staff-only events and who made each change are left out.
+var timelineEventTypes = map[string]bool{
+	OrderEventOrdered: true, OrderEventPaid: true, OrderEventRefunded: true, OrderEventStatusChanged: true,
+	OrderEventCancelled: true, OrderEventDeliveryScheduled: true, OrderEventRushRequested: true, OrderEventGiftWrapped: true,
+	OrderEventEdited: true, OrderEventSplit: true, OrderEventMergedInto: true,
+}
+
+// sharedTimelineEventTypes are the ones shown through a confirmation link,
+// which say nothing of amounts.
+var sharedTimelineEventTypes = map[string]bool{
+	OrderEventOrdered: true, OrderEventStatusChanged: true, OrderEventCancelled: true,
+	OrderEventDeliveryScheduled: true, OrderEventMergedInto: true,
+}
+
+type TimelineEvent struct {
+	Type    string    `json:"type"`
+	Summary string    `json:"summary"`
+	Status  string    `json:"status,omitempty"`
+	Amount  Money     `json:"amount,omitempty"`
+	Notes   string    `json:"notes,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// timelineEvent picks out of ev what the customer can see.
+func timelineEvent(ev StoredOrderEvent) TimelineEvent {
+	te := TimelineEvent{Type: ev.Type, Summary: describeOrderEvent(ev), At: ev.CreatedAt}
+	switch ev.Type {
+	case OrderEventOrdered:
+		var o Order
+		_ = json.Unmarshal(ev.Data, &o)
+		te.Status, te.Amount, te.Notes = o.Status, o.TotalAmount, o.Notes
+	case OrderEventPaid, OrderEventRefunded:
+		var p OrderPayment
+		_ = json.Unmarshal(ev.Data, &p)
+		te.Amount = p.Amount
+	case OrderEventStatusChanged:
+		var c StatusChange
+		_ = json.Unmarshal(ev.Data, &c)
+		te.Status = c.To
+	case OrderEventCancelled:
+		te.Status = "CANCELLED"
+	case OrderEventMergedInto:
+		te.Status = "MERGED"
+	case OrderEventEdited:
+		var e OrderEdit
+		_ = json.Unmarshal(ev.Data, &e)
+		te.Amount = e.TotalAmount
+		if e.Notes != nil {
+			te.Notes = *e.Notes
+		}
+	}
+	return te
+}
+
+// sharedTimelineEvent is timelineEvent for the holder of a confirmation
+// link: the amount and notes are dropped, and so is any amount named in
+// the summary.
+func sharedTimelineEvent(ev StoredOrderEvent) TimelineEvent {
+	te := timelineEvent(ev)
+	te.Amount, te.Notes = 0, ""
+	amounts := regexp.MustCompile(`(?: (?:for|at))? ` + regexp.QuoteMeta(currency()) + ` -?\d+\.\d{2}`)
+	te.Summary = amounts.ReplaceAllString(te.Summary, "")
+	return te
+}
+
+// apiOrderTimeline serves an order's timeline to staff, to the customer
+// signed in as its contact, and to holders of its confirmation link
+// (confirmation.go) passed as ?token=, who like on the confirmation page
+// don't see amounts, payments or notes. Order codes are sequential, so nobody else
+// gets to know an order even exists.
+func apiOrderTimeline(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	shared := verifyToken("order-confirmation", orderID, r.URL.Query().Get("token"))
+	var status, contact string
+	err := db.QueryRow("SELECT status, customer_id FROM orders WHERE order_id = ? AND deleted_at IS NULL", orderID).Scan(&status, &contact)
+	if !shared && (err != nil || contact == "" || customerContact(r) != contact) {
+		adminAPI(func(w http.ResponseWriter, r *http.Request) {
+			writeOrderTimeline(w, orderID, status, err, false)
+		}).ServeHTTP(w, r)
+		return
+	}
+	writeOrderTimeline(w, orderID, status, err, shared && customerContact(r) != contact)
+}
+
+// writeOrderTimeline answers with the timeline of the order whose status
+// was read with err; redacted keeps to sharedTimelineEventTypes.
+func writeOrderTimeline(w http.ResponseWriter, orderID, status string, err error, redacted bool) {
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "Order not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	events, err := orderHistory(orderID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	timeline := []TimelineEvent{}
+	for _, ev := range events {
+		if redacted && sharedTimelineEventTypes[ev.Type] {
+			timeline = append(timeline, sharedTimelineEvent(ev))
+		} else if !redacted && timelineEventTypes[ev.Type] {
+			timeline = append(timeline, timelineEvent(ev))
+		}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		OrderID string          `json:"order_id"`
+		Status  string          `json:"status"`
+		Events  []TimelineEvent `json:"events"`
+	}{orderID, status, timeline})
+}
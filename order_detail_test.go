@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedTimelineEvent(t *testing.T) {
+	settingsCache.Lock()
+	settingsCache.values, settingsCache.loadedAt = map[string]string{"currency": "LKR"}, time.Now()
+	settingsCache.Unlock()
+
+	event := func(typ string, data interface{}) StoredOrderEvent {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return StoredOrderEvent{OrderID: "ODR#00042", Type: typ, Data: raw, CreatedAt: time.Now()}
+	}
+	events := []StoredOrderEvent{
+		event(OrderEventOrdered, Order{OrderID: "ODR#00042", Status: "PENDING", TotalAmount: 1234567, Notes: "call before noon"}),
+		event(OrderEventStatusChanged, StatusChange{From: "PENDING", To: "PAID"}),
+		event(OrderEventCancelled, OrderCancellation{Reason: "out of stock"}),
+		event(OrderEventRushRequested, RushCharge{Fee: 150000}),
+	}
+	for _, ev := range events {
+		te := sharedTimelineEvent(ev)
+		if te.Amount != 0 || te.Notes != "" {
+			t.Errorf("%s: amount %v and notes %q shown through a confirmation link", ev.Type, te.Amount, te.Notes)
+		}
+		out, err := json.Marshal(te)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, leak := range []string{"LKR", "12345.67", "1500.00", "call before noon", `"amount"`, `"notes"`} {
+			if strings.Contains(string(out), leak) {
+				t.Errorf("%s: %s contains %s", ev.Type, out, leak)
+			}
+		}
+	}
+
+	if got := sharedTimelineEvent(events[3]).Summary; got != "Rush delivery requested" {
+		t.Errorf("summary = %q, want the amount left out", got)
+	}
+	if got := sharedTimelineEvent(events[1]).Status; got != "PAID" {
+		t.Errorf("status = %q, want PAID", got)
+	}
+}
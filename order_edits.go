@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PATCH /api/v1/orders/{id} changes some of an order before it leaves the
+// store: its size, quantity, delivery address, postal code and notes. Fields
+// left out of the body are kept. Size and quantity can only be changed on
+// single-item orders nothing has been paid on yet; the item is repriced,
+// shipping is quoted again and the total recalculated. A new address or
+// postal code is quoted for shipping again too, and once the order is paid
+// it must not change the fee. While an order paid in advance waits for the
+// transfer, the amount due follows the new total.
+
+// OrderEdit is the data of an OrderEventEdited event. Item is the order's
+// only line as it is after the edit.
+type OrderEdit struct {
+	Item        *OrderItem `json:"item,omitempty"`
+	Notes       *string    `json:"notes,omitempty"`
+	PostalCode  string     `json:"postal_code,omitempty"`
+	ShippingFee Money      `json:"shipping_fee"`
+	TotalAmount Money      `json:"total_amount"`
+}
+
+func (e OrderEdit) apply(o *Order) {
+	if e.Item != nil && len(o.Items) > 0 {
+		it := *e.Item
+		it.Status, it.LocationID = o.Items[0].Status, o.Items[0].LocationID
+		o.Items[0] = it
+		o.Size, o.Quantity = it.Size, it.Quantity
+	}
+	if e.Notes != nil {
+		o.Notes = *e.Notes
+	}
+	if e.PostalCode != "" {
+		o.PostalCode = e.PostalCode
+	}
+	o.ShippingFee, o.TotalAmount = e.ShippingFee, e.TotalAmount
+}
+
+type orderPatch struct {
+	Size       *string `json:"size" validate:"oneof=XS S M L XL XXL"`
+	Quantity   *int    `json:"quantity" validate:"min=1,max=100"`
+	Address    *string `json:"address" validate:"maxlen=300"`
+	PostalCode *string `json:"postal_code" validate:"maxlen=10"`
+	Notes      *string `json:"notes" validate:"maxlen=500"`
+}
+
+var (
+	errOrderNotEditable = errors.New("order can no longer be changed")
+	errItemNotEditable  = errors.New("size and quantity can only be changed on unpaid single-item orders")
+	errSizeUnavailable  = errors.New("the item is not available in that size")
+	errNotEnoughStock   = errors.New("not enough stock for that quantity")
+	errShippingChanged  = errors.New("the new address changes the shipping fee of a paid order")
+)
+
+// editOrder applies p to o inside tx.
+func editOrder(tx *sql.Tx, r *http.Request, o *Order, p orderPatch) error {
+	if o.Status != "PROCESSING" && o.Status != OrderBackordered {
+		return errOrderNotEditable
+	}
+	lines, err := orderLines(tx, o.OrderID)
+	if err != nil {
+		return err
+	}
+	o.Items = lines
+	var paid bool
+	err = tx.QueryRow("SELECT COUNT(*) > 0 FROM order_events WHERE order_id = ? AND type = ?", o.OrderID, OrderEventPaid).Scan(&paid)
+	if err != nil {
+		return err
+	}
+	edit := OrderEdit{Notes: p.Notes, ShippingFee: o.ShippingFee}
+	subtotal := o.Subtotal()
+	requote := p.Address != nil || p.PostalCode != nil
+	if p.Size != nil || p.Quantity != nil {
+		if paid || len(lines) != 1 || lines[0].Status != ItemPending {
+			return errItemNotEditable
+		}
+		it := lines[0]
+		v, err := variantByID(it.VariantID)
+		if err != nil {
+			return err
+		}
+		if p.Size != nil && *p.Size != it.Size {
+			err = scanVariant(tx.QueryRow("SELECT "+variantColumns+` FROM product_variants v JOIN products p ON p.id = v.product_id
+				WHERE v.product_id = ? AND v.color = ? AND v.size = ? AND v.active AND p.active`, v.ProductID, v.Color, *p.Size), &v)
+			if err == sql.ErrNoRows {
+				return errSizeUnavailable
+			} else if err != nil {
+				return err
+			}
+		}
+		qty := it.Quantity
+		if p.Quantity != nil {
+			qty = *p.Quantity
+		}
+		available, tracked, err := availableStock(tx, o.StoreID, v.ID, stockQueueStatuses)
+		if err != nil {
+			return err
+		}
+		if v.ID == it.VariantID {
+			available += it.Quantity // this order's own claim
+		}
+		// Backorders wait for stock anyway.
+		if tracked && qty > available && o.Status != OrderBackordered {
+			return errNotEnoughStock
+		}
+
+		it.VariantID, it.SKU, it.ProductName, it.Size, it.Color = v.ID, v.SKU, v.ProductName, v.Size, v.Color
+		it.Quantity = qty
+		// The order keeps the prices, and the pricing rules, of when it
+		// was placed.
+		base, err := orderTimePrice(tx, o.OrderID, v)
+		if err != nil {
+			return err
+		}
+		var placedAt time.Time
+		if err := tx.QueryRow("SELECT created_at FROM orders WHERE order_id = ?", o.OrderID).Scan(&placedAt); err != nil {
+			return err
+		}
+		if it.UnitPrice, _, _, err = dynamicPrice(tx, placedAt, o.CustomerID, o.Channel, v, qty, base); err != nil {
+			return err
+		}
+		subtotal = it.LineTotal()
+		edit.Item, lines[0], requote = &it, it, true
+		_, err = tx.Exec("UPDATE order_items SET variant_id = ?, sku = ?, product_name = ?, size = ?, color = ?, quantity = ?, unit_price = ?, unit_cost = ? WHERE id = ?",
+			it.VariantID, it.SKU, it.ProductName, it.Size, it.Color, it.Quantity, it.UnitPrice, v.Cost, it.ID)
+		if err != nil {
+			return err
+		}
+	}
+	if p.Address != nil {
+		a, err := geocodeAddress(*p.Address)
+		if err == errAddressNotFound {
+			return err
+		} else if err != nil {
+			log.Printf("geocoding delivery address: %v", err)
+		}
+		if err := setDeliveryAddress(tx, o, a); err != nil {
+			return err
+		}
+	}
+	postalCode := o.PostalCode
+	if p.PostalCode != nil {
+		postalCode = normalizePostalCode(*p.PostalCode)
+	}
+	if requote && !o.Pickup && postalCode != "" {
+		weight := 0
+		for _, it := range lines {
+			v, err := variantByID(it.VariantID)
+			if err != nil {
+				return err
+			}
+			weight += v.WeightGrams * it.Quantity
+		}
+		charge, err := shippingQuote(postalCode, weight, subtotal)
+		if err != nil {
+			return err
+		}
+		if paid && charge.Fee != o.ShippingFee {
+			return errShippingChanged
+		}
+		edit.PostalCode, edit.ShippingFee = charge.PostalCode, charge.Fee
+	}
+	if edit.Item == nil && edit.Notes == nil && edit.PostalCode == "" {
+		return nil
+	}
+	edit.TotalAmount = subtotal + edit.ShippingFee + o.RushFee + o.GiftWrapFee
+	oldTotal := o.TotalAmount
+	edit.apply(o)
+	_, err = tx.Exec("UPDATE orders SET size = ?, quantity = ?, notes = ?, postal_code = ?, shipping_fee = ?, total_amount = ? WHERE order_id = ?",
+		o.Size, o.Quantity, o.Notes, o.PostalCode, o.ShippingFee, o.TotalAmount, o.OrderID)
+	if err != nil {
+		return err
+	}
+	if o.TotalAmount != oldTotal {
+		_, err = tx.Exec("UPDATE stock_reservations SET amount_due = GREATEST(amount_due + ?, 0) WHERE order_id = ? AND status = ?",
+			o.TotalAmount-oldTotal, o.OrderID, ReservationHeld)
+		if err != nil {
+			return err
+		}
+	}
+	return recordOrderEventBy(tx, o.OrderID, OrderEventEdited, staffUser(r), edit)
+}
+
+func apiPatchOrder(w http.ResponseWriter, r *http.Request) {
+	var p orderPatch
+	if err := decodeJSON(r, &p); err != nil {
+		writeJSONInvalid(w, err)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	defer tx.Rollback()
+	var o Order
+	err = scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL FOR UPDATE",
+		mux.Vars(r)["orderID"], currentStoreID(r)), &o)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "Order not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	err = editOrder(tx, r, &o, p)
+	if err == nil {
+		err = recordAudit(tx, r, "order.edit", o.OrderID, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	switch err {
+	case nil:
+	case errOrderNotEditable:
+		writeAPIError(w, http.StatusConflict, "order_not_editable", "Order "+o.OrderID+" is "+o.Status+" and can no longer be changed.", nil)
+		return
+	case errItemNotEditable:
+		writeAPIError(w, http.StatusConflict, "order_not_editable", "Size and quantity can only be changed on unpaid single-item orders.", nil)
+		return
+	case errSizeUnavailable:
+		msg := "The item is not available in size " + *p.Size + "."
+		writeAPIError(w, http.StatusBadRequest, "validation_failed", msg, map[string]string{"size": msg})
+		return
+	case errNotEnoughStock:
+		writeAPIError(w, http.StatusConflict, "out_of_stock", "There is not enough stock for that quantity.", nil)
+		return
+	case errShippingChanged:
+		writeAPIError(w, http.StatusConflict, "order_not_editable", "Order "+o.OrderID+" is paid, and the new address would change its shipping fee.", nil)
+		return
+	case errAddressNotFound:
+		msg := "We could not find that delivery address, please check it."
+		writeAPIError(w, http.StatusBadRequest, "validation_failed", msg, map[string]string{"address": msg})
+		return
+	default:
+		writeJSONError(w, http.StatusInternalServerError, "DB update error")
+		return
+	}
+	emitOrderEvent(OrderEvent{Type: EventOrderUpdated, OrderID: o.OrderID, Order: &o})
+	writeJSON(w, http.StatusOK, o)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Every order mutation is appended to order_events in the same transaction
+// as the row change, so the orders table can always be rebuilt from the log.
+const (
+	OrderEventOrdered           = "ordered"
+	OrderEventPaid              = "paid"
+	OrderEventRefunded          = "refunded"
+	OrderEventStatusChanged     = "status_changed"
+	OrderEventCancelled         = "cancelled"
+	OrderEventDeliveryScheduled = "delivery_scheduled"
+	OrderEventShippingCharged   = "shipping_charged"
+	OrderEventAddressSet        = "address_set"
+	OrderEventPaymentMethodSet  = "payment_method_set"
+	OrderEventRushRequested     = "rush_requested"
+	OrderEventGiftWrapped       = "gift_wrapped"
+	OrderEventItemsUpdated      = "items_updated"
+	OrderEventEdited            = "edited"
+	OrderEventSplit             = "split"
+	OrderEventMerged            = "merged"
+	OrderEventMergedInto        = "merged_into"
+	OrderEventDeleted           = "deleted"
+)
+
+type StoredOrderEvent struct {
+	ID        int64           `json:"id"`
+	OrderID   string          `json:"order_id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	Actor     string          `json:"actor,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type StatusChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func recordOrderEvent(ex execer, orderID, typ string, data interface{}) error {
+	return recordOrderEventBy(ex, orderID, typ, "", data)
+}
+
+// recordOrderEventBy attributes the event to the staff member who made the
+// change; events recorded without one were made by the system.
+func recordOrderEventBy(ex execer, orderID, typ, actor string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err = ex.Exec("INSERT INTO order_events (order_id, type, data, actor) VALUES (?, ?, ?, ?)", orderID, typ, string(payload), actor); err != nil {
+		return err
+	}
+	// Not every change touches the order row itself, so updated_at is
+	// kept here too.
+	_, err = ex.Exec("UPDATE orders SET updated_at = CURRENT_TIMESTAMP(6) WHERE order_id = ?", orderID)
+	return err
+}
+
+// orderHistory loads the order's events, oldest first.
+func orderHistory(orderID string) ([]StoredOrderEvent, error) {
+	rows, err := db.Query("SELECT id, order_id, type, data, actor, created_at FROM order_events WHERE order_id = ? ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []StoredOrderEvent
+	for rows.Next() {
+		var ev StoredOrderEvent
+		var data string
+		if err := rows.Scan(&ev.ID, &ev.OrderID, &ev.Type, &data, &ev.Actor, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		ev.Data = json.RawMessage(data)
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// applyOrderEvent folds ev into o and reports whether the order no longer exists.
+func applyOrderEvent(o *Order, ev StoredOrderEvent) (deleted bool, err error) {
+	switch ev.Type {
+	case OrderEventOrdered:
+		*o = Order{}
+		if err := json.Unmarshal(ev.Data, o); err != nil {
+			return false, err
+		}
+		o.CreatedAt = ev.CreatedAt
+		if o.StoreID == 0 {
+			// Recorded before orders had a store.
+			o.StoreID = 1
+		}
+	case OrderEventStatusChanged:
+		var c StatusChange
+		if err := json.Unmarshal(ev.Data, &c); err != nil {
+			return false, err
+		}
+		o.Status = c.To
+	case OrderEventCancelled:
+		o.Status = "CANCELLED"
+	case OrderEventDeliveryScheduled:
+		var d DeliverySchedule
+		if err := json.Unmarshal(ev.Data, &d); err != nil {
+			return false, err
+		}
+		o.DeliveryDate, o.DeliverySlotID, o.DeliverySlot = d.Date, d.SlotID, d.Label
+	case OrderEventShippingCharged:
+		var c ShippingCharge
+		if err := json.Unmarshal(ev.Data, &c); err != nil {
+			return false, err
+		}
+		o.PostalCode, o.ShippingFee, o.Pickup = c.PostalCode, c.Fee, c.Pickup
+		o.TotalAmount = o.TotalAmount + c.Fee
+	case OrderEventAddressSet:
+		var a DeliveryAddress
+		if err := json.Unmarshal(ev.Data, &a); err != nil {
+			return false, err
+		}
+		o.Address, o.Latitude, o.Longitude, o.OutsideArea = a.Address, a.Latitude, a.Longitude, a.OutsideArea
+	case OrderEventPaymentMethodSet:
+		var p PaymentMethodChoice
+		if err := json.Unmarshal(ev.Data, &p); err != nil {
+			return false, err
+		}
+		o.PaymentMethod = p.Method
+	case OrderEventItemsUpdated:
+		var c ItemStatusChange
+		if err := json.Unmarshal(ev.Data, &c); err != nil {
+			return false, err
+		}
+		for _, line := range c.Lines {
+			if line < 0 || line >= len(o.Items) {
+				continue
+			}
+			o.Items[line].Status = c.Status
+			if c.LocationID != 0 {
+				o.Items[line].LocationID = c.LocationID
+			}
+		}
+	case OrderEventEdited:
+		var e OrderEdit
+		if err := json.Unmarshal(ev.Data, &e); err != nil {
+			return false, err
+		}
+		e.apply(o)
+	case OrderEventSplit:
+		var s OrderSplit
+		if err := json.Unmarshal(ev.Data, &s); err != nil {
+			return false, err
+		}
+		s.apply(o)
+	case OrderEventMerged:
+		var m OrderMerge
+		if err := json.Unmarshal(ev.Data, &m); err != nil {
+			return false, err
+		}
+		m.apply(o)
+	case OrderEventMergedInto:
+		var m OrderMergedInto
+		if err := json.Unmarshal(ev.Data, &m); err != nil {
+			return false, err
+		}
+		o.Status, o.MergedInto, o.Items = "MERGED", m.TargetOrderID, nil
+		o.DeliveryDate, o.DeliverySlotID, o.DeliverySlot = "", 0, ""
+	case OrderEventRushRequested:
+		var c RushCharge
+		if err := json.Unmarshal(ev.Data, &c); err != nil {
+			return false, err
+		}
+		o.Priority, o.RushFee = true, c.Fee
+		o.TotalAmount = o.TotalAmount + c.Fee
+	case OrderEventGiftWrapped:
+		var g GiftWrap
+		if err := json.Unmarshal(ev.Data, &g); err != nil {
+			return false, err
+		}
+		g.apply(o)
+	case OrderEventPaid, OrderEventRefunded:
+		// Payments are not projected onto the orders row.
+	case OrderEventDeleted:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown order event type %q", ev.Type)
+	}
+	o.UpdatedAt = ev.CreatedAt
+	return false, nil
+}
+
+// backfillOrderEvents synthesises events for orders created before the log existed.
+func backfillOrderEvents() error {
+	rows, err := db.Query("SELECT " + orderColumns + " FROM orders WHERE NOT EXISTS (SELECT 1 FROM order_events e WHERE e.order_id = orders.order_id)")
+	if err != nil {
+		return err
+	}
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			rows.Close()
+			return err
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, o := range orders {
+		current := o.Status
+		o.Status = statuses[0]
+		data, _ := json.Marshal(o)
+		if _, err := db.Exec("INSERT INTO order_events (order_id, type, data, created_at) SELECT ?, ?, ?, created_at FROM orders WHERE id = ?",
+			o.OrderID, OrderEventOrdered, string(data), o.ID); err != nil {
+			return err
+		}
+		if current != o.Status {
+			if err := recordOrderEvent(db, o.OrderID, OrderEventStatusChanged, StatusChange{From: o.Status, To: current}); err != nil {
+				return err
+			}
+		}
+	}
+	if len(orders) > 0 {
+		log.Printf("backfilled events for %d orders", len(orders))
+	}
+	return nil
+}
+
+// rebuildOrders replays the event log and rewrites every orders row from it.
+// Deleted orders keep their rows, with deleted_at set from the deleted event.
+func rebuildOrders() error {
+	if err := backfillOrderEvents(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, order_id, type, data, created_at FROM order_events ORDER BY id")
+	if err != nil {
+		return err
+	}
+	projected := map[string]*Order{}
+	deletedAt := map[string]time.Time{}
+	var order []string
+	for rows.Next() {
+		var ev StoredOrderEvent
+		var data string
+		if err := rows.Scan(&ev.ID, &ev.OrderID, &ev.Type, &data, &ev.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		ev.Data = json.RawMessage(data)
+		o := projected[ev.OrderID]
+		if o == nil {
+			order = append(order, ev.OrderID)
+			o = &Order{}
+			projected[ev.OrderID] = o
+		}
+		deleted, err := applyOrderEvent(o, ev)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("event %d: %v", ev.ID, err)
+		}
+		if deleted {
+			deletedAt[ev.OrderID] = ev.CreatedAt
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, orderID := range order {
+		o := projected[orderID]
+		var deleted sql.NullTime
+		if at, ok := deletedAt[orderID]; ok {
+			deleted = sql.NullTime{Time: at, Valid: true}
+		}
+		if o.OrderID == "" {
+			// Placed before the log existed and deleted since, so there is
+			// nothing to project but the deletion.
+			if _, err := tx.Exec("UPDATE orders SET deleted_at = COALESCE(deleted_at, ?) WHERE order_id = ?", deleted, orderID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := upsertOrderRow(tx, o, deleted); err != nil {
+			return err
+		}
+		// Events recorded before order_items existed carry no items; keep
+		// the backfilled rows for those.
+		if len(o.Items) > 0 {
+			if _, err := tx.Exec("DELETE FROM order_items WHERE order_id = ?", orderID); err != nil {
+				return err
+			}
+			if err := insertOrderItems(tx, orderID, o.Items); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("rebuilt %d orders from the event log", len(order))
+	return nil
+}
+
+func upsertOrderRow(tx *sql.Tx, o *Order, deletedAt sql.NullTime) error {
+	_, err := tx.Exec(`INSERT INTO orders (id, order_id, customer_id, size, quantity, total_amount, status, created_at, store_id, notes,
+			delivery_date, delivery_slot_id, postal_code, shipping_fee, address, latitude, longitude, outside_area, pickup,
+			payment_method, priority, rush_fee, parent_order_id, tracking_code, merged_into, channel, gift_wrap, gift_wrap_fee, gift_message, updated_at, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0), ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(NULLIF(?, ''), 'ONLINE'), ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE order_id = VALUES(order_id), customer_id = VALUES(customer_id), size = VALUES(size),
+			quantity = VALUES(quantity), total_amount = VALUES(total_amount), status = VALUES(status), store_id = VALUES(store_id),
+			notes = VALUES(notes), delivery_date = VALUES(delivery_date), delivery_slot_id = VALUES(delivery_slot_id),
+			postal_code = VALUES(postal_code), shipping_fee = VALUES(shipping_fee), address = VALUES(address),
+			latitude = VALUES(latitude), longitude = VALUES(longitude), outside_area = VALUES(outside_area),
+			pickup = VALUES(pickup), payment_method = VALUES(payment_method),
+			priority = VALUES(priority), rush_fee = VALUES(rush_fee), parent_order_id = VALUES(parent_order_id),
+			tracking_code = VALUES(tracking_code), merged_into = VALUES(merged_into), channel = VALUES(channel),
+			gift_wrap = VALUES(gift_wrap), gift_wrap_fee = VALUES(gift_wrap_fee), gift_message = VALUES(gift_message), updated_at = VALUES(updated_at),
+			deleted_at = VALUES(deleted_at)`,
+		o.ID, o.OrderID, o.CustomerID, o.Size, o.Quantity, o.TotalAmount, o.Status, o.CreatedAt, o.StoreID, o.Notes,
+		o.DeliveryDate, o.DeliverySlotID, o.PostalCode, o.ShippingFee,
+		o.Address, o.Latitude, o.Longitude, o.OutsideArea, o.Pickup,
+		o.PaymentMethod, o.Priority, o.RushFee, o.ParentOrderID, o.TrackingCode, o.MergedInto, o.Channel,
+		o.GiftWrap, o.GiftWrapFee, o.GiftMessage, o.UpdatedAt, deletedAt)
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// /admin/orders/{id}/export.json downloads everything we hold about one
+// order as a single JSON document, to attach to a support escalation or a
+// bug report. Besides the order, its items, payments, event log and
+// comments, Related has the rows of every other table that refers to the
+// order (tickets, ledger entries, stock movements…) as they are stored,
+// and the order's audit log entries.
+
+type OrderExport struct {
+	ExportedAt  time.Time                           `json:"exported_at"`
+	ExportedBy  string                              `json:"exported_by,omitempty"`
+	Order       Order                               `json:"order"`
+	Reservation *StockReservation                   `json:"reservation,omitempty"`
+	Payments    []OrderPaymentEntry                 `json:"payments"`
+	History     []StoredOrderEvent                  `json:"history"`
+	Comments    []*OrderComment                     `json:"comments"`
+	Related     map[string][]map[string]interface{} `json:"related"`
+}
+
+// Tables the export covers in its own sections.
+var orderExportSections = map[string]bool{
+	"orders": true, "order_items": true, "order_events": true, "order_comments": true, "stock_reservations": true,
+}
+
+// queryRows returns the rows of query as column-to-value maps.
+func queryRows(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	out := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		for i, c := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[c] = string(b)
+			} else {
+				row[c] = values[i]
+			}
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+// relatedOrderRows finds the rows of other tables with an order_id column
+// that refer to orderID.
+func relatedOrderRows(orderID string) (map[string][]map[string]interface{}, error) {
+	rows, err := db.Query("SELECT TABLE_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND COLUMN_NAME = 'order_id' ORDER BY TABLE_NAME")
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !orderExportSections[table] {
+			tables = append(tables, table)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	related := map[string][]map[string]interface{}{}
+	for _, table := range tables {
+		found, err := queryRows("SELECT * FROM `"+table+"` WHERE order_id = ?", orderID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", table, err)
+		}
+		if len(found) > 0 {
+			related[table] = found
+		}
+	}
+	audit, err := queryRows("SELECT * FROM audit_log WHERE entity_id = ? AND action LIKE 'order.%' ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	if len(audit) > 0 {
+		related["audit_log"] = audit
+	}
+	return related, nil
+}
+
+func exportOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	o, err := storeOrder(currentStoreID(r), orderID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	export := OrderExport{ExportedAt: time.Now(), ExportedBy: staffUser(r), Order: o}
+	if export.Order.Items, err = orderItems(orderID); err == nil {
+		export.Reservation, err = orderReservation(orderID)
+	}
+	if err == nil {
+		export.History, err = orderHistory(orderID)
+	}
+	if err == nil {
+		export.Payments = orderPayments(export.History)
+		export.Comments, err = orderComments(orderID)
+	}
+	if err == nil {
+		export.Related, err = relatedOrderRows(orderID)
+	}
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "order.export", orderID, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="order-`+orderID+`.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(export)
+}
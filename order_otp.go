@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Orders placed on the website under a phone number we don't know yet wait
+// for a code texted to it, which stops prank orders with made-up numbers or
+// someone else's. The form is kept in the session meanwhile and placed as
+// posted once the code is entered. A number is known once a code sent to
+// it has been entered, here or to sign in, or an order to it was
+// delivered. Staff taking an order and customers signed in as its contact
+// skip this; the order_otp feature turns it off. Codes are texted at most
+// once a minute and ORDER_CODES_PER_NUMBER (3) times an hour to a number,
+// and ORDER_CODES_PER_IP (10) times an hour for one address.
+
+const orderCodeResendWait = time.Minute
+
+func init() {
+	registerScheduledTask("order-code-send-cleanup", "25 * * * *", func() error {
+		_, err := db.Exec("DELETE FROM order_code_sends WHERE sent_at < NOW() - INTERVAL 1 DAY")
+		return err
+	})
+}
+
+func contactVerified(contact string) (bool, error) {
+	var ok bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM verified_contacts WHERE contact = ?)
+		OR EXISTS (SELECT 1 FROM orders WHERE customer_id = ? AND status = 'DELIVERED')`, contact, contact).Scan(&ok)
+	return ok, err
+}
+
+// markContactVerified records that a code texted to contact was entered.
+func markContactVerified(contact string) error {
+	_, err := db.Exec("INSERT IGNORE INTO verified_contacts (contact) VALUES (?)", contact)
+	return err
+}
+
+// orderNeedsCode is whether an order being placed under contact must wait
+// for a texted code.
+func orderNeedsCode(r *http.Request, contact string) (bool, error) {
+	if !featureEnabled("order_otp") || strings.Contains(contact, "@") || staffUser(r) != "" || customerContact(r) == contact {
+		return false, nil
+	}
+	verified, err := contactVerified(contact)
+	return !verified, err
+}
+
+// holdOrderForCode keeps the posted order form and texts a code to contact.
+func holdOrderForCode(w http.ResponseWriter, r *http.Request, contact string) {
+	if err := useFormToken(db, r); err == errFormTokenUsed {
+		http.Error(w, formTokenUsedMessage, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	sess := getSession(r)
+	sess.Values["order_code_contact"] = contact
+	sess.Values["order_code_form"] = r.PostForm.Encode()
+	_ = saveSession(sess)
+	sendOrderCode(w, r)
+}
+
+// orderCodeSendRefusal says why no more codes can be texted to contact from
+// ip for now, or is "" when one can.
+func orderCodeSendRefusal(contact, ip string) (string, error) {
+	var recent bool
+	var toNumber, fromIP int
+	err := db.QueryRow(`SELECT
+		EXISTS (SELECT 1 FROM order_code_sends WHERE contact = ? AND sent_at >= NOW() - INTERVAL ? SECOND),
+		(SELECT COUNT(*) FROM order_code_sends WHERE contact = ? AND sent_at >= NOW() - INTERVAL 1 HOUR),
+		(SELECT COUNT(*) FROM order_code_sends WHERE ip = ? AND sent_at >= NOW() - INTERVAL 1 HOUR)`,
+		contact, int(orderCodeResendWait.Seconds()), contact, ip).Scan(&recent, &toNumber, &fromIP)
+	switch {
+	case err != nil:
+		return "", err
+	case recent:
+		return "We just texted you a code. Wait a minute before asking for another.", nil
+	case toNumber >= envInt("ORDER_CODES_PER_NUMBER", 3), fromIP >= envInt("ORDER_CODES_PER_IP", 10):
+		return "We've texted too many codes. Please try again in an hour.", nil
+	}
+	return "", nil
+}
+
+func sendOrderCode(w http.ResponseWriter, r *http.Request) {
+	back := "/place-order/verify"
+	sess := getSession(r)
+	contact := sess.Values["order_code_contact"]
+	if contact == "" {
+		redirectWithFlash(w, r, "/place-order", "error", "Your order wasn't kept. Please fill it in again.")
+		return
+	}
+	if wait, err := loginWait("order", contact, clientIP(r)); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	} else if wait > 0 {
+		redirectWithFlash(w, r, back, "error", orderCodeWaitMessage(wait))
+		return
+	}
+	if reason, err := orderCodeSendRefusal(contact, clientIP(r)); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	} else if reason != "" {
+		redirectWithFlash(w, r, back, "error", reason)
+		return
+	}
+	code, err := oneTimeCode()
+	if err != nil {
+		http.Error(w, "Could not create a code", http.StatusInternalServerError)
+		return
+	}
+	_, msg := notificationText("order_code", map[string]string{"Code": code})
+	if _, err := db.Exec("INSERT INTO order_code_sends (contact, ip) VALUES (?, ?)", contact, clientIP(r)); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if err := enqueueJob("sms", SMSMessage{To: contact, Message: msg}); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	sess.Values["order_code_token"] = signToken("order-code", contact+"\x00"+code, 10*time.Minute)
+	sess.Values["order_code_attempts"] = "0"
+	_ = saveSession(sess)
+	redirectWithFlash(w, r, back, "success", "We texted a code to "+contact+".")
+}
+
+func orderCodeWaitMessage(wait time.Duration) string {
+	return fmt.Sprintf("Too many wrong codes. Try again in %s.", wait.Round(time.Second))
+}
+
+func orderCodePage(w http.ResponseWriter, r *http.Request) {
+	contact := getSession(r).Values["order_code_contact"]
+	if contact == "" {
+		http.Redirect(w, r, "/place-order", http.StatusSeeOther)
+		return
+	}
+	t := mustParseTemplates("order_verify.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Contact string
+		Flashes []Flash
+	}{contact, popFlashes(r)})
+}
+
+// verifyOrderCode checks the code and, if it is right, places the kept order.
+func verifyOrderCode(w http.ResponseWriter, r *http.Request) {
+	back := "/place-order/verify"
+	sess := getSession(r)
+	contact := sess.Values["order_code_contact"]
+	if contact == "" {
+		redirectWithFlash(w, r, "/place-order", "error", "Your order wasn't kept. Please fill it in again.")
+		return
+	}
+	wait, err := loginWait("order", contact, clientIP(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		redirectWithFlash(w, r, back, "error", orderCodeWaitMessage(wait))
+		return
+	}
+	attempts, _ := strconv.Atoi(sess.Values["order_code_attempts"])
+	code := strings.TrimSpace(r.FormValue("code"))
+	if attempts >= maxLoginAttempts || !verifyToken("order-code", contact+"\x00"+code, sess.Values["order_code_token"]) {
+		if err := recordLoginFailure("order", contact, clientIP(r)); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		attempts++
+		msg := "That code is wrong or has expired."
+		if attempts >= maxLoginAttempts {
+			delete(sess.Values, "order_code_token")
+			msg = "Too many attempts. Ask for a new code."
+		}
+		sess.Values["order_code_attempts"] = strconv.Itoa(attempts)
+		_ = saveSession(sess)
+		redirectWithFlash(w, r, back, "error", msg)
+		return
+	}
+
+	if err := clearLoginFailures("order", contact); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if err := markContactVerified(contact); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	form, _ := url.ParseQuery(sess.Values["order_code_form"])
+	for _, k := range []string{"order_code_contact", "order_code_form", "order_code_token", "order_code_attempts"} {
+		delete(sess.Values, k)
+	}
+	_ = saveSession(sess)
+	// The kept form was checked, and its token used, when it was sent.
+	r = withCheckedForm(r)
+	r.Form, r.PostForm = form, form
+	placeOrderPage(w, r)
+}
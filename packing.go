@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Packing slips tell the warehouse what goes in each parcel and where it
+// is going, without prices. They are printed one per page, for a single
+// order from its page or for a day's deliveries, optionally one slot, from
+// the deliveries page.
+
+type PackingSlipBatch struct {
+	Title  string
+	Back   string
+	Store  Store
+	Orders []Order
+}
+
+func renderPackingSlips(w http.ResponseWriter, batch PackingSlipBatch) {
+	for i := range batch.Orders {
+		items, err := orderItems(batch.Orders[i].OrderID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		batch.Orders[i].Items = items
+	}
+	t := mustParseTemplates("packing_slips.html")
+	_ = t.Execute(w, batch)
+}
+
+func orderPackingSlip(w http.ResponseWriter, r *http.Request) {
+	o, err := storeOrder(currentStoreID(r), mux.Vars(r)["orderID"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	renderPackingSlips(w, PackingSlipBatch{
+		Title:  "Packing slip " + o.OrderID,
+		Back:   "/orders/" + url.PathEscape(o.OrderID),
+		Store:  storeSwitcher(r).CurrentStore(),
+		Orders: []Order{o},
+	})
+}
+
+// deliveryPackingSlips prints slips for the orders still to go out on
+// ?date=, in the slot ?slot= if given.
+func deliveryPackingSlips(w http.ResponseWriter, r *http.Request) {
+	date := r.URL.Query().Get("date")
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		redirectWithFlash(w, r, "/admin/deliveries", "error", "Pick a delivery date to print packing slips for.")
+		return
+	}
+	where, args := "WHERE store_id = ? AND delivery_date = ? AND status NOT IN ('CANCELLED', 'DELIVERED', 'MERGED') AND deleted_at IS NULL", []interface{}{currentStoreID(r), date}
+	title := "Packing slips for " + date
+	if slot, _ := strconv.Atoi(r.URL.Query().Get("slot")); slot != 0 {
+		where += " AND delivery_slot_id = ?"
+		args = append(args, slot)
+		var label string
+		_ = db.QueryRow("SELECT label FROM delivery_slots WHERE id = ?", slot).Scan(&label)
+		title += ", " + label
+	}
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders "+where+" ORDER BY delivery_slot_id, priority DESC, created_at", args...)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			rows.Close()
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	renderPackingSlips(w, PackingSlipBatch{
+		Title:  title,
+		Back:   "/admin/deliveries?date=" + date,
+		Store:  storeSwitcher(r).CurrentStore(),
+		Orders: orders,
+	})
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are stored as argon2id hashes in the PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>. bcrypt hashes ($2a$, $2b$,
+// $2y$) are accepted as well, so credentials can come over from htpasswd
+// files. A stored hash that is bcrypt, or was made with other parameters
+// than PASSWORD_ARGON2_MEMORY (KiB), PASSWORD_ARGON2_TIME and
+// PASSWORD_ARGON2_THREADS, is replaced at the next successful sign-in.
+//
+// Stored hashes live in the credentials table by kind ("admin", …) and
+// account. An account without one falls back to its configured password,
+// which may be plain text or a hash.
+
+const passwordCheckTTL = time.Minute
+
+var passwordEncoding = base64.RawStdEncoding
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func currentArgon2Params() argon2Params {
+	return argon2Params{
+		memory:  uint32(envInt("PASSWORD_ARGON2_MEMORY", 64*1024)),
+		time:    uint32(envInt("PASSWORD_ARGON2_TIME", 3)),
+		threads: uint8(envInt("PASSWORD_ARGON2_THREADS", 2)),
+	}
+}
+
+func hashPassword(password string) (string, error) {
+	p := currentArgon2Params()
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads,
+		passwordEncoding.EncodeToString(salt), passwordEncoding.EncodeToString(key)), nil
+}
+
+func isPasswordHash(s string) bool {
+	return strings.HasPrefix(s, "$argon2id$") || strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// checkPassword reports whether password matches the hash encoded, and
+// whether the hash is due to be replaced.
+func checkPassword(password, encoded string) (ok, rehash bool) {
+	if !strings.HasPrefix(encoded, "$argon2id$") {
+		ok := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) == nil
+		return ok, ok
+	}
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+	var version int
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return false, false
+	}
+	salt, err1 := passwordEncoding.DecodeString(parts[4])
+	want, err2 := passwordEncoding.DecodeString(parts[5])
+	if err1 != nil || err2 != nil || len(want) == 0 {
+		return false, false
+	}
+	got := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return false, false
+	}
+	return true, p != currentArgon2Params()
+}
+
+// configuredPasswordMatches checks password against one set in the
+// environment, as plain text or a hash.
+func configuredPasswordMatches(password, configured string) bool {
+	if isPasswordHash(configured) {
+		ok, _ := checkPassword(password, configured)
+		return ok
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(configured)) == 1
+}
+
+// Basic auth sends the password with every request, so a match is
+// remembered briefly instead of hashing it each time. Entries are keyed by
+// an HMAC under a per-process key, never the password itself.
+var passwordChecks struct {
+	sync.Mutex
+	key    []byte
+	passed map[string]time.Time
+}
+
+func passwordCheckKey(parts ...string) string {
+	passwordChecks.Lock()
+	defer passwordChecks.Unlock()
+	if passwordChecks.key == nil {
+		passwordChecks.key = make([]byte, 32)
+		if _, err := rand.Read(passwordChecks.key); err != nil {
+			panic(err)
+		}
+	}
+	mac := hmac.New(sha256.New, passwordChecks.key)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return string(mac.Sum(nil))
+}
+
+func recentlyPassed(key string) bool {
+	passwordChecks.Lock()
+	defer passwordChecks.Unlock()
+	return time.Now().Before(passwordChecks.passed[key])
+}
+
+func rememberPassed(key string) {
+	passwordChecks.Lock()
+	defer passwordChecks.Unlock()
+	if passwordChecks.passed == nil {
+		passwordChecks.passed = map[string]time.Time{}
+	}
+	now := time.Now()
+	for k, until := range passwordChecks.passed {
+		if now.After(until) {
+			delete(passwordChecks.passed, k)
+		}
+	}
+	passwordChecks.passed[key] = now.Add(passwordCheckTTL)
+}
+
+func forgetPasswordChecks() {
+	passwordChecks.Lock()
+	passwordChecks.passed = nil
+	passwordChecks.Unlock()
+}
+
+func storedPassword(kind, account string) (string, error) {
+	var encoded string
+	err := db.QueryRow("SELECT password_hash FROM credentials WHERE kind = ? AND account = ?", kind, account).Scan(&encoded)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return encoded, err
+}
+
+func setPassword(ex execer, kind, account, password string) error {
+	encoded, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT INTO credentials (kind, account, password_hash) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE password_hash = VALUES(password_hash)`, kind, account, encoded)
+	forgetPasswordChecks()
+	return err
+}
+
+// verifyCredential checks password against the account's stored hash or,
+// without one, against configured. A stored hash made the old way is
+// rehashed on the spot.
+func verifyCredential(kind, account, password, configured string) (bool, error) {
+	key := passwordCheckKey(kind, account, password, configured)
+	if recentlyPassed(key) {
+		return true, nil
+	}
+	encoded, err := storedPassword(kind, account)
+	if err != nil {
+		return false, err
+	}
+	var ok, rehash bool
+	if encoded == "" {
+		ok = configured != "" && configuredPasswordMatches(password, configured)
+	} else {
+		ok, rehash = checkPassword(password, encoded)
+	}
+	if !ok {
+		return false, nil
+	}
+	if rehash {
+		if err := setPassword(db, kind, account, password); err != nil {
+			log.Printf("rehashing %s password for %s: %v", kind, account, err)
+		}
+	}
+	rememberPassed(key)
+	return true, nil
+}
+
+const minPasswordLength = 12
+
+// changeAdminPassword stores a new password for the signed-in admin. From
+// then on the one in the environment no longer works for them.
+func changeAdminPassword(w http.ResponseWriter, r *http.Request) {
+	user, _ := adminUser(r)
+	back := "/admin/security"
+	current, password := r.FormValue("current"), r.FormValue("password")
+	ok, err := verifyCredential("admin", user, current, configuredPassword(user))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case !ok:
+		redirectWithFlash(w, r, back, "error", "Your current password is wrong.")
+		return
+	case len(password) < minPasswordLength:
+		redirectWithFlash(w, r, back, "error", fmt.Sprintf("Choose a password of at least %d characters.", minPasswordLength))
+		return
+	case password != r.FormValue("confirm"):
+		redirectWithFlash(w, r, back, "error", "The new passwords don't match.")
+		return
+	case password == current:
+		redirectWithFlash(w, r, back, "error", "Choose a password you haven't been using.")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	err = setPassword(tx, "admin", user, password)
+	if err == nil {
+		err = recordAudit(tx, r, "password.change", user, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	forgetPasswordChecks()
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", "Password changed. Your browser will ask you to sign in again with the new one.")
+}
+
+// hashPasswordCommand prints the hash of a password read from stdin, for
+// ADMIN_PASSWORD: hash-password.
+func hashPasswordCommand(args []string) error {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("usage: echo <password> | hash-password")
+	}
+	encoded, err := hashPassword(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(encoded)
+	return nil
+}
+
+// resetPasswordCommand drops an admin's stored password, so the one in
+// the environment works again: reset-password <user>.
+func resetPasswordCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: reset-password <user>")
+	}
+	if _, err := db.Exec("DELETE FROM credentials WHERE kind = 'admin' AND account = ?", args[0]); err != nil {
+		return err
+	}
+	log.Printf("stored password cleared for %s; the configured one applies again", args[0])
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPassword(t *testing.T) {
+	t.Setenv("PASSWORD_ARGON2_MEMORY", "1024")
+	t.Setenv("PASSWORD_ARGON2_TIME", "1")
+	t.Setenv("PASSWORD_ARGON2_THREADS", "1")
+	current, err := hashPassword("s3cret pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PASSWORD_ARGON2_TIME", "2")
+	older, err := hashPassword("s3cret pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PASSWORD_ARGON2_TIME", "1")
+	bcrypted, err := bcrypt.GenerateFromPassword([]byte("s3cret pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(current, "$")
+
+	tests := []struct {
+		name, password, encoded string
+		ok, rehash              bool
+	}{
+		{"argon2id", "s3cret pass", current, true, false},
+		{"argon2id wrong password", "s3cret Pass", current, false, false},
+		{"argon2id empty password", "", current, false, false},
+		{"argon2id other parameters", "s3cret pass", older, true, true},
+		{"argon2id other parameters wrong password", "wrong", older, false, false},
+		{"bcrypt", "s3cret pass", string(bcrypted), true, true},
+		{"bcrypt wrong password", "wrong", string(bcrypted), false, false},
+		{"other version", "s3cret pass", strings.Replace(current, "$v=19$", "$v=16$", 1), false, false},
+		{"missing field", "s3cret pass", strings.Join(parts[:5], "$"), false, false},
+		{"bad parameters", "s3cret pass", strings.Replace(current, "m=1024", "m=lots", 1), false, false},
+		{"bad salt", "s3cret pass", strings.Join([]string{"", parts[1], parts[2], parts[3], "!!", parts[5]}, "$"), false, false},
+		{"empty hash", "s3cret pass", strings.Join([]string{"", parts[1], parts[2], parts[3], parts[4], ""}, "$"), false, false},
+		{"plain text", "s3cret pass", "s3cret pass", false, false},
+	}
+	for _, tt := range tests {
+		ok, rehash := checkPassword(tt.password, tt.encoded)
+		if ok != tt.ok || rehash != tt.rehash {
+			t.Errorf("%s: checkPassword = %t, %t, want %t, %t", tt.name, ok, rehash, tt.ok, tt.rehash)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Orders come in online or over the counter. A walk-in sale is paid and
+// handed over on the spot, so it is recorded as an order that is delivered
+// the moment it is placed, and shows up in the same reports as the rest.
+const (
+	ChannelOnline = "ONLINE"
+	ChannelWalkIn = "WALK_IN"
+)
+
+// In-store payments, taken at the counter.
+const (
+	PaymentCash = "cash"
+	PaymentCard = "card"
+)
+
+type WalkInSale struct {
+	OrderID   string
+	Item      string
+	Quantity  int
+	Amount    Money
+	Method    string
+	CreatedAt time.Time
+}
+
+func posPage(w http.ResponseWriter, r *http.Request) {
+	variants, err := activeVariantsIn(0)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query(`SELECT o.order_id, COALESCE((SELECT MIN(i.product_name) FROM order_items i WHERE i.order_id = o.order_id), ''),
+			o.quantity, o.total_amount, o.payment_method, o.created_at
+		FROM orders o WHERE o.store_id = ? AND o.channel = ? AND o.deleted_at IS NULL AND DATE(o.created_at) = CURDATE() ORDER BY o.id DESC`, currentStoreID(r), ChannelWalkIn)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var sales []WalkInSale
+	var total Money
+	for rows.Next() {
+		var s WalkInSale
+		if err := rows.Scan(&s.OrderID, &s.Item, &s.Quantity, &s.Amount, &s.Method, &s.CreatedAt); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		sales = append(sales, s)
+		total += s.Amount
+	}
+	t := mustParseTemplates("pos.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		Variants []Variant
+		Sales    []WalkInSale
+		Total    Money
+		Flashes  []Flash
+	}{storeSwitcher(r), variants, sales, total, popFlashes(r)})
+}
+
+type posSaleForm struct {
+	VariantID int    `form:"variant" label:"Product" validate:"required"`
+	Quantity  int    `form:"qty" label:"Quantity" validate:"required,min=1"`
+	Payment   string `form:"payment" validate:"required,oneof=cash card"`
+	Contact   string `form:"contact" validate:"maxlen=100"`
+}
+
+func posSale(w http.ResponseWriter, r *http.Request) {
+	back := "/admin/pos"
+	var f posSaleForm
+	if errs := decodeForm(r, &f); errs != nil {
+		redirectWithFlash(w, r, back, "error", errs.Error())
+		return
+	}
+	qty, method, contact := f.Quantity, f.Payment, f.Contact
+	v, err := variantByID(f.VariantID)
+	if err == sql.ErrNoRows || (err == nil && !v.Active) {
+		redirectWithFlash(w, r, back, "error", "That product is no longer sold.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	storeID := currentStoreID(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	available, tracked, err := availableStock(tx, storeID, v.ID, stockQueueStatuses)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if tracked && available < qty {
+		redirectWithFlash(w, r, back, "error", fmt.Sprintf("Only %d of %s can be sold; the rest is held for open orders.", max(available, 0), v.Label()))
+		return
+	}
+	order, err := sellWalkIn(tx, r, storeID, v, qty, method, contact, staffUser(r))
+	if err == nil {
+		err = recordAudit(tx, r, "order.walk_in", order.OrderID, fmt.Sprintf("%d × %s, %.2f by %s", qty, v.SKU, order.TotalAmount, method))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	emitOrderEvent(OrderEvent{Type: EventOrderCreated, OrderID: order.OrderID, Order: &order})
+	http.Redirect(w, r, "/admin/pos/"+url.PathEscape(order.OrderID)+"/receipt", http.StatusSeeOther)
+}
+
+// sellWalkIn records a sale over the counter inside tx: the stock leaves the
+// store, the order is delivered and the payment is booked. r is nil when
+// nobody is signed in, as for sales synced from an offline till.
+func sellWalkIn(tx *sql.Tx, r *http.Request, storeID int, v Variant, qty int, method, contact, actor string) (Order, error) {
+	order, err := createOrder(tx, storeID, ChannelWalkIn, contact, v, qty, "", actor)
+	if err == nil {
+		err = setPaymentMethod(tx, &order, method)
+	}
+	if err == nil {
+		err = fulfilOrder(tx, r, order.OrderID)
+	}
+	if err == nil {
+		err = markItemsDelivered(tx, order.OrderID)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE orders SET status = 'DELIVERED' WHERE order_id = ?", order.OrderID)
+	}
+	if err == nil {
+		err = recordOrderEventBy(tx, order.OrderID, OrderEventStatusChanged, actor, StatusChange{From: order.Status, To: "DELIVERED"})
+	}
+	if err == nil {
+		err = recordOrderEventBy(tx, order.OrderID, OrderEventPaid, actor, OrderPayment{Method: method, Amount: order.TotalAmount})
+	}
+	if err == nil {
+		err = recordLedgerEntry(tx, storeID, order.OrderID, LedgerWalkInSale, method, order.TotalAmount, "", actor)
+	}
+	order.Status = "DELIVERED"
+	return order, err
+}
+
+func posReceipt(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND store_id = ? AND channel = ? AND deleted_at IS NULL", orderID, currentStoreID(r), ChannelWalkIn), &o)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if o.Items, err = orderItems(orderID); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var servedBy string
+	_ = db.QueryRow("SELECT actor FROM order_events WHERE order_id = ? AND type = ? ORDER BY id LIMIT 1", orderID, OrderEventOrdered).Scan(&servedBy)
+	t := mustParseTemplates("pos_receipt.html")
+	_ = t.Execute(w, struct {
+		Store    Store
+		Order    Order
+		ServedBy string
+	}{storeSwitcher(r).CurrentStore(), o, servedBy})
+}
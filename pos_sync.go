@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tills keep selling while the internet is down and upload the sales they
+// rang up once it is back. Each till numbers its own sales; the code is
+// remembered with a fingerprint of the sale, so uploading a batch again
+// answers with the orders made the first time, and a code reused for a
+// different sale is reported as a conflict instead of being booked.
+// Tills authenticate with POS_API_KEY.
+const (
+	SyncCreated   = "created"
+	SyncDuplicate = "duplicate"
+	SyncConflict  = "conflict"
+	SyncRejected  = "rejected"
+)
+
+const maxSyncBatch = 200
+
+type offlineSale struct {
+	Code      string `json:"code"`
+	SKU       string `json:"sku"`
+	VariantID int    `json:"variant_id"`
+	Quantity  int    `json:"quantity"`
+	Payment   string `json:"payment"`
+	Contact   string `json:"contact"`
+	Cashier   string `json:"cashier"`
+	SoldAt    string `json:"sold_at"`
+}
+
+// fingerprint identifies what was sold, so a replay can be told apart
+// from a different sale under the same code.
+func (s offlineSale) fingerprint() string {
+	b, _ := json.Marshal(s)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type posSyncRequest struct {
+	Terminal string        `json:"terminal"`
+	Store    string        `json:"store"`
+	Sales    []offlineSale `json:"sales"`
+}
+
+type posSyncResult struct {
+	Code    string `json:"code"`
+	Status  string `json:"status"`
+	OrderID string `json:"order_id,omitempty"`
+	Amount  Money  `json:"amount,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func posSyncSales(w http.ResponseWriter, r *http.Request) {
+	var req posSyncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONInvalid(w, errInvalidJSON)
+		return
+	}
+	req.Terminal = strings.TrimSpace(req.Terminal)
+	if req.Terminal == "" || len(req.Terminal) > 50 {
+		writeJSONError(w, http.StatusBadRequest, "terminal is required, at most 50 characters")
+		return
+	}
+	if len(req.Sales) == 0 || len(req.Sales) > maxSyncBatch {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("send between 1 and %d sales", maxSyncBatch))
+		return
+	}
+	storeID := 1
+	if req.Store != "" {
+		s, err := storeByCode(req.Store)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Unknown store")
+			return
+		}
+		storeID = s.ID
+	}
+
+	results := make([]posSyncResult, 0, len(req.Sales))
+	created := 0
+	for _, sale := range req.Sales {
+		res, order, err := syncOfflineSale(storeID, req.Terminal, sale)
+		if err != nil {
+			log.Printf("pos sync %s/%s: %v", req.Terminal, sale.Code, err)
+			res = posSyncResult{Code: sale.Code, Status: SyncRejected, Error: "DB error, try again"}
+		}
+		if res.Status == SyncCreated {
+			created++
+			emitOrderEvent(OrderEvent{Type: EventOrderCreated, OrderID: order.OrderID, Order: &order})
+		}
+		results = append(results, res)
+	}
+	if created > 0 {
+		_ = recordAudit(db, r, "pos.sync", req.Terminal, fmt.Sprintf("%d of %d sales booked", created, len(req.Sales)))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// syncOfflineSale books one sale in its own transaction, so a bad sale
+// doesn't hold back the rest of the batch.
+func syncOfflineSale(storeID int, terminal string, sale offlineSale) (posSyncResult, Order, error) {
+	res := posSyncResult{Code: strings.TrimSpace(sale.Code)}
+	reject := func(msg string) (posSyncResult, Order, error) {
+		res.Status, res.Error = SyncRejected, msg
+		return res, Order{}, nil
+	}
+	if res.Code == "" || len(res.Code) > 50 {
+		return reject("code is required, at most 50 characters")
+	}
+	if sale.Quantity < 1 || sale.Quantity > 100 {
+		return reject("quantity must be between 1 and 100")
+	}
+	if sale.Payment != PaymentCash && sale.Payment != PaymentCard {
+		return reject("payment must be cash or card")
+	}
+	soldAt := time.Now()
+	if sale.SoldAt != "" {
+		t, err := time.Parse(time.RFC3339, sale.SoldAt)
+		if err != nil {
+			return reject("sold_at must be an RFC 3339 time")
+		}
+		maxAge := time.Duration(envInt("POS_SYNC_MAX_AGE_DAYS", 30)) * 24 * time.Hour
+		if t.After(time.Now().Add(5*time.Minute)) || t.Before(time.Now().Add(-maxAge)) {
+			return reject("sold_at is in the future or too long ago")
+		}
+		soldAt = t
+	}
+	var v Variant
+	var err error
+	if sale.SKU != "" {
+		v, err = variantBySKU(strings.ToUpper(sale.SKU))
+	} else {
+		v, err = variantByID(sale.VariantID)
+	}
+	if err == sql.ErrNoRows {
+		return reject("unknown product")
+	} else if err != nil {
+		return res, Order{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return res, Order{}, err
+	}
+	defer tx.Rollback()
+	fp := sale.fingerprint()
+	ins, err := tx.Exec("INSERT IGNORE INTO pos_sync (terminal, code, fingerprint, order_id) VALUES (?, ?, ?, '')", terminal, res.Code, fp)
+	if err != nil {
+		return res, Order{}, err
+	}
+	if n, _ := ins.RowsAffected(); n == 0 {
+		var seen string
+		err := tx.QueryRow(`SELECT s.fingerprint, s.order_id, COALESCE(o.total_amount, 0) FROM pos_sync s LEFT JOIN orders o ON o.order_id = s.order_id
+			WHERE s.terminal = ? AND s.code = ?`, terminal, res.Code).Scan(&seen, &res.OrderID, &res.Amount)
+		if err != nil {
+			return res, Order{}, err
+		}
+		res.Status = SyncDuplicate
+		if seen != fp {
+			res.Status, res.Error = SyncConflict, "code "+res.Code+" was already used for a different sale on this till"
+		}
+		return res, Order{}, nil
+	}
+
+	actor := "pos:" + terminal
+	if c := strings.TrimSpace(sale.Cashier); c != "" {
+		actor = c
+	}
+	// The goods have left the shop already, so the sale is booked even
+	// when the system thought they were held for other orders.
+	order, err := sellWalkIn(tx, nil, storeID, v, sale.Quantity, sale.Payment, strings.TrimSpace(sale.Contact), actor)
+	if err == nil {
+		err = backdateOrder(tx, order.OrderID, soldAt)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE pos_sync SET order_id = ? WHERE terminal = ? AND code = ?", order.OrderID, terminal, res.Code)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return res, Order{}, err
+	}
+	order.CreatedAt = soldAt.Local()
+	res.Status, res.OrderID, res.Amount = SyncCreated, order.OrderID, order.TotalAmount
+	return res, order, nil
+}
+
+// backdateOrder moves an order, its events and its ledger entries to when
+// the sale actually happened, so day totals and the journal match the till.
+func backdateOrder(tx *sql.Tx, orderID string, at time.Time) error {
+	for _, table := range []string{"orders", "order_events", "ledger_entries"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET created_at = ? WHERE order_id = ?", at, orderID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
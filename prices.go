@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Every change to a variant's price is kept in price_changes with who made
+// it and when it took effect, so the price that applied at any time can be
+// looked up again: editing an order keeps the price it was placed at.
+
+type PriceChange struct {
+	SKU         string
+	Label       string
+	OldPrice    Money // zero for the variant's first price
+	NewPrice    Money
+	ChangedBy   string
+	EffectiveAt time.Time
+}
+
+func recordPriceChange(ex execer, r *http.Request, variantID int, oldPrice, newPrice Money) error {
+	_, err := ex.Exec("INSERT INTO price_changes (variant_id, old_price, new_price, changed_by) VALUES (?, NULLIF(?, 0), ?, ?)",
+		variantID, oldPrice, newPrice, auditActor(r))
+	return err
+}
+
+// orderTimePrice is the price of v when orderID was placed: the last price
+// it was changed to before then, or failing that what it was changed from
+// after. Variants never changed have always had their current price.
+func orderTimePrice(tx *sql.Tx, orderID string, v Variant) (Money, error) {
+	var price Money
+	err := tx.QueryRow(`SELECT COALESCE(
+			(SELECT c.new_price FROM price_changes c WHERE c.variant_id = ? AND c.effective_at <= o.created_at ORDER BY c.effective_at DESC, c.id DESC LIMIT 1),
+			(SELECT c.old_price FROM price_changes c WHERE c.variant_id = ? AND c.effective_at > o.created_at ORDER BY c.effective_at, c.id LIMIT 1),
+			?) FROM orders o WHERE o.order_id = ?`, v.ID, v.ID, v.Price, orderID).Scan(&price)
+	return price, err
+}
+
+// priceHistory lists the latest price changes, those of ?sku= if given.
+func priceHistory(w http.ResponseWriter, r *http.Request) {
+	sku := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("sku")))
+	where, args := "", []interface{}{}
+	if sku != "" {
+		where, args = "WHERE v.sku = ?", append(args, sku)
+	}
+	rows, err := db.Query(`SELECT `+variantColumns+`, c.old_price, c.new_price, c.changed_by, c.effective_at FROM price_changes c
+		JOIN product_variants v ON v.id = c.variant_id JOIN products p ON p.id = v.product_id `+where+` ORDER BY c.effective_at DESC, c.id DESC LIMIT 200`, args...)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var changes []PriceChange
+	for rows.Next() {
+		var v Variant
+		var c PriceChange
+		if err := scanVariant(scanAlso{rows, []interface{}{&c.OldPrice, &c.NewPrice, &c.ChangedBy, &c.EffectiveAt}}, &v); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		c.SKU, c.Label = v.SKU, v.Label()
+		changes = append(changes, c)
+	}
+	t := mustParseTemplates("price_history.html", "partials.html")
+	_ = t.Execute(w, struct {
+		SKU     string
+		Changes []PriceChange
+		Flashes []Flash
+	}{sku, changes, popFlashes(r)})
+}
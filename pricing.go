@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pricing rules adjust a variant's list price by a percentage when an order
+// matches them: placed on certain days of the week, by a customer of a
+// loyalty tier, through a channel, for a product in a category or for at
+// least so many items. Empty conditions match anything. Every active rule
+// that matches applies, in priority order, each to the price the one before
+// left, so "+10% at weekends" and "-5% for gold customers" combine. The
+// price is worked out when the order is placed and kept on the order item.
+
+type PricingRule struct {
+	ID           int
+	Name         string
+	Days         string // comma-separated: "sat,sun"
+	Tier         string
+	Channel      string
+	CategoryID   int
+	CategoryName string
+	MinQuantity  int
+	Percent      float64
+	Priority     int
+	Active       bool
+}
+
+// PricingContext is what the rules are matched against.
+type PricingContext struct {
+	At         time.Time
+	Contact    string
+	Tier       string
+	Channel    string
+	Quantity   int
+	Categories []int
+}
+
+// AppliedRule is a rule that changed a price, and by how much.
+type AppliedRule struct {
+	Name    string  `json:"name"`
+	Percent float64 `json:"percent"`
+}
+
+var errUnknownSKU = errors.New("no variant has that SKU")
+
+var pricingDays = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+
+// Loyalty tiers, from lifetime spend on delivered orders; see loyaltyTier.
+const (
+	TierBronze = "bronze"
+	TierSilver = "silver"
+	TierGold   = "gold"
+)
+
+var loyaltyTiers = []string{TierBronze, TierSilver, TierGold}
+
+// OnDay reports whether the rule is limited to day ("mon" to "sun").
+func (p PricingRule) OnDay(day string) bool {
+	for _, d := range strings.Split(p.Days, ",") {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (p PricingRule) matches(c PricingContext) bool {
+	if p.Days != "" && !p.OnDay(strings.ToLower(c.At.Weekday().String()[:3])) {
+		return false
+	}
+	if (p.Tier != "" && p.Tier != c.Tier) || (p.Channel != "" && p.Channel != c.Channel) || c.Quantity < p.MinQuantity {
+		return false
+	}
+	if p.CategoryID == 0 {
+		return true
+	}
+	for _, id := range c.Categories {
+		if id == p.CategoryID {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPricingRules prices one item at base in context c. rules must be in
+// priority order.
+func applyPricingRules(rules []PricingRule, c PricingContext, base Money) (Money, []AppliedRule) {
+	price := base
+	var applied []AppliedRule
+	for _, p := range rules {
+		if p.Active && p.matches(c) {
+			price += price.Percent(p.Percent)
+			applied = append(applied, AppliedRule{p.Name, p.Percent})
+		}
+	}
+	if price < 0 {
+		price = 0
+	}
+	return price, applied
+}
+
+func loadPricingRules(q querier) ([]PricingRule, error) {
+	rows, err := q.Query(`SELECT r.id, r.name, r.days, r.tier, r.channel, COALESCE(r.category_id, 0), COALESCE(c.name, ''),
+		r.min_quantity, r.percent, r.priority, r.active
+		FROM pricing_rules r LEFT JOIN categories c ON c.id = r.category_id ORDER BY r.priority, r.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []PricingRule
+	for rows.Next() {
+		var p PricingRule
+		if err := rows.Scan(&p.ID, &p.Name, &p.Days, &p.Tier, &p.Channel, &p.CategoryID, &p.CategoryName,
+			&p.MinQuantity, &p.Percent, &p.Priority, &p.Active); err != nil {
+			return nil, err
+		}
+		rules = append(rules, p)
+	}
+	return rules, rows.Err()
+}
+
+type rowQuerier interface {
+	querier
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// loyaltyTier is the tier contact's delivered orders, at every store, have
+// earned. The thresholds are shop settings.
+func loyaltyTier(q rowQuerier, contact string) (string, error) {
+	var spent Money
+	err := q.QueryRow("SELECT COALESCE(SUM(total_amount), 0) FROM orders WHERE customer_id = ? AND status = 'DELIVERED'", contact).Scan(&spent)
+	switch {
+	case err != nil:
+		return "", err
+	case spent >= settingMoney("loyalty_gold_spend"):
+		return TierGold, nil
+	case spent >= settingMoney("loyalty_silver_spend"):
+		return TierSilver, nil
+	}
+	return TierBronze, nil
+}
+
+// dynamicPrice is the unit price of qty of v ordered by contact through
+// channel at the given time, starting from base.
+func dynamicPrice(q rowQuerier, at time.Time, contact, channel string, v Variant, qty int, base Money) (Money, []AppliedRule, PricingContext, error) {
+	c := PricingContext{At: at, Contact: contact, Channel: channel, Quantity: qty}
+	rules, err := loadPricingRules(q)
+	if err != nil {
+		return 0, nil, c, err
+	}
+	if c.Tier, err = loyaltyTier(q, contact); err != nil {
+		return 0, nil, c, err
+	}
+	rows, err := q.Query("SELECT category_id FROM product_categories WHERE product_id = ?", v.ProductID)
+	if err != nil {
+		return 0, nil, c, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, nil, c, err
+		}
+		c.Categories = append(c.Categories, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, c, err
+	}
+	price, applied := applyPricingRules(rules, c, base)
+	return price, applied, c, nil
+}
+
+// PricingPreview is what an item would cost, without ordering it.
+type PricingPreview struct {
+	SKU       string        `json:"sku"`
+	Quantity  int           `json:"quantity"`
+	Contact   string        `json:"contact,omitempty"`
+	Tier      string        `json:"tier"`
+	Channel   string        `json:"channel"`
+	At        string        `json:"at"`
+	BasePrice Money         `json:"base_price"`
+	UnitPrice Money         `json:"unit_price"`
+	Total     Money         `json:"total"`
+	Applied   []AppliedRule `json:"applied"`
+}
+
+// previewPrice dry-runs the pricing rules for ?sku=, ?qty=, ?contact=,
+// ?channel= and ?at= (2006-01-02T15:04, now by default).
+func previewPrice(r *http.Request) (PricingPreview, error) {
+	q := r.URL.Query()
+	v, err := variantBySKU(strings.ToUpper(strings.TrimSpace(q.Get("sku"))))
+	if err == sql.ErrNoRows {
+		return PricingPreview{}, errUnknownSKU
+	} else if err != nil {
+		return PricingPreview{}, err
+	}
+	qty, err := strconv.Atoi(q.Get("qty"))
+	if err != nil || qty < 1 {
+		qty = 1
+	}
+	at, err := time.ParseInLocation("2006-01-02T15:04", q.Get("at"), time.Local)
+	if err != nil {
+		at = time.Now()
+	}
+	channel := q.Get("channel")
+	if channel != ChannelWalkIn {
+		channel = ChannelOnline
+	}
+	contact := strings.TrimSpace(q.Get("contact"))
+	price, applied, c, err := dynamicPrice(db, at, contact, channel, v, qty, v.Price)
+	if err != nil {
+		return PricingPreview{}, err
+	}
+	return PricingPreview{v.SKU, qty, contact, c.Tier, channel, at.Format("2006-01-02T15:04"), v.Price, price,
+		price.Times(qty), append([]AppliedRule{}, applied...)}, nil
+}
+
+func pricingPreview(w http.ResponseWriter, r *http.Request) {
+	preview, err := previewPrice(r)
+	if err == errUnknownSKU {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	writeJSON(w, http.StatusOK, preview)
+}
+
+// pricingPage is the rule editor. Given a ?sku= it also shows the preview.
+func pricingPage(w http.ResponseWriter, r *http.Request) {
+	rules, err := loadPricingRules(db)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	categories, err := loadCategories()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var preview *PricingPreview
+	var previewError string
+	if r.URL.Query().Get("sku") != "" {
+		p, err := previewPrice(r)
+		if err == errUnknownSKU {
+			previewError = err.Error()
+		} else if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		} else {
+			preview = &p
+		}
+	}
+	t := mustParseTemplates("pricing.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Rules        []PricingRule
+		Categories   []Category
+		Days         []string
+		Tiers        []string
+		Channels     []string
+		Query        map[string]string
+		Preview      *PricingPreview
+		PreviewError string
+		Flashes      []Flash
+	}{rules, categories, pricingDays, loyaltyTiers, []string{ChannelOnline, ChannelWalkIn}, map[string]string{
+		"sku": r.URL.Query().Get("sku"), "qty": r.URL.Query().Get("qty"), "contact": r.URL.Query().Get("contact"),
+		"channel": r.URL.Query().Get("channel"), "at": r.URL.Query().Get("at"),
+	}, preview, previewError, popFlashes(r)})
+}
+
+func validPricingValue(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == value {
+			return true
+		}
+	}
+	return value == ""
+}
+
+// savePricingRule adds a rule, or updates one when an id is posted.
+func savePricingRule(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad form", http.StatusBadRequest)
+		return
+	}
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	name := strings.TrimSpace(r.FormValue("name"))
+	var days []string
+	for _, d := range r.Form["days"] {
+		if validPricingValue(d, pricingDays) && d != "" {
+			days = append(days, d)
+		}
+	}
+	tier, channel := r.FormValue("tier"), r.FormValue("channel")
+	categoryID, _ := strconv.Atoi(r.FormValue("category_id"))
+	minQty, _ := strconv.Atoi(r.FormValue("min_quantity"))
+	priority, _ := strconv.Atoi(r.FormValue("priority"))
+	percent, err := strconv.ParseFloat(r.FormValue("percent"), 64)
+	active := r.FormValue("active") == "on"
+	if name == "" || len(name) > 100 || err != nil || percent <= -100 || percent > 1000 || percent == 0 || minQty < 0 ||
+		!validPricingValue(tier, loyaltyTiers) || !validPricingValue(channel, []string{ChannelOnline, ChannelWalkIn}) {
+		redirectWithFlash(w, r, "/admin/pricing", "error", "A rule needs a name and a percentage above -100, other than 0.")
+		return
+	}
+	joined := strings.Join(days, ",")
+	if id == 0 {
+		var res sql.Result
+		res, err = db.Exec(`INSERT INTO pricing_rules (name, days, tier, channel, category_id, min_quantity, percent, priority, active, created_by)
+			VALUES (?, ?, ?, ?, NULLIF(?, 0), ?, ?, ?, ?, ?)`, name, joined, tier, channel, categoryID, minQty, percent, priority, active, auditActor(r))
+		if err == nil {
+			last, _ := res.LastInsertId()
+			id = int(last)
+		}
+	} else {
+		_, err = db.Exec(`UPDATE pricing_rules SET name = ?, days = ?, tier = ?, channel = ?, category_id = NULLIF(?, 0), min_quantity = ?,
+			percent = ?, priority = ?, active = ? WHERE id = ?`, name, joined, tier, channel, categoryID, minQty, percent, priority, active, id)
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "pricing_rule.save", strconv.Itoa(id), fmt.Sprintf("%s: %+g%% (days %q, tier %q, channel %q, category %d, from %d items, active %t)",
+		name, percent, joined, tier, channel, categoryID, minQty, active))
+	redirectWithFlash(w, r, "/admin/pricing", "success", "Pricing rule "+name+" saved.")
+}
+
+func deletePricingRule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := db.Exec("DELETE FROM pricing_rules WHERE id = ?", id); err != nil {
+		http.Error(w, "DB delete error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "pricing_rule.delete", id, "")
+	redirectWithFlash(w, r, "/admin/pricing", "success", "Pricing rule deleted.")
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Made-to-measure orders are made in the workshop before they go out. They
+// move from PROCESSING through the production stages to DELIVERING, and each
+// stage can be assigned to a worker; the production board at
+// /admin/production shows where every one of them is. Other orders go
+// straight from PROCESSING to DELIVERING.
+var productionStages = []string{"CUTTING", "SEWING", "QC"}
+
+// madeToOrderColumn selects whether an order is made to measure, which it
+// is when measurements were taken for it.
+const madeToOrderColumn = "EXISTS (SELECT 1 FROM order_measurements m WHERE m.order_id = orders.order_id)"
+
+// nextOrderStatus is the status staff advance an order in status to, or ""
+// when it can't be advanced by hand.
+func nextOrderStatus(status string, madeToOrder bool) string {
+	switch status {
+	case "PROCESSING":
+		if madeToOrder {
+			return productionStages[0]
+		}
+		return "DELIVERING"
+	case "PARTIALLY_SHIPPED":
+		return "DELIVERING"
+	case "DELIVERING":
+		return "DELIVERED"
+	}
+	for i, stage := range productionStages {
+		if stage == status {
+			if i+1 < len(productionStages) {
+				return productionStages[i+1]
+			}
+			return "DELIVERING"
+		}
+	}
+	return ""
+}
+
+func isProductionStage(status string) bool {
+	for _, stage := range productionStages {
+		if stage == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ProductionOrder is a card on the production board.
+type ProductionOrder struct {
+	Order
+	Workers   map[string]string // by stage
+	NextStage string
+}
+
+// Worker is who the order's current stage, or for orders not started yet
+// the first, is assigned to.
+func (p ProductionOrder) Worker() string {
+	if isProductionStage(p.Status) {
+		return p.Workers[p.Status]
+	}
+	return p.Workers[productionStages[0]]
+}
+
+// Stage is the stage the card's worker assignment is for.
+func (p ProductionOrder) Stage() string {
+	if isProductionStage(p.Status) {
+		return p.Status
+	}
+	return productionStages[0]
+}
+
+type ProductionColumn struct {
+	Status string
+	Orders []ProductionOrder
+}
+
+func productionBoard(w http.ResponseWriter, r *http.Request) {
+	worker := strings.TrimSpace(r.URL.Query().Get("worker"))
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE store_id = ? AND status IN ('PROCESSING', 'CUTTING', 'SEWING', 'QC') AND deleted_at IS NULL AND "+madeToOrderColumn+
+		" ORDER BY priority DESC, COALESCE(delivery_date, '9999-12-31'), created_at", currentStoreID(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var orders []ProductionOrder
+	for rows.Next() {
+		var p ProductionOrder
+		if err := scanOrder(rows, &p.Order); err != nil {
+			rows.Close()
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		p.Workers = map[string]string{}
+		p.NextStage = nextOrderStatus(p.Status, true)
+		orders = append(orders, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	assigned, err := db.Query(`SELECT a.order_id, a.stage, a.worker FROM production_assignments a
+		JOIN orders o ON o.order_id = a.order_id WHERE o.store_id = ? AND o.status IN ('PROCESSING', 'CUTTING', 'SEWING', 'QC')`, currentStoreID(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	byOrder := map[string]map[string]string{}
+	for _, p := range orders {
+		byOrder[p.OrderID] = p.Workers
+	}
+	for assigned.Next() {
+		var orderID, stage, name string
+		if err := assigned.Scan(&orderID, &stage, &name); err != nil {
+			assigned.Close()
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if workers, ok := byOrder[orderID]; ok {
+			workers[stage] = name
+		}
+	}
+	assigned.Close()
+
+	columns := []ProductionColumn{{Status: "PROCESSING"}}
+	for _, stage := range productionStages {
+		columns = append(columns, ProductionColumn{Status: stage})
+	}
+	for i := range orders {
+		o := orders[i]
+		o.Items, err = orderItems(o.OrderID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if worker != "" && !strings.EqualFold(o.Worker(), worker) {
+			continue
+		}
+		for j := range columns {
+			if columns[j].Status == o.Status {
+				columns[j].Orders = append(columns[j].Orders, o)
+			}
+		}
+	}
+
+	var workers []string
+	names, err := db.Query("SELECT DISTINCT worker FROM production_assignments ORDER BY worker")
+	if err == nil {
+		for names.Next() {
+			var name string
+			if names.Scan(&name) == nil {
+				workers = append(workers, name)
+			}
+		}
+		names.Close()
+	}
+	t := mustParseTemplates("production_board.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		Columns []ProductionColumn
+		Workers []string
+		Worker  string
+		Flashes []Flash
+	}{storeSwitcher(r), columns, workers, worker, popFlashes(r)})
+}
+
+// assignProductionStage gives one stage of a made-to-measure order to a
+// worker, or takes it back when no worker is given.
+func assignProductionStage(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	back := "/admin/production"
+	stage := r.FormValue("stage")
+	worker := strings.TrimSpace(r.FormValue("worker"))
+	if !isProductionStage(stage) || utf8.RuneCountInString(worker) > 100 {
+		redirectWithFlash(w, r, back, "error", "Pick a production stage and a worker name of up to 100 characters.")
+		return
+	}
+	var madeToOrder bool
+	err := db.QueryRow("SELECT "+madeToOrderColumn+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", orderID, currentStoreID(r)).Scan(&madeToOrder)
+	if err == sql.ErrNoRows || (err == nil && !madeToOrder) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if worker == "" {
+		_, err = db.Exec("DELETE FROM production_assignments WHERE order_id = ? AND stage = ?", orderID, stage)
+	} else {
+		_, err = db.Exec(`INSERT INTO production_assignments (order_id, stage, worker, assigned_by) VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE worker = VALUES(worker), assigned_by = VALUES(assigned_by), assigned_at = CURRENT_TIMESTAMP`,
+			orderID, stage, worker, auditActor(r))
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "production.assign", orderID, stage+": "+worker)
+	if worker == "" {
+		redirectWithFlash(w, r, back, "success", stage+" on "+orderID+" is no longer assigned.")
+		return
+	}
+	redirectWithFlash(w, r, back, "success", stage+" on "+orderID+" assigned to "+worker+".")
+}
+
+// advanceProduction moves a made-to-measure order on to its next stage from
+// the production board.
+func advanceProduction(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	back := "/admin/production"
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	change, err := advanceOrderStatus(tx, r, orderID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	switch err {
+	case nil:
+	case errOrderNotFound:
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	case errOrderFinal:
+		redirectWithFlash(w, r, back, "error", "Order "+orderID+" is "+change.From+" and cannot be advanced.")
+		return
+	case errInsufficientMaterial:
+		redirectWithFlash(w, r, back, "error", "There is not enough material in stock to cut "+orderID+". See the low-material report.")
+		return
+	default:
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	var o Order
+	if err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ?", orderID), &o); err == nil {
+		emitOrderEvent(OrderEvent{Type: EventOrderStatusChanged, OrderID: orderID, Order: &o, OldStatus: change.From})
+	}
+	redirectWithFlash(w, r, back, "success", "Order "+orderID+" is now "+change.To+".")
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type PushNotification struct {
+	CustomerID string            `json:"customer_id"`
+	Title      string            `json:"title"`
+	Body       string            `json:"body"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+var pushStatusMessages = map[string]string{
+	"PROCESSING":        "Good news: the items for your order %s are back in stock and we are preparing it.",
+	"PARTIALLY_SHIPPED": "Part of your order %s is on its way. The rest follows as soon as it is back in stock.",
+	"CUTTING":           "Work has started on your made-to-measure order %s.",
+	"QC":                "Your made-to-measure order %s is made and going through our final checks.",
+	"DELIVERING":        "Your order %s is out for delivery.",
+	"DELIVERED":         "Your order %s has been delivered. Enjoy!",
+	"REFUSED":           "Your order %s was returned to us as refused. Contact us if this was a mistake.",
+}
+
+func init() {
+	registerJobHandler("push", func(payload []byte) error {
+		var n PushNotification
+		if err := json.Unmarshal(payload, &n); err != nil {
+			return err
+		}
+		return sendPush(n)
+	})
+	onOrderEvent(func(ev OrderEvent) {
+		if ev.Type != EventOrderStatusChanged || ev.Order == nil || envOr("FCM_CREDENTIALS_FILE", "") == "" {
+			return
+		}
+		msg, ok := pushStatusMessages[ev.Order.Status]
+		if !ok {
+			return
+		}
+		err := enqueueJob("push", PushNotification{
+			CustomerID: ev.Order.CustomerID,
+			Title:      "Order " + ev.Order.Status,
+			Body:       fmt.Sprintf(msg, ev.OrderID),
+			Data:       map[string]string{"order_id": ev.OrderID, "status": ev.Order.Status},
+		})
+		if err != nil {
+			log.Printf("push: enqueue for %s: %v", ev.OrderID, err)
+		}
+	})
+}
+
+func sendPush(n PushNotification) error {
+	var optedOut bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM push_preferences WHERE customer_id = ? AND opted_out = TRUE", n.CustomerID).Scan(&optedOut)
+	if err != nil || optedOut {
+		return err
+	}
+
+	rows, err := db.Query("SELECT token FROM device_tokens WHERE customer_id = ?", n.CustomerID)
+	if err != nil {
+		return err
+	}
+	var tokens []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+
+	var failed []string
+	for _, token := range tokens {
+		err := fcm.send(token, n)
+		if errors.Is(err, errTokenUnregistered) {
+			db.Exec("DELETE FROM device_tokens WHERE token = ?", token)
+			continue
+		}
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+var errTokenUnregistered = errors.New("fcm: token unregistered")
+
+// fcmClient sends through the FCM HTTP v1 API using a service account key.
+type fcmClient struct {
+	mu          sync.Mutex
+	creds       *serviceAccount
+	accessToken string
+	expiry      time.Time
+}
+
+type serviceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+var fcm = &fcmClient{}
+
+func (c *fcmClient) send(token string, n PushNotification) error {
+	access, projectID, err := c.token()
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        token,
+			"notification": map[string]string{"title": n.Title, "body": n.Body},
+			"data":         n.Data,
+		},
+	})
+	req, err := http.NewRequest(http.MethodPost, "https://fcm.googleapis.com/v1/projects/"+projectID+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+access)
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errTokenUnregistered
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("fcm returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (c *fcmClient) token() (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds == nil {
+		data, err := os.ReadFile(envOr("FCM_CREDENTIALS_FILE", ""))
+		if err != nil {
+			return "", "", err
+		}
+		var sa serviceAccount
+		if err := json.Unmarshal(data, &sa); err != nil {
+			return "", "", err
+		}
+		if sa.TokenURI == "" {
+			sa.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+		c.creds = &sa
+	}
+	if c.accessToken != "" && time.Now().Before(c.expiry) {
+		return c.accessToken, c.creds.ProjectID, nil
+	}
+
+	assertion, err := signServiceAccountJWT(c.creds, "https://www.googleapis.com/auth/firebase.messaging")
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := http.PostForm(c.creds.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", "", err
+	}
+	if tok.AccessToken == "" {
+		return "", "", fmt.Errorf("fcm token exchange failed: %s", resp.Status)
+	}
+	c.accessToken = tok.AccessToken
+	c.expiry = time.Now().Add(time.Duration(tok.ExpiresIn-60) * time.Second)
+	return c.accessToken, c.creds.ProjectID, nil
+}
+
+func signServiceAccountJWT(sa *serviceAccount, scope string) (string, error) {
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return "", errors.New("service account private key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("service account key is not RSA")
+	}
+
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": sa.ClientEmail, "scope": scope, "aud": sa.TokenURI,
+		"iat": now, "exp": now + 3600,
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+type deviceRegistration struct {
+	CustomerID string `json:"customer_id"`
+	Token      string `json:"token"`
+	Platform   string `json:"platform"`
+}
+
+func registerDevice(w http.ResponseWriter, r *http.Request) {
+	var d deviceRegistration
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		writeJSONInvalid(w, errInvalidJSON)
+		return
+	}
+	if strings.TrimSpace(d.CustomerID) == "" || strings.TrimSpace(d.Token) == "" {
+		writeJSONError(w, http.StatusBadRequest, "customer_id and token are required")
+		return
+	}
+	_, err := db.Exec("INSERT INTO device_tokens (customer_id, token, platform) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE customer_id = VALUES(customer_id), platform = VALUES(platform)",
+		d.CustomerID, d.Token, d.Platform)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, d)
+}
+
+func unregisterDevice(w http.ResponseWriter, r *http.Request) {
+	if _, err := db.Exec("DELETE FROM device_tokens WHERE token = ?", mux.Vars(r)["token"]); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setPushPreference(w http.ResponseWriter, r *http.Request) {
+	var p struct {
+		CustomerID string `json:"customer_id"`
+		Enabled    bool   `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil || strings.TrimSpace(p.CustomerID) == "" {
+		writeJSONError(w, http.StatusBadRequest, "customer_id and enabled are required")
+		return
+	}
+	_, err := db.Exec("INSERT INTO push_preferences (customer_id, opted_out) VALUES (?, ?) ON DUPLICATE KEY UPDATE opted_out = VALUES(opted_out)",
+		p.CustomerID, !p.Enabled)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Read-only mode keeps the shop browsable while the database is migrated or
+// backed up: anything that would change data is turned away with 503, and
+// job workers and scheduled tasks wait until it is over. READ_ONLY=true
+// forces it on. Otherwise it is switched from the admin dashboard or with
+// the read-only command, and reaches other servers within SETTINGS_CACHE_TTL.
+
+const readOnlyMessage = "The shop is in read-only mode for maintenance, so nothing can be changed right now. Please try again in a few minutes."
+
+func readOnly() bool {
+	if on, _ := strconv.ParseBool(envOr("READ_ONLY", "")); on {
+		return true
+	}
+	return setting("read_only") == "true"
+}
+
+// readOnlyGuard rejects writes while the shop is read-only. The switch
+// itself, and the admin code check in front of it, stay open so it can be
+// turned off again.
+func readOnlyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == "/admin/read-only" || r.URL.Path == "/admin/two-factor" || !readOnly() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "300")
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeAPIError(w, http.StatusServiceUnavailable, "read_only", readOnlyMessage, nil)
+			return
+		}
+		if isHTMX(r) {
+			w.Header().Set("HX-Reswap", "none")
+		}
+		http.Error(w, readOnlyMessage, http.StatusServiceUnavailable)
+	})
+}
+
+func setReadOnly(on bool, actor string) error {
+	_, err := db.Exec("INSERT INTO settings (name, value, updated_by) VALUES ('read_only', ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value), updated_by = VALUES(updated_by)",
+		strconv.FormatBool(on), actor)
+	forgetSettings()
+	return err
+}
+
+func toggleReadOnly(w http.ResponseWriter, r *http.Request) {
+	on := r.FormValue("enabled") == "1"
+	err := setReadOnly(on, auditActor(r))
+	if err == nil {
+		err = recordAudit(db, r, "read_only", "shop", strconv.FormatBool(on))
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	msg := "The shop is open for changes again."
+	if on {
+		msg = "The shop is read-only. Orders, status changes and deletes are refused until you switch it back."
+	}
+	if !on && readOnly() {
+		msg = "READ_ONLY is set in the environment, so the shop stays read-only until it is removed."
+	}
+	redirectWithFlash(w, r, "/admin", "success", msg)
+}
+
+// readOnlyCommand switches read-only mode from a migration or backup
+// script: read-only on|off.
+func readOnlyCommand(args []string) error {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return fmt.Errorf("usage: read-only on|off")
+	}
+	if err := setReadOnly(args[0] == "on", "command"); err != nil {
+		return err
+	}
+	log.Printf("read-only mode %s; other servers follow within %s", args[0], envOr("SETTINGS_CACHE_TTL", "1m"))
+	return nil
+}
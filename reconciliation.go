@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Payments staff confirm on prepaid orders are checked against the payment
+// gateway's settlement reports. Reports are fetched from
+// SETTLEMENT_REPORT_URL when it is set, or uploaded as CSV by staff. Every
+// run records the mismatches it finds as exceptions for staff to look into,
+// and closes the ones that have since cleared up.
+const (
+	ExceptionUnpaidShipped  = "unpaid_shipped"
+	ExceptionPaidMissing    = "paid_missing"
+	ExceptionAmountMismatch = "amount_mismatch"
+	ExceptionUnsettled      = "unsettled"
+)
+
+var exceptionLabels = map[string]string{
+	ExceptionUnpaidShipped:  "Sent out but not paid",
+	ExceptionPaidMissing:    "Settled but no prepaid order",
+	ExceptionAmountMismatch: "Amount mismatch",
+	ExceptionUnsettled:      "Confirmed but not settled",
+}
+
+type PaymentException struct {
+	ID         int
+	StoreID    int
+	OrderID    string
+	Kind       string
+	Recorded   Money
+	Settled    Money
+	DetectedAt time.Time
+}
+
+func (e PaymentException) Label() string {
+	return exceptionLabels[e.Kind]
+}
+
+var settlementColumns = map[string]string{
+	"reference": "reference", "transaction_id": "reference", "txn_id": "reference",
+	"order_id": "order_id", "order": "order_id", "merchant_reference": "order_id",
+	"amount": "amount", "net_amount": "amount",
+	"fee": "fee", "gateway_fee": "fee", "commission": "fee",
+	"settled_at": "settled_at", "date": "settled_at", "settlement_date": "settled_at",
+}
+
+// importSettlements stores the lines of a settlement report CSV. Lines
+// already imported, by reference, are skipped, so overlapping reports are
+// fine. The gateway's fees on new lines go to the ledger. It returns how
+// many lines were new.
+func importSettlements(in io.Reader, source string) (int, error) {
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return 0, fmt.Errorf("reading header: %v", err)
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		if col, ok := settlementColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			cols[col] = i
+		}
+	}
+	for _, col := range []string{"reference", "order_id", "amount"} {
+		if _, ok := cols[col]; !ok {
+			return 0, fmt.Errorf("missing column %s", col)
+		}
+	}
+
+	added := 0
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return added, fmt.Errorf("line %d: %v", line, err)
+		}
+		field := func(col string) string {
+			if i, ok := cols[col]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		amount, err := parseMoney(field("amount"))
+		if err != nil || field("reference") == "" {
+			return added, fmt.Errorf("line %d: needs a reference and an amount", line)
+		}
+		fee, _ := parseMoney(field("fee"))
+		settledAt := time.Now()
+		if t, err := time.Parse("2006-01-02", firstN(field("settled_at"), 10)); err == nil {
+			settledAt = t
+		}
+		res, err := db.Exec("INSERT IGNORE INTO settlements (reference, order_id, amount, fee, settled_at, source) VALUES (?, ?, ?, ?, ?, ?)",
+			field("reference"), field("order_id"), amount, fee, settledAt.Format("2006-01-02"), source)
+		if err != nil {
+			return added, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		added++
+		if fee > 0 {
+			var storeID int
+			_ = db.QueryRow("SELECT store_id FROM orders WHERE order_id = ?", field("order_id")).Scan(&storeID)
+			if err := recordLedgerEntry(db, storeID, field("order_id"), LedgerGatewayFee, "gateway", -fee, field("reference"), "system"); err != nil {
+				return added, err
+			}
+		}
+	}
+	return added, nil
+}
+
+func firstN(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// fetchSettlementReport imports the gateway's report when one is configured.
+func fetchSettlementReport() (int, error) {
+	endpoint := envOr("SETTLEMENT_REPORT_URL", "")
+	if endpoint == "" {
+		return 0, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	if key := envOr("SETTLEMENT_REPORT_KEY", ""); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("settlement report returned %s", resp.Status)
+	}
+	return importSettlements(resp.Body, "gateway")
+}
+
+// recordedPrepayments sums the advance payments staff confirmed per order.
+func recordedPrepayments(since time.Time) (map[string]Money, error) {
+	rows, err := db.Query("SELECT order_id, data FROM order_events WHERE type = ? AND created_at >= ?", OrderEventPaid, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	paid := map[string]Money{}
+	for rows.Next() {
+		var orderID string
+		var data []byte
+		if err := rows.Scan(&orderID, &data); err != nil {
+			return nil, err
+		}
+		var p OrderPayment
+		if json.Unmarshal(data, &p) == nil && p.Method == PaymentPrepaid {
+			paid[orderID] = paid[orderID] + p.Amount
+		}
+	}
+	return paid, rows.Err()
+}
+
+// reconcilePayments fetches the latest settlement report and compares the
+// last RECONCILE_LOOKBACK_DAYS of prepaid orders against what settled.
+// Confirmed payments get SETTLEMENT_GRACE_DAYS to show up in a report.
+func reconcilePayments() error {
+	if _, err := fetchSettlementReport(); err != nil {
+		return err
+	}
+	since := time.Now().AddDate(0, 0, -envInt("RECONCILE_LOOKBACK_DAYS", 60))
+	grace := time.Now().AddDate(0, 0, -envInt("SETTLEMENT_GRACE_DAYS", 3))
+
+	recorded, err := recordedPrepayments(since)
+	if err != nil {
+		return err
+	}
+	settled := map[string]Money{}
+	rows, err := db.Query("SELECT order_id, SUM(amount) FROM settlements WHERE settled_at >= ? GROUP BY order_id", since)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var orderID string
+		var amount Money
+		if err := rows.Scan(&orderID, &amount); err != nil {
+			rows.Close()
+			return err
+		}
+		settled[orderID] = amount
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var found []PaymentException
+	seen := map[string]bool{}
+	rows, err = db.Query("SELECT order_id, store_id, status, created_at FROM orders WHERE payment_method = ? AND created_at >= ?", PaymentPrepaid, since)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var orderID, status string
+		var storeID int
+		var createdAt time.Time
+		if err := rows.Scan(&orderID, &storeID, &status, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		seen[orderID] = true
+		e := PaymentException{StoreID: storeID, OrderID: orderID, Recorded: recorded[orderID], Settled: settled[orderID]}
+		switch {
+		case status == "CANCELLED" && e.Settled > 0:
+			e.Kind = ExceptionPaidMissing
+		case status == "CANCELLED":
+			continue
+		case e.Settled == 0 && (status == "PARTIALLY_SHIPPED" || status == "DELIVERING" || status == "DELIVERED"):
+			e.Kind = ExceptionUnpaidShipped
+		case e.Settled > 0 && e.Settled != e.Recorded:
+			e.Kind = ExceptionAmountMismatch
+		case e.Recorded > 0 && e.Settled == 0 && createdAt.Before(grace):
+			e.Kind = ExceptionUnsettled
+		default:
+			continue
+		}
+		found = append(found, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for orderID, amount := range settled {
+		if !seen[orderID] {
+			var storeID int
+			_ = db.QueryRow("SELECT store_id FROM orders WHERE order_id = ?", orderID).Scan(&storeID)
+			found = append(found, PaymentException{StoreID: storeID, OrderID: orderID, Kind: ExceptionPaidMissing, Recorded: recorded[orderID], Settled: amount})
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Whatever this run doesn't find again has been sorted out.
+	if _, err := tx.Exec("UPDATE payment_exceptions SET stale = TRUE WHERE resolved_at IS NULL"); err != nil {
+		return err
+	}
+	for _, e := range found {
+		_, err := tx.Exec(`INSERT INTO payment_exceptions (store_id, order_id, kind, recorded, settled) VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE recorded = VALUES(recorded), settled = VALUES(settled), stale = FALSE,
+				resolved_at = IF(resolved_by = 'reconciliation', NULL, resolved_at), resolved_by = IF(resolved_at IS NULL, '', resolved_by)`,
+			e.StoreID, e.OrderID, e.Kind, e.Recorded, e.Settled)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE payment_exceptions SET resolved_at = NOW(), resolved_by = 'reconciliation', stale = FALSE WHERE stale"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func paymentExceptionsPage(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT id, store_id, order_id, kind, recorded, settled, detected_at FROM payment_exceptions
+		WHERE resolved_at IS NULL AND store_id IN (0, ?) ORDER BY detected_at, id`, currentStoreID(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var exceptions []PaymentException
+	for rows.Next() {
+		var e PaymentException
+		if err := rows.Scan(&e.ID, &e.StoreID, &e.OrderID, &e.Kind, &e.Recorded, &e.Settled, &e.DetectedAt); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		exceptions = append(exceptions, e)
+	}
+	var lastSettlement time.Time
+	_ = db.QueryRow("SELECT MAX(settled_at) FROM settlements").Scan(nullTime{&lastSettlement})
+	t := mustParseTemplates("payment_exceptions.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Exceptions     []PaymentException
+		LastSettlement time.Time
+		Flashes        []Flash
+	}{exceptions, lastSettlement, popFlashes(r)})
+}
+
+func uploadSettlements(w http.ResponseWriter, r *http.Request) {
+	back := "/admin/payment-exceptions"
+	if err := r.ParseMultipartForm(5 << 20); err != nil {
+		redirectWithFlash(w, r, back, "error", "Upload a CSV file of at most 5 MB.")
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		redirectWithFlash(w, r, back, "error", "Choose a settlement report to upload.")
+		return
+	}
+	defer file.Close()
+	added, err := importSettlements(file, header.Filename)
+	if err != nil {
+		redirectWithFlash(w, r, back, "error", fmt.Sprintf("%s: %v. %d line(s) were imported before the problem.", header.Filename, err, added))
+		return
+	}
+	_ = recordAudit(db, r, "settlement.import", header.Filename, fmt.Sprintf("%d new lines", added))
+	if err := reconcilePayments(); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", fmt.Sprintf("Imported %d new settlement line(s) and reconciled.", added))
+}
+
+// resolvePaymentException closes an exception staff have dealt with; the
+// next run won't raise it again.
+func resolvePaymentException(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	note := strings.TrimSpace(r.FormValue("note"))
+	if note == "" || len(note) > 300 {
+		redirectWithFlash(w, r, "/admin/payment-exceptions", "error", "Say in up to 300 characters how the exception was resolved.")
+		return
+	}
+	res, err := db.Exec("UPDATE payment_exceptions SET resolved_at = NOW(), resolved_by = ?, note = ? WHERE id = ? AND resolved_at IS NULL AND store_id IN (0, ?)",
+		auditActor(r), note, id, currentStoreID(r))
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		redirectWithFlash(w, r, "/admin/payment-exceptions", "error", "That exception is already resolved.")
+		return
+	}
+	_ = recordAudit(db, r, "payment_exception.resolve", id, note)
+	redirectWithFlash(w, r, "/admin/payment-exceptions", "success", "Exception resolved.")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ReorderSuggestion is computed per variant from recent sales velocity: enough
+// stock to cover the supplier lead time plus REORDER_COVER_DAYS, minus what is
+// already in stock or on open purchase orders.
+type ReorderSuggestion struct {
+	VariantID    int     `json:"variant_id"`
+	SKU          string  `json:"sku"`
+	Label        string  `json:"label"`
+	SoldLastDays int     `json:"sold"`
+	DailyRate    float64 `json:"daily_rate"`
+	InStock      int     `json:"in_stock"`
+	OnOrder      int     `json:"on_order"`
+	DaysLeft     float64 `json:"days_left"`
+	Suggested    int     `json:"suggested"`
+}
+
+type PurchaseOrder struct {
+	ID        int
+	Status    string
+	CreatedBy string
+	CreatedAt time.Time
+	Lines     []PurchaseOrderLine
+}
+
+type PurchaseOrderLine struct {
+	SKU      string
+	Quantity int
+}
+
+func reorderSuggestions(storeID int) ([]ReorderSuggestion, error) {
+	lookback := envInt("REORDER_LOOKBACK_DAYS", 30)
+	horizon := envInt("REORDER_LEAD_DAYS", 14) + envInt("REORDER_COVER_DAYS", 30)
+
+	variants, err := activeVariants()
+	if err != nil {
+		return nil, err
+	}
+	var out []ReorderSuggestion
+	for _, v := range variants {
+		out = append(out, ReorderSuggestion{VariantID: v.ID, SKU: v.SKU, Label: v.Label()})
+	}
+	byVariant := map[int]*ReorderSuggestion{}
+	for i := range out {
+		byVariant[out[i].VariantID] = &out[i]
+	}
+
+	queries := []struct {
+		sql  string
+		args []interface{}
+		dest func(*ReorderSuggestion) *int
+	}{
+		{"SELECT i.variant_id, SUM(i.quantity) FROM order_items i JOIN orders o ON o.order_id = i.order_id WHERE o.store_id = ? AND o.created_at >= NOW() - INTERVAL ? DAY GROUP BY i.variant_id",
+			[]interface{}{storeID, lookback}, func(s *ReorderSuggestion) *int { return &s.SoldLastDays }},
+		{"SELECT s.variant_id, SUM(s.quantity) FROM stock s JOIN locations l ON l.id = s.location_id WHERE l.store_id = ? GROUP BY s.variant_id",
+			[]interface{}{storeID}, func(s *ReorderSuggestion) *int { return &s.InStock }},
+		{"SELECT pl.variant_id, SUM(pl.quantity) FROM purchase_order_lines pl JOIN purchase_orders po ON po.id = pl.purchase_order_id WHERE po.store_id = ? AND po.status IN ('DRAFT', 'ORDERED') GROUP BY pl.variant_id",
+			[]interface{}{storeID}, func(s *ReorderSuggestion) *int { return &s.OnOrder }},
+	}
+	for _, q := range queries {
+		rows, err := db.Query(q.sql, q.args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var variantID, n int
+			if err := rows.Scan(&variantID, &n); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if s := byVariant[variantID]; s != nil {
+				*q.dest(s) = n
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range out {
+		s := &out[i]
+		s.DailyRate = math.Round(float64(s.SoldLastDays)/float64(lookback)*100) / 100
+		if s.DailyRate > 0 {
+			s.DaysLeft = math.Round(float64(s.InStock)/s.DailyRate*10) / 10
+		}
+		need := int(math.Ceil(float64(s.SoldLastDays)/float64(lookback)*float64(horizon))) - s.InStock - s.OnOrder
+		if need > 0 {
+			s.Suggested = need
+		}
+	}
+	return out, nil
+}
+
+func reorderPage(w http.ResponseWriter, r *http.Request) {
+	storeID := currentStoreID(r)
+	suggestions, err := reorderSuggestions(storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	pos, err := openPurchaseOrders(storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("reorder.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		Suggestions    []ReorderSuggestion
+		PurchaseOrders []PurchaseOrder
+		Lookback       int
+		Flashes        []Flash
+	}{storeSwitcher(r), suggestions, pos, envInt("REORDER_LOOKBACK_DAYS", 30), popFlashes(r)})
+}
+
+func reorderSuggestionsAPI(w http.ResponseWriter, r *http.Request) {
+	suggestions, err := reorderSuggestions(currentStoreID(r))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	writeJSON(w, http.StatusOK, suggestions)
+}
+
+func openPurchaseOrders(storeID int) ([]PurchaseOrder, error) {
+	rows, err := db.Query(`SELECT po.id, po.status, po.created_by, po.created_at, COALESCE(v.sku, ''), pl.quantity
+		FROM purchase_orders po JOIN purchase_order_lines pl ON pl.purchase_order_id = po.id
+		LEFT JOIN product_variants v ON v.id = pl.variant_id
+		WHERE po.store_id = ? AND po.status IN ('DRAFT', 'ORDERED') ORDER BY po.id DESC`, storeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pos []PurchaseOrder
+	for rows.Next() {
+		var po PurchaseOrder
+		var line PurchaseOrderLine
+		if err := rows.Scan(&po.ID, &po.Status, &po.CreatedBy, &po.CreatedAt, &line.SKU, &line.Quantity); err != nil {
+			return nil, err
+		}
+		if n := len(pos); n > 0 && pos[n-1].ID == po.ID {
+			pos[n-1].Lines = append(pos[n-1].Lines, line)
+			continue
+		}
+		po.Lines = []PurchaseOrderLine{line}
+		pos = append(pos, po)
+	}
+	return pos, rows.Err()
+}
+
+func createDraftPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	storeID := currentStoreID(r)
+	suggestions, err := reorderSuggestions(storeID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var lines []string
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO purchase_orders (store_id, created_by) VALUES (?, ?)", storeID, auditActor(r))
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	poID, _ := res.LastInsertId()
+	for _, s := range suggestions {
+		if s.Suggested == 0 {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO purchase_order_lines (purchase_order_id, variant_id, quantity) VALUES (?, ?, ?)", poID, s.VariantID, s.Suggested); err != nil {
+			http.Error(w, "DB insert error", http.StatusInternalServerError)
+			return
+		}
+		lines = append(lines, fmt.Sprintf("%d x %s", s.Suggested, s.SKU))
+	}
+	if len(lines) == 0 {
+		redirectWithFlash(w, r, "/admin/reorder", "error", "Nothing needs reordering right now.")
+		return
+	}
+	if err := recordAudit(tx, r, "purchase_order.draft", strconv.FormatInt(poID, 10), strings.Join(lines, ", ")); err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "DB commit error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/reorder", "success", fmt.Sprintf("Draft purchase order #%d created.", poID))
+}
+
+func discardPurchaseOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid purchase order ID", http.StatusBadRequest)
+		return
+	}
+	res, err := db.Exec("UPDATE purchase_orders SET status = 'CANCELLED' WHERE id = ? AND store_id = ? AND status = 'DRAFT'", id, currentStoreID(r))
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		redirectWithFlash(w, r, "/admin/reorder", "error", "Only draft purchase orders can be discarded.")
+		return
+	}
+	_ = recordAudit(db, r, "purchase_order.discard", strconv.Itoa(id), "")
+	redirectWithFlash(w, r, "/admin/reorder", "success", fmt.Sprintf("Purchase order #%d discarded.", id))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// DB_REPLICA_DSN names a read-only replica for the heavy reads: the reports,
+// margins, shift report and accounting export. They can be a little behind
+// the primary, which is fine for looking back over a month, and in return
+// end-of-month reporting doesn't slow down order placement. Without a
+// replica, or while it can't be reached, they read from the primary; a
+// replica that is down at startup is tried again once its breaker's
+// cooldown is over.
+
+var (
+	replica        *sql.DB
+	replicaBreaker circuitBreaker
+)
+
+func openReplica() error {
+	dsn := envOr("DB_REPLICA_DSN", "")
+	if dsn == "" {
+		return nil
+	}
+	opened, err := openInShopZone(dsn, &replicaBreaker)
+	if err != nil {
+		return err
+	}
+	if err := opened.Ping(); connectionError(err) {
+		log.Printf("replica unreachable (%v), reports read from the primary for now", err)
+		replicaBreaker.trip()
+	} else if err != nil {
+		log.Printf("replica: %v, reports read from the primary", err)
+		opened.Close()
+		return nil
+	} else {
+		log.Printf("reports read from the replica")
+	}
+	replica = opened
+	return nil
+}
+
+// reportDB is where report queries go.
+func reportDB() *sql.DB {
+	if replica != nil && replicaBreaker.allow() {
+		return replica
+	}
+	return db
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Orders to be paid in advance hold their stock while we wait for the
+// transfer, for at most PAYMENT_RESERVATION_WINDOW. Staff confirm the
+// payment when it arrives; if it doesn't, the order is cancelled so its
+// stock goes back on sale. While held, the order's items count against
+// availability like any other open order's, so nobody else can buy them.
+const (
+	ReservationHeld      = "HELD"
+	ReservationConfirmed = "CONFIRMED"
+	ReservationReleased  = "RELEASED"
+)
+
+type StockReservation struct {
+	OrderID   string    `json:"order_id"`
+	AmountDue Money     `json:"amount_due"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Status    string    `json:"status"`
+}
+
+// OrderCancellation is the data of an OrderEventCancelled event.
+type OrderCancellation struct {
+	Reason string `json:"reason"`
+}
+
+func paymentReservationWindow() time.Duration {
+	return envDuration("PAYMENT_RESERVATION_WINDOW", 24*time.Hour)
+}
+
+// reserveStock holds o's stock inside tx until amountDue has been paid.
+func reserveStock(tx *sql.Tx, o Order, amountDue Money) error {
+	_, err := tx.Exec(`INSERT INTO stock_reservations (order_id, store_id, amount_due, expires_at, status)
+		VALUES (?, ?, ?, NOW() + INTERVAL ? SECOND, ?)`,
+		o.OrderID, o.StoreID, amountDue, int(paymentReservationWindow().Seconds()), ReservationHeld)
+	return err
+}
+
+// orderReservation returns nil when the order never waited for a payment.
+func orderReservation(orderID string) (*StockReservation, error) {
+	var res StockReservation
+	err := db.QueryRow("SELECT order_id, amount_due, expires_at, status FROM stock_reservations WHERE order_id = ?", orderID).
+		Scan(&res.OrderID, &res.AmountDue, &res.ExpiresAt, &res.Status)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &res, err
+}
+
+// confirmPayment records that the customer's transfer for a held order
+// arrived, so the order keeps its stock.
+func confirmPayment(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	back := "/change-status"
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var status string
+	var amount Money
+	err = tx.QueryRow("SELECT status, amount_due FROM stock_reservations WHERE order_id = ? AND store_id = ? FOR UPDATE", orderID, currentStoreID(r)).
+		Scan(&status, &amount)
+	if err == sql.ErrNoRows {
+		redirectWithFlash(w, r, back, "error", "Order "+orderID+" is not waiting for a payment.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if status != ReservationHeld {
+		redirectWithFlash(w, r, back, "error", "The payment for order "+orderID+" is already "+status+".")
+		return
+	}
+	_, err = tx.Exec("UPDATE stock_reservations SET status = ?, resolved_at = NOW() WHERE order_id = ?", ReservationConfirmed, orderID)
+	if err == nil {
+		err = recordOrderEventBy(tx, orderID, OrderEventPaid, staffUser(r), OrderPayment{Method: PaymentPrepaid, Amount: amount})
+	}
+	if err == nil {
+		err = recordLedgerEntry(tx, currentStoreID(r), orderID, LedgerSale, PaymentPrepaid, amount, "", auditActor(r))
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "order.payment_received", orderID, fmt.Sprintf("%.2f", amount))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", fmt.Sprintf("Payment of %s received for order %s.", money(amount), orderID))
+}
+
+// expireStockReservations cancels held orders whose payment did not arrive
+// in time and gives back any gift card balance spent on them.
+func expireStockReservations() error {
+	rows, err := db.Query("SELECT order_id FROM stock_reservations WHERE status = ? AND expires_at < NOW() ORDER BY expires_at", ReservationHeld)
+	if err != nil {
+		return err
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range expired {
+		if err := expireStockReservation(id); err != nil {
+			log.Printf("stock reservation for %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func expireStockReservation(orderID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var status string
+	err = tx.QueryRow("SELECT status FROM stock_reservations WHERE order_id = ? FOR UPDATE", orderID).Scan(&status)
+	if err != nil || status != ReservationHeld {
+		// Paid since it was loaded.
+		return err
+	}
+	var o Order
+	if err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? FOR UPDATE", orderID), &o); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE stock_reservations SET status = ?, resolved_at = NOW() WHERE order_id = ?", ReservationReleased, orderID); err != nil {
+		return err
+	}
+	// Orders staff already sent out are left to them.
+	cancel := o.Status == statuses[0] || o.Status == OrderBackordered || o.Status == OrderOnHold
+	old := o.Status
+	if cancel {
+		if _, err := tx.Exec("UPDATE orders SET status = 'CANCELLED' WHERE order_id = ?", orderID); err != nil {
+			return err
+		}
+		if err := recordOrderEvent(tx, orderID, OrderEventCancelled, OrderCancellation{Reason: "payment not received"}); err != nil {
+			return err
+		}
+		if err := reverseGiftCardRedemptions(tx, orderID); err != nil {
+			return err
+		}
+		if err := notifyCustomer(tx, o.CustomerID, "reservation_expired", map[string]string{"OrderID": orderID}); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if cancel {
+		o.Status = "CANCELLED"
+		emitOrderEvent(OrderEvent{Type: EventOrderStatusChanged, OrderID: orderID, Order: &o, OldStatus: old})
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Returns are approved by staff on delivered orders. Approving one gives it
+// an RMA code and a label the customer sticks on the parcel to send it back
+// to the shop; the parcel is then tracked as it is received, inspected and
+// finally refunded to the customer's store credit.
+var returnStatuses = []string{"APPROVED", "RECEIVED", "INSPECTED", "REFUNDED"}
+
+type Return struct {
+	ID           int
+	RMACode      string
+	OrderID      string
+	StoreID      int
+	Reason       string
+	Status       string
+	RefundAmount Money // zero until refunded
+	ApprovedBy   string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// NextStatus is the status the parcel moves to next, "" once refunded.
+func (rt Return) NextStatus() string {
+	for i, s := range returnStatuses[:len(returnStatuses)-1] {
+		if s == rt.Status {
+			return returnStatuses[i+1]
+		}
+	}
+	return ""
+}
+
+const returnColumns = "id, rma_code, order_id, store_id, reason, status, refund_amount, approved_by, created_at, updated_at"
+
+func scanReturn(row rowScanner, rt *Return) error {
+	return row.Scan(&rt.ID, &rt.RMACode, &rt.OrderID, &rt.StoreID, &rt.Reason, &rt.Status, &rt.RefundAmount, &rt.ApprovedBy, &rt.CreatedAt, &rt.UpdatedAt)
+}
+
+func queryReturns(where string, args ...interface{}) ([]Return, error) {
+	rows, err := db.Query("SELECT "+returnColumns+" FROM returns "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var returns []Return
+	for rows.Next() {
+		var rt Return
+		if err := scanReturn(rows, &rt); err != nil {
+			return nil, err
+		}
+		returns = append(returns, rt)
+	}
+	return returns, rows.Err()
+}
+
+func validReturnStatus(status string) bool {
+	for _, s := range returnStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// approveReturn opens a return on a delivered order and texts the customer
+// its RMA code. An order has one return in progress at a time.
+func approveReturn(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	back := "/orders/" + url.PathEscape(orderID)
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" || utf8.RuneCountInString(reason) > 300 {
+		redirectWithFlash(w, r, back, "error", "Give a reason for the return, up to 300 characters.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var status, customerID string
+	err = tx.QueryRow("SELECT status, customer_id FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL FOR UPDATE", orderID, currentStoreID(r)).Scan(&status, &customerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if status != "DELIVERED" {
+		redirectWithFlash(w, r, back, "error", "Only delivered orders can be returned.")
+		return
+	}
+	var open int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM returns WHERE order_id = ? AND status <> 'REFUNDED'", orderID).Scan(&open); err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if open > 0 {
+		redirectWithFlash(w, r, back, "error", "Order "+orderID+" already has a return in progress.")
+		return
+	}
+
+	code := newGiftCardCode("RMA")
+	_, err = tx.Exec("INSERT INTO returns (rma_code, order_id, store_id, reason, approved_by) VALUES (?, ?, ?, ?, ?)",
+		code, orderID, currentStoreID(r), reason, auditActor(r))
+	if err == nil {
+		err = recordAudit(tx, r, "return.approve", orderID, code+": "+reason)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	err = notifyCustomer(db, customerID, "return_approved", map[string]string{"OrderID": orderID, "Code": code})
+	if err != nil {
+		log.Printf("return notification for %s: %v", orderID, err)
+	}
+	redirectWithFlash(w, r, back, "success", "Return "+code+" approved. Print the return label for the customer.")
+}
+
+func returnsPage(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	where, args := "WHERE store_id = ?", []interface{}{currentStoreID(r)}
+	if validReturnStatus(status) {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+	returns, err := queryReturns(where+" ORDER BY updated_at DESC LIMIT 200", args...)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("returns.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		Returns  []Return
+		Status   string
+		Statuses []string
+		Flashes  []Flash
+	}{storeSwitcher(r), returns, status, returnStatuses, popFlashes(r)})
+}
+
+// adminReturn loads a return in the current store.
+func adminReturn(w http.ResponseWriter, r *http.Request) (Return, bool) {
+	var rt Return
+	err := scanReturn(db.QueryRow("SELECT "+returnColumns+" FROM returns WHERE id = ? AND store_id = ?", mux.Vars(r)["id"], currentStoreID(r)), &rt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Return not found", http.StatusNotFound)
+		return rt, false
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return rt, false
+	}
+	return rt, true
+}
+
+// advanceReturn moves a return on to its next status. Refunding it puts
+// ?amount on the customer's store credit.
+func advanceReturn(w http.ResponseWriter, r *http.Request) {
+	rt, ok := adminReturn(w, r)
+	if !ok {
+		return
+	}
+	back := "/admin/returns"
+	next := rt.NextStatus()
+	if next == "" || r.FormValue("status") != next {
+		redirectWithFlash(w, r, back, "error", "Return "+rt.RMACode+" is already "+rt.Status+".")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE returns SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?", next, rt.ID, rt.Status)
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		redirectWithFlash(w, r, back, "error", "Return "+rt.RMACode+" was changed by someone else, try again.")
+		return
+	}
+	details := rt.RMACode + ": " + rt.Status + " → " + next
+	var customerID, code string
+	var amount Money
+	if next == "REFUNDED" {
+		amount, err = parseMoney(r.FormValue("amount"))
+		if err != nil || amount <= 0 {
+			redirectWithFlash(w, r, back, "error", "Enter a positive amount to refund.")
+			return
+		}
+		var left Money
+		customerID, left, err = refundableAmount(tx, rt.StoreID, rt.OrderID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if amount > left {
+			redirectWithFlash(w, r, back, "error", fmt.Sprintf("Only %s of %s is left to refund.", money(left), rt.OrderID))
+			return
+		}
+		code, err = creditRefund(tx, r, customerID, rt.OrderID, amount)
+		if err == nil {
+			_, err = tx.Exec("UPDATE returns SET refund_amount = ? WHERE id = ?", amount, rt.ID)
+		}
+		details += fmt.Sprintf(", %.2f to %s", amount, code)
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "return.status", rt.OrderID, details)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if next != "REFUNDED" {
+		redirectWithFlash(w, r, back, "success", "Return "+rt.RMACode+" marked "+next+".")
+		return
+	}
+	err = notifyCustomer(db, customerID, "store_credit_refund", map[string]string{"Total": fmt.Sprintf("%.2f", amount), "OrderID": rt.OrderID, "Code": code})
+	if err != nil {
+		log.Printf("store credit notification for %s: %v", rt.OrderID, err)
+	}
+	redirectWithFlash(w, r, back, "success", fmt.Sprintf("Return %s refunded, %s to store credit %s.", rt.RMACode, money(amount), code))
+}
+
+// returnLabel prints the label for the customer's parcel: from the delivery
+// address back to the shop, with the RMA code as a QR code for whoever
+// opens it at the store.
+func returnLabel(w http.ResponseWriter, r *http.Request) {
+	rt, ok := adminReturn(w, r)
+	if !ok {
+		return
+	}
+	o, err := storeOrder(rt.StoreID, rt.OrderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var store Store
+	_ = db.QueryRow("SELECT id, code, name, created_at FROM stores WHERE id = ?", rt.StoreID).Scan(&store.ID, &store.Code, &store.Name, &store.CreatedAt)
+
+	width, height := labelSize()
+	p := &pdfPage{}
+	const margin = 14.0
+	right := width - margin
+	chars := int((width - 2*margin) / 6)
+	y := height - margin - 8
+	p.text(margin, y, 8, false, "From: "+o.CustomerID)
+	for _, line := range wrapText(o.Address+" "+o.PostalCode, chars+10) {
+		y -= 10
+		p.text(margin, y, 8, false, line)
+	}
+	y -= 8
+	p.line(margin, y, right, y)
+
+	y -= 16
+	p.text(margin, y, 9, true, "RETURN TO")
+	y -= 18
+	p.text(margin, y, 13, true, shopName())
+	if store.Name != "" {
+		y -= 15
+		p.text(margin, y, 12, false, store.Name)
+	}
+	for _, part := range strings.Split(setting("shop_address"), "\n") {
+		for _, line := range wrapText(part, chars) {
+			y -= 15
+			p.text(margin, y, 12, false, line)
+		}
+	}
+	y -= 10
+	p.line(margin, y, right, y)
+
+	qr, err := qrEncode(rt.RMACode)
+	if err != nil {
+		http.Error(w, "Could not draw the label", http.StatusInternalServerError)
+		return
+	}
+	side := min(width*0.42, y-margin-50)
+	module := side / float64(qr.size)
+	top := y - 10
+	for row := 0; row < qr.size; row++ {
+		for col := 0; col < qr.size; col++ {
+			if qr.dark[row][col] {
+				p.rect(margin+float64(col)*module, top-float64(row+1)*module, module, module)
+			}
+		}
+	}
+	x := margin + side + 12
+	p.text(x, top-16, 9, false, "Order")
+	p.text(x, top-30, 11, true, o.OrderID)
+
+	y = margin + 14
+	p.line(margin, y+34, right, y+34)
+	p.text(margin, y+14, 9, true, "RMA")
+	p.text(margin, y-4, 16, true, rt.RMACode)
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="return-`+rt.RMACode+`.pdf"`)
+	_, _ = w.Write(pdfDocument(width, height, p))
+}
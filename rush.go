@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Rush orders pay RUSH_ORDER_FEE on top and are listed first in staff views.
+// A rush order still PROCESSING after RUSH_ORDER_SLA has breached its SLA
+// and is highlighted.
+
+// staffOrderBy sorts staff order lists with rush orders first.
+const staffOrderBy = " ORDER BY priority DESC, created_at DESC"
+
+// RushCharge is the data of an OrderEventRushRequested event.
+type RushCharge struct {
+	Fee Money `json:"fee"`
+}
+
+func rushOrderFee() Money {
+	return Money(envInt("RUSH_ORDER_FEE", 500)) * 100
+}
+
+func rushOrderSLA() time.Duration {
+	return envDuration("RUSH_ORDER_SLA", 4*time.Hour)
+}
+
+// SLABreached reports whether a rush order has waited too long to be sent out.
+func (o Order) SLABreached() bool {
+	return o.Priority && o.Status == "PROCESSING" && time.Duration(o.AgeMinutes)*time.Minute > rushOrderSLA()
+}
+
+// requestRush makes o a rush order inside tx and adds the fee to its total.
+func requestRush(tx *sql.Tx, o *Order) error {
+	fee := rushOrderFee()
+	if _, err := tx.Exec("UPDATE orders SET priority = TRUE, rush_fee = ?, total_amount = total_amount + ? WHERE order_id = ?", fee, fee, o.OrderID); err != nil {
+		return err
+	}
+	o.Priority, o.RushFee = true, fee
+	o.TotalAmount = o.TotalAmount + fee
+	return recordOrderEvent(tx, o.OrderID, OrderEventRushRequested, RushCharge{Fee: fee})
+}
+
+// lateRushOrders lists a store's rush orders that have breached their SLA,
+// longest waiting first.
+func lateRushOrders(storeID int) ([]Order, error) {
+	rows, err := db.Query("SELECT "+orderColumns+" FROM orders WHERE store_id = ? AND priority AND status = 'PROCESSING' AND deleted_at IS NULL AND created_at < NOW() - INTERVAL ? MINUTE ORDER BY created_at",
+		storeID, int(rushOrderSLA().Minutes()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var orders []Order
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
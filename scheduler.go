@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// cronSchedule is a parsed five-field cron expression
+// (minute hour day-of-month month day-of-week).
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	var sets [5]map[int]bool
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", spec, err)
+		}
+		sets[i] = set
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, lo, hi int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		from, to := lo, hi
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+			from, to = n, n
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("bad range %q", part)
+				}
+			} else if step > 1 {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	domOK, dowOK := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if c.domAny || c.dowAny {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+func (c *cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	for i := 0; i < 366*24*60; i++ {
+		if c.matches(t) {
+			return t
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}
+}
+
+type ScheduledTask struct {
+	Name         string
+	Spec         string
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string
+	NextRun      time.Time
+	Running      bool
+
+	schedule *cronSchedule
+	run      func() error
+	local    bool
+}
+
+var (
+	schedulerMu    sync.Mutex
+	scheduledTasks = map[string]*ScheduledTask{}
+)
+
+// Every instance runs the scheduler, and each run of a task is claimed in
+// scheduled_runs by (task, tick) first, so that only the instance that
+// claims it runs it. Tasks that look after something of their own
+// instance, such as its in-memory sessions, run on every instance.
+
+// registerScheduledTask adds a recurring task. The default spec can be
+// overridden with SCHEDULE_<NAME> (dashes become underscores); "off" disables it.
+func registerScheduledTask(name, defaultSpec string, run func() error) {
+	addScheduledTask(name, defaultSpec, run, false)
+}
+
+// registerLocalScheduledTask adds a recurring task that runs on every
+// instance.
+func registerLocalScheduledTask(name, defaultSpec string, run func() error) {
+	addScheduledTask(name, defaultSpec, run, true)
+}
+
+func addScheduledTask(name, defaultSpec string, run func() error, local bool) {
+	key := "SCHEDULE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	spec := envOr(key, defaultSpec)
+	if spec == "off" {
+		return
+	}
+	schedule, err := parseCron(spec)
+	if err != nil {
+		log.Printf("scheduler: task %s disabled: %v", name, err)
+		return
+	}
+	schedulerMu.Lock()
+	defer schedulerMu.Unlock()
+	scheduledTasks[name] = &ScheduledTask{Name: name, Spec: spec, schedule: schedule, run: run, local: local}
+}
+
+// claimScheduledRun reports whether this instance gets to run task at tick.
+func claimScheduledRun(task string, tick time.Time) (bool, error) {
+	instance, _ := os.Hostname()
+	res, err := db.Exec("INSERT IGNORE INTO scheduled_runs (task, tick, instance) VALUES (?, ?, ?)", task, tick, instance)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// startScheduler runs the tasks when they are due. It is called once the
+// shop's time zone is set, which the schedules are in.
+func startScheduler() {
+	schedulerMu.Lock()
+	for _, t := range scheduledTasks {
+		t.NextRun = t.schedule.next(time.Now())
+	}
+	schedulerMu.Unlock()
+	go func() {
+		for {
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			tick := time.Now().Truncate(time.Minute)
+
+			if readOnly() {
+				log.Printf("scheduler: read-only mode, skipping %s", tick.Format("15:04"))
+				continue
+			}
+			schedulerMu.Lock()
+			for _, t := range scheduledTasks {
+				if t.schedule.matches(tick) {
+					startScheduledTask(t, tick)
+				}
+			}
+			schedulerMu.Unlock()
+		}
+	}()
+}
+
+// startScheduledTask runs t for tick, or straight away when tick is zero.
+// It must be called with schedulerMu held.
+func startScheduledTask(t *ScheduledTask, tick time.Time) {
+	if t.Running {
+		log.Printf("scheduler: %s still running, skipping", t.Name)
+		return
+	}
+	t.Running = true
+	go func() {
+		if !tick.IsZero() && !t.local {
+			claimed, err := claimScheduledRun(t.Name, tick)
+			if err != nil {
+				log.Printf("scheduler: claiming %s: %v", t.Name, err)
+			}
+			if !claimed {
+				schedulerMu.Lock()
+				defer schedulerMu.Unlock()
+				t.Running = false
+				t.NextRun = t.schedule.next(tick)
+				return
+			}
+		}
+		start := time.Now()
+		err := runScheduledTask(t)
+		schedulerMu.Lock()
+		defer schedulerMu.Unlock()
+		t.Running = false
+		t.LastRun = start
+		t.LastDuration = time.Since(start).Round(time.Millisecond)
+		t.LastError = ""
+		if err != nil {
+			t.LastError = err.Error()
+			log.Printf("scheduler: %s failed: %v", t.Name, err)
+		}
+		t.NextRun = t.schedule.next(time.Now())
+	}()
+}
+
+func runScheduledTask(t *ScheduledTask) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return t.run()
+}
+
+func schedulerPage(w http.ResponseWriter, r *http.Request) {
+	schedulerMu.Lock()
+	var tasks []ScheduledTask
+	for _, t := range scheduledTasks {
+		tasks = append(tasks, *t)
+	}
+	schedulerMu.Unlock()
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+
+	t := mustParseTemplates("scheduler.html")
+	_ = t.Execute(w, tasks)
+}
+
+func runTaskNow(w http.ResponseWriter, r *http.Request) {
+	schedulerMu.Lock()
+	t, ok := scheduledTasks[mux.Vars(r)["name"]]
+	if ok {
+		startScheduledTask(t, time.Time{})
+	}
+	schedulerMu.Unlock()
+	if !ok {
+		http.Error(w, "Unknown task", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/admin/scheduler", http.StatusSeeOther)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 7",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		spec, after, want string
+	}{
+		{"* * * * *", "2026-10-14 10:07", "2026-10-14 10:08"},
+		{"*/15 * * * *", "2026-10-14 10:07", "2026-10-14 10:15"},
+		{"*/15 * * * *", "2026-10-14 10:45", "2026-10-14 11:00"},
+		{"0 9 * * *", "2026-10-14 08:59", "2026-10-14 09:00"},
+		{"0 9 * * *", "2026-10-14 09:00", "2026-10-15 09:00"},
+		{"30 23 * * *", "2026-12-31 23:30", "2027-01-01 23:30"},
+		{"5,35 8-9 * * *", "2026-10-14 08:36", "2026-10-14 09:05"},
+		{"10-20/5 * * * *", "2026-10-14 10:16", "2026-10-14 10:20"},
+		{"5/20 * * * *", "2026-10-14 10:26", "2026-10-14 10:45"},
+		{"0 0 1 * *", "2026-01-31 10:00", "2026-02-01 00:00"},
+		{"0 0 29 2 *", "2027-03-01 00:00", "2028-02-29 00:00"},
+		// Sunday only.
+		{"0 6 * * 0", "2026-10-14 10:00", "2026-10-18 06:00"},
+		// Both day fields restricted: the 13th or a Friday, whichever is first.
+		{"0 0 13 * 5", "2026-10-12 12:00", "2026-10-13 00:00"},
+		{"0 0 13 * 5", "2026-10-13 12:00", "2026-10-16 00:00"},
+		// One day field a wildcard: only the other counts.
+		{"0 0 * * 5", "2026-10-13 12:00", "2026-10-16 00:00"},
+		{"0 0 13 * *", "2026-10-13 12:00", "2026-11-13 00:00"},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := c.next(at(tt.after)); !got.Equal(at(tt.want)) {
+			t.Errorf("%q next after %s = %s, want %s", tt.spec, tt.after, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	c, err := parseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.next(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("next of 31 February = %s, want the zero time", got)
+	}
+}
@@ -0,0 +1,872 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS orders (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(20) NOT NULL,
+		customer_id VARCHAR(100) NOT NULL,
+		size VARCHAR(5) NOT NULL,
+		quantity INT NOT NULL,
+		total_amount DECIMAL(10,2) NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_orders_order_id (order_id),
+		INDEX idx_orders_customer_id (customer_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS jobs (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		kind VARCHAR(50) NOT NULL,
+		payload TEXT NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'PENDING',
+		attempts INT NOT NULL DEFAULT 0,
+		max_attempts INT NOT NULL DEFAULT 5,
+		last_error TEXT,
+		run_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_jobs_status_run_at (status, run_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_events (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(20) NOT NULL,
+		type VARCHAR(30) NOT NULL,
+		data JSON NOT NULL,
+		actor VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_order_events_order_id (order_id),
+		INDEX idx_order_events_actor (actor, created_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		action VARCHAR(50) NOT NULL,
+		entity_id VARCHAR(100) NOT NULL,
+		details TEXT,
+		actor VARCHAR(100) NOT NULL,
+		ip VARCHAR(45) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_audit_log_entity_id (entity_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS device_tokens (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		customer_id VARCHAR(100) NOT NULL,
+		token VARCHAR(255) NOT NULL UNIQUE,
+		platform VARCHAR(20) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_device_tokens_customer_id (customer_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS push_preferences (
+		customer_id VARCHAR(100) PRIMARY KEY,
+		opted_out BOOLEAN NOT NULL DEFAULT FALSE
+	)`,
+	`CREATE TABLE IF NOT EXISTS stores (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		code VARCHAR(20) NOT NULL UNIQUE,
+		name VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`INSERT IGNORE INTO stores (id, code, name) VALUES (1, 'main', 'Main Store')`,
+	`CREATE TABLE IF NOT EXISTS locations (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		store_id INT NOT NULL,
+		code VARCHAR(30) NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		position INT NOT NULL DEFAULT 0,
+		UNIQUE KEY uq_locations_store_code (store_id, code)
+	)`,
+	`INSERT IGNORE INTO locations (id, store_id, code, name, position) VALUES
+		(1, 1, 'shop-floor', 'Shop Floor', 1), (2, 1, 'back-store', 'Back Store', 2), (3, 1, 'warehouse', 'Warehouse', 3)`,
+	`CREATE TABLE IF NOT EXISTS stock (
+		location_id INT NOT NULL,
+		variant_id INT NOT NULL,
+		quantity INT NOT NULL DEFAULT 0,
+		PRIMARY KEY (location_id, variant_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS stock_movements (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		variant_id INT NOT NULL,
+		quantity INT NOT NULL,
+		from_location_id INT NULL,
+		to_location_id INT NULL,
+		reason VARCHAR(20) NOT NULL,
+		order_id VARCHAR(20) NULL,
+		actor VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_stock_movements_order_id (order_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS purchase_orders (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		store_id INT NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'DRAFT',
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_purchase_orders_store_status (store_id, status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS purchase_order_lines (
+		purchase_order_id INT NOT NULL,
+		variant_id INT NOT NULL,
+		quantity INT NOT NULL,
+		PRIMARY KEY (purchase_order_id, variant_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS products (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		product_type VARCHAR(30) NOT NULL DEFAULT 't-shirt',
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS product_variants (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		product_id INT NOT NULL,
+		sku VARCHAR(40) NOT NULL UNIQUE,
+		size VARCHAR(5) NOT NULL,
+		color VARCHAR(30) NOT NULL DEFAULT '',
+		material VARCHAR(50) NOT NULL DEFAULT '',
+		price DECIMAL(10,2) NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		INDEX idx_product_variants_product_id (product_id)
+	)`,
+	// The original single T-shirt line; orders from before the catalog map onto it by size.
+	`INSERT IGNORE INTO products (id, name) VALUES (1, 'Classic T-Shirt')`,
+	`INSERT IGNORE INTO product_variants (id, product_id, sku, size, color, material, price) VALUES
+		(1, 1, 'TS-CLASSIC-XS', 'XS', 'White', 'Cotton', 600), (2, 1, 'TS-CLASSIC-S', 'S', 'White', 'Cotton', 800),
+		(3, 1, 'TS-CLASSIC-M', 'M', 'White', 'Cotton', 900), (4, 1, 'TS-CLASSIC-L', 'L', 'White', 'Cotton', 1000),
+		(5, 1, 'TS-CLASSIC-XL', 'XL', 'White', 'Cotton', 1100), (6, 1, 'TS-CLASSIC-XXL', 'XXL', 'White', 'Cotton', 1200)`,
+	`CREATE TABLE IF NOT EXISTS order_items (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(20) NOT NULL,
+		variant_id INT NOT NULL,
+		sku VARCHAR(40) NOT NULL,
+		product_name VARCHAR(100) NOT NULL,
+		size VARCHAR(5) NOT NULL,
+		color VARCHAR(30) NOT NULL DEFAULT '',
+		quantity INT NOT NULL,
+		unit_price DECIMAL(10,2) NOT NULL,
+		INDEX idx_order_items_order_id (order_id)
+	)`,
+	`INSERT INTO order_items (order_id, variant_id, sku, product_name, size, color, quantity, unit_price)
+		SELECT o.order_id, v.id, v.sku, p.name, v.size, v.color, o.quantity, o.total_amount / o.quantity
+		FROM orders o JOIN product_variants v ON v.product_id = 1 AND v.size = o.size JOIN products p ON p.id = v.product_id
+		WHERE o.order_id <> '' AND NOT EXISTS (SELECT 1 FROM order_items i WHERE i.order_id = o.order_id)`,
+	`CREATE TABLE IF NOT EXISTS categories (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		slug VARCHAR(100) NOT NULL UNIQUE,
+		kind VARCHAR(20) NOT NULL DEFAULT 'category',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS product_categories (
+		product_id INT NOT NULL,
+		category_id INT NOT NULL,
+		PRIMARY KEY (product_id, category_id),
+		INDEX idx_product_categories_category_id (category_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS size_charts (
+		product_type VARCHAR(30) NOT NULL,
+		measurement VARCHAR(50) NOT NULL,
+		size VARCHAR(5) NOT NULL,
+		value VARCHAR(20) NOT NULL,
+		position INT NOT NULL DEFAULT 0,
+		PRIMARY KEY (product_type, measurement, size)
+	)`,
+	`INSERT IGNORE INTO size_charts (product_type, measurement, size, value, position) VALUES
+		('t-shirt', 'Chest (cm)', 'XS', '86', 1), ('t-shirt', 'Chest (cm)', 'S', '91', 1), ('t-shirt', 'Chest (cm)', 'M', '97', 1),
+		('t-shirt', 'Chest (cm)', 'L', '102', 1), ('t-shirt', 'Chest (cm)', 'XL', '107', 1), ('t-shirt', 'Chest (cm)', 'XXL', '112', 1),
+		('t-shirt', 'Length (cm)', 'XS', '66', 2), ('t-shirt', 'Length (cm)', 'S', '69', 2), ('t-shirt', 'Length (cm)', 'M', '72', 2),
+		('t-shirt', 'Length (cm)', 'L', '74', 2), ('t-shirt', 'Length (cm)', 'XL', '76', 2), ('t-shirt', 'Length (cm)', 'XXL', '78', 2)`,
+	`CREATE TABLE IF NOT EXISTS wishlist_items (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		customer_id VARCHAR(100) NOT NULL,
+		variant_id INT NOT NULL,
+		order_id VARCHAR(20) NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_wishlist_items_customer_variant (customer_id, variant_id),
+		INDEX idx_wishlist_items_variant_id (variant_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_drafts (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		token VARCHAR(32) NOT NULL UNIQUE,
+		customer_id VARCHAR(100) NOT NULL,
+		variant_id INT NULL,
+		quantity INT NULL,
+		order_id VARCHAR(20) NULL,
+		reminded_at TIMESTAMP NULL,
+		ordered_at TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_order_drafts_created_at (created_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_comments (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(20) NOT NULL,
+		parent_id BIGINT NULL,
+		author VARCHAR(100) NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_order_comments_order_id (order_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS tickets (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(20) NOT NULL,
+		customer_id VARCHAR(100) NOT NULL,
+		subject VARCHAR(150) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'OPEN',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_tickets_order_id (order_id),
+		INDEX idx_tickets_customer_id (customer_id),
+		INDEX idx_tickets_status (status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ticket_messages (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		ticket_id INT NOT NULL,
+		author VARCHAR(100) NOT NULL,
+		staff BOOLEAN NOT NULL DEFAULT FALSE,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_ticket_messages_ticket_id (ticket_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS gift_cards (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		code VARCHAR(20) NOT NULL UNIQUE,
+		kind VARCHAR(20) NOT NULL DEFAULT 'gift_card',
+		customer_id VARCHAR(100) NULL,
+		initial_amount DECIMAL(10,2) NOT NULL,
+		balance DECIMAL(10,2) NOT NULL,
+		expires_at DATE NULL,
+		issued_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_gift_cards_customer_id (customer_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS gift_card_transactions (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		gift_card_id INT NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		reason VARCHAR(20) NOT NULL,
+		order_id VARCHAR(20) NULL,
+		actor VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_gift_card_transactions_gift_card_id (gift_card_id),
+		INDEX idx_gift_card_transactions_order_id (order_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS delivery_slots (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		store_id INT NOT NULL,
+		label VARCHAR(50) NOT NULL,
+		position INT NOT NULL DEFAULT 0,
+		capacity INT NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		INDEX idx_delivery_slots_store_id (store_id)
+	)`,
+	`INSERT IGNORE INTO delivery_slots (id, store_id, label, position, capacity) VALUES
+		(1, 1, '10:00–12:00', 1, 20), (2, 1, '12:00–14:00', 2, 20), (3, 1, '14:00–16:00', 3, 20), (4, 1, '16:00–18:00', 4, 20)`,
+	`CREATE TABLE IF NOT EXISTS shipping_zones (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		postcodes VARCHAR(1000) NOT NULL DEFAULT ''
+	)`,
+	`INSERT IGNORE INTO shipping_zones (id, name, postcodes) VALUES (1, 'Colombo', '00,01'), (2, 'Western Province', '10,11,12')`,
+	`CREATE TABLE IF NOT EXISTS shipping_rules (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		position INT NOT NULL DEFAULT 0,
+		zone_id INT NULL,
+		min_weight_grams INT NOT NULL DEFAULT 0,
+		max_weight_grams INT NULL,
+		min_order_value DECIMAL(10,2) NOT NULL DEFAULT 0,
+		fee DECIMAL(10,2) NOT NULL
+	)`,
+	`INSERT IGNORE INTO shipping_rules (id, position, zone_id, max_weight_grams, min_order_value, fee) VALUES
+		(1, 10, NULL, NULL, 10000, 0), (2, 20, 1, 2000, 0, 250), (3, 30, 1, NULL, 0, 400), (4, 40, 2, 2000, 0, 350),
+		(5, 50, 2, NULL, 0, 550), (6, 60, NULL, 2000, 0, 500), (7, 70, NULL, NULL, 0, 800)`,
+	`CREATE TABLE IF NOT EXISTS standing_orders (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		store_id INT NOT NULL,
+		customer_id VARCHAR(100) NOT NULL,
+		variant_id INT NOT NULL,
+		quantity INT NOT NULL,
+		frequency VARCHAR(10) NOT NULL,
+		next_run DATE NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'ACTIVE',
+		notes VARCHAR(500) NOT NULL DEFAULT '',
+		address VARCHAR(300) NOT NULL DEFAULT '',
+		postal_code VARCHAR(10) NOT NULL DEFAULT '',
+		pickup BOOLEAN NOT NULL DEFAULT FALSE,
+		payment_method VARCHAR(20) NOT NULL DEFAULT 'cod',
+		reminded_for DATE NULL,
+		last_order_id VARCHAR(20) NULL,
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_standing_orders_customer_id (customer_id),
+		INDEX idx_standing_orders_due (status, next_run)
+	)`,
+	`CREATE TABLE IF NOT EXISTS settlements (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		reference VARCHAR(100) NOT NULL UNIQUE,
+		order_id VARCHAR(20) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		settled_at DATE NOT NULL,
+		source VARCHAR(200) NOT NULL,
+		imported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_settlements_order_id (order_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS payment_exceptions (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		store_id INT NOT NULL,
+		order_id VARCHAR(20) NOT NULL,
+		kind VARCHAR(20) NOT NULL,
+		recorded DECIMAL(10,2) NOT NULL,
+		settled DECIMAL(10,2) NOT NULL,
+		stale BOOLEAN NOT NULL DEFAULT FALSE,
+		detected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		resolved_at DATETIME NULL,
+		resolved_by VARCHAR(100) NOT NULL DEFAULT '',
+		note VARCHAR(300) NOT NULL DEFAULT '',
+		UNIQUE KEY uq_payment_exceptions_order_kind (order_id, kind)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ledger_entries (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		store_id INT NOT NULL,
+		order_id VARCHAR(20) NULL,
+		kind VARCHAR(20) NOT NULL,
+		method VARCHAR(20) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		reference VARCHAR(100) NOT NULL DEFAULT '',
+		actor VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_ledger_entries_store (store_id, created_at),
+		INDEX idx_ledger_entries_order_id (order_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS notification_templates (
+		name VARCHAR(50) PRIMARY KEY,
+		subject VARCHAR(200) NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		updated_by VARCHAR(100) NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS notification_preferences (
+		customer_id VARCHAR(100) PRIMARY KEY,
+		sms BOOLEAN NOT NULL DEFAULT TRUE,
+		email BOOLEAN NOT NULL DEFAULT FALSE,
+		whatsapp BOOLEAN NOT NULL DEFAULT FALSE,
+		email_address VARCHAR(100) NOT NULL DEFAULT '',
+		muted VARCHAR(500) NOT NULL DEFAULT '',
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS verified_contacts (
+		contact VARCHAR(100) PRIMARY KEY,
+		verified_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS verified_emails (
+		customer_id VARCHAR(100) NOT NULL,
+		email VARCHAR(100) NOT NULL,
+		verified_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (customer_id, email)
+	)`,
+	`CREATE TABLE IF NOT EXISTS blocked_identities (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		kind VARCHAR(10) NOT NULL,
+		value VARCHAR(100) NOT NULL,
+		action VARCHAR(10) NOT NULL,
+		reason VARCHAR(300) NOT NULL,
+		hits INT NOT NULL DEFAULT 0,
+		last_hit_at DATETIME NULL,
+		created_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_blocked_identities_kind_value (kind, value)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_reviews (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		order_id VARCHAR(20) NOT NULL UNIQUE,
+		store_id INT NOT NULL,
+		reasons TEXT NOT NULL,
+		held BOOLEAN NOT NULL,
+		flagged_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		decision VARCHAR(20) NOT NULL DEFAULT '',
+		decided_by VARCHAR(100) NOT NULL DEFAULT '',
+		decided_at DATETIME NULL,
+		INDEX idx_order_reviews_open (store_id, decided_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS used_form_tokens (
+		token VARCHAR(100) PRIMARY KEY,
+		used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_used_form_tokens_used_at (used_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_code_sends (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		contact VARCHAR(100) NOT NULL,
+		ip VARCHAR(45) NOT NULL,
+		sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_order_code_sends_contact (contact, sent_at),
+		INDEX idx_order_code_sends_ip (ip, sent_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_runs (
+		task VARCHAR(100) NOT NULL,
+		tick DATETIME NOT NULL,
+		instance VARCHAR(255) NOT NULL DEFAULT '',
+		started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (task, tick)
+	)`,
+	`CREATE TABLE IF NOT EXISTS settings (
+		name VARCHAR(50) PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_by VARCHAR(100) NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS feature_flags (
+		name VARCHAR(50) PRIMARY KEY,
+		enabled BOOLEAN NOT NULL,
+		updated_by VARCHAR(100) NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS experiment_exposures (
+		experiment VARCHAR(50) NOT NULL,
+		variant VARCHAR(50) NOT NULL,
+		visitor_id VARCHAR(32) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (experiment, visitor_id),
+		INDEX idx_experiment_exposures_visitor_id (visitor_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS experiment_conversions (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		experiment VARCHAR(50) NOT NULL,
+		variant VARCHAR(50) NOT NULL,
+		visitor_id VARCHAR(32) NOT NULL,
+		order_id VARCHAR(50) NOT NULL,
+		amount DECIMAL(10,2) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_experiment_conversions_variant (experiment, variant)
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_usage (
+		key_name VARCHAR(100) NOT NULL,
+		day DATE NOT NULL,
+		requests INT NOT NULL DEFAULT 0,
+		PRIMARY KEY (key_name, day)
+	)`,
+	`CREATE TABLE IF NOT EXISTS webhook_endpoints (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		url VARCHAR(500) NOT NULL,
+		events VARCHAR(200) NOT NULL DEFAULT '',
+		secret VARCHAR(100) NOT NULL,
+		previous_secret VARCHAR(100) NOT NULL DEFAULT '',
+		previous_until TIMESTAMP NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS login_failures (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		scope VARCHAR(20) NOT NULL,
+		account VARCHAR(100) NOT NULL,
+		ip VARCHAR(45) NOT NULL,
+		failed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_login_failures_account (scope, account, failed_at),
+		INDEX idx_login_failures_ip (ip, failed_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS google_accounts (
+		subject VARCHAR(255) PRIMARY KEY,
+		email VARCHAR(100) NOT NULL,
+		customer_id VARCHAR(100) NOT NULL,
+		linked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS credentials (
+		kind VARCHAR(20) NOT NULL,
+		account VARCHAR(100) NOT NULL,
+		password_hash VARCHAR(255) NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY (kind, account)
+	)`,
+	`CREATE TABLE IF NOT EXISTS admin_totp (
+		username VARCHAR(100) PRIMARY KEY,
+		secret VARCHAR(64) NOT NULL,
+		confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+		last_step BIGINT NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS admin_backup_codes (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		username VARCHAR(100) NOT NULL,
+		code_hash CHAR(64) NOT NULL,
+		used_at TIMESTAMP NULL,
+		INDEX idx_admin_backup_codes_username (username)
+	)`,
+	`CREATE TABLE IF NOT EXISTS pos_sync (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		terminal VARCHAR(50) NOT NULL,
+		code VARCHAR(50) NOT NULL,
+		fingerprint CHAR(64) NOT NULL,
+		order_id VARCHAR(20) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_pos_sync_terminal_code (terminal, code)
+	)`,
+	`CREATE TABLE IF NOT EXISTS day_closings (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		store_id INT NOT NULL,
+		day DATE NOT NULL,
+		expected DECIMAL(10,2) NOT NULL,
+		counted DECIMAL(10,2) NOT NULL,
+		difference DECIMAL(10,2) NOT NULL,
+		note VARCHAR(500) NOT NULL DEFAULT '',
+		closed_by VARCHAR(100) NOT NULL,
+		closed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_day_closings_store_day (store_id, day)
+	)`,
+	`CREATE TABLE IF NOT EXISTS stock_reservations (
+		order_id VARCHAR(20) PRIMARY KEY,
+		store_id INT NOT NULL,
+		amount_due DECIMAL(10,2) NOT NULL,
+		expires_at DATETIME NOT NULL,
+		status VARCHAR(20) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		resolved_at DATETIME NULL,
+		INDEX idx_stock_reservations_due (status, expires_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS returns (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		rma_code VARCHAR(20) NOT NULL UNIQUE,
+		order_id VARCHAR(20) NOT NULL,
+		store_id INT NOT NULL,
+		reason VARCHAR(300) NOT NULL,
+		status VARCHAR(20) NOT NULL DEFAULT 'APPROVED',
+		refund_amount DECIMAL(10,2) NULL,
+		approved_by VARCHAR(100) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_returns_order_id (order_id),
+		INDEX idx_returns_store_status (store_id, status)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_measurements (
+		order_id VARCHAR(20) NOT NULL,
+		name VARCHAR(20) NOT NULL,
+		cm DECIMAL(5,1) NOT NULL,
+		PRIMARY KEY (order_id, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS production_assignments (
+		order_id VARCHAR(20) NOT NULL,
+		stage VARCHAR(20) NOT NULL,
+		worker VARCHAR(100) NOT NULL,
+		assigned_by VARCHAR(100) NOT NULL DEFAULT '',
+		assigned_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (order_id, stage)
+	)`,
+	`CREATE TABLE IF NOT EXISTS materials (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL UNIQUE,
+		unit VARCHAR(10) NOT NULL,
+		low_level DECIMAL(10,2) NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS material_stock (
+		store_id INT NOT NULL,
+		material_id INT NOT NULL,
+		quantity DECIMAL(10,2) NOT NULL DEFAULT 0,
+		PRIMARY KEY (store_id, material_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS material_movements (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		store_id INT NOT NULL,
+		material_id INT NOT NULL,
+		quantity DECIMAL(10,2) NOT NULL,
+		reason VARCHAR(20) NOT NULL,
+		order_id VARCHAR(20) NULL,
+		actor VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_material_movements_store (store_id, id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS price_changes (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		variant_id INT NOT NULL,
+		old_price DECIMAL(10,2) NULL,
+		new_price DECIMAL(10,2) NOT NULL,
+		changed_by VARCHAR(100) NOT NULL DEFAULT '',
+		effective_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_price_changes_variant (variant_id, effective_at)
+	)`,
+	`CREATE TABLE IF NOT EXISTS bill_of_materials (
+		product_id INT NOT NULL,
+		material_id INT NOT NULL,
+		quantity DECIMAL(8,2) NOT NULL,
+		PRIMARY KEY (product_id, material_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS pricing_rules (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		days VARCHAR(30) NOT NULL DEFAULT '',
+		tier VARCHAR(20) NOT NULL DEFAULT '',
+		channel VARCHAR(20) NOT NULL DEFAULT '',
+		category_id INT NULL,
+		min_quantity INT NOT NULL DEFAULT 0,
+		percent DECIMAL(6,2) NOT NULL,
+		priority INT NOT NULL DEFAULT 0,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_by VARCHAR(100) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS daily_sales (
+		store_id INT NOT NULL,
+		day DATE NOT NULL,
+		channel VARCHAR(20) NOT NULL,
+		orders INT NOT NULL,
+		items INT NOT NULL,
+		revenue DECIMAL(12,2) NOT NULL,
+		refreshed_at TIMESTAMP(6) NOT NULL,
+		PRIMARY KEY (store_id, day, channel),
+		INDEX idx_daily_sales_day (day)
+	)`,
+}
+
+// schemaIndexes adds indexes to tables created before them.
+var schemaIndexes = []struct {
+	table, index, migrate string
+}{
+	// Order codes are unique; they used to be only indexed.
+	{"orders", "uq_orders_order_id", "ALTER TABLE orders DROP INDEX idx_orders_order_id, ADD UNIQUE KEY uq_orders_order_id (order_id)"},
+}
+
+// schemaColumns migrates tables created before the column existed; the
+// statements run in order only when the column is missing.
+var schemaColumns = []struct {
+	table, column string
+	migrate       []string
+}{
+	{"orders", "store_id", []string{"ALTER TABLE orders ADD COLUMN store_id INT NOT NULL DEFAULT 1, ADD INDEX idx_orders_store_id (store_id)"}},
+	{"orders", "fulfilled_location_id", []string{"ALTER TABLE orders ADD COLUMN fulfilled_location_id INT NULL"}},
+	{"orders", "notes", []string{"ALTER TABLE orders ADD COLUMN notes VARCHAR(500) NOT NULL DEFAULT ''"}},
+	{"orders", "delivery_date", []string{"ALTER TABLE orders ADD COLUMN delivery_date DATE NULL, ADD COLUMN delivery_slot_id INT NULL, ADD INDEX idx_orders_delivery (delivery_date, delivery_slot_id)"}},
+	{"orders", "shipping_fee", []string{"ALTER TABLE orders ADD COLUMN postal_code VARCHAR(10) NOT NULL DEFAULT '', ADD COLUMN shipping_fee DECIMAL(10,2) NOT NULL DEFAULT 0"}},
+	{"orders", "address", []string{"ALTER TABLE orders ADD COLUMN address VARCHAR(300) NOT NULL DEFAULT '', ADD COLUMN latitude DECIMAL(9,6) NULL, ADD COLUMN longitude DECIMAL(9,6) NULL, ADD COLUMN outside_area BOOLEAN NOT NULL DEFAULT FALSE"}},
+	{"orders", "pickup", []string{"ALTER TABLE orders ADD COLUMN pickup BOOLEAN NOT NULL DEFAULT FALSE"}},
+	{"orders", "payment_method", []string{"ALTER TABLE orders ADD COLUMN payment_method VARCHAR(20) NOT NULL DEFAULT ''"}},
+	{"orders", "parent_order_id", []string{"ALTER TABLE orders ADD COLUMN parent_order_id VARCHAR(20) NOT NULL DEFAULT '', ADD INDEX idx_orders_parent (parent_order_id)"}},
+	{"orders", "tracking_code", []string{"ALTER TABLE orders ADD COLUMN tracking_code VARCHAR(20) NOT NULL DEFAULT '', ADD COLUMN merged_into VARCHAR(20) NOT NULL DEFAULT ''"}},
+	{"order_items", "status", []string{
+		"ALTER TABLE order_items ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'PENDING', ADD COLUMN location_id INT NULL",
+		`UPDATE order_items i JOIN orders o ON o.order_id = i.order_id
+			SET i.status = CASE o.status WHEN 'DELIVERED' THEN 'DELIVERED' WHEN 'REFUSED' THEN 'RETURNED' ELSE 'SHIPPED' END, i.location_id = o.fulfilled_location_id
+			WHERE o.status IN ('DELIVERING', 'DELIVERED', 'REFUSED')`,
+	}},
+	{"orders", "priority", []string{"ALTER TABLE orders ADD COLUMN priority BOOLEAN NOT NULL DEFAULT FALSE, ADD COLUMN rush_fee DECIMAL(10,2) NOT NULL DEFAULT 0"}},
+	{"orders", "channel", []string{"ALTER TABLE orders ADD COLUMN channel VARCHAR(20) NOT NULL DEFAULT 'ONLINE'"}},
+	{"orders", "gift_wrap", []string{"ALTER TABLE orders ADD COLUMN gift_wrap BOOLEAN NOT NULL DEFAULT FALSE, ADD COLUMN gift_wrap_fee DECIMAL(10,2) NOT NULL DEFAULT 0, ADD COLUMN gift_message VARCHAR(200) NOT NULL DEFAULT ''"}},
+	// updated_at follows every change to an order: ON UPDATE catches changes
+	// to the row and recordOrderEvent touches it for the rest. It is to the
+	// microsecond so two changes within a second still tell apart for
+	// caching. Existing orders start from their last event.
+	{"orders", "updated_at", []string{
+		"ALTER TABLE orders ADD COLUMN updated_at TIMESTAMP(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6), ADD INDEX idx_orders_updated_at (store_id, updated_at)",
+		`UPDATE orders o SET o.updated_at = COALESCE((SELECT MAX(e.created_at) FROM order_events e WHERE e.order_id = o.order_id), o.created_at)`,
+	}},
+	// Guest orders (guest.go) were placed by someone not signed in as
+	// their contact.
+	{"orders", "guest", []string{"ALTER TABLE orders ADD COLUMN guest BOOLEAN NOT NULL DEFAULT FALSE"}},
+	// Deleted orders are kept, marked with when they were deleted, and left
+	// out of every list, lookup and workflow.
+	{"orders", "deleted_at", []string{"ALTER TABLE orders ADD COLUMN deleted_at DATETIME NULL"}},
+	// A running job is leased to its worker until locked_until.
+	{"jobs", "locked_until", []string{"ALTER TABLE jobs ADD COLUMN locked_until DATETIME NULL"}},
+	// The address web orders came from, for the velocity checks (fraud.go).
+	{"orders", "client_ip", []string{"ALTER TABLE orders ADD COLUMN client_ip VARCHAR(45) NOT NULL DEFAULT '', ADD INDEX idx_orders_client_ip (client_ip, created_at)"}},
+	{"order_events", "actor", []string{"ALTER TABLE order_events ADD COLUMN actor VARCHAR(100) NOT NULL DEFAULT '', ADD INDEX idx_order_events_actor (actor, created_at)"}},
+	{"settlements", "fee", []string{"ALTER TABLE settlements ADD COLUMN fee DECIMAL(10,2) NOT NULL DEFAULT 0"}},
+	{"product_variants", "restock_date", []string{"ALTER TABLE product_variants ADD COLUMN restock_date DATE NULL"}},
+	{"products", "made_to_measure", []string{"ALTER TABLE products ADD COLUMN made_to_measure BOOLEAN NOT NULL DEFAULT FALSE"}},
+	{"product_variants", "weight_grams", []string{"ALTER TABLE product_variants ADD COLUMN weight_grams INT NOT NULL DEFAULT 250"}},
+	{"product_variants", "cost", []string{"ALTER TABLE product_variants ADD COLUMN cost DECIMAL(10,2) NOT NULL DEFAULT 0"}},
+	{"order_items", "unit_cost", []string{"ALTER TABLE order_items ADD COLUMN unit_cost DECIMAL(10,2) NOT NULL DEFAULT 0"}},
+	// Stock and purchase orders were tracked per size before product variants.
+	{"stock", "variant_id", []string{
+		"ALTER TABLE stock ADD COLUMN variant_id INT NOT NULL DEFAULT 0",
+		"UPDATE stock s JOIN product_variants v ON v.product_id = 1 AND v.size = s.size SET s.variant_id = v.id",
+		"ALTER TABLE stock DROP PRIMARY KEY, DROP COLUMN size, ADD PRIMARY KEY (location_id, variant_id)",
+	}},
+	{"stock_movements", "variant_id", []string{
+		"ALTER TABLE stock_movements ADD COLUMN variant_id INT NOT NULL DEFAULT 0 AFTER id",
+		"UPDATE stock_movements m JOIN product_variants v ON v.product_id = 1 AND v.size = m.size SET m.variant_id = v.id",
+		"ALTER TABLE stock_movements DROP COLUMN size",
+	}},
+	{"purchase_order_lines", "variant_id", []string{
+		"ALTER TABLE purchase_order_lines ADD COLUMN variant_id INT NOT NULL DEFAULT 0",
+		"UPDATE purchase_order_lines l JOIN product_variants v ON v.product_id = 1 AND v.size = l.size SET l.variant_id = v.id",
+		"ALTER TABLE purchase_order_lines DROP PRIMARY KEY, DROP COLUMN size, ADD PRIMARY KEY (purchase_order_id, variant_id)",
+	}},
+}
+
+func ensureSchema() error {
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %w", statementSummary(stmt), err)
+		}
+	}
+	for _, c := range schemaColumns {
+		var n int
+		err := db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+			c.table, c.column).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		for _, stmt := range c.migrate {
+			if _, err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("adding %s.%s: %s: %w", c.table, c.column, statementSummary(stmt), err)
+			}
+		}
+	}
+	for _, i := range schemaIndexes {
+		var n int
+		err := db.QueryRow("SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?",
+			i.table, i.index).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.Exec(i.migrate); err != nil {
+			return fmt.Errorf("adding index %s on %s: %w", i.index, i.table, err)
+		}
+	}
+	if err := syncOrdersArchive(); err != nil {
+		return fmt.Errorf("orders_archive: %w", err)
+	}
+	if err := raiseOrderSequence(); err != nil {
+		return fmt.Errorf("order codes: %w", err)
+	}
+	return nil
+}
+
+func statementSummary(stmt string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(stmt), "\n")
+	if len(line) > 80 {
+		line = line[:77] + "..."
+	}
+	return line
+}
+
+// tableSchema is what the app expects of a table, as read from
+// schemaStatements and schemaColumns so it can't drift from them.
+type tableSchema struct {
+	name             string
+	columns, indexes []string
+}
+
+var (
+	createTableRe = regexp.MustCompile(`(?s)^CREATE TABLE IF NOT EXISTS (\w+) \((.*)\)$`)
+	alterTableRe  = regexp.MustCompile(`ADD COLUMN (\w+)|DROP COLUMN (\w+)|ADD (?:UNIQUE )?(?:INDEX|KEY) (\w+)`)
+)
+
+func expectedSchema() []*tableSchema {
+	var tables []*tableSchema
+	byName := map[string]*tableSchema{}
+	for _, stmt := range schemaStatements {
+		m := createTableRe.FindStringSubmatch(strings.TrimSpace(stmt))
+		if m == nil {
+			continue
+		}
+		t := &tableSchema{name: m[1]}
+		for _, line := range strings.Split(m[2], "\n") {
+			f := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ","))
+			switch {
+			case len(f) == 0 || f[0] == "PRIMARY":
+			case f[0] == "INDEX" || f[0] == "KEY":
+				t.indexes = append(t.indexes, f[1])
+			case f[0] == "UNIQUE":
+				t.indexes = append(t.indexes, f[2])
+			default:
+				t.columns = append(t.columns, f[0])
+			}
+		}
+		tables = append(tables, t)
+		byName[t.name] = t
+	}
+	for _, c := range schemaColumns {
+		t := byName[c.table]
+		if t == nil {
+			continue
+		}
+		for _, stmt := range c.migrate {
+			if !strings.HasPrefix(stmt, "ALTER TABLE "+c.table+" ") {
+				continue
+			}
+			for _, m := range alterTableRe.FindAllStringSubmatch(stmt, -1) {
+				switch {
+				case m[1] != "":
+					// Columns the CREATE TABLE already has are listed once.
+					if !slices.Contains(t.columns, m[1]) {
+						t.columns = append(t.columns, m[1])
+					}
+				case m[2] != "":
+					t.columns = slices.DeleteFunc(t.columns, func(col string) bool { return col == m[2] })
+				default:
+					t.indexes = append(t.indexes, m[3])
+				}
+			}
+		}
+	}
+	return tables
+}
+
+// verifySchema checks the database has every table and column the app
+// uses, so a schema that couldn't be brought up to date stops the app at
+// startup with what is missing rather than failing its pages one by one.
+// A missing index only slows queries down, so it is logged.
+func verifySchema() error {
+	have := map[string]bool{}
+	rows, err := db.Query("SELECT LOWER(TABLE_NAME), LOWER(COLUMN_NAME) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE()")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			rows.Close()
+			return err
+		}
+		have[table], have[table+"."+column] = true, true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows, err = db.Query("SELECT DISTINCT LOWER(TABLE_NAME), LOWER(INDEX_NAME) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE()")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var table, index string
+		if err := rows.Scan(&table, &index); err != nil {
+			rows.Close()
+			return err
+		}
+		have[table+" "+index] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, t := range expectedSchema() {
+		name := strings.ToLower(t.name)
+		if !have[name] {
+			missing = append(missing, "table "+t.name)
+			continue
+		}
+		for _, c := range t.columns {
+			if !have[name+"."+strings.ToLower(c)] {
+				missing = append(missing, "column "+t.name+"."+c)
+			}
+		}
+		for _, i := range t.indexes {
+			if !have[name+" "+strings.ToLower(i)] {
+				log.Printf("schema: index %s on %s is missing", i, t.name)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the database is missing %s; check the DB user may create and alter tables, then restart", strings.Join(missing, ", "))
+	}
+	return nil
+}
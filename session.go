@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionCookie = "fashionshop_session"
+
+type Session struct {
+	ID      string            `json:"id"`
+	Values  map[string]string `json:"values"`
+	Expires time.Time         `json:"expires"`
+}
+
+type sessionStore interface {
+	Load(id string) (*Session, error)
+	Save(s *Session) error
+	Delete(id string) error
+}
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func (m *memorySessionStore) Load(id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || time.Now().After(s.Expires) {
+		delete(m.sessions, id)
+		return nil, nil
+	}
+	cp := *s
+	cp.Values = make(map[string]string, len(s.Values))
+	for k, v := range s.Values {
+		cp.Values[k] = v
+	}
+	return &cp, nil
+}
+
+func (m *memorySessionStore) Save(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = s
+	return nil
+}
+
+func (m *memorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+var sessions sessionStore = &memorySessionStore{sessions: map[string]*Session{}}
+
+// redisSessionStore keeps sessions in Redis, so any instance behind a load
+// balancer can serve any visitor. Redis expires them itself.
+type redisSessionStore struct {
+	client *redisClient
+}
+
+func (s redisSessionStore) key(id string) string {
+	return "fashionshop:session:" + id
+}
+
+func (s redisSessionStore) Load(id string) (*Session, error) {
+	raw, err := s.client.get(s.key(id))
+	if err == errRedisNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sess Session
+	if err := json.Unmarshal([]byte(raw), &sess); err != nil {
+		// Not one of ours; start over rather than fail every request.
+		return nil, nil
+	}
+	if sess.Values == nil {
+		sess.Values = map[string]string{}
+	}
+	return &sess, nil
+}
+
+func (s redisSessionStore) Save(sess *Session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return s.client.set(s.key(sess.ID), string(data), time.Until(sess.Expires))
+}
+
+func (s redisSessionStore) Delete(id string) error {
+	return s.client.del(s.key(id))
+}
+
+// setupSessions picks where sessions are kept: in memory (the default),
+// which needs sticky sessions when running more than one instance, or with
+// SESSION_STORE=redis in Redis at REDIS_URL. Order drafts, the carts the
+// order form saves as it is filled in (abandoned.go), are in the database
+// and the session only holds their token, so they follow the session.
+// Redis needs APP_SECRET, so that every instance signs and checks tokens
+// with the same key.
+func setupSessions() error {
+	switch store := envOr("SESSION_STORE", "memory"); store {
+	case "memory":
+		return nil
+	case "redis":
+		if envOr("APP_SECRET", "") == "" {
+			return errors.New("SESSION_STORE=redis needs APP_SECRET to be set")
+		}
+		client, err := newRedisClient(envOr("REDIS_URL", "redis://127.0.0.1:6379/0"))
+		if err != nil {
+			return err
+		}
+		if _, err := client.do("PING"); err != nil {
+			return err
+		}
+		sessions = redisSessionStore{client: client}
+		return nil
+	default:
+		return fmt.Errorf("unknown SESSION_STORE %q", store)
+	}
+}
+
+func init() {
+	registerLocalScheduledTask("session-cleanup", "*/30 * * * *", func() error {
+		if m, ok := sessions.(*memorySessionStore); ok {
+			m.purgeExpired()
+		}
+		return nil
+	})
+}
+
+func (m *memorySessionStore) purgeExpired() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, s := range m.sessions {
+		if now.After(s.Expires) {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type sessionKey struct{}
+
+// sessionMiddleware loads (or starts) the caller's session once per request.
+// Handlers persist changes with saveSession. When the session store can't
+// be read the request gets a 503, rather than a fresh session that would
+// sign the caller out.
+func sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s *Session
+		if c, err := r.Cookie(sessionCookie); err == nil {
+			if s, err = sessions.Load(c.Value); err != nil {
+				log.Printf("loading session: %v", err)
+				w.Header().Set("Retry-After", "5")
+				msg := "We can't load your session right now. Please try again in a moment."
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					writeAPIError(w, http.StatusServiceUnavailable, "unavailable", msg, nil)
+					return
+				}
+				http.Error(w, msg, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if s == nil {
+			s = &Session{ID: newSessionID(), Values: map[string]string{}}
+			setSessionCookie(w, r, s.ID)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, s)))
+	})
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+}
+
+// renewSession moves the session to a fresh ID, e.g. after signing in, so an
+// ID planted before login is useless afterwards.
+func renewSession(w http.ResponseWriter, r *http.Request) *Session {
+	s := getSession(r)
+	_ = sessions.Delete(s.ID)
+	s.ID = newSessionID()
+	setSessionCookie(w, r, s.ID)
+	return s
+}
+
+func getSession(r *http.Request) *Session {
+	return r.Context().Value(sessionKey{}).(*Session)
+}
+
+func saveSession(s *Session) error {
+	s.Expires = time.Now().Add(envDuration("SESSION_TTL", 24*time.Hour))
+	return sessions.Save(s)
+}
+
+type Flash struct {
+	Kind    string
+	Message string
+}
+
+func addFlash(r *http.Request, kind, message string) {
+	s := getSession(r)
+	var flashes []Flash
+	_ = json.Unmarshal([]byte(s.Values["flashes"]), &flashes)
+	flashes = append(flashes, Flash{Kind: kind, Message: message})
+	data, _ := json.Marshal(flashes)
+	s.Values["flashes"] = string(data)
+	_ = saveSession(s)
+}
+
+// popFlashes returns pending flash messages and clears them.
+func popFlashes(r *http.Request) []Flash {
+	s := getSession(r)
+	raw, ok := s.Values["flashes"]
+	if !ok {
+		return nil
+	}
+	var flashes []Flash
+	_ = json.Unmarshal([]byte(raw), &flashes)
+	delete(s.Values, "flashes")
+	_ = saveSession(s)
+	return flashes
+}
+
+// redirectWithFlash finishes a POST with a 303 so a browser refresh
+// cannot resubmit the form.
+func redirectWithFlash(w http.ResponseWriter, r *http.Request, url, kind, message string) {
+	addFlash(r, kind, message)
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shop-wide settings are kept in the settings table and edited on the admin
+// settings page. Values are cached for SETTINGS_CACHE_TTL (1m by default),
+// so other instances pick up a change within that time. A setting that was
+// never saved falls back to its environment variable, then its default.
+
+type Setting struct {
+	Key       string
+	Label     string
+	Help      string
+	Multiline bool
+	Number    bool
+	Required  bool
+	Env       string
+	Default   string
+
+	Value string
+}
+
+var shopSettings = []Setting{
+	{Key: "shop_name", Label: "Shop name", Required: true, Default: "Fashion Shop",
+		Help: "Printed on invoices and receipts."},
+	{Key: "shop_address", Label: "Address", Multiline: true},
+	{Key: "currency", Label: "Currency", Required: true, Default: "LKR",
+		Help: "Shown next to every amount."},
+	{Key: "tax_rate", Label: "Sales tax rate (%)", Number: true, Env: "SALES_TAX_RATE", Default: "0",
+		Help: "Included in prices; the accounting export splits it out."},
+	{Key: "opening_hours", Label: "Opening hours", Multiline: true, Default: "Mon–Sat 09:00–19:00"},
+	{Key: "delivery_fee", Label: "Delivery fee", Number: true, Env: "SHIPPING_DEFAULT_FEE", Default: "500",
+		Help: "Charged when no shipping rule matches the order."},
+	{Key: "gift_wrap_fee", Label: "Gift wrap fee", Number: true, Env: "GIFT_WRAP_FEE", Default: "250",
+		Help: "Added to orders the customer asks to have gift wrapped."},
+	{Key: "loyalty_silver_spend", Label: "Silver tier from", Number: true, Default: "50000",
+		Help: "Lifetime spend on delivered orders that makes a customer silver, for pricing rules."},
+	{Key: "loyalty_gold_spend", Label: "Gold tier from", Number: true, Default: "150000",
+		Help: "Lifetime spend on delivered orders that makes a customer gold."},
+	{Key: "timezone", Label: "Time zone", Required: true, Env: "SHOP_TIMEZONE", Default: "Asia/Colombo",
+		Help: "Dates and times are in this zone, e.g. Asia/Colombo. Takes effect on restart."},
+}
+
+var settingsCache struct {
+	sync.Mutex
+	values   map[string]string
+	loadedAt time.Time
+}
+
+func settingDefault(key string) string {
+	for _, s := range shopSettings {
+		if s.Key == key {
+			return envOr(s.Env, s.Default)
+		}
+	}
+	return ""
+}
+
+// setting is the current value of key. When the table can't be read the
+// last values read are used, or the defaults.
+func setting(key string) string {
+	settingsCache.Lock()
+	defer settingsCache.Unlock()
+	if settingsCache.values == nil || time.Since(settingsCache.loadedAt) > envDuration("SETTINGS_CACHE_TTL", time.Minute) {
+		values, err := loadSettings()
+		if err != nil {
+			log.Printf("settings: %v", err)
+		} else {
+			settingsCache.values = values
+		}
+		settingsCache.loadedAt = time.Now()
+	}
+	if v, ok := settingsCache.values[key]; ok {
+		return v
+	}
+	return settingDefault(key)
+}
+
+func settingFloat(key string) float64 {
+	v, err := strconv.ParseFloat(setting(key), 64)
+	if err != nil {
+		v, _ = strconv.ParseFloat(settingDefault(key), 64)
+	}
+	return v
+}
+
+func settingMoney(key string) Money {
+	m, err := parseMoney(setting(key))
+	if err != nil {
+		m, _ = parseMoney(settingDefault(key))
+	}
+	return m
+}
+
+func forgetSettings() {
+	settingsCache.Lock()
+	settingsCache.values = nil
+	settingsCache.Unlock()
+}
+
+func loadSettings() (map[string]string, error) {
+	rows, err := db.Query("SELECT name, value FROM settings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	return values, rows.Err()
+}
+
+func shopName() string {
+	return setting("shop_name")
+}
+
+func currency() string {
+	return setting("currency")
+}
+
+// money formats an amount with the shop's currency, e.g. "LKR 1800.00".
+func money(amount Money) string {
+	return fmt.Sprintf("%s %.2f", currency(), amount)
+}
+
+func settingsPage(w http.ResponseWriter, r *http.Request) {
+	renderSettings(w, r, nil, "")
+}
+
+// renderSettings shows the form, with the values just posted when they
+// failed to save with problem.
+func renderSettings(w http.ResponseWriter, r *http.Request, posted map[string]string, problem string) {
+	forgetSettings()
+	settings := make([]Setting, len(shopSettings))
+	for i, s := range shopSettings {
+		s.Value = setting(s.Key)
+		if v, ok := posted[s.Key]; ok {
+			s.Value = v
+		}
+		settings[i] = s
+	}
+	flashes := popFlashes(r)
+	if problem != "" {
+		flashes = append(flashes, Flash{Kind: "error", Message: problem})
+	}
+	t := mustParseTemplates("settings.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Settings []Setting
+		Flashes  []Flash
+	}{settings, flashes})
+}
+
+func saveSettings(w http.ResponseWriter, r *http.Request) {
+	posted := map[string]string{}
+	for _, s := range shopSettings {
+		posted[s.Key] = strings.TrimSpace(r.FormValue(s.Key))
+	}
+	for _, s := range shopSettings {
+		v := posted[s.Key]
+		if s.Required && v == "" {
+			renderSettings(w, r, posted, s.Label+" can't be empty.")
+			return
+		}
+		if len(v) > 500 {
+			renderSettings(w, r, posted, s.Label+" is too long.")
+			return
+		}
+		if s.Number {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || n < 0 {
+				renderSettings(w, r, posted, s.Label+" must be a number of at least 0.")
+				return
+			}
+			if s.Key == "tax_rate" && n >= 100 {
+				renderSettings(w, r, posted, s.Label+" must be below 100.")
+				return
+			}
+		}
+		if _, err := time.LoadLocation(v); s.Key == "timezone" && (err != nil || v == "Local") {
+			renderSettings(w, r, posted, s.Label+" must be a zone name like Asia/Colombo.")
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var changed []string
+	for _, s := range shopSettings {
+		v := posted[s.Key]
+		if v == setting(s.Key) {
+			continue
+		}
+		_, err = tx.Exec("INSERT INTO settings (name, value, updated_by) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value), updated_by = VALUES(updated_by)",
+			s.Key, v, auditActor(r))
+		if err != nil {
+			break
+		}
+		changed = append(changed, s.Key+"="+v)
+	}
+	if err == nil && len(changed) > 0 {
+		err = recordAudit(tx, r, "settings.update", "shop", strings.Join(changed, ", "))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	forgetSettings()
+	redirectWithFlash(w, r, "/admin/settings", "success", "Settings saved.")
+}
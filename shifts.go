@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Staff work in shifts set by STAFF_SHIFTS, a comma-separated list of
+// name=HH:MM-HH:MM entries. A shift that runs past midnight belongs to the
+// day it started on.
+const defaultStaffShifts = "Morning=06:00-14:00,Evening=14:00-22:00,Night=22:00-06:00"
+
+type Shift struct {
+	Name       string
+	Start, End int // minutes after midnight
+}
+
+func (s Shift) Hours() string {
+	return fmt.Sprintf("%02d:%02d–%02d:%02d", s.Start/60, s.Start%60, s.End/60, s.End%60)
+}
+
+func staffShifts() []Shift {
+	shifts := parseShifts(envOr("STAFF_SHIFTS", defaultStaffShifts))
+	if len(shifts) == 0 {
+		log.Printf("STAFF_SHIFTS has no valid shifts, using %s", defaultStaffShifts)
+		shifts = parseShifts(defaultStaffShifts)
+	}
+	return shifts
+}
+
+func parseShifts(spec string) []Shift {
+	var shifts []Shift
+	for _, entry := range strings.Split(spec, ",") {
+		name, hours, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		from, to, ok2 := strings.Cut(hours, "-")
+		if !ok || !ok2 || name == "" {
+			continue
+		}
+		start, err := time.Parse("15:04", strings.TrimSpace(from))
+		if err != nil {
+			continue
+		}
+		end, err := time.Parse("15:04", strings.TrimSpace(to))
+		if err != nil {
+			continue
+		}
+		shifts = append(shifts, Shift{Name: strings.TrimSpace(name),
+			Start: start.Hour()*60 + start.Minute(), End: end.Hour()*60 + end.Minute()})
+	}
+	return shifts
+}
+
+// shiftAt returns the day and index of the shift t falls in, or -1 when it
+// falls outside every shift.
+func shiftAt(shifts []Shift, t time.Time) (string, int) {
+	minute := t.Hour()*60 + t.Minute()
+	for i, s := range shifts {
+		switch {
+		case s.Start < s.End && minute >= s.Start && minute < s.End:
+			return t.Format("2006-01-02"), i
+		case s.Start >= s.End && minute >= s.Start:
+			return t.Format("2006-01-02"), i
+		case s.Start >= s.End && minute < s.End:
+			return t.AddDate(0, 0, -1).Format("2006-01-02"), i
+		}
+	}
+	return t.Format("2006-01-02"), -1
+}
+
+type ShiftReportRow struct {
+	Day        string
+	Shift      string
+	Staff      string
+	Orders     int
+	Revenue    Money
+	Deliveries int
+
+	shift    int
+	orderIDs map[string]bool
+}
+
+// shiftReport adds up, per staff member and shift, the orders they placed
+// or changed, the money they took in and the deliveries they completed
+// between from and to (exclusive).
+func shiftReport(storeID int, from, to time.Time) ([]ShiftReportRow, error) {
+	shifts := staffShifts()
+	rows := map[string]*ShiftReportRow{}
+	row := func(actor string, at time.Time) *ShiftReportRow {
+		day, i := shiftAt(shifts, at)
+		name := "Outside shifts"
+		if i >= 0 {
+			name = shifts[i].Name
+		} else {
+			i = len(shifts)
+		}
+		key := day + "\x00" + name + "\x00" + actor
+		if rows[key] == nil {
+			rows[key] = &ShiftReportRow{Day: day, Shift: name, Staff: actor, shift: i, orderIDs: map[string]bool{}}
+		}
+		return rows[key]
+	}
+
+	events, err := reportDB().Query(`SELECT e.order_id, e.type, e.data, e.actor, e.created_at, o.channel FROM order_events e JOIN orders o ON o.order_id = e.order_id
+		WHERE o.store_id = ? AND e.actor NOT IN ('', 'anonymous') AND e.created_at >= ? AND e.created_at < ?`, storeID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for events.Next() {
+		var orderID, kind, actor, channel string
+		var data []byte
+		var at time.Time
+		if err := events.Scan(&orderID, &kind, &data, &actor, &at, &channel); err != nil {
+			events.Close()
+			return nil, err
+		}
+		rr := row(actor, at)
+		rr.orderIDs[orderID] = true
+		var c StatusChange
+		if kind == OrderEventStatusChanged && channel != ChannelWalkIn && json.Unmarshal(data, &c) == nil && c.To == "DELIVERED" {
+			rr.Deliveries++
+		}
+	}
+	events.Close()
+	if err := events.Err(); err != nil {
+		return nil, err
+	}
+
+	ledger, err := reportDB().Query(`SELECT actor, amount, created_at FROM ledger_entries
+		WHERE store_id = ? AND amount > 0 AND actor NOT IN ('', 'anonymous', 'system') AND created_at >= ? AND created_at < ?`, storeID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer ledger.Close()
+	for ledger.Next() {
+		var actor string
+		var amount Money
+		var at time.Time
+		if err := ledger.Scan(&actor, &amount, &at); err != nil {
+			return nil, err
+		}
+		rr := row(actor, at)
+		rr.Revenue = rr.Revenue + amount
+	}
+	if err := ledger.Err(); err != nil {
+		return nil, err
+	}
+
+	report := make([]ShiftReportRow, 0, len(rows))
+	for _, rr := range rows {
+		rr.Orders = len(rr.orderIDs)
+		report = append(report, *rr)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i], report[j]
+		if a.Day != b.Day {
+			return a.Day > b.Day
+		}
+		if a.shift != b.shift {
+			return a.shift < b.shift
+		}
+		return a.Staff < b.Staff
+	})
+	return report, nil
+}
+
+func shiftReportPage(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := monthRange(r)
+	if !ok {
+		redirectWithFlash(w, r, "/admin/shift-report", "error", "Pick a date range that ends after it starts.")
+		return
+	}
+	// Night shifts started on the last day end the next morning.
+	report, err := shiftReport(currentStoreID(r), from, to.AddDate(0, 0, 2))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	last := to.Format("2006-01-02")
+	first := from.Format("2006-01-02")
+	rows := report[:0]
+	for _, rr := range report {
+		if rr.Day >= first && rr.Day <= last {
+			rows = append(rows, rr)
+		}
+	}
+	t := mustParseTemplates("shift_report.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		From, To string
+		Shifts   []Shift
+		Rows     []ShiftReportRow
+		Flashes  []Flash
+	}{storeSwitcher(r), first, last, staffShifts(), rows, popFlashes(r)})
+}
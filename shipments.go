@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Orders can ship in parts. Staff send out the items that are in stock and
+// the order stays PARTIALLY_SHIPPED until the rest follow, so every line
+// item carries its own status.
+const (
+	ItemPending   = "PENDING"
+	ItemShipped   = "SHIPPED"
+	ItemDelivered = "DELIVERED"
+	ItemReturned  = "RETURNED"
+)
+
+// ItemStatusChange is the data of an OrderEventItemsUpdated event. Lines are
+// positions in the order's item list.
+type ItemStatusChange struct {
+	Lines      []int  `json:"lines"`
+	Status     string `json:"status"`
+	LocationID int    `json:"location_id,omitempty"`
+}
+
+// orderLines loads the order's items inside tx, in the same order as the
+// ordered event lists them.
+func orderLines(tx *sql.Tx, orderID string) ([]OrderItem, error) {
+	rows, err := tx.Query(`SELECT id, variant_id, sku, product_name, size, color, quantity, unit_price, status, COALESCE(location_id, 0)
+		FROM order_items WHERE order_id = ? ORDER BY id FOR UPDATE`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lines []OrderItem
+	for rows.Next() {
+		var it OrderItem
+		if err := rows.Scan(&it.ID, &it.VariantID, &it.SKU, &it.ProductName, &it.Size, &it.Color, &it.Quantity, &it.UnitPrice, &it.Status, &it.LocationID); err != nil {
+			return nil, err
+		}
+		lines = append(lines, it)
+	}
+	return lines, rows.Err()
+}
+
+// linesWithStatus lists the positions of the lines in one of statuses.
+func linesWithStatus(lines []OrderItem, statuses ...string) []int {
+	var positions []int
+	for i, it := range lines {
+		for _, s := range statuses {
+			if it.Status == s {
+				positions = append(positions, i)
+				break
+			}
+		}
+	}
+	return positions
+}
+
+// setItemStatus moves the lines at positions to status inside tx. A
+// locationID of 0 leaves the lines' location alone.
+func setItemStatus(tx *sql.Tx, orderID string, lines []OrderItem, positions []int, status string, locationID int) error {
+	if len(positions) == 0 {
+		return nil
+	}
+	for _, p := range positions {
+		if _, err := tx.Exec("UPDATE order_items SET status = ?, location_id = COALESCE(NULLIF(?, 0), location_id) WHERE id = ?", status, locationID, lines[p].ID); err != nil {
+			return err
+		}
+	}
+	return recordOrderEvent(tx, orderID, OrderEventItemsUpdated, ItemStatusChange{Lines: positions, Status: status, LocationID: locationID})
+}
+
+func markItemsDelivered(tx *sql.Tx, orderID string) error {
+	lines, err := orderLines(tx, orderID)
+	if err != nil {
+		return err
+	}
+	return setItemStatus(tx, orderID, lines, linesWithStatus(lines, ItemShipped), ItemDelivered, 0)
+}
+
+// shipInStockItems sends out every pending line that some location in the
+// order's store has enough stock for, and reports how many lines went and
+// how many are still waiting.
+func shipInStockItems(tx *sql.Tx, r *http.Request, orderID string) (shipped, waiting int, err error) {
+	var storeID int
+	if err := tx.QueryRow("SELECT store_id FROM orders WHERE order_id = ?", orderID).Scan(&storeID); err != nil {
+		return 0, 0, err
+	}
+	lines, err := orderLines(tx, orderID)
+	if err != nil {
+		return 0, 0, err
+	}
+	locations, err := storeLocations(storeID)
+	if err != nil {
+		return 0, 0, err
+	}
+	byLocation := map[int][]int{}
+	for _, p := range linesWithStatus(lines, ItemPending) {
+		it := lines[p]
+		from := 0
+		for _, l := range locations {
+			var have int
+			err := tx.QueryRow("SELECT quantity FROM stock WHERE location_id = ? AND variant_id = ?", l.ID, it.VariantID).Scan(&have)
+			if err != nil && err != sql.ErrNoRows {
+				return 0, 0, err
+			}
+			if have >= it.Quantity {
+				from = l.ID
+				break
+			}
+		}
+		if from == 0 {
+			waiting++
+			continue
+		}
+		if err := moveStock(tx, r, it.VariantID, it.Quantity, from, 0, "fulfilment", orderID); err != nil {
+			return 0, 0, err
+		}
+		byLocation[from] = append(byLocation[from], p)
+		shipped++
+	}
+	for _, l := range locations {
+		if err := setItemStatus(tx, orderID, lines, byLocation[l.ID], ItemShipped, l.ID); err != nil {
+			return 0, 0, err
+		}
+	}
+	return shipped, waiting, nil
+}
+
+// shipAvailableItems sends out the in-stock part of an order now and leaves
+// the rest for when it arrives. Once nothing is waiting the order is
+// DELIVERING as usual.
+func shipAvailableItems(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	back := "/change-status"
+	var status string
+	var madeToOrder bool
+	err := db.QueryRow("SELECT status, "+madeToOrderColumn+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", orderID, currentStoreID(r)).Scan(&status, &madeToOrder)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if status != "PROCESSING" && status != "PARTIALLY_SHIPPED" {
+		redirectWithFlash(w, r, back, "error", "Order "+orderID+" has already been sent out.")
+		return
+	}
+	if madeToOrder {
+		redirectWithFlash(w, r, back, "error", "Order "+orderID+" is made to measure and goes out once it has passed QC.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	shipped, waiting, err := shipInStockItems(tx, r, orderID)
+	if err != nil {
+		http.Error(w, "DB stock error", http.StatusInternalServerError)
+		return
+	}
+	if shipped == 0 {
+		redirectWithFlash(w, r, back, "error", "None of the items still to ship on order "+orderID+" are in stock.")
+		return
+	}
+	newStatus := "PARTIALLY_SHIPPED"
+	if waiting == 0 {
+		newStatus = "DELIVERING"
+	}
+	if newStatus != status {
+		_, err = tx.Exec("UPDATE orders SET status = ? WHERE order_id = ?", newStatus, orderID)
+		if err == nil {
+			err = recordOrderEventBy(tx, orderID, OrderEventStatusChanged, staffUser(r), StatusChange{From: status, To: newStatus})
+		}
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "order.ship_available", orderID, fmt.Sprintf("%d lines shipped, %d waiting", shipped, waiting))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if newStatus != status {
+		var o Order
+		if err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ?", orderID), &o); err != nil {
+			log.Printf("reload shipped order %s: %v", orderID, err)
+		}
+		emitOrderEvent(OrderEvent{Type: EventOrderStatusChanged, OrderID: orderID, Order: &o, OldStatus: status})
+	}
+	msg := fmt.Sprintf("Order %s: %d item(s) sent out, %d still waiting for stock.", orderID, shipped, waiting)
+	if waiting == 0 {
+		msg = "Order " + orderID + " is now DELIVERING."
+	}
+	redirectWithFlash(w, r, back, "success", msg)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Shipping is charged from the first rule, by position, whose zone, weight
+// range and minimum order value all match the order. Empty limits match
+// anything, so a zero-fee rule with a minimum order value gives free
+// shipping over a threshold. Orders no rule matches pay the delivery fee from
+// the shop settings.
+//
+// The zones are also the areas we deliver to. Depending on
+// DELIVERY_ZONE_POLICY, orders to postcodes outside every zone are flagged
+// for staff ("flag", the default), refused ("reject") or let through ("off").
+// Customers can always choose store pickup instead.
+
+// defaultVariantWeight is used for variants added without a weight.
+const defaultVariantWeight = 250
+
+type ShippingZone struct {
+	ID        int
+	Name      string
+	Postcodes string
+}
+
+// ShippingRule limits are inclusive; zero means no limit, except MinWeight.
+type ShippingRule struct {
+	ID            int
+	Position      int
+	ZoneID        int
+	ZoneName      string
+	MinWeight     int
+	MaxWeight     int
+	MinOrderValue Money
+	Fee           Money
+}
+
+// ShippingCharge is the data of an OrderEventShippingCharged event.
+type ShippingCharge struct {
+	PostalCode string `json:"postal_code"`
+	Zone       string `json:"zone"`
+	Fee        Money  `json:"fee"`
+	Pickup     bool   `json:"pickup,omitempty"`
+}
+
+// Subtotal is what the order's items cost, before shipping, rush and gift
+// wrap fees.
+func (o Order) Subtotal() Money {
+	return o.TotalAmount - o.ShippingFee - o.RushFee - o.GiftWrapFee
+}
+
+func (r ShippingRule) matches(zoneID, weight int, subtotal Money) bool {
+	return (r.ZoneID == 0 || r.ZoneID == zoneID) &&
+		weight >= r.MinWeight && (r.MaxWeight == 0 || weight <= r.MaxWeight) &&
+		subtotal >= r.MinOrderValue
+}
+
+func normalizePostalCode(code string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(code), ""))
+}
+
+func loadShippingZones() ([]ShippingZone, error) {
+	rows, err := db.Query("SELECT id, name, postcodes FROM shipping_zones ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var zones []ShippingZone
+	for rows.Next() {
+		var z ShippingZone
+		if err := rows.Scan(&z.ID, &z.Name, &z.Postcodes); err != nil {
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	return zones, rows.Err()
+}
+
+// shippingZoneFor picks the zone with the longest postcode prefix matching
+// postalCode, or the zero zone when none does.
+func shippingZoneFor(zones []ShippingZone, postalCode string) ShippingZone {
+	var best ShippingZone
+	longest := 0
+	for _, z := range zones {
+		for _, prefix := range strings.Split(z.Postcodes, ",") {
+			prefix = normalizePostalCode(prefix)
+			if prefix != "" && len(prefix) > longest && strings.HasPrefix(postalCode, prefix) {
+				best, longest = z, len(prefix)
+			}
+		}
+	}
+	return best
+}
+
+func loadShippingRules() ([]ShippingRule, error) {
+	rows, err := db.Query(`SELECT r.id, r.position, COALESCE(r.zone_id, 0), COALESCE(z.name, ''), r.min_weight_grams,
+		COALESCE(r.max_weight_grams, 0), r.min_order_value, r.fee
+		FROM shipping_rules r LEFT JOIN shipping_zones z ON z.id = r.zone_id ORDER BY r.position, r.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []ShippingRule
+	for rows.Next() {
+		var r ShippingRule
+		if err := rows.Scan(&r.ID, &r.Position, &r.ZoneID, &r.ZoneName, &r.MinWeight, &r.MaxWeight, &r.MinOrderValue, &r.Fee); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func shippingQuote(postalCode string, weight int, subtotal Money) (ShippingCharge, error) {
+	postalCode = normalizePostalCode(postalCode)
+	zones, err := loadShippingZones()
+	if err != nil {
+		return ShippingCharge{}, err
+	}
+	rules, err := loadShippingRules()
+	if err != nil {
+		return ShippingCharge{}, err
+	}
+	zone := shippingZoneFor(zones, postalCode)
+	charge := ShippingCharge{PostalCode: postalCode, Zone: zone.Name, Fee: settingMoney("delivery_fee")}
+	for _, r := range rules {
+		if r.matches(zone.ID, weight, subtotal) {
+			charge.Fee = r.Fee
+			break
+		}
+	}
+	return charge, nil
+}
+
+// chargeShipping adds the shipping fee for o to its total inside tx.
+func chargeShipping(tx *sql.Tx, o *Order, postalCode string, weight int) error {
+	charge, err := shippingQuote(postalCode, weight, o.TotalAmount)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE orders SET postal_code = ?, shipping_fee = ?, total_amount = total_amount + ? WHERE order_id = ?",
+		charge.PostalCode, charge.Fee, charge.Fee, o.OrderID)
+	if err != nil {
+		return err
+	}
+	o.PostalCode, o.ShippingFee = charge.PostalCode, charge.Fee
+	o.TotalAmount = o.TotalAmount + charge.Fee
+	return recordOrderEvent(tx, o.OrderID, OrderEventShippingCharged, charge)
+}
+
+// choosePickup records inside tx that o will be collected from its store, so
+// no shipping is charged.
+func choosePickup(tx *sql.Tx, o *Order) error {
+	if _, err := tx.Exec("UPDATE orders SET pickup = TRUE WHERE order_id = ?", o.OrderID); err != nil {
+		return err
+	}
+	o.Pickup = true
+	return recordOrderEvent(tx, o.OrderID, OrderEventShippingCharged, ShippingCharge{Pickup: true})
+}
+
+func deliveryZonePolicy() string {
+	return envOr("DELIVERY_ZONE_POLICY", "flag")
+}
+
+// postalCodeServiced reports whether we deliver to postalCode, that is
+// whether it falls in one of the shipping zones.
+func postalCodeServiced(postalCode string) (bool, error) {
+	zones, err := loadShippingZones()
+	if err != nil {
+		return false, err
+	}
+	return shippingZoneFor(zones, normalizePostalCode(postalCode)).ID != 0, nil
+}
+
+// shippingQuoteAPI lets the order form show the fee before the order is placed.
+func shippingQuoteAPI(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.URL.Query().Get("variant"))
+	qty, err := strconv.Atoi(r.URL.Query().Get("qty"))
+	if err != nil || qty < 1 {
+		writeJSONError(w, http.StatusBadRequest, "qty must be a positive number")
+		return
+	}
+	v, err := variantByID(id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusBadRequest, "Unknown product")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	charge, err := shippingQuote(r.URL.Query().Get("postal_code"), v.WeightGrams*qty, v.Price.Times(qty))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ShippingCharge
+		Serviced bool `json:"serviced"`
+	}{charge, charge.Zone != "" || deliveryZonePolicy() == "off"})
+}
+
+func shippingPage(w http.ResponseWriter, r *http.Request) {
+	zones, err := loadShippingZones()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	rules, err := loadShippingRules()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("shipping.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Zones      []ShippingZone
+		Rules      []ShippingRule
+		DefaultFee Money
+		Flashes    []Flash
+	}{zones, rules, settingMoney("delivery_fee"), popFlashes(r)})
+}
+
+// saveShippingZone adds a zone, or updates one when an id is posted.
+func saveShippingZone(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	name := strings.TrimSpace(r.FormValue("name"))
+	var prefixes []string
+	for _, p := range strings.Split(r.FormValue("postcodes"), ",") {
+		if p = normalizePostalCode(p); p != "" {
+			prefixes = append(prefixes, p)
+		}
+	}
+	postcodes := strings.Join(prefixes, ",")
+	if name == "" || len(name) > 100 || len(postcodes) > 1000 {
+		redirectWithFlash(w, r, "/admin/shipping", "error", "A zone needs a name and at most 1000 characters of postcodes.")
+		return
+	}
+	var err error
+	if id == 0 {
+		_, err = db.Exec("INSERT INTO shipping_zones (name, postcodes) VALUES (?, ?)", name, postcodes)
+	} else {
+		_, err = db.Exec("UPDATE shipping_zones SET name = ?, postcodes = ? WHERE id = ?", name, postcodes, id)
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "shipping_zone.save", name, postcodes)
+	redirectWithFlash(w, r, "/admin/shipping", "success", "Zone "+name+" saved.")
+}
+
+// saveShippingRule adds a rule, or updates one when an id is posted.
+func saveShippingRule(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	position, _ := strconv.Atoi(r.FormValue("position"))
+	zoneID, _ := strconv.Atoi(r.FormValue("zone_id"))
+	minWeight, _ := strconv.Atoi(r.FormValue("min_weight"))
+	maxWeight, _ := strconv.Atoi(r.FormValue("max_weight"))
+	minValue, _ := parseMoney(r.FormValue("min_order_value"))
+	fee, err := parseMoney(r.FormValue("fee"))
+	if err != nil || fee < 0 || minWeight < 0 || maxWeight < 0 || minValue < 0 || (maxWeight != 0 && maxWeight < minWeight) {
+		redirectWithFlash(w, r, "/admin/shipping", "error", "A rule needs a fee of zero or more and a valid weight range.")
+		return
+	}
+	if id == 0 {
+		_, err = db.Exec(`INSERT INTO shipping_rules (position, zone_id, min_weight_grams, max_weight_grams, min_order_value, fee)
+			VALUES (?, NULLIF(?, 0), ?, NULLIF(?, 0), ?, ?)`, position, zoneID, minWeight, maxWeight, minValue, fee)
+	} else {
+		_, err = db.Exec(`UPDATE shipping_rules SET position = ?, zone_id = NULLIF(?, 0), min_weight_grams = ?, max_weight_grams = NULLIF(?, 0),
+			min_order_value = ?, fee = ? WHERE id = ?`, position, zoneID, minWeight, maxWeight, minValue, fee, id)
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "shipping_rule.save", strconv.Itoa(id), fmt.Sprintf("zone %d, %d-%dg, from %.2f: %.2f", zoneID, minWeight, maxWeight, minValue, fee))
+	redirectWithFlash(w, r, "/admin/shipping", "success", "Shipping rule saved.")
+}
+
+func deleteShippingRule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := db.Exec("DELETE FROM shipping_rules WHERE id = ?", id); err != nil {
+		http.Error(w, "DB delete error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "shipping_rule.delete", id, "")
+	redirectWithFlash(w, r, "/admin/shipping", "success", "Shipping rule deleted.")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The storefront: /shop lists everything that can be ordered,
+// /shop/{category} one category or collection by its slug, and
+// /shop/{id}-{name} one product with each of its variants linking to the
+// order form with that variant picked. They read through the same lastGood
+// caches as the order form, so they keep showing while the database is down.
+
+type ShopPage struct {
+	Categories []Category
+	Category   *Category
+	Products   []Product
+	// Missing is set when a product asked for can't be ordered any more.
+	Missing bool
+}
+
+type ShopProductPage struct {
+	Categories []Category
+	Product    Product
+	SizeCharts []SizeChart
+}
+
+// ShopPath is the product's storefront page.
+func (p Product) ShopPath() string {
+	return "/shop/" + strconv.Itoa(p.ID) + "-" + slugify(p.Name)
+}
+
+// FromPrice is the lowest price among the product's variants.
+func (p Product) FromPrice() Money {
+	var from Money
+	for i, v := range p.Variants {
+		if i == 0 || v.Price < from {
+			from = v.Price
+		}
+	}
+	return from
+}
+
+// shopProducts groups variants, which come in product order, into products.
+func shopProducts(variants []Variant) []Product {
+	var products []Product
+	for _, v := range variants {
+		if n := len(products); n == 0 || products[n-1].ID != v.ProductID {
+			products = append(products, Product{ID: v.ProductID, Name: v.ProductName, ProductType: v.ProductType, Active: true, MadeToMeasure: v.MadeToMeasure})
+		}
+		p := &products[len(products)-1]
+		p.Variants = append(p.Variants, v)
+	}
+	return products
+}
+
+// shopCategories leaves out the categories with nothing in them.
+func shopCategories() []Category {
+	categories, _ := loadCategories()
+	var shown []Category
+	for _, c := range categories {
+		if c.ProductCount > 0 {
+			shown = append(shown, c)
+		}
+	}
+	return shown
+}
+
+func shopPage(w http.ResponseWriter, r *http.Request) {
+	variants, err := activeVariantsIn(0)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	renderShop(w, ShopPage{Categories: shopCategories(), Products: shopProducts(variants)})
+}
+
+// shopSlugPage serves /shop/{slug}, which is a category's slug or a
+// product's id and name.
+func shopSlugPage(w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+	categories := shopCategories()
+	for i, c := range categories {
+		if c.Slug != slug {
+			continue
+		}
+		variants, err := activeVariantsIn(c.ID)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		renderShop(w, ShopPage{Categories: categories, Category: &categories[i], Products: shopProducts(variants)})
+		return
+	}
+
+	variants, err := activeVariantsIn(0)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	products := shopProducts(variants)
+	id, name, _ := strings.Cut(slug, "-")
+	productID, _ := strconv.Atoi(id)
+	for _, p := range products {
+		if p.ID != productID {
+			continue
+		}
+		if name != slugify(p.Name) {
+			http.Redirect(w, r, p.ShopPath(), http.StatusMovedPermanently)
+			return
+		}
+		charts, _ := variantSizeCharts(p.Variants)
+		t := mustParseTemplates("shop_product.html")
+		_ = t.Execute(w, ShopProductPage{Categories: categories, Product: p, SizeCharts: charts})
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+	renderShop(w, ShopPage{Categories: categories, Products: products, Missing: true})
+}
+
+func renderShop(w http.ResponseWriter, page ShopPage) {
+	t := mustParseTemplates("shop.html")
+	_ = t.Execute(w, page)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	secretOnce sync.Once
+	secret     []byte
+)
+
+// appSecret is the HMAC key for signed tokens. Without APP_SECRET a random
+// key is used, so tokens do not survive a restart.
+func appSecret() []byte {
+	secretOnce.Do(func() {
+		if s := envOr("APP_SECRET", ""); s != "" {
+			secret = []byte(s)
+			return
+		}
+		log.Printf("APP_SECRET not set, using a temporary signing key")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+	})
+	return secret
+}
+
+func tokenMAC(purpose, value string, expires int64) string {
+	mac := hmac.New(sha256.New, appSecret())
+	mac.Write([]byte(purpose + "\x00" + value + "\x00" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signToken returns a token proving value was issued for purpose, valid for ttl.
+func signToken(purpose, value string, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+	return strconv.FormatInt(expires, 10) + "." + tokenMAC(purpose, value, expires)
+}
+
+func verifyToken(purpose, value, token string) bool {
+	exp, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(tokenMAC(purpose, value, expires)))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	token := signToken("order-confirmation", "ODR#00042", time.Hour)
+	exp, sig, _ := strings.Cut(token, ".")
+	expires, _ := strconv.ParseInt(exp, 10, 64)
+	// A token for the same value whose expiry was pushed back by hand.
+	extended := strconv.FormatInt(expires+3600, 10) + "." + sig
+	tampered := sig[:len(sig)-1] + "A"
+	if tampered == sig {
+		tampered = sig[:len(sig)-1] + "B"
+	}
+
+	tests := []struct {
+		name, purpose, value, token string
+		ok                          bool
+	}{
+		{"valid", "order-confirmation", "ODR#00042", token, true},
+		{"other purpose", "order-code", "ODR#00042", token, false},
+		{"other value", "order-confirmation", "ODR#00043", token, false},
+		{"expired", "order-confirmation", "ODR#00042", signToken("order-confirmation", "ODR#00042", -time.Minute), false},
+		{"expiry changed", "order-confirmation", "ODR#00042", extended, false},
+		{"signature changed", "order-confirmation", "ODR#00042", exp + "." + tampered, false},
+		{"no signature", "order-confirmation", "ODR#00042", exp + ".", false},
+		{"no separator", "order-confirmation", "ODR#00042", exp + sig, false},
+		{"bad expiry", "order-confirmation", "ODR#00042", "soon." + sig, false},
+		{"empty", "order-confirmation", "ODR#00042", "", false},
+		// The parts are kept apart, so they can't be shifted between each other.
+		{"purpose and value run together", "order", "-confirmationODR#00042", token, false},
+	}
+	for _, tt := range tests {
+		if got := verifyToken(tt.purpose, tt.value, tt.token); got != tt.ok {
+			t.Errorf("%s: verifyToken = %t, want %t", tt.name, got, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A SizeChart holds the measurements for one product type, one row per
+// measurement with a value for each size.
+type SizeChart struct {
+	ProductType string
+	Sizes       []string
+	Rows        []SizeChartRow
+}
+
+type SizeChartRow struct {
+	Measurement string
+	Values      map[string]string
+}
+
+// loadSizeCharts returns the charts for the given product types, or for every
+// product type when none are given.
+func loadSizeCharts(productTypes ...string) ([]SizeChart, error) {
+	query := "SELECT product_type, measurement, size, value FROM size_charts"
+	var args []interface{}
+	if len(productTypes) > 0 {
+		query += " WHERE product_type IN (?" + strings.Repeat(", ?", len(productTypes)-1) + ")"
+		for _, pt := range productTypes {
+			args = append(args, pt)
+		}
+	}
+	rows, err := db.Query(query+" ORDER BY product_type, position, measurement", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var charts []SizeChart
+	for rows.Next() {
+		var productType, measurement, size, value string
+		if err := rows.Scan(&productType, &measurement, &size, &value); err != nil {
+			return nil, err
+		}
+		if n := len(charts); n == 0 || charts[n-1].ProductType != productType {
+			charts = append(charts, SizeChart{ProductType: productType, Sizes: sizes})
+		}
+		c := &charts[len(charts)-1]
+		if n := len(c.Rows); n == 0 || c.Rows[n-1].Measurement != measurement {
+			c.Rows = append(c.Rows, SizeChartRow{Measurement: measurement, Values: map[string]string{}})
+		}
+		c.Rows[len(c.Rows)-1].Values[size] = value
+	}
+	return charts, rows.Err()
+}
+
+// variantSizeCharts picks the charts for the product types on offer.
+func variantSizeCharts(variants []Variant) ([]SizeChart, error) {
+	seen := map[string]bool{}
+	var types []string
+	for _, v := range variants {
+		if !seen[v.ProductType] {
+			seen[v.ProductType] = true
+			types = append(types, v.ProductType)
+		}
+	}
+	if len(types) == 0 {
+		return nil, nil
+	}
+	return loadSizeCharts(types...)
+}
+
+func sizeChartsPage(w http.ResponseWriter, r *http.Request) {
+	charts, err := loadSizeCharts()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	// Product types without a chart yet get an empty one to fill in.
+	rows, err := db.Query("SELECT DISTINCT product_type FROM products")
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	charted := map[string]bool{}
+	for _, c := range charts {
+		charted[c.ProductType] = true
+	}
+	for rows.Next() {
+		var pt string
+		_ = rows.Scan(&pt)
+		if !charted[pt] {
+			charts = append(charts, SizeChart{ProductType: pt, Sizes: sizes})
+		}
+	}
+	sort.Slice(charts, func(i, j int) bool { return charts[i].ProductType < charts[j].ProductType })
+
+	t := mustParseTemplates("size_charts.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Charts  []SizeChart
+		Sizes   []string
+		Flashes []Flash
+	}{charts, sizes, popFlashes(r)})
+}
+
+// updateSizeChart replaces a product type's chart. The form posts one
+// "measurement" field per row and, for each size, one field per row named
+// after the size; rows with no measurement name are dropped.
+func updateSizeChart(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	productType := strings.TrimSpace(r.PostForm.Get("product_type"))
+	if productType == "" {
+		redirectWithFlash(w, r, "/admin/size-charts", "error", "Pick a product type.")
+		return
+	}
+	measurements := r.PostForm["measurement"]
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM size_charts WHERE product_type = ?", productType)
+	var kept []string
+	for i, m := range measurements {
+		m = strings.TrimSpace(m)
+		if err != nil {
+			break
+		}
+		if m == "" {
+			continue
+		}
+		kept = append(kept, m)
+		for _, size := range sizes {
+			values := r.PostForm[size]
+			if i >= len(values) || strings.TrimSpace(values[i]) == "" {
+				continue
+			}
+			_, err = tx.Exec("INSERT INTO size_charts (product_type, measurement, size, value, position) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)",
+				productType, m, size, strings.TrimSpace(values[i]), len(kept))
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "size_chart.update", productType, strings.Join(kept, ", "))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/size-charts", "success", "Size chart for "+productType+" saved.")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The public order form carries two cheap checks against bots. A honeypot
+// field hidden from people ("website") must come back empty, and the form
+// carries the time it was shown, signed, so one submitted sooner than
+// ORDER_FORM_MIN_FILL (3s) after it, or with the time missing or tampered
+// with, is turned away. A shown form can only be sent once: its token is
+// used up when the order is placed or kept to wait for a texted code, and
+// the kept form is placed later without being checked again. Each catch is
+// counted by kind in the order_form_spam metric at /admin/metrics. The
+// form_spam_checks feature turns them off.
+
+var formSpamCaught = expvar.NewMap("order_form_spam")
+
+var errFormTokenUsed = errors.New("form already sent")
+
+const formTokenUsedMessage = "This form has already been sent. Please reload the page and fill it in again."
+
+func init() {
+	registerScheduledTask("used-form-token-cleanup", "50 * * * *", func() error {
+		_, err := db.Exec("DELETE FROM used_form_tokens WHERE used_at < NOW() - INTERVAL ? SECOND", int(formGuardTTL.Seconds()))
+		return err
+	})
+}
+
+// checkedFormKey marks a request replaying a form that was checked, and
+// its token used, when it was first sent.
+type checkedFormKey struct{}
+
+func withCheckedForm(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), checkedFormKey{}, true))
+}
+
+func formChecked(r *http.Request) bool {
+	checked, _ := r.Context().Value(checkedFormKey{}).(bool)
+	return checked
+}
+
+// formGuardTTL is how long a shown form can be submitted for.
+const formGuardTTL = 24 * time.Hour
+
+// FormGuard is what the form_guard partial puts in a form.
+type FormGuard struct {
+	Shown string
+	Token string
+}
+
+func newFormGuard(purpose string) FormGuard {
+	shown := strconv.FormatInt(time.Now().Unix(), 10)
+	return FormGuard{Shown: shown, Token: signToken(purpose, shown, formGuardTTL)}
+}
+
+// formSpamReason returns what gives the posted form away as sent by a bot,
+// as the message to show, or "" when nothing does.
+func formSpamReason(r *http.Request, purpose string) (string, error) {
+	if !featureEnabled("form_spam_checks") || formChecked(r) {
+		return "", nil
+	}
+	if strings.TrimSpace(r.PostFormValue("website")) != "" {
+		formSpamCaught.Add("honeypot", 1)
+		return "We couldn't take this order. Please try again.", nil
+	}
+	shown := r.PostFormValue("form_shown")
+	started, err := strconv.ParseInt(shown, 10, 64)
+	if err != nil || !verifyToken(purpose, shown, r.PostFormValue("form_token")) {
+		formSpamCaught.Add("bad_token", 1)
+		return "This form has expired. Please reload the page and fill it in again.", nil
+	}
+	if time.Since(time.Unix(started, 0)) < envDuration("ORDER_FORM_MIN_FILL", 3*time.Second) {
+		formSpamCaught.Add("too_fast", 1)
+		return "That was quicker than we expected. Please check your order and send it again.", nil
+	}
+	var used bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM used_form_tokens WHERE token = ?)", r.PostFormValue("form_token")).Scan(&used); err != nil {
+		return "", err
+	}
+	if used {
+		formSpamCaught.Add("reused", 1)
+		return formTokenUsedMessage, nil
+	}
+	return "", nil
+}
+
+// useFormToken uses up the posted form's token on ex, so the form can't be
+// sent again. It returns errFormTokenUsed when it already was.
+func useFormToken(ex execer, r *http.Request) error {
+	if !featureEnabled("form_spam_checks") || formChecked(r) {
+		return nil
+	}
+	res, err := ex.Exec("INSERT IGNORE INTO used_form_tokens (token) VALUES (?)", r.PostFormValue("form_token"))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		formSpamCaught.Add("reused", 1)
+		return errFormTokenUsed
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Staff can split items that have not shipped yet off a large order into a
+// child order, for example to deliver them on another day. The child keeps
+// the parent's customer, address and payment method; shipping and rush fees
+// stay on the parent, so the two totals add up to the original.
+
+// LineMove takes Quantity units off the parent's item at position Line.
+type LineMove struct {
+	Line     int `json:"line"`
+	Quantity int `json:"quantity"`
+}
+
+// OrderSplit is the data of an OrderEventSplit event, recorded on the parent.
+type OrderSplit struct {
+	ChildOrderID string     `json:"child_order_id"`
+	Moves        []LineMove `json:"moves"`
+	Amount       Money      `json:"amount"`
+}
+
+var errNothingToSplit = errors.New("nothing to split")
+
+// apply takes the split items off o. Lines that are moved entirely are
+// dropped, last first so the positions of the others hold.
+func (s OrderSplit) apply(o *Order) {
+	moves := append([]LineMove(nil), s.Moves...)
+	sort.Slice(moves, func(i, j int) bool { return moves[i].Line > moves[j].Line })
+	for _, m := range moves {
+		if m.Line < 0 || m.Line >= len(o.Items) {
+			continue
+		}
+		o.Quantity -= m.Quantity
+		if o.Items[m.Line].Quantity -= m.Quantity; o.Items[m.Line].Quantity <= 0 {
+			o.Items = append(o.Items[:m.Line], o.Items[m.Line+1:]...)
+		}
+	}
+	o.TotalAmount = o.TotalAmount - s.Amount
+	if len(o.Items) > 0 {
+		o.Size = o.Items[0].Size
+	}
+}
+
+// splitOrder moves the given quantities of parent's pending lines into a new
+// PROCESSING child order inside tx. At least one unit must stay behind.
+func splitOrder(tx *sql.Tx, parent *Order, lines []OrderItem, moves []LineMove) (Order, error) {
+	remaining := 0
+	for _, it := range lines {
+		remaining += it.Quantity
+	}
+	child := Order{
+		CustomerID: parent.CustomerID, Status: statuses[0], StoreID: parent.StoreID, Notes: parent.Notes,
+		PostalCode: parent.PostalCode, Address: parent.Address, Latitude: parent.Latitude, Longitude: parent.Longitude,
+		OutsideArea: parent.OutsideArea, Pickup: parent.Pickup, PaymentMethod: parent.PaymentMethod,
+		ParentOrderID: parent.OrderID,
+	}
+	split := OrderSplit{}
+	for _, m := range moves {
+		it := lines[m.Line]
+		if it.Status != ItemPending || m.Quantity < 1 || m.Quantity > it.Quantity {
+			return Order{}, errNothingToSplit
+		}
+		remaining -= m.Quantity
+		moved := it
+		moved.ID, moved.Quantity = 0, m.Quantity
+		child.Items = append(child.Items, moved)
+		child.Quantity += m.Quantity
+		child.TotalAmount += it.UnitPrice.Times(m.Quantity)
+		split.Moves = append(split.Moves, m)
+	}
+	if len(child.Items) == 0 || remaining < 1 {
+		return Order{}, errNothingToSplit
+	}
+	child.Size = child.Items[0].Size
+
+	res, err := tx.Exec(`INSERT INTO orders (order_id, customer_id, size, quantity, total_amount, status, store_id, notes,
+			postal_code, address, latitude, longitude, outside_area, pickup, payment_method, parent_order_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), ?, ?, ?, ?)`,
+		pendingOrderID(), child.CustomerID, child.Size, child.Quantity, child.TotalAmount, child.Status, child.StoreID, child.Notes,
+		child.PostalCode, child.Address, child.Latitude, child.Longitude, child.OutsideArea, child.Pickup, child.PaymentMethod, child.ParentOrderID)
+	if err != nil {
+		return Order{}, err
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return Order{}, err
+	}
+	child.ID, child.OrderID = int(lastID), generateOrderID(int(lastID))
+	if _, err = tx.Exec("UPDATE orders SET order_id = ? WHERE id = ?", child.OrderID, lastID); err != nil {
+		return Order{}, err
+	}
+	if err = insertOrderItems(tx, child.OrderID, child.Items); err != nil {
+		return Order{}, err
+	}
+	if err = recordOrderEvent(tx, child.OrderID, OrderEventOrdered, child); err != nil {
+		return Order{}, err
+	}
+
+	split.ChildOrderID, split.Amount = child.OrderID, child.TotalAmount
+	for _, m := range split.Moves {
+		it := lines[m.Line]
+		if m.Quantity == it.Quantity {
+			_, err = tx.Exec("DELETE FROM order_items WHERE id = ?", it.ID)
+		} else {
+			_, err = tx.Exec("UPDATE order_items SET quantity = quantity - ? WHERE id = ?", m.Quantity, it.ID)
+		}
+		if err != nil {
+			return Order{}, err
+		}
+	}
+	parent.Items = lines
+	split.apply(parent)
+	_, err = tx.Exec("UPDATE orders SET size = ?, quantity = ?, total_amount = ? WHERE order_id = ?",
+		parent.Size, parent.Quantity, parent.TotalAmount, parent.OrderID)
+	if err != nil {
+		return Order{}, err
+	}
+	return child, recordOrderEvent(tx, parent.OrderID, OrderEventSplit, split)
+}
+
+func splitOrderPage(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	var o Order
+	err := scanOrder(db.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL", orderID, currentStoreID(r)), &o)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	o.Items, err = orderItems(o.OrderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	slots, err := deliverySlots(o.StoreID, time.Now().Format("2006-01-02"), true)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("split_order.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Order   Order
+		Slots   []DeliverySlot
+		Flashes []Flash
+	}{o, slots, popFlashes(r)})
+}
+
+// splitOrderHandler moves the posted quantities (qty_<line>) into a child
+// order, optionally booked for its own delivery date and slot.
+func splitOrderHandler(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderID"]
+	back := "/admin/orders/" + url.PathEscape(orderID) + "/split"
+	date := r.FormValue("delivery_date")
+	slotID, _ := strconv.Atoi(r.FormValue("slot_id"))
+	if date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil || slotID == 0 {
+			redirectWithFlash(w, r, back, "error", "Pick both a delivery date and a slot, or neither.")
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var parent Order
+	err = scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM orders WHERE order_id = ? AND store_id = ? AND deleted_at IS NULL FOR UPDATE", orderID, currentStoreID(r)), &parent)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if parent.Status != "PROCESSING" && parent.Status != "PARTIALLY_SHIPPED" {
+		redirectWithFlash(w, r, back, "error", "Only orders that have not been sent out can be split.")
+		return
+	}
+	lines, err := orderLines(tx, orderID)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	var moves []LineMove
+	for i := range lines {
+		if qty, _ := strconv.Atoi(r.FormValue("qty_" + strconv.Itoa(i))); qty != 0 {
+			moves = append(moves, LineMove{Line: i, Quantity: qty})
+		}
+	}
+
+	child, err := splitOrder(tx, &parent, lines, moves)
+	if err == errNothingToSplit {
+		redirectWithFlash(w, r, back, "error", "Move at least one unshipped item, and leave at least one on the original order.")
+		return
+	}
+	if err == nil && slotID != 0 {
+		err = scheduleDelivery(tx, &child, slotID, date)
+		if err == errDeliverySlotFull || err == errDeliverySlotUnavailable {
+			redirectWithFlash(w, r, back, "error", "That delivery slot cannot take the new order: "+err.Error()+".")
+			return
+		}
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "order.split", orderID, fmt.Sprintf("%s (%s) split off", child.OrderID, money(child.TotalAmount)))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	emitOrderEvent(OrderEvent{Type: EventOrderCreated, OrderID: child.OrderID, Order: &child})
+	redirectWithFlash(w, r, "/change-status", "success", fmt.Sprintf("Order %s split: %s now holds %s of it.", orderID, child.OrderID, money(child.TotalAmount)))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var sseEventNames = map[string]string{
+	EventOrderCreated:       "order-created",
+	EventOrderStatusChanged: "status-changed",
+}
+
+var (
+	sseMu      sync.Mutex
+	sseClients = map[chan OrderEvent]int{} // by the store they follow
+)
+
+func init() {
+	onOrderEvent(func(ev OrderEvent) {
+		if _, ok := sseEventNames[ev.Type]; !ok {
+			return
+		}
+		sseMu.Lock()
+		defer sseMu.Unlock()
+		for ch, storeID := range sseClients {
+			if ev.EventStoreID() != storeID {
+				continue
+			}
+			select {
+			case ch <- ev:
+			default:
+				// Slow client; it will resync when it reconnects.
+			}
+		}
+	})
+}
+
+func eventsStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := make(chan OrderEvent, 16)
+	sseMu.Lock()
+	sseClients[ch] = currentStoreID(r)
+	sseMu.Unlock()
+	defer func() {
+		sseMu.Lock()
+		delete(sseClients, ch)
+		sseMu.Unlock()
+	}()
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev := <-ch:
+			data, err := json.Marshal(ev.forStaffFeed())
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", sseEventNames[ev.Type], data)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Standing orders place the same order again every week or month, such as a
+// school's monthly uniform order. Staff set them up; customers get a text
+// STANDING_ORDER_NOTICE_DAYS before each renewal and can pause or cancel
+// them from their account.
+const (
+	StandingOrderActive    = "ACTIVE"
+	StandingOrderPaused    = "PAUSED"
+	StandingOrderCancelled = "CANCELLED"
+)
+
+var standingOrderFrequencies = map[string]string{
+	"weekly":  "Every week",
+	"monthly": "Every month",
+}
+
+type StandingOrder struct {
+	ID            int
+	StoreID       int
+	CustomerID    string
+	Variant       Variant
+	Quantity      int
+	Frequency     string
+	NextRun       string
+	Status        string
+	Notes         string
+	Address       string
+	PostalCode    string
+	Pickup        bool
+	PaymentMethod string
+	LastOrderID   string
+	CreatedAt     time.Time
+}
+
+func (s StandingOrder) FrequencyLabel() string {
+	return standingOrderFrequencies[s.Frequency]
+}
+
+// advance is the first renewal date after today, counting on from date.
+func (s StandingOrder) advance(date string, today time.Time) string {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		t = today
+	}
+	for !t.After(today) {
+		if s.Frequency == "weekly" {
+			t = t.AddDate(0, 0, 7)
+		} else {
+			t = t.AddDate(0, 1, 0)
+		}
+	}
+	return t.Format("2006-01-02")
+}
+
+const standingOrderColumns = variantColumns + ", s.id, s.store_id, s.customer_id, s.quantity, s.frequency, DATE_FORMAT(s.next_run, '%Y-%m-%d'), s.status, s.notes, " +
+	"s.address, s.postal_code, s.pickup, s.payment_method, COALESCE(s.last_order_id, ''), s.created_at"
+
+func queryStandingOrders(where string, args ...interface{}) ([]StandingOrder, error) {
+	rows, err := db.Query("SELECT "+standingOrderColumns+` FROM standing_orders s
+		JOIN product_variants v ON v.id = s.variant_id JOIN products p ON p.id = v.product_id `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []StandingOrder
+	for rows.Next() {
+		var s StandingOrder
+		err := scanVariant(scanAlso{rows, []interface{}{&s.ID, &s.StoreID, &s.CustomerID, &s.Quantity, &s.Frequency, &s.NextRun, &s.Status, &s.Notes,
+			&s.Address, &s.PostalCode, &s.Pickup, &s.PaymentMethod, &s.LastOrderID, &s.CreatedAt}}, &s.Variant)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// renewStandingOrders places today's standing orders. One failing does not
+// hold up the others.
+func renewStandingOrders() error {
+	due, err := queryStandingOrders("WHERE s.status = ? AND s.next_run <= CURDATE() ORDER BY s.next_run, s.id", StandingOrderActive)
+	if err != nil {
+		return err
+	}
+	for _, s := range due {
+		if err := renewStandingOrder(s); err != nil {
+			log.Printf("standing order %d: %v", s.ID, err)
+		}
+	}
+	return nil
+}
+
+func renewStandingOrder(s StandingOrder) error {
+	if !s.Variant.Active {
+		return fmt.Errorf("%s is no longer sold", s.Variant.SKU)
+	}
+	delivery := DeliveryAddress{Address: s.Address}
+	if !s.Pickup && s.Address != "" {
+		if a, err := geocodeAddress(s.Address); err == nil {
+			delivery = a
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	next := s.advance(s.NextRun, time.Now())
+	res, err := tx.Exec("UPDATE standing_orders SET next_run = ?, reminded_for = NULL WHERE id = ? AND status = ? AND next_run = ?",
+		next, s.ID, StandingOrderActive, s.NextRun)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Renewed, paused or cancelled since it was loaded.
+		return nil
+	}
+	order, err := createOrder(tx, s.StoreID, ChannelOnline, s.CustomerID, s.Variant, s.Quantity, s.Notes, "")
+	if err != nil {
+		return err
+	}
+	if s.Pickup {
+		err = choosePickup(tx, &order)
+	} else {
+		if delivery.Address != "" {
+			err = setDeliveryAddress(tx, &order, delivery)
+		}
+		if err == nil {
+			err = chargeShipping(tx, &order, s.PostalCode, s.Variant.WeightGrams*s.Quantity)
+		}
+	}
+	if err == nil {
+		err = setPaymentMethod(tx, &order, s.PaymentMethod)
+	}
+	if err == nil && s.PaymentMethod == PaymentPrepaid {
+		err = reserveStock(tx, order, order.TotalAmount)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE standing_orders SET last_order_id = ? WHERE id = ?", order.OrderID, s.ID)
+	}
+	if err == nil {
+		err = notifyCustomer(tx, s.CustomerID, "standing_order_placed", map[string]string{
+			"OrderID": order.OrderID, "Total": fmt.Sprintf("%.2f", order.TotalAmount), "NextDate": next})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+	emitOrderEvent(OrderEvent{Type: EventOrderCreated, OrderID: order.OrderID, Order: &order})
+	return nil
+}
+
+// remindStandingOrders texts customers whose standing order renews within
+// STANDING_ORDER_NOTICE_DAYS, once per renewal.
+func remindStandingOrders() error {
+	upcoming, err := queryStandingOrders(`WHERE s.status = ? AND s.next_run > CURDATE() AND s.next_run <= CURDATE() + INTERVAL ? DAY
+		AND (s.reminded_for IS NULL OR s.reminded_for <> s.next_run) ORDER BY s.id`, StandingOrderActive, envInt("STANDING_ORDER_NOTICE_DAYS", 3))
+	if err != nil {
+		return err
+	}
+	for _, s := range upcoming {
+		err := notifyCustomer(db, s.CustomerID, "standing_order_reminder", map[string]string{
+			"Quantity": fmt.Sprint(s.Quantity), "Product": s.Variant.Label(), "Date": s.NextRun})
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE standing_orders SET reminded_for = next_run WHERE id = ?", s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeStandingOrder pauses, resumes or cancels a standing order. A resumed
+// order renews tomorrow at the earliest. customerID limits the change to
+// that customer's orders when set.
+func changeStandingOrder(id int, customerID, action string) (bool, error) {
+	query := map[string]string{
+		"pause":  "UPDATE standing_orders SET status = 'PAUSED' WHERE id = ? AND status = 'ACTIVE'",
+		"resume": "UPDATE standing_orders SET status = 'ACTIVE', next_run = GREATEST(next_run, CURDATE() + INTERVAL 1 DAY) WHERE id = ? AND status = 'PAUSED'",
+		"cancel": "UPDATE standing_orders SET status = 'CANCELLED' WHERE id = ? AND status <> 'CANCELLED'",
+	}[action]
+	if query == "" {
+		return false, nil
+	}
+	args := []interface{}{id}
+	if customerID != "" {
+		query += " AND customer_id = ?"
+		args = append(args, customerID)
+	}
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func standingOrdersPage(w http.ResponseWriter, r *http.Request) {
+	list, err := queryStandingOrders("WHERE s.store_id = ? ORDER BY s.status = 'CANCELLED', s.next_run, s.id", currentStoreID(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	variants, err := activeVariants()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("standing_orders.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		StandingOrders []StandingOrder
+		Variants       []Variant
+		Frequencies    map[string]string
+		Tomorrow       string
+		Flashes        []Flash
+	}{storeSwitcher(r), list, variants, standingOrderFrequencies, time.Now().AddDate(0, 0, 1).Format("2006-01-02"), popFlashes(r)})
+}
+
+type standingOrderForm struct {
+	Contact    string `form:"contact" validate:"required,maxlen=100"`
+	VariantID  int    `form:"variant" label:"Product" validate:"required"`
+	Quantity   int    `form:"qty" label:"Quantity" validate:"required,min=1,max=100"`
+	Frequency  string `form:"frequency" validate:"required,oneof=weekly monthly"`
+	FirstRun   string `form:"first_run" label:"First order date" validate:"required,future"`
+	Fulfilment string `form:"fulfilment"`
+	Address    string `form:"address" validate:"maxlen=300"`
+	PostalCode string `form:"postal_code"`
+	Notes      string `form:"notes" validate:"maxlen=500"`
+	Payment    string `form:"payment"`
+}
+
+func createStandingOrder(w http.ResponseWriter, r *http.Request) {
+	back := "/admin/standing-orders"
+	var f standingOrderForm
+	errs := decodeForm(r, &f)
+	pickup := f.Fulfilment == "pickup"
+	if !pickup && f.Address == "" {
+		errs = append(errs, FieldError{"address", "A delivered standing order needs an address."})
+	}
+	if errs != nil {
+		redirectWithFlash(w, r, back, "error", errs.Error())
+		return
+	}
+	contact, qty, frequency, firstRun, address, notes := f.Contact, f.Quantity, f.Frequency, f.FirstRun, f.Address, f.Notes
+	method := PaymentCOD
+	if f.Payment == PaymentPrepaid {
+		method = PaymentPrepaid
+	}
+	v, err := variantByID(f.VariantID)
+	if err == sql.ErrNoRows || (err == nil && !v.Active) {
+		redirectWithFlash(w, r, back, "error", "Pick a product that is on sale.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if pickup {
+		address = ""
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO standing_orders (store_id, customer_id, variant_id, quantity, frequency, next_run, notes, address, postal_code, pickup, payment_method, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		currentStoreID(r), contact, v.ID, qty, frequency, firstRun, notes, address, normalizePostalCode(f.PostalCode), pickup, method, auditActor(r))
+	var id int64
+	if err == nil {
+		id, err = res.LastInsertId()
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "standing_order.create", strconv.FormatInt(id, 10), fmt.Sprintf("%s: %d x %s %s from %s", contact, qty, v.SKU, frequency, firstRun))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", fmt.Sprintf("Standing order #%d set up. The first order is placed on %s.", id, firstRun))
+}
+
+func adminChangeStandingOrder(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	action := mux.Vars(r)["action"]
+	var storeID int
+	err := db.QueryRow("SELECT store_id FROM standing_orders WHERE id = ?", id).Scan(&storeID)
+	if err == sql.ErrNoRows || (err == nil && storeID != currentStoreID(r)) {
+		http.Error(w, "Standing order not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	changed, err := changeStandingOrder(id, "", action)
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		redirectWithFlash(w, r, "/admin/standing-orders", "error", fmt.Sprintf("Standing order #%d cannot %s now.", id, action))
+		return
+	}
+	_ = recordAudit(db, r, "standing_order."+action, strconv.Itoa(id), "")
+	redirectWithFlash(w, r, "/admin/standing-orders", "success", fmt.Sprintf("Standing order #%d updated.", id))
+}
+
+func customerStandingOrdersPage(w http.ResponseWriter, r *http.Request) {
+	contact := customerContact(r)
+	list, err := queryStandingOrders("WHERE s.customer_id = ? AND s.status <> 'CANCELLED' ORDER BY s.next_run, s.id", contact)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("account_standing_orders.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Customer       string
+		StandingOrders []StandingOrder
+		Flashes        []Flash
+	}{contact, list, popFlashes(r)})
+}
+
+func customerChangeStandingOrder(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	action := mux.Vars(r)["action"]
+	changed, err := changeStandingOrder(id, customerContact(r), action)
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		redirectWithFlash(w, r, "/account/standing-orders", "error", "That standing order cannot be changed.")
+		return
+	}
+	_ = recordAudit(db, r, "standing_order."+action, strconv.Itoa(id), "by customer "+customerContact(r))
+	redirectWithFlash(w, r, "/account/standing-orders", "success", "Your standing order was updated.")
+}
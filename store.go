@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Store struct {
+	ID        int
+	Code      string
+	Name      string
+	CreatedAt time.Time
+}
+
+// StoreSwitcher is embedded in page data that renders the "store_switcher" partial.
+type StoreSwitcher struct {
+	Stores  []Store
+	StoreID int
+	Locked  bool
+	Back    string
+}
+
+func (s StoreSwitcher) CurrentStore() Store {
+	for _, st := range s.Stores {
+		if st.ID == s.StoreID {
+			return st
+		}
+	}
+	return Store{ID: s.StoreID}
+}
+
+var storesRead lastGood[[]Store]
+
+func loadStores() ([]Store, error) {
+	return storesRead.load("", queryStores)
+}
+
+func queryStores() ([]Store, error) {
+	rows, err := db.Query("SELECT id, code, name, created_at FROM stores ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stores []Store
+	for rows.Next() {
+		var s Store
+		if err := rows.Scan(&s.ID, &s.Code, &s.Name, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		stores = append(stores, s)
+	}
+	return stores, rows.Err()
+}
+
+func storeByCode(code string) (Store, error) {
+	var s Store
+	err := db.QueryRow("SELECT id, code, name, created_at FROM stores WHERE code = ?", code).Scan(&s.ID, &s.Code, &s.Name, &s.CreatedAt)
+	return s, err
+}
+
+// currentStoreID is the store the request works on. Store-scoped admins are
+// pinned to their own store; everyone else uses the one picked with the
+// switcher, defaulting to the main store.
+func currentStoreID(r *http.Request) int {
+	if code := adminStoreCode(r); code != "" {
+		s, err := storeByCode(code)
+		if err != nil {
+			return 0
+		}
+		return s.ID
+	}
+	if id, err := strconv.Atoi(getSession(r).Values["store_id"]); err == nil {
+		return id
+	}
+	return 1
+}
+
+func storeSwitcher(r *http.Request) StoreSwitcher {
+	stores, _ := loadStores()
+	return StoreSwitcher{Stores: stores, StoreID: currentStoreID(r), Locked: adminStoreCode(r) != "", Back: r.URL.Path}
+}
+
+func switchStore(w http.ResponseWriter, r *http.Request) {
+	back := r.FormValue("back")
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") {
+		back = "/"
+	}
+	id, err := strconv.Atoi(r.FormValue("store_id"))
+	if err == nil {
+		err = db.QueryRow("SELECT id FROM stores WHERE id = ?", id).Scan(&id)
+	}
+	if err != nil {
+		redirectWithFlash(w, r, back, "error", "Unknown store.")
+		return
+	}
+	s := getSession(r)
+	s.Values["store_id"] = strconv.Itoa(id)
+	_ = saveSession(s)
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+var storeCodePattern = regexp.MustCompile(`^[a-z0-9-]{1,20}$`)
+
+func storesPage(w http.ResponseWriter, r *http.Request) {
+	if adminStoreCode(r) != "" {
+		http.Error(w, "Only the shop owner can manage stores", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodGet {
+		stores, err := loadStores()
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		t := mustParseTemplates("stores.html", "partials.html")
+		_ = t.Execute(w, struct {
+			Stores  []Store
+			Flashes []Flash
+		}{stores, popFlashes(r)})
+		return
+	}
+
+	code := strings.ToLower(strings.TrimSpace(r.FormValue("code")))
+	name := strings.TrimSpace(r.FormValue("name"))
+	if !storeCodePattern.MatchString(code) || name == "" {
+		redirectWithFlash(w, r, "/admin/stores", "error", "A store needs a name and a short code (lowercase letters, digits and dashes).")
+		return
+	}
+	if _, err := storeByCode(code); err == nil {
+		redirectWithFlash(w, r, "/admin/stores", "error", "A store with code "+code+" already exists.")
+		return
+	} else if err != sql.ErrNoRows {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO stores (code, name) VALUES (?, ?)", code, name)
+	if err == nil {
+		var id int64
+		if id, err = res.LastInsertId(); err == nil {
+			err = createDefaultLocations(tx, id)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	_ = recordAudit(db, r, "store.create", code, name)
+	redirectWithFlash(w, r, "/admin/stores", "success", "Store "+name+" created.")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerScheduledTask("stale-order-reminders", "0 9 * * *", remindStaleOrders)
+	registerScheduledTask("daily-report-email", "30 23 * * *", emailDailyReport)
+	registerScheduledTask("job-retention-cleanup", "15 3 * * *", cleanupOldJobs)
+	registerScheduledTask("standing-orders", "0 6 * * *", renewStandingOrders)
+	registerScheduledTask("standing-order-reminders", "0 10 * * *", remindStandingOrders)
+	registerScheduledTask("backorder-release", "*/15 * * * *", releaseWaitingBackorders)
+	registerScheduledTask("stock-reservation-expiry", "*/5 * * * *", expireStockReservations)
+	registerScheduledTask("payment-reconciliation", "0 5 * * *", reconcilePayments)
+}
+
+func remindStaleOrders() error {
+	to := envOr("ADMIN_EMAIL", "")
+	if to == "" {
+		return nil
+	}
+	rows, err := db.Query("SELECT order_id, customer_id, created_at FROM orders WHERE status = ? AND deleted_at IS NULL AND created_at < DATE_SUB(NOW(), INTERVAL ? DAY) ORDER BY created_at",
+		statuses[0], envInt("STALE_ORDER_DAYS", 2))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var orderID, contact string
+		var createdAt time.Time
+		if err := rows.Scan(&orderID, &contact, &createdAt); err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s  placed %s", orderID, contact, formatDateTime(createdAt)))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return enqueueJob("email", EmailMessage{
+		To:      to,
+		Subject: fmt.Sprintf("%d orders still PROCESSING", len(lines)),
+		Body:    "These orders have not moved out of PROCESSING:\n\n" + strings.Join(lines, "\n") + "\n",
+	})
+}
+
+func emailDailyReport() error {
+	to := envOr("REPORT_EMAIL", envOr("ADMIN_EMAIL", ""))
+	if to == "" {
+		return nil
+	}
+	if err := refreshDailySales(); err != nil {
+		return err
+	}
+	var count int
+	var revenue Money
+	err := db.QueryRow("SELECT COALESCE(SUM(orders), 0), COALESCE(SUM(revenue), 0) FROM daily_sales WHERE day = CURDATE()").Scan(&count, &revenue)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Orders today: %d\nRevenue today: %s\n\nBy status:\n", count, money(revenue))
+
+	rows, err := db.Query("SELECT status, COUNT(*) FROM orders WHERE deleted_at IS NULL GROUP BY status")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return err
+		}
+		body += fmt.Sprintf("  %-12s %d\n", status, n)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return enqueueJob("email", EmailMessage{To: to, Subject: "Daily sales report", Body: body})
+}
+
+func cleanupOldJobs() error {
+	_, err := db.Exec("DELETE FROM jobs WHERE status = 'DONE' AND created_at < DATE_SUB(NOW(), INTERVAL ? DAY)",
+		envInt("JOB_RETENTION_DAYS", 30))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM scheduled_runs WHERE tick < NOW() - INTERVAL 7 DAY")
+	return err
+}
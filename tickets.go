@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Ticket statuses. A customer reply reopens a ticket whatever its status.
+var ticketStatuses = []string{"OPEN", "WAITING_CUSTOMER", "RESOLVED"}
+
+type Ticket struct {
+	ID         int
+	OrderID    string
+	CustomerID string
+	Subject    string
+	Status     string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Messages   []TicketMessage
+}
+
+type TicketMessage struct {
+	Author    string
+	Staff     bool
+	Body      string
+	CreatedAt time.Time
+}
+
+const ticketColumns = "id, order_id, customer_id, subject, status, created_at, updated_at"
+
+func scanTicket(row rowScanner, t *Ticket) error {
+	return row.Scan(&t.ID, &t.OrderID, &t.CustomerID, &t.Subject, &t.Status, &t.CreatedAt, &t.UpdatedAt)
+}
+
+func queryTickets(where string, args ...interface{}) ([]Ticket, error) {
+	rows, err := db.Query("SELECT "+ticketColumns+" FROM tickets "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tickets []Ticket
+	for rows.Next() {
+		var t Ticket
+		if err := scanTicket(rows, &t); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, t)
+	}
+	return tickets, rows.Err()
+}
+
+// openTickets lists tickets still needing attention in a store, oldest first.
+func openTickets(storeID, limit int) ([]Ticket, error) {
+	return queryTickets("WHERE status <> 'RESOLVED' AND order_id IN (SELECT order_id FROM orders WHERE store_id = ?) ORDER BY updated_at LIMIT ?", storeID, limit)
+}
+
+func loadTicket(id int) (Ticket, error) {
+	var t Ticket
+	if err := scanTicket(db.QueryRow("SELECT "+ticketColumns+" FROM tickets WHERE id = ?", id), &t); err != nil {
+		return t, err
+	}
+	rows, err := db.Query("SELECT author, staff, body, created_at FROM ticket_messages WHERE ticket_id = ? ORDER BY id", id)
+	if err != nil {
+		return t, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m TicketMessage
+		if err := rows.Scan(&m.Author, &m.Staff, &m.Body, &m.CreatedAt); err != nil {
+			return t, err
+		}
+		t.Messages = append(t.Messages, m)
+	}
+	return t, rows.Err()
+}
+
+func validTicketText(s string, max int) bool {
+	return s != "" && utf8.RuneCountInString(s) <= max
+}
+
+func validTicketStatus(status string) bool {
+	for _, s := range ticketStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func addTicketMessage(tx *sql.Tx, ticketID int64, author string, staff bool, body, status string) error {
+	if _, err := tx.Exec("INSERT INTO ticket_messages (ticket_id, author, staff, body) VALUES (?, ?, ?, ?)", ticketID, author, staff, body); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE tickets SET status = ?, updated_at = NOW() WHERE id = ?", status, ticketID)
+	return err
+}
+
+// customerTicket loads a ticket only if it belongs to the signed-in customer.
+func customerTicket(w http.ResponseWriter, r *http.Request) (Ticket, bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	t, err := loadTicket(id)
+	if err == sql.ErrNoRows || (err == nil && t.CustomerID != customerContact(r)) {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return t, false
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return t, false
+	}
+	return t, true
+}
+
+func customerTicketsPage(w http.ResponseWriter, r *http.Request) {
+	contact := customerContact(r)
+	tickets, err := queryTickets("WHERE customer_id = ? ORDER BY updated_at DESC", contact)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query("SELECT order_id FROM orders WHERE customer_id = ? AND NOT guest AND deleted_at IS NULL ORDER BY created_at DESC LIMIT 50", contact)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var orders []string
+	for rows.Next() {
+		var id string
+		_ = rows.Scan(&id)
+		orders = append(orders, id)
+	}
+	t := mustParseTemplates("tickets.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Customer string
+		Tickets  []Ticket
+		Orders   []string
+		OrderID  string
+		Flashes  []Flash
+	}{contact, tickets, orders, r.URL.Query().Get("order"), popFlashes(r)})
+}
+
+func openTicket(w http.ResponseWriter, r *http.Request) {
+	contact := customerContact(r)
+	orderID := r.FormValue("order_id")
+	subject := strings.TrimSpace(r.FormValue("subject"))
+	body := strings.TrimSpace(r.FormValue("body"))
+	if !validTicketText(subject, 150) || !validTicketText(body, 2000) {
+		redirectWithFlash(w, r, "/account/tickets", "error", "Give your issue a subject and a description.")
+		return
+	}
+	var owner string
+	err := db.QueryRow("SELECT customer_id FROM orders WHERE order_id = ?", orderID).Scan(&owner)
+	if err == sql.ErrNoRows || (err == nil && owner != contact) {
+		redirectWithFlash(w, r, "/account/tickets", "error", "Pick one of your orders.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO tickets (order_id, customer_id, subject, status) VALUES (?, ?, ?, ?)", orderID, contact, subject, ticketStatuses[0])
+	var id int64
+	if err == nil {
+		id, _ = res.LastInsertId()
+		err = addTicketMessage(tx, id, contact, false, body, ticketStatuses[0])
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, fmt.Sprintf("/account/tickets/%d", id), "success", "Thanks, we have your ticket and will reply soon.")
+}
+
+func customerTicketPage(w http.ResponseWriter, r *http.Request) {
+	ticket, ok := customerTicket(w, r)
+	if !ok {
+		return
+	}
+	t := mustParseTemplates("ticket.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Ticket
+		Staff    bool
+		Statuses []string
+		Flashes  []Flash
+	}{ticket, false, nil, popFlashes(r)})
+}
+
+func customerTicketReply(w http.ResponseWriter, r *http.Request) {
+	ticket, ok := customerTicket(w, r)
+	if !ok {
+		return
+	}
+	back := fmt.Sprintf("/account/tickets/%d", ticket.ID)
+	body := strings.TrimSpace(r.FormValue("body"))
+	if !validTicketText(body, 2000) {
+		redirectWithFlash(w, r, back, "error", "Write a message first.")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	err = addTicketMessage(tx, int64(ticket.ID), ticket.CustomerID, false, body, ticketStatuses[0])
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", "Message sent.")
+}
+
+func adminTicketsPage(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	where, args := "WHERE order_id IN (SELECT order_id FROM orders WHERE store_id = ?)", []interface{}{currentStoreID(r)}
+	if validTicketStatus(status) {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+	tickets, err := queryTickets(where+" ORDER BY updated_at DESC LIMIT 200", args...)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("admin_tickets.html", "partials.html")
+	_ = t.Execute(w, struct {
+		StoreSwitcher
+		Tickets  []Ticket
+		Status   string
+		Statuses []string
+	}{storeSwitcher(r), tickets, status, ticketStatuses})
+}
+
+// adminTicket loads a ticket on an order in the current store.
+func adminTicket(w http.ResponseWriter, r *http.Request) (Ticket, bool) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	t, err := loadTicket(id)
+	var storeID int
+	if err == nil {
+		err = db.QueryRow("SELECT store_id FROM orders WHERE order_id = ?", t.OrderID).Scan(&storeID)
+	}
+	if err == sql.ErrNoRows || (err == nil && storeID != currentStoreID(r)) {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return t, false
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return t, false
+	}
+	return t, true
+}
+
+func adminTicketPage(w http.ResponseWriter, r *http.Request) {
+	ticket, ok := adminTicket(w, r)
+	if !ok {
+		return
+	}
+	t := mustParseTemplates("ticket.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Ticket
+		Staff    bool
+		Statuses []string
+		Flashes  []Flash
+	}{ticket, true, ticketStatuses, popFlashes(r)})
+}
+
+// adminTicketReply posts a staff reply and/or changes the ticket's status.
+// The customer is texted when staff reply.
+func adminTicketReply(w http.ResponseWriter, r *http.Request) {
+	ticket, ok := adminTicket(w, r)
+	if !ok {
+		return
+	}
+	back := fmt.Sprintf("/admin/tickets/%d", ticket.ID)
+	body := strings.TrimSpace(r.FormValue("body"))
+	status := r.FormValue("status")
+	if !validTicketStatus(status) || utf8.RuneCountInString(body) > 2000 || (body == "" && status == ticket.Status) {
+		redirectWithFlash(w, r, back, "error", "Write a reply or pick a new status.")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if body != "" {
+		err = addTicketMessage(tx, int64(ticket.ID), auditActor(r), true, body, status)
+	} else {
+		_, err = tx.Exec("UPDATE tickets SET status = ?, updated_at = NOW() WHERE id = ?", status, ticket.ID)
+	}
+	if err == nil && status != ticket.Status {
+		err = recordAudit(tx, r, "ticket.status", strconv.Itoa(ticket.ID), ticket.Status+" -> "+status)
+	}
+	if err == nil && body != "" {
+		err = notifyCustomer(tx, ticket.CustomerID, "ticket_reply", map[string]string{"OrderID": ticket.OrderID})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, back, "success", "Ticket updated.")
+}
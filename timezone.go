@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+	_ "time/tzdata" // the timezone setting must load on hosts without a zoneinfo database
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Times are kept in the database as the shop's wall-clock time, in the time
+// zone of the timezone setting: that is what DATE(created_at) = CURDATE()
+// and the day-based reports count on. At startup time.Local is set to that
+// zone and the database connections are opened in it, so NOW() and
+// CURRENT_TIMESTAMP, the time.Time values read back and the dates the
+// pages, exports and PDFs print all agree whatever zone the servers run in.
+// Changing the setting takes effect on the next restart.
+
+const (
+	dateLayout     = "2006-01-02"
+	dateTimeLayout = "2006-01-02 15:04"
+	clockLayout    = "15:04"
+)
+
+func shopLocation() *time.Location {
+	loc, err := time.LoadLocation(setting("timezone"))
+	if err != nil {
+		log.Printf("timezone %q: %v, using %s", setting("timezone"), err, time.Local)
+		return time.Local
+	}
+	return loc
+}
+
+// useShopTimezone reopens db in the shop's time zone.
+func useShopTimezone(dsn string) error {
+	time.Local = shopLocation()
+	reopened, err := openInShopZone(dsn, &dbBreaker)
+	if err != nil {
+		return err
+	}
+	if err := reopened.Ping(); err != nil {
+		reopened.Close()
+		return err
+	}
+	db.Close()
+	db = reopened
+	return nil
+}
+
+// openInShopZone opens dsn with its sessions in time.Local, once
+// useShopTimezone has set it to the shop's zone. MySQL only knows zones by
+// name when its time zone tables are loaded; without them each connection
+// gets the zone's offset as it is made, and connections are replaced every
+// hour so that a daylight saving change is picked up.
+func openInShopZone(dsn string, b *circuitBreaker) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ParseTime, cfg.Loc = true, time.Local
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	if zone := time.Local.String(); mysqlKnowsZone(zone) {
+		cfg.Params["time_zone"] = "'" + zone + "'"
+		return openDBConfig(cfg, b)
+	}
+	delete(cfg.Params, "time_zone")
+	err = cfg.Apply(mysql.BeforeConnect(func(_ context.Context, c *mysql.Config) error {
+		params := make(map[string]string, len(c.Params)+1)
+		for k, v := range c.Params {
+			params[k] = v
+		}
+		params["time_zone"] = "'" + time.Now().Format("-07:00") + "'"
+		c.Params = params
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	opened, err := openDBConfig(cfg, b)
+	if err != nil {
+		return nil, err
+	}
+	opened.SetConnMaxLifetime(time.Hour)
+	return opened, nil
+}
+
+// mysqlKnowsZone reports whether the database has zone in its time zone
+// tables.
+func mysqlKnowsZone(zone string) bool {
+	var known bool
+	err := db.QueryRow("SELECT CONVERT_TZ('2000-01-01 00:00:00', '+00:00', ?) IS NOT NULL", zone).Scan(&known)
+	if err != nil {
+		log.Printf("checking MySQL knows time zone %s: %v", zone, err)
+	}
+	return known
+}
+
+// formatDateTime is how times are shown: in the shop's time zone, to the
+// minute. The zero time, for something that hasn't happened, is "".
+func formatDateTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(time.Local).Format(dateTimeLayout)
+}
+
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(time.Local).Format(dateLayout)
+}
+
+// formatClock is the time of day alone, for lists that cover one day.
+func formatClock(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(time.Local).Format(clockLayout)
+}
+
+// nullTime scans a nullable DATETIME into t, NULL being the zero time.
+type nullTime struct{ t *time.Time }
+
+func (n nullTime) Scan(src interface{}) error {
+	var nt sql.NullTime
+	if err := nt.Scan(src); err != nil {
+		return err
+	}
+	*n.t = nt.Time
+	return nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admins can add a second factor to their password: an authenticator app
+// set up on /admin/security. Once it is on, each new admin session asks for
+// a six-digit code, or one of the backup codes handed out at setup, before
+// any admin page opens. ADMIN_REQUIRE_2FA=true keeps admins who haven't set
+// one up on the setup page. The reset-2fa command clears a lost one.
+
+const (
+	totpPeriod          = 30
+	backupCodeCount     = 10
+	twoFactorSessionKey = "admin_2fa"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func twoFactorRequired() bool {
+	on, _ := strconv.ParseBool(envOr("ADMIN_REQUIRE_2FA", ""))
+	return on
+}
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode is the RFC 6238 code for a 30-second time step.
+func totpCode(secret string, step int64) string {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return ""
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+// totpMatch returns the time step code belongs to, allowing a step of clock
+// drift either way.
+func totpMatch(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != 6 {
+		return 0, false
+	}
+	step := now.Unix() / totpPeriod
+	for _, s := range []int64{step, step - 1, step + 1} {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, s)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is what the QR code holds for the authenticator app to scan.
+func totpURI(user, secret string) string {
+	q := url.Values{"secret": {secret}, "issuer": {shopName()}}
+	// Some apps show "+" literally, so spaces are sent as %20.
+	return "otpauth://totp/" + url.PathEscape(shopName()+":"+user) + "?" + strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+type adminTOTP struct {
+	Secret    string
+	Confirmed bool
+}
+
+// loadAdminTOTP is the admin's authenticator, or nil before they start
+// setting one up.
+func loadAdminTOTP(user string) (*adminTOTP, error) {
+	var t adminTOTP
+	err := db.QueryRow("SELECT secret, confirmed FROM admin_totp WHERE username = ?", user).Scan(&t.Secret, &t.Confirmed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// useTOTPCode accepts a current code from the admin's app, each only once.
+func useTOTPCode(user string, t *adminTOTP, code string) (bool, error) {
+	step, ok := totpMatch(t.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	res, err := db.Exec("UPDATE admin_totp SET last_step = ? WHERE username = ? AND last_step < ?", step, user, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// useSecondFactor accepts an authenticator code or spends a backup code.
+func useSecondFactor(user string, t *adminTOTP, code string) (bool, error) {
+	if ok, err := useTOTPCode(user, t, code); ok || err != nil {
+		return ok, err
+	}
+	res, err := db.Exec("UPDATE admin_backup_codes SET used_at = NOW() WHERE username = ? AND code_hash = ? AND used_at IS NULL",
+		user, backupCodeHash(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if n == 1 {
+		log.Printf("admin %s signed in with a backup code", user)
+	}
+	return n == 1, err
+}
+
+func backupCodeHash(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newBackupCodes replaces the admin's backup codes. Only their hashes are
+// kept, so the codes returned are shown once.
+func newBackupCodes(ex execer, user string) ([]string, error) {
+	if _, err := ex.Exec("DELETE FROM admin_backup_codes WHERE username = ?", user); err != nil {
+		return nil, err
+	}
+	codes := make([]string, backupCodeCount)
+	for i := range codes {
+		c := strings.ToLower(rand.Text())
+		codes[i] = c[:5] + "-" + c[5:10]
+		if _, err := ex.Exec("INSERT INTO admin_backup_codes (username, code_hash) VALUES (?, ?)", user, backupCodeHash(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// tryCode checks the posted code, throttled like any sign-in, and sends
+// the admin back to try again when it doesn't do.
+func tryCode(w http.ResponseWriter, r *http.Request, user string, t *adminTOTP, back string) bool {
+	wait, err := loginWait("admin_2fa", user, clientIP(r))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		redirectWithFlash(w, r, back, "error", loginWaitMessage(wait))
+		return false
+	}
+	ok, err := useSecondFactor(user, t, strings.TrimSpace(r.FormValue("code")))
+	if err == nil && ok {
+		err = clearLoginFailures("admin_2fa", user)
+	} else if err == nil {
+		err = recordLoginFailure("admin_2fa", user, clientIP(r))
+	}
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		redirectWithFlash(w, r, back, "error", "That code is wrong or was already used.")
+	}
+	return ok
+}
+
+// secondFactorPassed lets the request on once the admin has entered a code
+// in this session, and otherwise sends them to enter one (or to set up an
+// authenticator when that is required).
+func secondFactorPassed(w http.ResponseWriter, r *http.Request, user string) bool {
+	if getSession(r).Values[twoFactorSessionKey] == user || r.URL.Path == "/admin/two-factor" {
+		return true
+	}
+	t, err := loadAdminTOTP(user)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "DB error")
+		return false
+	}
+	switch {
+	case t != nil && t.Confirmed:
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeAPIError(w, http.StatusUnauthorized, "two_factor_required", "enter your authenticator code on /admin first", nil)
+			return false
+		}
+		back := r.URL.RequestURI()
+		if r.Method != http.MethodGet {
+			back = "/admin"
+		}
+		http.Redirect(w, r, "/admin/two-factor?next="+url.QueryEscape(back), http.StatusSeeOther)
+		return false
+	case twoFactorRequired() && !strings.HasPrefix(r.URL.Path, "/admin/security"):
+		redirectWithFlash(w, r, "/admin/security", "error", "Set up an authenticator app before using the admin pages.")
+		return false
+	}
+	return true
+}
+
+func twoFactorPage(w http.ResponseWriter, r *http.Request) {
+	user, _ := adminUser(r)
+	next := r.URL.Query().Get("next")
+	if next == "" {
+		next = "/admin"
+	}
+	t := mustParseTemplates("admin_two_factor.html", "partials.html")
+	_ = t.Execute(w, struct {
+		User    string
+		Next    string
+		Flashes []Flash
+	}{user, localPath(next), popFlashes(r)})
+}
+
+func verifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := adminUser(r)
+	next := localPath(r.FormValue("next"))
+	back := "/admin/two-factor?next=" + url.QueryEscape(next)
+	t, err := loadAdminTOTP(user)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if t == nil || !t.Confirmed {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	if !tryCode(w, r, user, t, back) {
+		return
+	}
+	sess := renewSession(w, r)
+	sess.Values[twoFactorSessionKey] = user
+	_ = saveSession(sess)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func securityPage(w http.ResponseWriter, r *http.Request) {
+	renderSecurity(w, r, nil)
+}
+
+// renderSecurity shows the admin's two-factor state, with freshly made
+// backup codes when there are some to hand out.
+func renderSecurity(w http.ResponseWriter, r *http.Request, backupCodes []string) {
+	user, _ := adminUser(r)
+	t, err := loadAdminTOTP(user)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		User        string
+		Enabled     bool
+		Pending     bool
+		Secret      string
+		QRCode      template.HTML
+		BackupCodes []string
+		BackupLeft  int
+		Required    bool
+		Flashes     []Flash
+	}{User: user, BackupCodes: backupCodes, Required: twoFactorRequired()}
+	switch {
+	case t != nil && t.Confirmed:
+		data.Enabled = true
+		err = db.QueryRow("SELECT COUNT(*) FROM admin_backup_codes WHERE username = ? AND used_at IS NULL", user).Scan(&data.BackupLeft)
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	case t != nil:
+		data.Pending = true
+		var groups []string
+		for i := 0; i < len(t.Secret); i += 4 {
+			groups = append(groups, t.Secret[i:min(i+4, len(t.Secret))])
+		}
+		data.Secret = strings.Join(groups, " ")
+		qr, err := qrEncode(totpURI(user, t.Secret))
+		if err != nil {
+			http.Error(w, "Could not draw the QR code", http.StatusInternalServerError)
+			return
+		}
+		data.QRCode = template.HTML(qr.SVG(5))
+	}
+	data.Flashes = popFlashes(r)
+	tmpl := mustParseTemplates("admin_security.html", "partials.html")
+	_ = tmpl.Execute(w, data)
+}
+
+// startTOTPSetup makes a new secret for the admin to scan. It only takes
+// effect once a code from it is confirmed.
+func startTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	user, _ := adminUser(r)
+	t, err := loadAdminTOTP(user)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if t != nil && t.Confirmed {
+		redirectWithFlash(w, r, "/admin/security", "error", "Two-factor sign-in is already on.")
+		return
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		http.Error(w, "Could not create a secret", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec(`INSERT INTO admin_totp (username, secret) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), last_step = 0`, user, secret)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
+
+func confirmTOTPSetup(w http.ResponseWriter, r *http.Request) {
+	user, _ := adminUser(r)
+	t, err := loadAdminTOTP(user)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if t == nil || t.Confirmed {
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+	ok, err := useTOTPCode(user, t, strings.TrimSpace(r.FormValue("code")))
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		redirectWithFlash(w, r, "/admin/security", "error", "That code doesn't match. Check the time on your phone and try the next one.")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE admin_totp SET confirmed = TRUE WHERE username = ?", user)
+	var codes []string
+	if err == nil {
+		codes, err = newBackupCodes(tx, user)
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "two_factor.enable", user, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	sess := renewSession(w, r)
+	sess.Values[twoFactorSessionKey] = user
+	_ = saveSession(sess)
+	addFlash(r, "success", "Two-factor sign-in is on.")
+	renderSecurity(w, r, codes)
+}
+
+// checkCurrentCode guards changes to an enabled second factor behind a
+// fresh code, so an unattended session can't turn it off.
+func checkCurrentCode(w http.ResponseWriter, r *http.Request, user string) bool {
+	t, err := loadAdminTOTP(user)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return false
+	}
+	if t == nil || !t.Confirmed {
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return false
+	}
+	return tryCode(w, r, user, t, "/admin/security")
+}
+
+func regenerateBackupCodes(w http.ResponseWriter, r *http.Request) {
+	user, _ := adminUser(r)
+	if !checkCurrentCode(w, r, user) {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	codes, err := newBackupCodes(tx, user)
+	if err == nil {
+		err = recordAudit(tx, r, "two_factor.backup_codes", user, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	addFlash(r, "success", "New backup codes made. The old ones no longer work.")
+	renderSecurity(w, r, codes)
+}
+
+func disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := adminUser(r)
+	if !checkCurrentCode(w, r, user) {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	err = clearTwoFactor(tx, user)
+	if err == nil {
+		err = recordAudit(tx, r, "two_factor.disable", user, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/security", "success", "Two-factor sign-in is off.")
+}
+
+func clearTwoFactor(ex execer, user string) error {
+	if _, err := ex.Exec("DELETE FROM admin_backup_codes WHERE username = ?", user); err != nil {
+		return err
+	}
+	_, err := ex.Exec("DELETE FROM admin_totp WHERE username = ?", user)
+	return err
+}
+
+// resetTwoFactorCommand turns off two-factor sign-in for an admin who lost
+// both their phone and their backup codes: reset-2fa <user>.
+func resetTwoFactorCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: reset-2fa <user>")
+	}
+	if err := clearTwoFactor(db, args[0]); err != nil {
+		return err
+	}
+	log.Printf("two-factor sign-in reset for %s", args[0])
+	return nil
+}
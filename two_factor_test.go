@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		unix     int64
+		wantStep int64
+		ok       bool
+	}{
+		// The RFC's eight-digit codes, cut to the six apps show.
+		{"rfc vector 59", "287082", 59, 1, true},
+		{"rfc vector 1111111109", "081804", 1111111109, 37037036, true},
+		{"rfc vector 1234567890", "005924", 1234567890, 41152263, true},
+		{"rfc vector 2000000000", "279037", 2000000000, 66666666, true},
+		{"spaces ignored", "287 082", 59, 1, true},
+		{"step behind", "287082", 89, 1, true},
+		{"step ahead", "287082", 29, 1, true},
+		{"two steps behind", "287082", 119, 0, false},
+		{"two steps ahead", "287082", -31, 0, false},
+		{"wrong code", "287083", 59, 0, false},
+		{"too short", "28708", 59, 0, false},
+		{"too long", "2870820", 59, 0, false},
+		{"empty", "", 59, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := totpMatch(rfc6238Secret, tt.code, time.Unix(tt.unix, 0))
+		if ok != tt.ok || step != tt.wantStep {
+			t.Errorf("%s: totpMatch(%q) = %d, %t, want %d, %t", tt.name, tt.code, step, ok, tt.wantStep, tt.ok)
+		}
+	}
+}
+
+func TestTOTPMatchBadSecret(t *testing.T) {
+	if _, ok := totpMatch("not base32!", "000000", time.Unix(59, 0)); ok {
+		t.Error("a code matched a secret that doesn't decode")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Handlers describe their input as a struct and let decodeForm or
+// decodeJSON fill and check it, so every form and API endpoint reports
+// problems the same way, field by field. Fields are read from the form
+// value named by their form tag (or JSON key by their json tag), and
+// checked by the rules in their validate tag:
+//
+//	required     not empty or zero
+//	min=N max=N  number range
+//	maxlen=N     at most N characters
+//	oneof=a b    one of the listed values
+//	date         a YYYY-MM-DD date
+//	future       a date after today
+//
+// Strings are trimmed first. Messages use the label tag, or else the
+// field's name, e.g. "Quantity must be between 1 and 100."
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// FieldErrors lists what is wrong with the input, in the order the
+// fields are declared.
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	var msgs []string
+	for _, fe := range e {
+		msgs = append(msgs, fe.Message)
+	}
+	return strings.Join(msgs, " ")
+}
+
+// Map gives the errors keyed by field, for API responses.
+func (e FieldErrors) Map() map[string]string {
+	m := map[string]string{}
+	for _, fe := range e {
+		m[fe.Field] = fe.Message
+	}
+	return m
+}
+
+type fieldRules struct {
+	key, label   string
+	required     bool
+	min, max     *float64
+	maxLen       int
+	oneOf        []string
+	date, future bool
+}
+
+func parseFieldRules(f reflect.StructField, keyTag string) fieldRules {
+	rules := fieldRules{key: strings.Split(f.Tag.Get(keyTag), ",")[0], label: f.Tag.Get("label")}
+	if rules.key == "" {
+		rules.key = strings.ToLower(f.Name)
+	}
+	if rules.label == "" {
+		rules.label = strings.ReplaceAll(rules.key, "_", " ")
+		rules.label = strings.ToUpper(rules.label[:1]) + rules.label[1:]
+	}
+	for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			rules.required = true
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				panic(fmt.Sprintf("validate: bad %s on %s", rule, f.Name))
+			}
+			if name == "min" {
+				rules.min = &n
+			} else {
+				rules.max = &n
+			}
+		case "maxlen":
+			rules.maxLen, _ = strconv.Atoi(arg)
+		case "oneof":
+			rules.oneOf = strings.Fields(arg)
+		case "date":
+			rules.date = true
+		case "future":
+			rules.date, rules.future = true, true
+		}
+	}
+	return rules
+}
+
+// check returns what is wrong with v, or "". A pointer field is present
+// when it is set, even to a zero value, and its value is checked.
+func (rules fieldRules) check(v reflect.Value) string {
+	present := !v.IsZero()
+	if v.Kind() == reflect.Ptr && present {
+		v = v.Elem()
+	}
+	if !present {
+		if rules.required {
+			return rules.label + " is required."
+		}
+		return ""
+	}
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		switch {
+		case rules.maxLen > 0 && utf8.RuneCountInString(s) > rules.maxLen:
+			return fmt.Sprintf("%s must be at most %d characters.", rules.label, rules.maxLen)
+		case len(rules.oneOf) > 0 && !containsString(rules.oneOf, s):
+			return fmt.Sprintf("%s must be one of %s.", rules.label, strings.Join(rules.oneOf, ", "))
+		case rules.date:
+			d, err := time.ParseInLocation("2006-01-02", s, time.Local)
+			if err != nil {
+				return rules.label + " must be a date."
+			}
+			if rules.future && !d.After(time.Now()) {
+				return rules.label + " must be in the future."
+			}
+		}
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		var n float64
+		if v.Kind() == reflect.Float64 {
+			n = v.Float()
+		} else {
+			n = float64(v.Int())
+		}
+		tooLow := rules.min != nil && n < *rules.min
+		tooHigh := rules.max != nil && n > *rules.max
+		switch {
+		case (tooLow || tooHigh) && rules.min != nil && rules.max != nil:
+			return fmt.Sprintf("%s must be between %g and %g.", rules.label, *rules.min, *rules.max)
+		case tooLow:
+			return fmt.Sprintf("%s must be at least %g.", rules.label, *rules.min)
+		case tooHigh:
+			return fmt.Sprintf("%s must be at most %g.", rules.label, *rules.max)
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateWith trims dst's strings and checks its fields, naming them by
+// keyTag. dst must point to a struct.
+func validateWith(dst interface{}, keyTag string) FieldErrors {
+	v := reflect.ValueOf(dst).Elem()
+	var errs FieldErrors
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		if s := reflect.Indirect(fv); s.Kind() == reflect.String {
+			s.SetString(strings.TrimSpace(s.String()))
+		}
+		rules := parseFieldRules(f, keyTag)
+		if msg := rules.check(fv); msg != "" {
+			errs = append(errs, FieldError{rules.key, msg})
+		}
+	}
+	return errs
+}
+
+// decodeForm fills dst from the request's form values and checks it.
+func decodeForm(r *http.Request, dst interface{}) FieldErrors {
+	v := reflect.ValueOf(dst).Elem()
+	var errs FieldErrors
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		name := f.Tag.Get("form")
+		if name == "" || !f.IsExported() {
+			continue
+		}
+		raw := strings.TrimSpace(r.FormValue(name))
+		if raw == "" {
+			continue
+		}
+		fv := v.Field(i)
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(raw)
+		case reflect.Bool:
+			fv.SetBool(raw == "true" || raw == "on" || raw == "1")
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				errs = append(errs, FieldError{name, parseFieldRules(f, "form").label + " must be a whole number."})
+				continue
+			}
+			fv.SetInt(n)
+		case reflect.Float64:
+			n, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				errs = append(errs, FieldError{name, parseFieldRules(f, "form").label + " must be a number."})
+				continue
+			}
+			fv.SetFloat(n)
+		}
+	}
+	for _, fe := range validateWith(dst, "form") {
+		if !errs.has(fe.Field) {
+			errs = append(errs, fe)
+		}
+	}
+	return errs
+}
+
+func (e FieldErrors) has(field string) bool {
+	for _, fe := range e {
+		if fe.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// errInvalidJSON is what decodeJSON returns for a body that isn't JSON
+// of the expected shape.
+var errInvalidJSON = errors.New("Invalid JSON body")
+
+// decodeJSON fills dst from the JSON request body and checks it. The
+// error is errInvalidJSON or FieldErrors.
+func decodeJSON(r *http.Request, dst interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		return errInvalidJSON
+	}
+	if errs := validateWith(dst, "json"); errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// writeJSONInvalid answers a request decodeJSON turned down.
+func writeJSONInvalid(w http.ResponseWriter, err error) {
+	errs, ok := err.(FieldErrors)
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", err.Error(), nil)
+		return
+	}
+	writeAPIError(w, http.StatusBadRequest, "validation_failed", errs.Error(), errs.Map())
+}
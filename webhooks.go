@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Order events are posted to the endpoints set up at /admin/webhooks. Each
+// delivery is signed so the receiver can tell it came from us:
+//
+//	X-Webhook-Timestamp: 1760600000
+//	X-Webhook-Signature: v1=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// Receivers should accept a delivery when any v1 value matches under their
+// secret, and reject old timestamps to stop replays. Rotating an
+// endpoint's secret keeps the old one signing alongside the new, giving a
+// second v1 value, for WEBHOOK_ROTATION_GRACE (24h) or until it is
+// retired, so receivers can switch over without missing a delivery.
+
+var webhookEvents = []string{EventOrderCreated, EventOrderStatusChanged, EventOrderUpdated, EventOrderDeleted}
+
+type WebhookDelivery struct {
+	EndpointID int             `json:"endpoint_id,omitempty"`
+	URL        string          `json:"url"`
+	Event      string          `json:"event"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type WebhookEndpoint struct {
+	ID             int
+	URL            string
+	Events         string
+	Secret         string
+	PreviousSecret string
+	PreviousUntil  sql.NullTime
+	CreatedAt      time.Time
+}
+
+// Receives reports whether the endpoint wants event; no events listed
+// means all of them.
+func (e WebhookEndpoint) Receives(event string) bool {
+	if e.Events == "" {
+		return true
+	}
+	for _, ev := range strings.Split(e.Events, ",") {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Rotating reports whether the previous secret still signs deliveries.
+func (e WebhookEndpoint) Rotating() bool {
+	return e.PreviousSecret != "" && e.PreviousUntil.Valid && time.Now().Before(e.PreviousUntil.Time)
+}
+
+func init() {
+	registerJobHandler("webhook", func(payload []byte) error {
+		var d WebhookDelivery
+		if err := json.Unmarshal(payload, &d); err != nil {
+			return err
+		}
+		return deliverWebhook(d)
+	})
+	onOrderEvent(func(ev OrderEvent) {
+		endpoints, err := loadWebhookEndpoints()
+		if err != nil {
+			log.Printf("webhooks: %v", err)
+			return
+		}
+		var body []byte
+		for _, e := range endpoints {
+			if !e.Receives(ev.Type) {
+				continue
+			}
+			if body == nil {
+				if body, err = json.Marshal(ev); err != nil {
+					log.Printf("webhooks: encode %s: %v", ev.Type, err)
+					return
+				}
+			}
+			if err := enqueueJob("webhook", WebhookDelivery{EndpointID: e.ID, URL: e.URL, Event: ev.Type, Body: body}); err != nil {
+				log.Printf("webhooks: enqueue %s for %s: %v", ev.Type, e.URL, err)
+			}
+		}
+	})
+}
+
+const webhookColumns = "id, url, events, secret, previous_secret, previous_until, created_at"
+
+func scanWebhookEndpoint(row rowScanner, e *WebhookEndpoint) error {
+	return row.Scan(&e.ID, &e.URL, &e.Events, &e.Secret, &e.PreviousSecret, &e.PreviousUntil, &e.CreatedAt)
+}
+
+func loadWebhookEndpoints() ([]WebhookEndpoint, error) {
+	rows, err := db.Query("SELECT " + webhookColumns + " FROM webhook_endpoints ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var endpoints []WebhookEndpoint
+	for rows.Next() {
+		var e WebhookEndpoint
+		if err := scanWebhookEndpoint(rows, &e); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+func newWebhookSecret() string {
+	return "whsec_" + rand.Text()
+}
+
+// webhookSignature is the X-Webhook-Signature value for body sent at ts,
+// with one v1 entry per secret.
+func webhookSignature(ts int64, body []byte, secrets ...string) string {
+	var sigs []string
+	for _, s := range secrets {
+		mac := hmac.New(sha256.New, []byte(s))
+		mac.Write([]byte(strconv.FormatInt(ts, 10) + "."))
+		mac.Write(body)
+		sigs = append(sigs, "v1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(sigs, ", ")
+}
+
+func deliverWebhook(d WebhookDelivery) error {
+	var secrets []string
+	if d.EndpointID != 0 {
+		// Secrets are looked up at send time, so retries after a rotation
+		// carry the new signature.
+		var e WebhookEndpoint
+		err := scanWebhookEndpoint(db.QueryRow("SELECT "+webhookColumns+" FROM webhook_endpoints WHERE id = ?", d.EndpointID), &e)
+		if err == sql.ErrNoRows {
+			return nil // endpoint removed since
+		} else if err != nil {
+			return err
+		}
+		d.URL = e.URL
+		secrets = append(secrets, e.Secret)
+		if e.Rotating() {
+			secrets = append(secrets, e.PreviousSecret)
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event", d.Event)
+	if len(secrets) > 0 {
+		ts := time.Now().Unix()
+		req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(ts, 10))
+		req.Header.Set("X-Webhook-Signature", webhookSignature(ts, d.Body, secrets...))
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", d.URL, resp.Status)
+	}
+	return nil
+}
+
+func webhooksPage(w http.ResponseWriter, r *http.Request) {
+	renderWebhooks(w, r, 0, "")
+}
+
+// renderWebhooks shows the endpoints, and a newly made secret for the one
+// with id shown, the only time it is displayed.
+func renderWebhooks(w http.ResponseWriter, r *http.Request, shown int, secret string) {
+	endpoints, err := loadWebhookEndpoints()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("webhooks.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Endpoints []WebhookEndpoint
+		Events    []string
+		ShownID   int
+		Secret    string
+		Flashes   []Flash
+	}{endpoints, webhookEvents, shown, secret, popFlashes(r)})
+}
+
+func addWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	url := strings.TrimSpace(r.FormValue("url"))
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		redirectWithFlash(w, r, "/admin/webhooks", "error", "Enter the endpoint's full http:// or https:// address.")
+		return
+	}
+	var events []string
+	for _, ev := range r.Form["events"] {
+		for _, known := range webhookEvents {
+			if ev == known {
+				events = append(events, ev)
+			}
+		}
+	}
+	secret := newWebhookSecret()
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO webhook_endpoints (url, events, secret) VALUES (?, ?, ?)", url, strings.Join(events, ","), secret)
+	var id int64
+	if err == nil {
+		id, err = res.LastInsertId()
+	}
+	if err == nil {
+		err = recordAudit(tx, r, "webhook.create", strconv.FormatInt(id, 10), url)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	addFlash(r, "success", "Endpoint added. Give its receiver the signing secret below.")
+	renderWebhooks(w, r, int(id), secret)
+}
+
+// rotateWebhookSecret gives an endpoint a new secret. The current one
+// keeps signing alongside it through the grace period.
+func rotateWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	secret := newWebhookSecret()
+	grace := envDuration("WEBHOOK_ROTATION_GRACE", 24*time.Hour)
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE webhook_endpoints SET previous_secret = secret, previous_until = NOW() + INTERVAL ? SECOND, secret = ?
+		WHERE id = ?`, int(grace.Seconds()), secret, id)
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		redirectWithFlash(w, r, "/admin/webhooks", "error", "That endpoint no longer exists.")
+		return
+	}
+	err = recordAudit(tx, r, "webhook.rotate", id, "")
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	shown, _ := strconv.Atoi(id)
+	addFlash(r, "success", fmt.Sprintf("New secret made. Deliveries are signed with both it and the old one for the next %s.", grace))
+	renderWebhooks(w, r, shown, secret)
+}
+
+// retireWebhookSecret stops signing with the previous secret once the
+// receiver has switched over.
+func retireWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE webhook_endpoints SET previous_secret = '', previous_until = NULL WHERE id = ?", id)
+	if err == nil {
+		err = recordAudit(tx, r, "webhook.retire_secret", id, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB update error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/webhooks", "success", "Old secret retired.")
+}
+
+func deleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM webhook_endpoints WHERE id = ?", id)
+	if err == nil {
+		err = recordAudit(tx, r, "webhook.delete", id, "")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB delete error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/admin/webhooks", "success", "Endpoint removed.")
+}
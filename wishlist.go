@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type WishlistItem struct {
+	ID      int
+	Variant Variant
+	AddedAt time.Time
+}
+
+type WishlistStat struct {
+	Variant   Variant
+	Customers int
+	Ordered   int
+}
+
+func wishlistItems(contact string) ([]WishlistItem, error) {
+	rows, err := db.Query(`SELECT `+variantColumns+`, w.id, w.created_at FROM wishlist_items w
+		JOIN product_variants v ON v.id = w.variant_id JOIN products p ON p.id = v.product_id
+		WHERE w.customer_id = ? AND w.order_id IS NULL ORDER BY w.created_at DESC, w.id DESC`, contact)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WishlistItem
+	for rows.Next() {
+		var it WishlistItem
+		err := scanVariant(scanAlso{rows, []interface{}{&it.ID, &it.AddedAt}}, &it.Variant)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+func wishlistPage(w http.ResponseWriter, r *http.Request) {
+	contact := customerContact(r)
+	items, err := wishlistItems(contact)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	t := mustParseTemplates("wishlist.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Customer string
+		Items    []WishlistItem
+		Flashes  []Flash
+	}{contact, items, popFlashes(r)})
+}
+
+func addToWishlist(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.FormValue("variant"))
+	if err != nil {
+		redirectWithFlash(w, r, "/place-order", "error", "Pick a product to save.")
+		return
+	}
+	v, err := variantByID(id)
+	if err == sql.ErrNoRows || (err == nil && !v.Active) {
+		redirectWithFlash(w, r, "/place-order", "error", "That product is not available.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("INSERT INTO wishlist_items (customer_id, variant_id) VALUES (?, ?) ON DUPLICATE KEY UPDATE order_id = NULL, created_at = NOW()", customerContact(r), v.ID); err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/wishlist", "success", v.Label()+" saved to your wishlist.")
+}
+
+func removeWishlistItem(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	if _, err := db.Exec("DELETE FROM wishlist_items WHERE id = ? AND customer_id = ?", id, customerContact(r)); err != nil {
+		http.Error(w, "DB delete error", http.StatusInternalServerError)
+		return
+	}
+	redirectWithFlash(w, r, "/wishlist", "success", "Removed from your wishlist.")
+}
+
+// orderWishlistItem places an order for a saved item under the customer's
+// contact number. The entry is kept, marked with the order, for the report.
+func orderWishlistItem(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	contact := customerContact(r)
+	qty, err := strconv.Atoi(r.FormValue("qty"))
+	if err != nil || qty < 1 || qty > 100 {
+		redirectWithFlash(w, r, "/wishlist", "error", "Quantity must be between 1 and 100.")
+		return
+	}
+	var variantID int
+	err = db.QueryRow("SELECT variant_id FROM wishlist_items WHERE id = ? AND customer_id = ? AND order_id IS NULL", id, contact).Scan(&variantID)
+	if err == sql.ErrNoRows {
+		redirectWithFlash(w, r, "/wishlist", "error", "That item is no longer on your wishlist.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	v, err := variantByID(variantID)
+	if err == sql.ErrNoRows || (err == nil && !v.Active) {
+		redirectWithFlash(w, r, "/wishlist", "error", "Sorry, that product is no longer available.")
+		return
+	} else if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	order, err := createOrder(tx, currentStoreID(r), ChannelOnline, contact, v, qty, "", "")
+	if err == nil {
+		_, err = tx.Exec("UPDATE wishlist_items SET order_id = ? WHERE id = ?", order.OrderID, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "DB insert error", http.StatusInternalServerError)
+		return
+	}
+	emitOrderEvent(OrderEvent{Type: EventOrderCreated, OrderID: order.OrderID, Order: &order})
+
+	sess := getSession(r)
+	sess.Values["last_order"] = order.OrderID
+	_ = saveSession(sess)
+	redirectWithFlash(w, r, "/order-placed", "success", "Order "+order.OrderID+" placed successfully.")
+}
+
+// wishlistReport ranks variants by how many customers have saved them, with
+// how many of those were then ordered from the wishlist.
+func wishlistReport(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT ` + variantColumns + `, COUNT(w.id), COUNT(w.order_id)
+		FROM wishlist_items w JOIN product_variants v ON v.id = w.variant_id JOIN products p ON p.id = v.product_id
+		GROUP BY v.id, p.id ORDER BY COUNT(w.id) DESC, v.id LIMIT 50`)
+	if err != nil {
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var stats []WishlistStat
+	for rows.Next() {
+		var s WishlistStat
+		_ = scanVariant(scanAlso{rows, []interface{}{&s.Customers, &s.Ordered}}, &s.Variant)
+		stats = append(stats, s)
+	}
+	t := mustParseTemplates("wishlist_report.html", "partials.html")
+	_ = t.Execute(w, struct {
+		Stats []WishlistStat
+	}{stats})
+}